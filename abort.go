@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// the status nginx logs for a client that hung up before the answer
+	statusClientClosedRequest = 499
+
+	// bounds a write carried on after its client hung up, see detachWrite
+	detachedWriteTimeout = 10 * time.Second
+)
+
+var clientClosedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_client_closed_requests_total",
+		Help: "Requests whose client hung up before they were answered, by route.",
+	},
+	[]string{"route"},
+)
+
+func init() {
+	prometheus.MustRegister(clientClosedRequests)
+}
+
+// clientClosed reports whether the client of r has gone away, or its
+// deadline passed, so nothing more can be sent to it. Failures that follow
+// from that are no server errors.
+func clientClosed(r *http.Request) bool {
+	err := r.Context().Err()
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// logRequestError logs a failure while serving r, unless it came from the
+// client hanging up; accessLog records those.
+func logRequestError(r *http.Request, format string, args ...interface{}) {
+	if clientClosed(r) {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// detachWrite returns the context for the writes of r once it passed
+// validation. It keeps the values of the request, the tenant among them, but
+// not its cancellation: a client hanging up mid-way can't leave it unknown
+// whether the write happened, it happened. detachedWriteTimeout bounds it
+// instead.
+func detachWrite(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(r.Context()), detachedWriteTimeout)
+}
+
+// accessLog is middleware.Logger, except that a request left unanswered
+// because its client hung up is logged with status 499 and counted in
+// todo_client_closed_requests_total.
+var accessLog = middleware.RequestLogger(clientClosedFormatter{
+	&middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+})
+
+type clientClosedFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f clientClosedFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	return clientClosedEntry{LogEntry: f.LogFormatter.NewLogEntry(r), r: r}
+}
+
+type clientClosedEntry struct {
+	middleware.LogEntry
+	r *http.Request
+}
+
+func (e clientClosedEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	if status == 0 && clientClosed(e.r) {
+		status = statusClientClosedRequest
+		route := ""
+		if rctx := chi.RouteContext(e.r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		clientClosedRequests.WithLabelValues(route).Inc()
+	}
+	e.LogEntry.Write(status, bytes, header, elapsed, extra)
+}
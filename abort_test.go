@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type abortTestKey struct{}
+
+func TestDetachWrite(t *testing.T) {
+	ctx, cancelRequest := context.WithCancel(context.WithValue(context.Background(), abortTestKey{}, "tenant"))
+	r := httptest.NewRequest(http.MethodPost, "/todo", nil).WithContext(ctx)
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+
+	cancelRequest()
+	if err := writeCtx.Err(); err != nil {
+		t.Errorf("the write was canceled with its request: %v", err)
+	}
+	if writeCtx.Value(abortTestKey{}) != "tenant" {
+		t.Error("the write lost the values of its request")
+	}
+	if deadline, ok := writeCtx.Deadline(); !ok || time.Until(deadline) > detachedWriteTimeout {
+		t.Errorf("deadline = %v, %v, want within %v", deadline, ok, detachedWriteTimeout)
+	}
+}
+
+// A client hanging up after its todo passed validation still gets the todo
+// created, and nothing is written to it.
+func TestCreateTodoAfterClientClosed(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/todo", strings.NewReader(`{"title":"write report"}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+
+	mongo.commands()
+	router.ServeHTTP(rw, r)
+	if todo := insertedTodo(t, mongo.commands()); todo["title"] != "write report" {
+		t.Errorf("inserted %v", todo)
+	}
+	if rw.Body.Len() > 0 {
+		t.Errorf("answered a client that hung up with %s", rw.Body)
+	}
+}
+
+func TestClientClosedAccessLog(t *testing.T) {
+	var logged bytes.Buffer
+	logger := middleware.RequestLogger(clientClosedFormatter{
+		&middleware.DefaultLogFormatter{Logger: log.New(&logged, "", 0), NoColor: true},
+	})
+	router := chi.NewRouter()
+	router.Use(logger)
+	router.Get("/todo/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		// the handler gives up on a client that hung up
+		if clientClosed(r) {
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	labels := map[string]string{"route": "/todo/{id}"}
+	closed := metricValue(t, "todo_client_closed_requests_total", labels)
+
+	tests := []struct {
+		name   string
+		cancel bool
+		want   string
+	}{
+		{"answered", false, " - 204 "},
+		{"client hung up", true, " - 499 "},
+	}
+	for _, tt := range tests {
+		logged.Reset()
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancel {
+			cancel()
+		}
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/todo/1", nil).WithContext(ctx))
+		cancel()
+		if !strings.Contains(logged.String(), tt.want) {
+			t.Errorf("%s: logged %q, want status%s", tt.name, logged.String(), tt.want)
+		}
+	}
+	if got := metricValue(t, "todo_client_closed_requests_total", labels) - closed; got != 1 {
+		t.Errorf("counted %v closed requests, want 1", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+)
+
+type (
+	// toggle read-only mode
+	ReadOnlyRequest struct {
+		Enabled bool `json:"enabled"`
+	}
+	// the read-only mode after a toggle
+	ReadOnlyResponse struct {
+		Message  string `json:"message"`
+		ReadOnly bool   `json:"read_only"`
+	}
+)
+
+// adminOnly only lets requests through whose caller auth.policy grants
+// admin, by default those presenting the admin key, either as X-Admin-Key,
+// as an Authorization bearer token or as the password of basic auth, which
+// browsers prompt for. The /admin endpoints are disabled while no key is
+// configured.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if currentConfig().Admin.Key == "" {
+			writeError(rw, r, http.StatusForbidden, "admin_disabled", nil)
+			return
+		}
+
+		c := requestCaller(r)
+		switch {
+		case c.can(permAdmin):
+		case c.mechanism == authAnonymous:
+			rw.Header().Set("WWW-Authenticate", `Basic realm="todo admin", charset="UTF-8"`)
+			writeError(rw, r, http.StatusUnauthorized, "admin_key_required", nil)
+			return
+		default:
+			writeError(rw, r, http.StatusForbidden, "permission_denied", renderer.M{
+				"permission": permAdmin,
+			})
+			return
+		}
+		actor := "admin"
+		if c.mechanism != authAdminKey {
+			actor = c.mechanism
+		}
+		ctx := context.WithValue(r.Context(), actorKey{}, actor)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// setReadOnlyHandler switches read-only mode on or off at runtime.
+func setReadOnlyHandler(rw http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", nil)
+		return
+	}
+
+	action := "readonly.disable"
+	if req.Enabled {
+		action = "readonly.enable"
+	}
+	auditID, err := beginAudit(r, action)
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_readonly")
+		return
+	}
+
+	setReadOnly(req.Enabled)
+	finishAudit(r.Context(), auditID, 0, nil)
+	log.Printf("read-only mode set to %t by %s\n", req.Enabled, clientIP(r))
+
+	renderJSON(rw, r, http.StatusOK, ReadOnlyResponse{
+		Message:  localize(r, "readonly_updated"),
+		ReadOnly: req.Enabled,
+	})
+}
+
+// adminAPIHandlers serves the admin-key protected /admin API.
+func adminAPIHandlers() http.Handler {
+	router := chi.NewRouter()
+	router.Use(adminOnly)
+	router.Get("/config", getAdminConfig)
+	router.Post("/readonly", setReadOnlyHandler)
+	router.Post("/drain", drainHandler(true))
+	router.Post("/undrain", drainHandler(false))
+	router.Post("/routes/disable", switchRouteHandler(true))
+	router.Post("/routes/enable", switchRouteHandler(false))
+	router.Get("/jobs", getJobs)
+	router.Post("/jobs/{name}/run", runJob)
+	// the audit log of a tenant is in its database; read-only mode is global
+	// and audited in the shared one
+	router.With(withTenant).Get("/audit", getAuditLog)
+	router.With(withTenant).Get("/outbox", getOutbox)
+	router.With(withTenant).Post("/outbox/{id}/retry", retryOutboxEvent)
+	router.With(withTenant).Get("/migrations", getMigrations)
+	router.With(withTenant).Get("/backup", getBackup)
+	router.With(withTenant).Get("/backups", getBackups)
+	router.With(withTenant).Post("/integrity-check", postIntegrityCheck)
+	router.With(withTenant, readOnlyMiddleware).Post("/restore", restoreBackup)
+	router.With(withTenant).Get("/todos", adminTodosPage)
+	router.With(withTenant, readOnlyMiddleware).Post("/todos", adminCreateTodo)
+	router.With(withTenant, readOnlyMiddleware).Post("/todos/{id}/toggle", adminToggleTodo)
+	router.With(withTenant, readOnlyMiddleware).Post("/todos/{id}/delete", adminDeleteTodo)
+
+	return router
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// how long the forms of a rendered admin page can be submitted
+	adminCSRFValidity = 12 * time.Hour
+
+	// the page renders no scripts and no third-party resources, so a title
+	// that slipped past escaping still couldn't run anything
+	adminContentSecurityPolicy string = "default-src 'none'; style-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+	// the cookie carrying a notice to the admin list a form redirects to
+	adminNoticeCookie string = "admin_notice"
+)
+
+var (
+	// the parameters of the admin todo list kept across its links and forms
+	adminTodosParams = []string{"q", "completed", "page", "limit"}
+
+	// the notices the forms of the admin list leave for it
+	adminNotices = []string{"todo_created", "form_already_submitted"}
+)
+
+// AdminTodosPage is the data of the admin todo list. Return is the query
+// of the page, which its forms come back to.
+type AdminTodosPage struct {
+	PageLocale
+	Search    string
+	Completed string
+	Todos     []Todo
+	Total     int64
+	Page      int64
+	Skipped   int
+	// the page is after the last one; PrevURL leads to the last one
+	PastEnd   bool
+	PrevURL   string
+	NextURL   string
+	Return    string
+	CSRFToken string
+	Errors    []string
+	Notice    string
+	// the create form: its one-time token and what was typed in it
+	FormToken string
+	NewTitle  string
+	NewTags   string
+}
+
+// adminTodosPage renders every todo for operators, searchable by title,
+// filtered by ?completed and paginated by ?page and ?limit. The links to the
+// previous and next pages keep the other parameters and are sent as Link
+// headers as well. A page after the last one is empty and leads back to
+// the last one.
+func adminTodosPage(rw http.ResponseWriter, r *http.Request) {
+	var page AdminTodosPage
+	if cookie, err := r.Cookie(adminNoticeCookie); err == nil {
+		if slices.Contains(adminNotices, cookie.Value) {
+			page.Notice = localizePage(r, cookie.Value)
+		}
+		http.SetCookie(rw, &http.Cookie{Name: adminNoticeCookie, Path: "/admin/todos", MaxAge: -1})
+	}
+	renderAdminPage(rw, r, http.StatusOK, r.URL.Query(), page)
+}
+
+// adminCreateTodo adds a todo from the form of the admin list. The form
+// carries a one-time token, so sending it twice, as a double click does,
+// creates the todo once: the second submission goes back to the list with a
+// notice, while the first may still be adding it. A form whose token expired
+// is shown again with what was typed in.
+func adminCreateTodo(rw http.ResponseWriter, r *http.Request) {
+	query, ok := parseAdminPost(rw, r)
+	if !ok {
+		return
+	}
+	lang := pageLanguage(r)
+	input := AdminTodosPage{NewTitle: r.PostForm.Get("title"), NewTags: r.PostForm.Get("tags")}
+	fail := func(status int, problem string) {
+		input.Errors = []string{problem}
+		renderAdminPage(rw, r, status, query, input)
+	}
+
+	title := cleanTitle(input.NewTitle)
+	if code, params := titleProblem(title); code != "" {
+		fail(http.StatusBadRequest, translate(lang, code, params))
+		return
+	}
+	tags := cleanTags(strings.Split(input.NewTags, ","))
+	for _, tag := range tags {
+		if code := tagProblem(tag); code != "" {
+			fail(http.StatusBadRequest, translate(lang, code, renderer.M{"tag": tag}))
+			return
+		}
+	}
+	remaining, limited, err := quotaRemaining(r.Context())
+	if err != nil {
+		logRequestError(r, "failed to check the todo quota: %v\n", err)
+		fail(dbErrorStatus(err), localizePage(r, "quota_check_failed"))
+		return
+	}
+	if limited && remaining < 1 {
+		limit := currentConfig().Quota.MaxTodos
+		fail(http.StatusForbidden, translate(lang, "quota_exceeded", renderer.M{"used": limit, "limit": limit}))
+		return
+	}
+
+	token := r.PostForm.Get("form_token")
+	err = claimFormToken(r.Context(), token, time.Now())
+	var used errFormTokenUsed
+	switch {
+	case errors.As(err, &used):
+		setAdminNotice(rw, "form_already_submitted")
+		http.Redirect(rw, r, adminTodosURL(query), http.StatusSeeOther)
+		return
+	case errors.Is(err, errFormTokenExpired):
+		fail(http.StatusBadRequest, localizePage(r, "form_expired"))
+		return
+	case err != nil:
+		logRequestError(r, "failed to claim form token: %v\n", err)
+		fail(dbErrorStatus(err), localizePage(r, "todo_create_failed"))
+		return
+	}
+
+	now := time.Now().UTC()
+	td := newTodoModel(title, now)
+	td.Tags = tags
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	if err := insertTodo(writeCtx, td); err != nil {
+		if err := releaseFormToken(writeCtx, token); err != nil {
+			logRequestError(r, "failed to release form token: %v\n", err)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			fail(http.StatusConflict, localizePage(r, "duplicate_title"))
+			return
+		}
+		logRequestError(r, "failed to insert data into the db: %v\n", err.Error())
+		fail(dbErrorStatus(err), localizePage(r, "todo_create_failed"))
+		return
+	}
+	if err := settleFormToken(writeCtx, token, td.ID); err != nil {
+		logRequestError(r, "failed to settle form token: %v\n", err)
+	}
+	setAdminNotice(rw, "todo_created")
+	http.Redirect(rw, r, adminTodosURL(query), http.StatusSeeOther)
+}
+
+// setAdminNotice leaves the notice code for the admin list the response
+// redirects to, which shows it once.
+func setAdminNotice(rw http.ResponseWriter, code string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     adminNoticeCookie,
+		Value:    code,
+		Path:     "/admin/todos",
+		MaxAge:   60,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// adminToggleTodo completes the todo {id} of the admin list, or reopens it,
+// and goes back to the list.
+func adminToggleTodo(rw http.ResponseWriter, r *http.Request) {
+	id, query, ok := parseAdminForm(rw, r)
+	if !ok {
+		return
+	}
+
+	var td TodoModel
+	err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}, options.FindOne().SetProjection(bson.M{"completed": 1})).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		renderAdminTodos(rw, r, http.StatusNotFound, query, localizePage(r, "todo_not_found"))
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		renderAdminTodos(rw, r, dbErrorStatus(err), query, localizePage(r, "todo_update_failed"))
+		return
+	}
+
+	completed := !td.Completed
+	update := bumpVersion(bson.M{"$set": bson.M{"completed": completed, "updated_at": time.Now().UTC()}})
+	clearCompletion(update, completed)
+	cancelReminders(update, completed)
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	updated, err := updateTodoOnce(writeCtx, id, update, &completed)
+	if mongo.IsDuplicateKeyError(err) {
+		renderAdminTodos(rw, r, http.StatusConflict, query, localizePage(r, "duplicate_title"))
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		renderAdminTodos(rw, r, dbErrorStatus(err), query, localizePage(r, "todo_update_failed"))
+		return
+	}
+	if updated == nil {
+		renderAdminTodos(rw, r, http.StatusNotFound, query, localizePage(r, "todo_not_found"))
+		return
+	}
+	http.Redirect(rw, r, adminTodosURL(query), http.StatusSeeOther)
+}
+
+// adminDeleteTodo deletes the todo {id} of the admin list as the API does and
+// goes back to the list.
+func adminDeleteTodo(rw http.ResponseWriter, r *http.Request) {
+	id, query, ok := parseAdminForm(rw, r)
+	if !ok {
+		return
+	}
+
+	deleted, gone, code, err := removeTodo(r, id)
+	if err != nil {
+		logRequestError(r, "could not delete item from database: %v\n", err.Error())
+		renderAdminTodos(rw, r, dbErrorStatus(err), query, localizePage(r, code))
+		return
+	}
+	if deleted == nil && !gone {
+		renderAdminTodos(rw, r, http.StatusNotFound, query, localizePage(r, "todo_not_found"))
+		return
+	}
+	http.Redirect(rw, r, adminTodosURL(query), http.StatusSeeOther)
+}
+
+// parseAdminForm reads a form of a row of the admin list: the {id} it acts
+// on besides what parseAdminPost reads. It renders the list with the problem
+// when any of them is wrong.
+func parseAdminForm(rw http.ResponseWriter, r *http.Request) (id primitive.ObjectID, query url.Values, ok bool) {
+	query, ok = parseAdminPost(rw, r)
+	if !ok {
+		return id, nil, false
+	}
+	var err error
+	if id, err = parseTodoID(r); err != nil {
+		renderAdminTodos(rw, r, http.StatusBadRequest, query, localizePage(r, "invalid_id"))
+		return id, nil, false
+	}
+	return id, query, true
+}
+
+// parseAdminPost reads what every form of the admin list carries: the list
+// to go back to and its CSRF token. It renders the list with the problem
+// when either is wrong.
+func parseAdminPost(rw http.ResponseWriter, r *http.Request) (query url.Values, ok bool) {
+	if err := r.ParseForm(); err != nil {
+		renderAdminTodos(rw, r, http.StatusBadRequest, url.Values{}, translate(pageLanguage(r), "invalid_body", renderer.M{
+			"error": err.Error(),
+		}))
+		return nil, false
+	}
+	query, err := url.ParseQuery(r.PostForm.Get("return"))
+	if err != nil {
+		query = url.Values{}
+	}
+	if !validAdminCSRFToken(r, r.PostForm.Get("csrf_token"), time.Now()) {
+		renderAdminTodos(rw, r, http.StatusForbidden, query, localizePage(r, "invalid_csrf_token"))
+		return nil, false
+	}
+	return query, true
+}
+
+// renderAdminTodos renders the admin list for query with status, after the
+// problem message of a form when there is one.
+func renderAdminTodos(rw http.ResponseWriter, r *http.Request, status int, query url.Values, problem string) {
+	var page AdminTodosPage
+	if problem != "" {
+		page.Errors = []string{problem}
+	}
+	renderAdminPage(rw, r, status, query, page)
+}
+
+// renderAdminPage renders the admin list for query with status, keeping the
+// errors, notice and create form input of page. Failing to list the todos
+// still renders the page, with the error in place of the rows. Each
+// rendering issues a new token for the create form, but none in read-only
+// mode, where the form isn't shown.
+func renderAdminPage(rw http.ResponseWriter, r *http.Request, status int, query url.Values, page AdminTodosPage) {
+	if !haveTemplates {
+		writeFallbackPage(rw)
+		return
+	}
+	query = adminTodosQuery(query)
+	page.PageLocale = newPageLocale(rw, r, "/admin/todos", query)
+	lang := page.Lang
+	page.Search = query.Get("q")
+	page.Completed = query.Get("completed")
+	page.Return = query.Encode()
+	page.CSRFToken = adminCSRFToken(r, time.Now())
+	page.Todos = []Todo{}
+	if !readOnly.Load() {
+		token, err := issueFormToken(r.Context(), time.Now())
+		if err != nil {
+			logRequestError(r, "failed to issue form token: %v\n", err)
+		} else {
+			page.FormToken = token
+		}
+	}
+	valid := true
+	fail := func(code string, err error) {
+		valid = false
+		if status == http.StatusOK {
+			status = http.StatusBadRequest
+		}
+		page.Errors = append(page.Errors, translate(lang, code, renderer.M{"error": err.Error()}))
+	}
+
+	pageNumber, limit, err := parsePagination(query.Get("page"), query.Get("limit"))
+	if err != nil {
+		fail("invalid_pagination", err)
+	}
+	filter, err := listFilter(url.Values{"completed": {page.Completed}}, currentConfig().location)
+	if err != nil {
+		fail("invalid_filter", err)
+	}
+	if search := strings.TrimSpace(page.Search); search != "" {
+		if titlesEncrypted() {
+			fail("search_encrypted", errTitlesEncrypted)
+		}
+		filter = bson.M{"$and": bson.A{filter, titleSearchFilter(search)}}
+	}
+
+	if valid {
+		page.Page = pageNumber
+		sort, _ := listSort(url.Values{})
+		page.Total, err = tenantDB(r.Context()).Collection(collectionName).CountDocuments(r.Context(), filter)
+		var found todoPage
+		if err == nil {
+			found, err = findTodoPage(r.Context(), filter, sort, nil, (pageNumber-1)*limit, limit)
+		}
+		if err != nil {
+			logRequestError(r, "failed to fetch todo records from the db: %v\n", err)
+			if status == http.StatusOK {
+				status = dbErrorStatus(err)
+			}
+			if status == http.StatusServiceUnavailable {
+				rw.Header().Set("Retry-After", dbRetryAfter)
+			}
+			page.Errors = append(page.Errors, localizePage(r, "todos_fetch_failed"))
+		}
+		page.Skipped = found.skipped
+		for _, td := range found.todos {
+			page.Todos = append(page.Todos, td.toTodo(currentConfig().location))
+		}
+		if err == nil && pageNumber > 1 && len(found.todos) == 0 && found.skipped == 0 {
+			page.PastEnd = true
+		}
+		if pageNumber > 1 {
+			lastPage := max((page.Total+limit-1)/limit, 1)
+			page.PrevURL = adminTodosURL(withAdminParam(query, "page", strconv.FormatInt(min(pageNumber-1, lastPage), 10)))
+			rw.Header().Add("Link", "<"+page.PrevURL+`>; rel="prev"`)
+		}
+		if found.more {
+			page.NextURL = adminTodosURL(withAdminParam(query, "page", strconv.FormatInt(pageNumber+1, 10)))
+			rw.Header().Add("Link", "<"+page.NextURL+`>; rel="next"`)
+		}
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Security-Policy", adminContentSecurityPolicy)
+	rw.Header().Set("Referrer-Policy", "same-origin")
+	renderHTML(rw, r, status, "adminTodosPage", page)
+}
+
+// adminTodosQuery keeps the parameters of the admin list from query, so
+// nothing else makes it into its links.
+func adminTodosQuery(query url.Values) url.Values {
+	kept := url.Values{}
+	for _, param := range adminTodosParams {
+		if value := query.Get(param); value != "" {
+			kept.Set(param, value)
+		}
+	}
+	return kept
+}
+
+// withAdminParam returns a copy of query with param set to value.
+func withAdminParam(query url.Values, param, value string) url.Values {
+	copied := adminTodosQuery(query)
+	copied.Set(param, value)
+	return copied
+}
+
+// adminTodosURL is the path of the admin list for query.
+func adminTodosURL(query url.Values) string {
+	if encoded := adminTodosQuery(query).Encode(); encoded != "" {
+		return "/admin/todos?" + encoded
+	}
+	return "/admin/todos"
+}
+
+// adminCSRFToken returns the token the forms of an admin page rendered at now
+// carry. Browsers send the admin credentials by themselves, so only a page of
+// this server can know it: it is the time signed with the admin key, for the
+// tenant of r.
+func adminCSRFToken(r *http.Request, now time.Time) string {
+	issued := strconv.FormatInt(now.Unix(), 10)
+	return issued + "." + base64.RawURLEncoding.EncodeToString(adminCSRFSignature(r, issued))
+}
+
+// validAdminCSRFToken reports whether token was issued by adminCSRFToken for
+// the tenant of r less than adminCSRFValidity before now.
+func validAdminCSRFToken(r *http.Request, token string, now time.Time) bool {
+	issued, signature, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	seconds, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age < -time.Minute || age > adminCSRFValidity {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(mac, adminCSRFSignature(r, issued))
+}
+
+func adminCSRFSignature(r *http.Request, issued string) []byte {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return shareSignature("admin-csrf\n"+tenant+"\n"+issued, currentConfig().Admin.Key)
+}
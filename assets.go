@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// fingerprinted URLs change with their content, so they can be cached forever
+	immutableCacheControl string = "public, max-age=31536000, immutable"
+	// everything else is revalidated every few minutes
+	staticCacheControl string = "public, max-age=300"
+)
+
+// assetManifest maps the files of the static directory to URLs carrying a hash
+// of their content, like /static/style.1a2b3c4d.css. It is built once at
+// startup; files changed later keep their old hash until the next restart.
+type assetManifest struct {
+	// file name, relative to the static directory, to fingerprinted name
+	hashed map[string]string
+	// fingerprinted name back to the file name
+	original map[string]string
+	// file name to the ETag of its content
+	etags map[string]string
+}
+
+// loadAssets hashes every file below dir. A missing dir gives an empty manifest.
+func loadAssets(dir string) (*assetManifest, error) {
+	m := &assetManifest{
+		hashed:   map[string]string{},
+		original: map[string]string{},
+		etags:    map[string]string{},
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		// like missing templates, a missing directory shouldn't stop the API
+		if p == dir && errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("static directory not found, serving no static files", "static_dir", dir)
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		ext := path.Ext(name)
+		hashed := strings.TrimSuffix(name, ext) + "." + sum[:8] + ext
+
+		m.hashed[name] = hashed
+		m.original[hashed] = name
+		m.etags[name] = `"` + sum[:16] + `"`
+		return nil
+	})
+	return m, err
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// url returns the fingerprinted URL of a static file. Files unknown to the
+// manifest get their plain URL so the page still works.
+func (m *assetManifest) url(name string) string {
+	if hashed, ok := m.hashed[name]; ok {
+		return "/static/" + hashed
+	}
+	return "/static/" + name
+}
+
+// staticHandler serves dir, resolving fingerprinted names back to their file
+// and caching them for a year. Other files get a short max-age. Every known
+// file has an ETag, so conditional requests are answered with 304. Paths with
+// a null byte, a backslash or anything path.Clean would change, like //, /./
+// and /../ in plain or encoded form, are refused with 400 before the
+// filesystem sees them; see staticFS for what it serves of the rest.
+func staticHandler(dir string, m *assetManifest) http.Handler {
+	files := http.FileServer(staticFS{root: dir})
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !validStaticPath(r.URL.Path) {
+			http.Error(rw, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		cacheControl := staticCacheControl
+		if original, ok := m.original[name]; ok {
+			name, cacheControl = original, immutableCacheControl
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + original
+			r.URL.RawPath = ""
+		}
+
+		if etag, ok := m.etags[name]; ok {
+			rw.Header().Set("ETag", etag)
+		}
+		// browsers mustn't guess a type, say HTML, for what isn't one
+		rw.Header().Set("X-Content-Type-Options", "nosniff")
+		if ext := path.Ext(name); ext != "" && mime.TypeByExtension(ext) == "" {
+			rw.Header().Set("Content-Type", "application/octet-stream")
+		}
+		rw.Header().Set("Cache-Control", cacheControl)
+		files.ServeHTTP(rw, r)
+	})
+}
+
+// validStaticPath reports whether p, the decoded path below /static, is
+// clean: rooted, without null bytes or backslashes and unchanged by
+// path.Clean.
+func validStaticPath(p string) bool {
+	if p == "" {
+		p = "/"
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\x00\\") {
+		return false
+	}
+	clean := path.Clean(p)
+	if clean != "/" && strings.HasSuffix(p, "/") {
+		clean += "/"
+	}
+	return clean == p
+}
+
+// staticFS is the static directory as http.FileServer sees it. Hidden files
+// and directories don't exist in it, nor does a directory without an
+// index.html, so there are no listings, nor anything a symbolic link leads
+// to outside the directory.
+type staticFS struct {
+	root string
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	if err := s.within(name); err != nil {
+		return nil, err
+	}
+	f, err := http.Dir(s.root).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := http.Dir(s.root).Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// within checks that name resolves, symbolic links followed, to a path
+// inside the root.
+func (s staticFS) within(name string) error {
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name))))
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fs.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidStaticPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"", true},
+		{"/", true},
+		{"/app.js", true},
+		{"/css/style.css", true},
+		{"/docs/", true},
+		{"app.js", false},
+		{"/../secret", false},
+		{"/css/../app.js", false},
+		{"/./app.js", false},
+		{"//app.js", false},
+		{"/css//style.css", false},
+		{"/..", false},
+		{"/app.js\x00.png", false},
+		{"/..\\secret", false},
+		{"/css\\style.css", false},
+	}
+	for _, tt := range tests {
+		if got := validStaticPath(tt.path); got != tt.want {
+			t.Errorf("validStaticPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// staticTree lays out a static directory next to a secret file outside it.
+func staticTree(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "static")
+	files := map[string]string{
+		"secret.txt":               "outside",
+		"static/app.js":            "app",
+		"static/.env":              "hidden",
+		"static/.git/config":       "hidden",
+		"static/css/style.css":     "css",
+		"static/docs/index.html":   "docs",
+		"static/empty/placeholder": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"static/inside.js":  "app.js",
+		"static/secret.txt": "../secret.txt",
+		"static/up":         "..",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Skipf("symbolic links unsupported: %v", err)
+		}
+	}
+	return root
+}
+
+func TestStaticFSOpen(t *testing.T) {
+	root := staticTree(t)
+	static := staticFS{root: root}
+
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"/app.js", "app", true},
+		{"/css/style.css", "css", true},
+		{"/docs/", "", true},
+		{"/inside.js", "app", true},
+		{"/missing.js", "", false},
+		{"/.env", "", false},
+		{"/.git/config", "", false},
+		{"/css/.hidden", "", false},
+		{"/empty/", "", false},
+		{"/", "", false},
+		{"/secret.txt", "", false},
+		{"/up/secret.txt", "", false},
+		{"/../secret.txt", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := static.Open(tt.name)
+			if !tt.ok {
+				if err == nil {
+					f.Close()
+					t.Fatal("Open() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer f.Close()
+			if tt.want == "" {
+				return
+			}
+			data, err := io.ReadAll(f)
+			if err != nil || string(data) != tt.want {
+				t.Errorf("Open() read %q, %v, want %q", data, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := static.Open("/.env"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(/.env) error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	root := staticTree(t)
+	handler := staticHandler(root, &assetManifest{})
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/app.js", http.StatusOK},
+		{"/docs/", http.StatusOK},
+		{"/missing.js", http.StatusNotFound},
+		{"/.env", http.StatusNotFound},
+		{"/secret.txt", http.StatusNotFound},
+		{"/up/secret.txt", http.StatusNotFound},
+		{"/css/", http.StatusNotFound},
+		{"/../secret.txt", http.StatusBadRequest},
+		{"/%2e%2e/secret.txt", http.StatusBadRequest},
+		{"/css/%2E%2E/%2E%2E/secret.txt", http.StatusBadRequest},
+		{"/..%2fsecret.txt", http.StatusBadRequest},
+		{"/..%5csecret.txt", http.StatusBadRequest},
+		{"/app.js%00.png", http.StatusBadRequest},
+		{"//app.js", http.StatusBadRequest},
+		{"/./app.js", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rw.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d", tt.target, rw.Code, tt.status)
+			}
+			if rw.Code == http.StatusOK && rw.Header().Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("X-Content-Type-Options is not nosniff")
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the multipart field holding the uploaded file
+const attachmentFormField string = "file"
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+type (
+	// the GridFS files document of an attachment
+	AttachmentModel struct {
+		ID         primitive.ObjectID `bson:"_id"`
+		Name       string             `bson:"filename"`
+		Length     int64              `bson:"length"`
+		UploadDate time.Time          `bson:"uploadDate"`
+		Metadata   AttachmentMetadata `bson:"metadata"`
+	}
+	// links a GridFS file back to its todo
+	AttachmentMetadata struct {
+		TodoID      primitive.ObjectID `bson:"todo_id"`
+		ContentType string             `bson:"content_type"`
+	}
+	// an attachment as returned by the API
+	Attachment struct {
+		ID          string    `json:"id"`
+		TodoID      string    `json:"todo_id"`
+		Name        string    `json:"name"`
+		Size        int64     `json:"size"`
+		ContentType string    `json:"content_type"`
+		UploadedAt  time.Time `json:"uploaded_at"`
+	}
+	// the attachments of a todo
+	GetAttachmentsResponse struct {
+		Message string       `json:"message"`
+		Data    []Attachment `json:"data"`
+	}
+	// an uploaded attachment
+	CreateAttachmentResponse struct {
+		Message string     `json:"message"`
+		Data    Attachment `json:"data"`
+	}
+)
+
+func attachmentBucket(ctx context.Context) (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(tenantDB(ctx))
+}
+
+// ensureAttachmentIndexes indexes the GridFS files by the todo they belong to.
+func ensureAttachmentIndexes(ctx context.Context) error {
+	bucket, err := attachmentBucket(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = bucket.GetFilesCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "metadata.todo_id", Value: 1}, {Key: "uploadDate", Value: -1}},
+	})
+	return err
+}
+
+// uploadAttachment streams a multipart upload into GridFS. Only the first
+// "file" part is stored; its size and content type are checked against the
+// attachments configuration.
+func uploadAttachment(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	count, err := tenantDB(r.Context()).Collection(collectionName).CountDocuments(r.Context(), bson.M{"id": todoID}, options.Count().SetLimit(1))
+	if err != nil {
+		logRequestError(r, "failed to look up todo %s: %v\n", todoID.Hex(), err)
+		writeDBError(rw, r, err, "attachment_store_failed")
+		return
+	}
+	if count == 0 {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+
+	cfg := currentConfig().Attachments
+	r.Body = http.MaxBytesReader(rw, r.Body, bodyLimit(http.MethodPost, attachmentUploadPattern))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "multipart_required", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeError(rw, r, http.StatusBadRequest, "attachment_file_required", renderer.M{
+				"field": attachmentFormField,
+			})
+			return
+		}
+		if err != nil {
+			writeError(rw, r, http.StatusBadRequest, "upload_unreadable", renderer.M{
+				"error": err.Error(),
+			})
+			return
+		}
+		if part.FormName() != attachmentFormField || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || !slices.Contains(cfg.ContentTypes, contentType) {
+			writeError(rw, r, http.StatusUnsupportedMediaType, "content_type_not_allowed", renderer.M{
+				"allowed": cfg.ContentTypes,
+			})
+			return
+		}
+
+		attachment, err := storeAttachment(r.Context(), todoID, part.FileName(), contentType, part, cfg.MaxSize)
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errAttachmentTooLarge) || errors.As(err, &maxBytesErr) {
+			writeError(rw, r, http.StatusRequestEntityTooLarge, "attachment_too_large", renderer.M{
+				"max_size": humanBytes(cfg.MaxSize),
+			})
+			return
+		}
+		if err != nil {
+			logRequestError(r, "failed to store attachment: %v\n", err)
+			writeDBError(rw, r, err, "attachment_store_failed")
+			return
+		}
+
+		renderJSON(rw, r, http.StatusCreated, CreateAttachmentResponse{
+			Message: localize(r, "attachment_stored"),
+			Data:    attachment,
+		})
+		return
+	}
+}
+
+// storeAttachment copies src into a new GridFS file, aborting the upload once
+// it grows past maxSize so no partial file is left behind.
+func storeAttachment(ctx context.Context, todoID primitive.ObjectID, name, contentType string, src io.Reader, maxSize int64) (Attachment, error) {
+	bucket, err := attachmentBucket(ctx)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		bucket.SetWriteDeadline(deadline)
+	}
+
+	metadata := AttachmentMetadata{TodoID: todoID, ContentType: contentType}
+	upload, err := bucket.OpenUploadStream(name, options.GridFSUpload().SetMetadata(metadata))
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	n, err := io.Copy(upload, io.LimitReader(src, maxSize+1))
+	if err == nil && n > maxSize {
+		err = errAttachmentTooLarge
+	}
+	if err != nil {
+		if abortErr := upload.Abort(); abortErr != nil {
+			log.Printf("failed to abort attachment upload: %v\n", abortErr)
+		}
+		return Attachment{}, err
+	}
+	if err := upload.Close(); err != nil {
+		return Attachment{}, err
+	}
+
+	return AttachmentModel{
+		ID:         upload.FileID.(primitive.ObjectID),
+		Name:       name,
+		Length:     n,
+		UploadDate: time.Now().UTC(),
+		Metadata:   metadata,
+	}.toAttachment(), nil
+}
+
+// getAttachments lists the attachments of a todo, newest first.
+func getAttachments(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	files, err := findAttachments(r.Context(), todoID)
+	if err != nil {
+		logRequestError(r, "failed to fetch attachments: %v\n", err)
+		writeDBError(rw, r, err, "attachments_fetch_failed")
+		return
+	}
+
+	attachments := []Attachment{}
+	for _, f := range files {
+		attachments = append(attachments, f.toAttachment())
+	}
+	renderJSON(rw, r, http.StatusOK, GetAttachmentsResponse{
+		Message: localize(r, "attachments_retrieved"),
+		Data:    attachments,
+	})
+}
+
+// findAttachments returns the GridFS files of a todo, newest first.
+func findAttachments(ctx context.Context, todoID primitive.ObjectID) ([]AttachmentModel, error) {
+	bucket, err := attachmentBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.GridFSFind().SetSort(bson.D{{Key: "uploadDate", Value: -1}})
+	cursor, err := bucket.FindContext(ctx, bson.M{"metadata.todo_id": todoID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var files []AttachmentModel
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// inlineContentTypes are the attachment types browsers may show in place:
+// raster images, which can't carry a script the way SVG or HTML can. Every
+// other type is downloaded.
+var inlineContentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// downloadAttachment streams an attachment from GridFS. Range requests are
+// served by reopening the download at the requested offset.
+func downloadAttachment(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	bucket, err := attachmentBucket(r.Context())
+	if err != nil {
+		logRequestError(r, "failed to open attachment bucket: %v\n", err)
+		writeDBError(rw, r, err, "attachment_fetch_failed")
+		return
+	}
+
+	var file AttachmentModel
+	err = bucket.GetFilesCollection().FindOne(r.Context(), bson.M{"_id": id}).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "attachment_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch attachment %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "attachment_fetch_failed")
+		return
+	}
+
+	content := &gridfsReader{bucket: bucket, id: id, size: file.Length}
+	defer content.Close()
+
+	// served as the type it was uploaded with, never as what a browser
+	// sniffs from the content
+	rw.Header().Set("Content-Type", file.Metadata.ContentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	disposition := "attachment"
+	if inlineContentTypes[file.Metadata.ContentType] {
+		disposition = "inline"
+	}
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}))
+	http.ServeContent(rw, r, file.Name, file.UploadDate, content)
+}
+
+// deleteAttachment removes an attachment and its chunks.
+func deleteAttachment(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	bucket, err := attachmentBucket(r.Context())
+	if err == nil {
+		err = bucket.DeleteContext(r.Context(), id)
+	}
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		writeError(rw, r, http.StatusNotFound, "attachment_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "could not delete attachment %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "attachment_delete_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "attachment_deleted"),
+	})
+}
+
+// deleteTodoAttachments removes every GridFS file of a deleted todo.
+func deleteTodoAttachments(ctx context.Context, todoID primitive.ObjectID) error {
+	bucket, err := attachmentBucket(ctx)
+	if err != nil {
+		return err
+	}
+	files, err := findAttachments(ctx, todoID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		if err := bucket.DeleteContext(ctx, f.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// attachmentHandlers serves the attachments by their own id.
+func attachmentHandlers(version apiVersion) http.Handler {
+	rg := chi.NewRouter()
+	rg.Use(withAPIVersion(version), limitBody, routeOptions)
+	rg.Group(func(r chi.Router) {
+		r.Get("/{id}", downloadAttachment)
+		r.Delete("/{id}", deleteAttachment)
+	})
+	return rg
+}
+
+func (a AttachmentModel) toAttachment() Attachment {
+	return Attachment{
+		ID:          formatID(a.ID),
+		TodoID:      formatID(a.Metadata.TodoID),
+		Name:        a.Name,
+		Size:        a.Length,
+		ContentType: a.Metadata.ContentType,
+		UploadedAt:  a.UploadDate,
+	}
+}
+
+// gridfsReader is an io.ReadSeeker over a GridFS file for http.ServeContent.
+// Download streams can only skip forward, so seeking closes the current
+// stream and the next Read opens a new one at the offset.
+type gridfsReader struct {
+	bucket *gridfs.Bucket
+	id     primitive.ObjectID
+	size   int64
+	offset int64
+	stream *gridfs.DownloadStream
+}
+
+func (g *gridfsReader) Read(p []byte) (int, error) {
+	if g.offset >= g.size {
+		return 0, io.EOF
+	}
+	if g.stream == nil {
+		stream, err := g.bucket.OpenDownloadStream(g.id)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := stream.Skip(g.offset); err != nil {
+			stream.Close()
+			return 0, err
+		}
+		g.stream = stream
+	}
+	n, err := g.stream.Read(p)
+	g.offset += int64(n)
+	return n, err
+}
+
+func (g *gridfsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.offset
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != g.offset {
+		g.Close()
+		g.offset = offset
+	}
+	return offset, nil
+}
+
+func (g *gridfsReader) Close() error {
+	if g.stream == nil {
+		return nil
+	}
+	err := g.stream.Close()
+	g.stream = nil
+	return err
+}
+
+// humanBytes formats a size in bytes for error messages.
+func humanBytes(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + " MB"
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return strconv.FormatInt(n>>10, 10) + " KB"
+	default:
+		return strconv.FormatInt(n, 10) + " bytes"
+	}
+}
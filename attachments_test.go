@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Downloads keep their uploaded type, and only raster images are shown in
+// place rather than downloaded.
+func TestDownloadAttachmentHeaders(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	tests := []struct {
+		contentType string
+		disposition string
+	}{
+		{"image/png", `inline; filename=report.bin`},
+		{"image/svg+xml", `attachment; filename=report.bin`},
+		{"text/html", `attachment; filename=report.bin`},
+		{"application/pdf", `attachment; filename=report.bin`},
+	}
+	for _, tt := range tests {
+		file := AttachmentModel{
+			ID:         primitive.NewObjectID(),
+			Name:       "report.bin",
+			UploadDate: time.Now().UTC(),
+			Metadata:   AttachmentMetadata{TodoID: primitive.NewObjectID(), ContentType: tt.contentType},
+		}
+		mongo.seed("fs.files", file)
+
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, apiV1.prefix()+"/attachment/"+formatID(file.ID), nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("%s: GET = %d: %s", tt.contentType, rw.Code, rw.Body)
+		}
+		if got := rw.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: Content-Type = %q", tt.contentType, got)
+		}
+		if got := rw.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options = %q, want nosniff", tt.contentType, got)
+		}
+		if got := rw.Header().Get("Content-Disposition"); got != tt.disposition {
+			t.Errorf("%s: Content-Disposition = %q, want %q", tt.contentType, got, tt.disposition)
+		}
+	}
+}
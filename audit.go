@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditCollectionName string = "audit_log"
+	auditIndexName      string = "timestamp_ttl"
+
+	// audit outcomes
+	auditPending   string = "pending"
+	auditSucceeded string = "succeeded"
+	auditFailed    string = "failed"
+)
+
+type actorKey struct{}
+
+type (
+	// record of an administrative or destructive action
+	AuditEntry struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		Actor     string             `bson:"actor" json:"actor"`
+		Action    string             `bson:"action" json:"action"`
+		Route     string             `bson:"route" json:"route"`
+		Affected  int64              `bson:"affected" json:"affected"`
+		Outcome   string             `bson:"outcome" json:"outcome"`
+		ClientIP  string             `bson:"client_ip" json:"client_ip"`
+		Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+		// the single document an action changed and how, when it names one
+		Target string `bson:"target,omitempty" json:"target,omitempty"`
+		Detail string `bson:"detail,omitempty" json:"detail,omitempty"`
+	}
+	// the paginated audit log
+	GetAuditResponse struct {
+		Message string       `json:"message"`
+		Data    []AuditEntry `json:"data"`
+		Page    int64        `json:"page"`
+		Limit   int64        `json:"limit"`
+		Total   int64        `json:"total"`
+	}
+)
+
+// actor names who is performing the request.
+func actor(r *http.Request) string {
+	if a, ok := r.Context().Value(actorKey{}).(string); ok {
+		return a
+	}
+	return "anonymous"
+}
+
+// beginAudit records an action before it is carried out, so nothing
+// destructive can happen without an entry. Callers must fail the request when
+// it returns an error and report the result through finishAudit.
+func beginAudit(r *http.Request, action string) (primitive.ObjectID, error) {
+	entry := AuditEntry{
+		ID:        primitive.NewObjectID(),
+		Actor:     actor(r),
+		Action:    action,
+		Route:     r.Method + " " + r.URL.Path,
+		Outcome:   auditPending,
+		ClientIP:  clientIP(r),
+		Timestamp: time.Now().UTC(),
+	}
+	if _, err := tenantDB(r.Context()).Collection(auditCollectionName).InsertOne(r.Context(), entry); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return entry.ID, nil
+}
+
+// finishAudit stores the outcome and the number of affected documents.
+func finishAudit(ctx context.Context, id primitive.ObjectID, affected int64, actionErr error) {
+	outcome := auditSucceeded
+	if actionErr != nil {
+		outcome = auditFailed
+	}
+	update := bson.M{"$set": bson.M{"affected": affected, "outcome": outcome}}
+	// the action already happened, so don't let a cancelled request lose its result
+	if _, err := tenantDB(ctx).Collection(auditCollectionName).UpdateByID(context.WithoutCancel(ctx), id, update); err != nil {
+		log.Printf("failed to complete audit entry %s: %v\n", id.Hex(), err)
+	}
+}
+
+// ensureAuditIndexes keeps the audit log bounded with a TTL index on the
+// timestamp. A retention of zero keeps entries forever.
+func ensureAuditIndexes(ctx context.Context, retention time.Duration) error {
+	coll := tenantDB(ctx).Collection(auditCollectionName)
+	if retention <= 0 {
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("timestamp"),
+		})
+		return err
+	}
+
+	expireAfter := int32(retention.Seconds())
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: -1}},
+		Options: options.Index().SetName(auditIndexName).SetExpireAfterSeconds(expireAfter),
+	})
+
+	// the retention changed since the index was created: update it in place
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "IndexOptionsConflict" {
+		return tenantDB(ctx).RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: auditCollectionName},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: auditIndexName},
+				{Key: "expireAfterSeconds", Value: expireAfter},
+			}},
+		}).Err()
+	}
+	return err
+}
+
+// getAuditLog lists audit entries newest first, with ?page, ?limit and ?from/?to (RFC 3339 or YYYY-MM-DD).
+func getAuditLog(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, limit, err := parsePagination(query.Get("page"), query.Get("limit"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_pagination", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := bson.M{}
+	timestamp := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseDateParam(value)
+		if err != nil {
+			writeError(rw, r, http.StatusBadRequest, "invalid_date", renderer.M{
+				"param": param,
+				"error": err.Error(),
+			})
+			return
+		}
+		timestamp[op] = t
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	coll := tenantDB(r.Context()).Collection(auditCollectionName)
+	total, err := coll.CountDocuments(r.Context(), filter)
+	if err != nil {
+		logRequestError(r, "failed to count audit entries: %v\n", err)
+		writeDBError(rw, r, err, "audit_fetch_failed")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := coll.Find(r.Context(), filter, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch audit entries: %v\n", err)
+		writeDBError(rw, r, err, "audit_fetch_failed")
+		return
+	}
+
+	entries := []AuditEntry{}
+	if err := cursor.All(r.Context(), &entries); err != nil {
+		logRequestError(r, "failed to decode audit entries: %v\n", err)
+		writeDBError(rw, r, err, "audit_fetch_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetAuditResponse{
+		Message: localize(r, "audit_retrieved"),
+		Data:    entries,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+	})
+}
+
+// parsePagination reads 1-based page numbers and page sizes capped at maxPageLimit.
+func parsePagination(pageParam, limitParam string) (page, limit int64, err error) {
+	page, limit = 1, defaultPageLimit
+	if pageParam != "" {
+		if page, err = strconv.ParseInt(pageParam, 10, 64); err != nil || page < 1 {
+			return 0, 0, errors.New("page must be a positive integer")
+		}
+	}
+	if limitParam != "" {
+		if limit, err = strconv.ParseInt(limitParam, 10, 64); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+	}
+	return page, limit, nil
+}
+
+// parseDateParam accepts an RFC 3339 timestamp or a plain date.
+func parseDateParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
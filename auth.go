@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// permissions a route needs, granted to callers by auth.policy
+const (
+	permRead  string = "read"
+	permWrite string = "write"
+	permAdmin string = "admin"
+)
+
+// how a caller authenticated
+const (
+	authAnonymous string = "anonymous"
+	authAPIKey    string = "api_key"
+	authAdminKey  string = "admin_key"
+)
+
+// permissions lists the permissions auth.policy may grant.
+var permissions = []string{permRead, permWrite, permAdmin}
+
+type callerKey struct{}
+
+// caller is who sent a request, as far as the policy is concerned.
+type caller struct {
+	// one of the auth constants
+	mechanism   string
+	permissions []string
+}
+
+func (c caller) can(permission string) bool {
+	return slices.Contains(c.permissions, permission)
+}
+
+// resolveCaller tells the mechanism of r by its credentials and looks up the
+// permissions auth.policy grants it. The key comes as X-Admin-Key or
+// X-API-Key, an Authorization bearer token or the password of basic auth.
+// Credentials matching no key are taken as none, so an open route stays
+// open whatever a client sends.
+func resolveCaller(r *http.Request) caller {
+	cfg := currentConfig()
+	key := r.Header.Get("X-Admin-Key")
+	if key == "" {
+		key = r.Header.Get("X-API-Key")
+	}
+	if _, password, ok := r.BasicAuth(); key == "" && ok {
+		key = password
+	}
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	switch {
+	case key == "":
+	case cfg.Admin.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.Admin.Key)) == 1:
+		return caller{mechanism: authAdminKey, permissions: cfg.Auth.Policy.AdminKey}
+	case matchesKey(key, cfg.Auth.APIKeys):
+		return caller{mechanism: authAPIKey, permissions: cfg.Auth.Policy.APIKey}
+	}
+	return caller{mechanism: authAnonymous, permissions: cfg.Auth.Policy.Anonymous}
+}
+
+// matchesKey reports whether key is one of keys, comparing all of them in
+// constant time.
+func matchesKey(key string, keys []string) bool {
+	found := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// authenticate resolves the caller of each request once, for the routes
+// further down to check with requirePermission.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), callerKey{}, resolveCaller(r))
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// requestCaller returns the caller authenticate resolved, resolving it on
+// routes it doesn't run on.
+func requestCaller(r *http.Request) caller {
+	if c, ok := r.Context().Value(callerKey{}).(caller); ok {
+		return c
+	}
+	return resolveCaller(r)
+}
+
+// requirePermission lets through the requests whose caller has permission.
+// The others get a 401 when they sent no valid credentials, which may
+// earn it, and a 403 when theirs fall short.
+func requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !checkPermission(rw, r, permission) {
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// requireMethodPermission needs read for the safe methods and write for the
+// others, for route groups that mix both.
+func requireMethodPermission(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		permission := permWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			permission = permRead
+		}
+		if !checkPermission(rw, r, permission) {
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// checkPermission answers r with a 401 or 403 and returns false unless its
+// caller has permission.
+func checkPermission(rw http.ResponseWriter, r *http.Request, permission string) bool {
+	c := requestCaller(r)
+	if c.can(permission) {
+		return true
+	}
+	if c.mechanism == authAnonymous {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="todo"`)
+		writeError(rw, r, http.StatusUnauthorized, "authentication_required", renderer.M{
+			"permission": permission,
+		})
+		return false
+	}
+	writeError(rw, r, http.StatusForbidden, "permission_denied", renderer.M{
+		"permission": permission,
+	})
+	return false
+}
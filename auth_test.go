@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testAdminKey = "admin-secret"
+	testAPIKey   = "api-secret"
+)
+
+// useAuthPolicy puts a policy in effect letting anyone read, API keys
+// also write and the admin key do everything.
+func useAuthPolicy(t *testing.T) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Admin.Key = testAdminKey
+	cfg.Auth.APIKeys = []string{"other-key", testAPIKey}
+	cfg.Auth.Policy.Anonymous = []string{permRead}
+	cfg.Auth.Policy.APIKey = []string{permRead, permWrite}
+	cfg.Auth.Policy.AdminKey = []string{permRead, permWrite, permAdmin}
+	useConfig(t, cfg)
+}
+
+func TestResolveCaller(t *testing.T) {
+	useAuthPolicy(t)
+
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		basicAuth string
+		mechanism string
+	}{
+		{name: "no credentials", mechanism: authAnonymous},
+		{name: "admin key", header: "X-Admin-Key", value: testAdminKey, mechanism: authAdminKey},
+		{name: "API key", header: "X-API-Key", value: testAPIKey, mechanism: authAPIKey},
+		{name: "admin key as an API key", header: "X-API-Key", value: testAdminKey, mechanism: authAdminKey},
+		{name: "bearer token", header: "Authorization", value: "Bearer " + testAPIKey, mechanism: authAPIKey},
+		{name: "basic auth password", basicAuth: testAdminKey, mechanism: authAdminKey},
+		{name: "unknown key", header: "X-API-Key", value: "guess", mechanism: authAnonymous},
+		{name: "prefix of a key", header: "X-API-Key", value: testAPIKey[:5], mechanism: authAnonymous},
+		{name: "unknown bearer token", header: "Authorization", value: "Bearer guess", mechanism: authAnonymous},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/todo", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if tt.basicAuth != "" {
+			r.SetBasicAuth("anyone", tt.basicAuth)
+		}
+		if got := resolveCaller(r); got.mechanism != tt.mechanism {
+			t.Errorf("%s: mechanism = %s, want %s", tt.name, got.mechanism, tt.mechanism)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	useAuthPolicy(t)
+	useRenderer(t, nil)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { rw.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		key     string
+		status  int
+	}{
+		{"anonymous read", requireMethodPermission(ok), http.MethodGet, "", http.StatusNoContent},
+		{"anonymous head", requireMethodPermission(ok), http.MethodHead, "", http.StatusNoContent},
+		{"anonymous write", requireMethodPermission(ok), http.MethodPost, "", http.StatusUnauthorized},
+		{"unknown key write", requireMethodPermission(ok), http.MethodDelete, "guess", http.StatusUnauthorized},
+		{"API key write", requireMethodPermission(ok), http.MethodPatch, testAPIKey, http.StatusNoContent},
+		{"API key admin", requirePermission(permAdmin)(ok), http.MethodGet, testAPIKey, http.StatusForbidden},
+		{"admin key admin", requirePermission(permAdmin)(ok), http.MethodPost, testAdminKey, http.StatusNoContent},
+		{"through authenticate", authenticate(requirePermission(permWrite)(ok)), http.MethodPost, testAPIKey, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/todo", nil)
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			rw := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rw, r)
+			if rw.Code != tt.status {
+				t.Errorf("status = %d, want %d", rw.Code, tt.status)
+			}
+			challenge := rw.Header().Get("WWW-Authenticate")
+			if (rw.Code == http.StatusUnauthorized) != (challenge == `Bearer realm="todo"`) {
+				t.Errorf("WWW-Authenticate = %q with status %d", challenge, rw.Code)
+			}
+		})
+	}
+}
+
+// Every route of the router, with every method it answers, refuses each
+// caller the policy of useAuthPolicy doesn't grant its permission before
+// anything reaches the database, and lets the others read.
+func TestRoutePermissionMatrix(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.Auth.APIKeys = []string{"other-key", testAPIKey}
+		cfg.Auth.Policy.Anonymous = []string{permRead}
+		cfg.Auth.Policy.APIKey = []string{permRead, permWrite}
+		cfg.Auth.Policy.AdminKey = []string{permRead, permWrite, permAdmin}
+	})
+	routes, err := routeTable(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// needed returns the permission method on pattern takes, empty for none
+	needed := func(pattern, method string) string {
+		switch {
+		case pattern == "/healthz", pattern == "/metrics", pattern == "/debug/routes",
+			strings.HasPrefix(pattern, "/static/"), strings.HasPrefix(pattern, "/t/"):
+			return ""
+		case strings.HasPrefix(pattern, "/admin/"):
+			return permAdmin
+		case method == http.MethodGet, method == http.MethodHead, method == http.MethodOptions:
+			return permRead
+		}
+		return permWrite
+	}
+	callers := []struct {
+		name, key   string
+		permissions []string
+		anonymous   bool
+	}{
+		{"anonymous", "", []string{permRead}, true},
+		{"unknown key", "guess", []string{permRead}, true},
+		{"API key", testAPIKey, []string{permRead, permWrite}, false},
+		{"admin key", testAdminKey, []string{permRead, permWrite, permAdmin}, false},
+	}
+
+	var checked int
+	for _, route := range routes {
+		path := strings.ReplaceAll(route.Pattern, "{id}", primitive.NewObjectID().Hex())
+		path = strings.ReplaceAll(path, "/*", "/style.css")
+		for _, param := range []string{"{token}", "{view}", "{tag}", "{name}", "{commentId}", "{reminderId}", "{blockerId}", "{attachmentId}"} {
+			path = strings.ReplaceAll(path, param, "x")
+		}
+		for _, method := range route.Methods {
+			permission := needed(route.Pattern, method)
+			for _, c := range callers {
+				granted := permission == "" || slices.Contains(c.permissions, permission)
+				// the handlers behind granted writes would act on the request
+				if granted && method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions {
+					continue
+				}
+				checked++
+				r := httptest.NewRequest(method, path, nil)
+				if c.key != "" {
+					r.Header.Set("X-API-Key", c.key)
+				}
+				mongo.commands()
+				rw := httptest.NewRecorder()
+				router.ServeHTTP(rw, r)
+				refused := strings.Contains(rw.Body.String(), `"authentication_required"`) ||
+					strings.Contains(rw.Body.String(), `"admin_key_required"`) ||
+					strings.Contains(rw.Body.String(), `"permission_denied"`)
+
+				name := method + " " + route.Pattern + " as " + c.name
+				switch {
+				case granted && refused:
+					t.Errorf("%s = %d: %s, want it let through", name, rw.Code, rw.Body)
+				case granted:
+				case c.anonymous && rw.Code != http.StatusUnauthorized, !c.anonymous && rw.Code != http.StatusForbidden:
+					t.Errorf("%s = %d: %s, want it refused", name, rw.Code, rw.Body)
+				case !refused:
+					t.Errorf("%s = %d: %s, want the refusal to name the permission", name, rw.Code, rw.Body)
+				default:
+					for _, cmd := range mongo.commands() {
+						if cmd.Name != "hello" && cmd.Name != "isMaster" && cmd.Name != "endSessions" {
+							t.Errorf("%s sent %s to the database before being refused", name, cmd.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	if checked == 0 {
+		t.Fatal("found no routes to check")
+	}
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// version of the archive layout, not of the data in it
+	backupFormat             = 1
+	backupManifestName       = "manifest.json"
+	backupRestoreModeMerge   = "merge"
+	backupRestoreModeReplace = "replace"
+
+	// how the collections of a backup were read: all at the same point in
+	// time, or one after the other while writes went on
+	backupConsistencySnapshot   = "snapshot"
+	backupConsistencyBestEffort = "best_effort"
+	// the wire version of MongoDB 5.0, the first to read at a snapshot
+	// outside a transaction
+	snapshotReadsWireVersion = 13
+
+	// backup keys shorter than this are refused by the configuration
+	minBackupKeyLength = 32
+	// plaintext bytes sealed at a time in an encrypted archive
+	backupChunkSize = 64 << 10
+	// documents written to the database per round trip by a restore
+	restoreBatchSize = 500
+)
+
+// backupMagic starts every encrypted archive; a plain one starts with the
+// gzip header instead.
+var backupMagic = []byte("TDOBAK\x00\x01")
+
+// backupCollections are dumped by a backup, each as <name>.ndjson. The
+// outbox, the deletions and the migration records are left out: pending
+// deliveries belong to the running instance, syncing clients start over
+// after a restore and the schema version is in the manifest.
+var backupCollections = []string{
+	collectionName,
+	commentCollectionName,
+	filterCollectionName,
+	templateCollectionName,
+	auditCollectionName,
+	mergedCollectionName,
+	// the default GridFS bucket holding the attachments
+	"fs.files",
+	"fs.chunks",
+}
+
+var errBackupCorrupt = errors.New("backup archive is corrupt")
+
+type (
+	// the first entry of a backup archive
+	BackupManifest struct {
+		Format        int       `json:"format"`
+		SchemaVersion int       `json:"schema_version"`
+		Tenant        string    `json:"tenant,omitempty"`
+		CreatedAt     time.Time `json:"created_at"`
+		// one of the backupConsistency constants
+		Consistency string `json:"consistency"`
+		// the time the data is of: that of the snapshot, else when reading
+		// the first collection began
+		SnapshotAt  time.Time          `json:"snapshot_at"`
+		Collections []BackupCollection `json:"collections"`
+	}
+	// a collection dump in a backup archive
+	BackupCollection struct {
+		Name   string `json:"name"`
+		Count  int64  `json:"count"`
+		SHA256 string `json:"sha256"`
+	}
+	// a finished restore
+	RestoreResponse struct {
+		Message       string             `json:"message"`
+		Mode          string             `json:"mode"`
+		SchemaVersion int                `json:"schema_version"`
+		Collections   []BackupCollection `json:"collections"`
+	}
+	// a collection dump spooled to a temporary file
+	backupDump struct {
+		BackupCollection
+		file *os.File
+	}
+)
+
+// latestSchemaVersion is the version of the last migration this build knows.
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// getBackup streams the data of the tenant as a gzipped tarball: the
+// manifest, then one NDJSON file of canonical extended JSON per collection.
+// With backup.key set the archive is encrypted as a whole. The collections
+// are dumped to temporary files first, since a tar entry needs its size up
+// front, so memory use doesn't grow with the data. With
+// ?consistency=snapshot every collection is read at the same point in time
+// where MongoDB can do that; the manifest and X-Backup-Consistency tell
+// whether it did.
+func getBackup(rw http.ResponseWriter, r *http.Request) {
+	consistency := r.URL.Query().Get("consistency")
+	if consistency == "" {
+		consistency = backupConsistencyBestEffort
+	}
+	if consistency != backupConsistencySnapshot && consistency != backupConsistencyBestEffort {
+		writeError(rw, r, http.StatusBadRequest, "invalid_backup_consistency", renderer.M{
+			"allowed": backupConsistencySnapshot + ", " + backupConsistencyBestEffort,
+		})
+		return
+	}
+
+	auditID, err := beginAudit(r, "backup.create")
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_backup")
+		return
+	}
+
+	manifest, dumps, err := dumpBackup(r.Context(), consistency)
+	defer removeDumps(dumps)
+	if err != nil {
+		finishAudit(r.Context(), auditID, 0, err)
+		logRequestError(r, "failed to dump the database: %v\n", err)
+		writeDBError(rw, r, err, "backup_failed")
+		return
+	}
+	finishAudit(r.Context(), auditID, manifest.documents(), nil)
+
+	key := currentConfig().Backup.Key
+	rw.Header().Set("Content-Type", "application/gzip")
+	if key != "" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+	}
+	rw.Header().Set("Content-Disposition", `attachment; filename="`+backupFilename(manifest, key != "")+`"`)
+	rw.Header().Set("X-Backup-Consistency", manifest.Consistency)
+	// a large archive takes longer than the server's write timeout
+	if err := http.NewResponseController(rw).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("failed to lift the write deadline of the backup: %v\n", err)
+	}
+	rw.WriteHeader(http.StatusOK)
+
+	// the status is out, so a failure can only cut the archive short, which
+	// the gzip trailer or the encryption make detectable
+	if err := writeBackup(rw, key, manifest, dumps); err != nil {
+		log.Printf("failed to stream the backup: %v\n", err)
+	}
+}
+
+// dumpBackup dumps every collection of backupCollections and returns the
+// manifest describing them. The dumps must be removed by the caller, even
+// with an error.
+//
+// With consistency backupConsistencySnapshot, and MongoDB able to, the
+// collections are read in a snapshot session: all at the cluster time of
+// the first read, so a todo renamed meanwhile is in the archive once, as it
+// was. Such reads fail once the snapshot is older than the server keeps
+// history for, five minutes by default. Elsewhere the collections are read
+// one after the other and the manifest says best_effort.
+func dumpBackup(ctx context.Context, consistency string) (BackupManifest, []*backupDump, error) {
+	manifest := BackupManifest{
+		Format:      backupFormat,
+		CreatedAt:   time.Now().UTC(),
+		Consistency: backupConsistencyBestEffort,
+	}
+	manifest.SnapshotAt = manifest.CreatedAt
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		manifest.Tenant = tenant
+	}
+	if consistency == backupConsistencySnapshot && snapshotReadsSupported(ctx) {
+		session, err := client.StartSession(options.Session().SetSnapshot(true))
+		if err != nil {
+			return manifest, nil, err
+		}
+		defer session.EndSession(ctx)
+		ctx = mongo.NewSessionContext(ctx, session)
+		manifest.Consistency = backupConsistencySnapshot
+	}
+
+	// in a snapshot session this first read picks the snapshot
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return manifest, nil, err
+	}
+	for version := range applied {
+		manifest.SchemaVersion = max(manifest.SchemaVersion, version)
+	}
+	if at := snapshotTime(ctx); at != nil {
+		manifest.SnapshotAt = time.Unix(int64(at.T), 0).UTC()
+	}
+
+	var dumps []*backupDump
+	for _, name := range backupCollections {
+		dump, err := dumpCollection(ctx, name)
+		if dump != nil {
+			dumps = append(dumps, dump)
+		}
+		if err != nil {
+			return manifest, dumps, fmt.Errorf("collection %s: %w", name, err)
+		}
+		manifest.Collections = append(manifest.Collections, dump.BackupCollection)
+	}
+	return manifest, dumps, nil
+}
+
+// snapshotReadsSupported asks MongoDB whether it reads at a snapshot outside
+// a transaction, which takes a replica set or mongos of version 5.0 or
+// later.
+func snapshotReadsSupported(ctx context.Context) bool {
+	var hello struct {
+		SetName        string `bson:"setName"`
+		Msg            string `bson:"msg"`
+		MaxWireVersion int32  `bson:"maxWireVersion"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Printf("failed to detect snapshot read support: %v\n", err)
+		return false
+	}
+	return (hello.SetName != "" || hello.Msg == "isdbgrid") && hello.MaxWireVersion >= snapshotReadsWireVersion
+}
+
+// snapshotTime is the cluster time the snapshot session of ctx reads at,
+// nil outside one or before its first read.
+func snapshotTime(ctx context.Context) *primitive.Timestamp {
+	session, ok := mongo.SessionFromContext(ctx).(mongo.XSession)
+	if !ok {
+		return nil
+	}
+	return session.ClientSession().SnapshotTime
+}
+
+// documents is the number of documents in the archive.
+func (m BackupManifest) documents() int64 {
+	var total int64
+	for _, collection := range m.Collections {
+		total += collection.Count
+	}
+	return total
+}
+
+// backupFilename names the archive of manifest, which is made in UTC so the
+// names of a tenant sort by time.
+func backupFilename(manifest BackupManifest, encrypted bool) string {
+	name := "todo-backup-"
+	if manifest.Tenant != "" {
+		name += manifest.Tenant + "-"
+	}
+	name += manifest.CreatedAt.Format("20060102T150405Z") + ".tar.gz"
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+func removeDumps(dumps []*backupDump) {
+	for _, dump := range dumps {
+		dump.file.Close()
+		os.Remove(dump.file.Name())
+	}
+}
+
+// dumpCollection writes every document of the collection name to a
+// temporary file, one canonical extended JSON document a line. The returned
+// dump is rewound and must be removed by the caller, even with an error.
+func dumpCollection(ctx context.Context, name string) (*backupDump, error) {
+	file, err := os.CreateTemp("", "todo-backup-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	dump := &backupDump{BackupCollection: BackupCollection{Name: name}, file: file}
+
+	cursor, err := tenantDB(ctx).Collection(name).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return dump, err
+	}
+	defer cursor.Close(ctx)
+
+	digest := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(file, digest))
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return dump, err
+		}
+		out.Write(line)
+		if err := out.WriteByte('\n'); err != nil {
+			return dump, err
+		}
+		dump.Count++
+	}
+	if err := cursor.Err(); err != nil {
+		return dump, err
+	}
+	if err := out.Flush(); err != nil {
+		return dump, err
+	}
+	dump.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	_, err = file.Seek(0, io.SeekStart)
+	return dump, err
+}
+
+// writeBackup writes the archive of manifest and dumps to w, encrypted with
+// key unless it is empty.
+func writeBackup(w io.Writer, key string, manifest BackupManifest, dumps []*backupDump) error {
+	var encrypter *backupEncrypter
+	if key != "" {
+		var err error
+		if encrypter, err = newBackupEncrypter(w, key); err != nil {
+			return err
+		}
+		w = encrypter
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, backupManifestName, int64(len(data)), manifest.CreatedAt, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for _, dump := range dumps {
+		info, err := dump.file.Stat()
+		if err != nil {
+			return err
+		}
+		if err := writeTarEntry(tw, dump.Name+".ndjson", info.Size(), manifest.CreatedAt, dump.file); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if encrypter != nil {
+		return encrypter.Close()
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, modTime time.Time, content io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, content)
+	return err
+}
+
+// restoreBackup loads an archive made by getBackup into the tenant. With
+// ?mode=merge, the default, the documents of the archive replace those with
+// the same _id and the others are kept; with ?mode=replace the backed up
+// collections are emptied first. The whole archive is read and checked
+// against its manifest before anything is written. An archive from a newer
+// schema than this build knows is refused; one from an older schema has the
+// later migrations applied to it.
+func restoreBackup(rw http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = backupRestoreModeMerge
+	}
+	if mode != backupRestoreModeMerge && mode != backupRestoreModeReplace {
+		writeError(rw, r, http.StatusBadRequest, "invalid_restore_mode", renderer.M{
+			"allowed": backupRestoreModeMerge + ", " + backupRestoreModeReplace,
+		})
+		return
+	}
+
+	cfg := currentConfig().Backup
+	r.Body = http.MaxBytesReader(rw, r.Body, cfg.MaxRestoreSize)
+	if err := http.NewResponseController(rw).SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("failed to lift the read deadline of the restore: %v\n", err)
+	}
+
+	manifest, dumps, err := readBackup(r.Body, cfg.Key)
+	defer removeDumps(dumps)
+	var tooLarge *http.MaxBytesError
+	var tooNew *backupSchemaError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(rw, r, http.StatusRequestEntityTooLarge, "backup_too_large", renderer.M{
+			"max": cfg.MaxRestoreSize,
+		})
+		return
+	case errors.Is(err, errBackupKeyRequired):
+		writeError(rw, r, http.StatusBadRequest, "backup_key_required", nil)
+		return
+	case errors.As(err, &tooNew):
+		writeError(rw, r, http.StatusConflict, "backup_schema_too_new", renderer.M{
+			"version":   tooNew.version,
+			"supported": latestSchemaVersion(),
+		})
+		return
+	case err != nil:
+		log.Printf("refused backup archive: %v\n", err)
+		writeError(rw, r, http.StatusBadRequest, "backup_invalid", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	auditID, err := beginAudit(r, "backup.restore_"+mode)
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_backup")
+		return
+	}
+
+	restored := []BackupCollection{}
+	var total int64
+	for _, dump := range dumps {
+		// keep the entry of this restore when the audit log is replaced
+		keep := bson.M{}
+		if dump.Name == auditCollectionName {
+			keep = bson.M{"_id": auditID}
+		}
+		count, err := restoreCollection(r.Context(), dump, mode == backupRestoreModeReplace, keep)
+		total += count
+		restored = append(restored, BackupCollection{Name: dump.Name, Count: count, SHA256: dump.SHA256})
+		if err != nil {
+			finishAudit(r.Context(), auditID, total, err)
+			logRequestError(r, "failed to restore collection %s: %v\n", dump.Name, err)
+			writeDBError(rw, r, err, "restore_failed")
+			return
+		}
+	}
+	// migrations are idempotent, so documents the database already had
+	// before a merge are safe to go through them again
+	for _, m := range migrations {
+		if m.version <= manifest.SchemaVersion {
+			continue
+		}
+		if err := m.up(r.Context()); err != nil {
+			finishAudit(r.Context(), auditID, total, err)
+			logRequestError(r, "failed to migrate the restored data with %d %s: %v\n", m.version, m.name, err)
+			writeDBError(rw, r, err, "restore_failed")
+			return
+		}
+	}
+	finishAudit(r.Context(), auditID, total, nil)
+	releaseQuota(r.Context())
+	recordSyncReset(r.Context())
+
+	renderJSON(rw, r, http.StatusOK, RestoreResponse{
+		Message:       localize(r, "backup_restored"),
+		Mode:          mode,
+		SchemaVersion: manifest.SchemaVersion,
+		Collections:   restored,
+	})
+}
+
+var errBackupKeyRequired = errors.New("backup archive is encrypted and backup.key is not set")
+
+// backupSchemaError is the error of an archive from a newer schema.
+type backupSchemaError struct {
+	version int
+}
+
+func (e *backupSchemaError) Error() string {
+	return fmt.Sprintf("backup has schema version %d, this build supports up to %d", e.version, latestSchemaVersion())
+}
+
+// readBackup reads an archive, decrypting it with key when it is encrypted,
+// and spools its dumps to temporary files, checking each against the
+// manifest. The dumps must be removed by the caller, even with an error.
+func readBackup(body io.Reader, key string) (BackupManifest, []*backupDump, error) {
+	var manifest BackupManifest
+	var dumps []*backupDump
+
+	in := bufio.NewReader(body)
+	if magic, _ := in.Peek(len(backupMagic)); bytes.Equal(magic, backupMagic) {
+		if key == "" {
+			return manifest, dumps, errBackupKeyRequired
+		}
+		decrypter, err := newBackupDecrypter(in, key)
+		if err != nil {
+			return manifest, dumps, err
+		}
+		in = bufio.NewReader(decrypter)
+	}
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return manifest, dumps, err
+	}
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil {
+		return manifest, dumps, err
+	}
+	if header.Name != backupManifestName {
+		return manifest, dumps, fmt.Errorf("%w: expected %s first, found %s", errBackupCorrupt, backupManifestName, header.Name)
+	}
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return manifest, dumps, fmt.Errorf("%w: %v", errBackupCorrupt, err)
+	}
+	if manifest.Format != backupFormat {
+		return manifest, dumps, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+	if manifest.SchemaVersion > latestSchemaVersion() {
+		return manifest, dumps, &backupSchemaError{version: manifest.SchemaVersion}
+	}
+	expected := map[string]BackupCollection{}
+	for _, collection := range manifest.Collections {
+		if !slices.Contains(backupCollections, collection.Name) {
+			return manifest, dumps, fmt.Errorf("%w: unknown collection %s", errBackupCorrupt, collection.Name)
+		}
+		expected[collection.Name+".ndjson"] = collection
+	}
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return manifest, dumps, err
+		}
+		collection, ok := expected[header.Name]
+		if !ok {
+			return manifest, dumps, fmt.Errorf("%w: unexpected entry %s", errBackupCorrupt, header.Name)
+		}
+		delete(expected, header.Name)
+
+		file, err := os.CreateTemp("", "todo-restore-*.ndjson")
+		if err != nil {
+			return manifest, dumps, err
+		}
+		dump := &backupDump{BackupCollection: BackupCollection{Name: collection.Name}, file: file}
+		dumps = append(dumps, dump)
+		digest := sha256.New()
+		if dump.Count, err = copyLines(io.MultiWriter(file, digest), tr); err != nil {
+			return manifest, dumps, err
+		}
+		dump.SHA256 = hex.EncodeToString(digest.Sum(nil))
+		if dump.Count != collection.Count || dump.SHA256 != collection.SHA256 {
+			return manifest, dumps, fmt.Errorf("%w: %s doesn't match the manifest", errBackupCorrupt, header.Name)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return manifest, dumps, err
+		}
+	}
+	for name := range expected {
+		return manifest, dumps, fmt.Errorf("%w: %s is missing", errBackupCorrupt, name)
+	}
+	// the gzip trailer is only checked once the stream is read to its end
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return manifest, dumps, err
+	}
+	return manifest, dumps, nil
+}
+
+// copyLines copies src to dst and counts the lines it holds.
+func copyLines(dst io.Writer, src io.Reader) (int64, error) {
+	var lines int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return lines, werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// restoreCollection writes the documents of dump to their collection and
+// returns how many it wrote. With replace the collection is emptied first,
+// except for the documents matching keep.
+func restoreCollection(ctx context.Context, dump *backupDump, replace bool, keep bson.M) (int64, error) {
+	coll := tenantDB(ctx).Collection(dump.Name)
+	if replace {
+		filter := bson.M{}
+		if len(keep) > 0 {
+			filter = bson.M{"$nor": bson.A{keep}}
+		}
+		if _, err := coll.DeleteMany(ctx, filter); err != nil {
+			return 0, err
+		}
+	}
+
+	var restored int64
+	var batch []mongo.WriteModel
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result, err := coll.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			restored += result.InsertedCount + result.UpsertedCount + result.MatchedCount
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	scanner := bufio.NewScanner(dump.file)
+	// GridFS chunks are 255 KiB of binary, a third more as base64
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return restored, fmt.Errorf("%w: %v", errBackupCorrupt, err)
+		}
+		id, ok := documentID(doc)
+		if !ok {
+			return restored, fmt.Errorf("%w: a document of %s has no _id", errBackupCorrupt, dump.Name)
+		}
+		if replace {
+			batch = append(batch, mongo.NewInsertOneModel().SetDocument(doc))
+		} else {
+			batch = append(batch, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(doc).SetUpsert(true))
+		}
+		if len(batch) == restoreBatchSize {
+			if err := flush(); err != nil {
+				return restored, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return restored, err
+	}
+	return restored, flush()
+}
+
+func documentID(doc bson.D) (interface{}, bool) {
+	for _, elem := range doc {
+		if elem.Key == "_id" {
+			return elem.Value, true
+		}
+	}
+	return nil, false
+}
+
+// backupAEAD is AES-256-GCM keyed with the SHA-256 of key, so any string of
+// sufficient length will do as backup.key.
+func backupAEAD(key string) (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupNonce is the nonce of chunk counter of an encrypted archive. The
+// last chunk is sealed with a nonce of its own, so an archive cut short at a
+// chunk boundary fails to decrypt instead of passing as complete.
+func backupNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// backupEncrypter encrypts what is written to it in chunks of
+// backupChunkSize, each sealed with AES-GCM and prefixed with its length,
+// after the magic and a random nonce prefix. Close seals the last chunk.
+type backupEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newBackupEncrypter(w io.Writer, key string) (*backupEncrypter, error) {
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &backupEncrypter{w: w, aead: aead, prefix: make([]byte, 7)}
+	if _, err := rand.Read(e.prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(slices.Clone(backupMagic), e.prefix...)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// a full chunk is held back until more follows, as it may be the last
+	for len(e.buf) > backupChunkSize {
+		if err := e.seal(e.buf[:backupChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[backupChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *backupEncrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *backupEncrypter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, backupNonce(e.prefix, e.counter, last), chunk, nil)
+	e.counter++
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(sealed)))
+	if _, err := e.w.Write(size); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// backupDecrypter reads what a backupEncrypter wrote.
+type backupDecrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func newBackupDecrypter(r *bufio.Reader, key string) (*backupDecrypter, error) {
+	aead, err := backupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(backupMagic)+7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	return &backupDecrypter{r: r, aead: aead, prefix: header[len(backupMagic):]}, nil
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *backupDecrypter) open() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, size); err != nil {
+		return truncatedBackup(err)
+	}
+	length := binary.BigEndian.Uint32(size)
+	if length > backupChunkSize+uint32(d.aead.Overhead()) {
+		return errBackupCorrupt
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return truncatedBackup(err)
+	}
+	_, err := d.r.Peek(1)
+	last := errors.Is(err, io.EOF)
+	if err != nil && !last {
+		return err
+	}
+	chunk, err := d.aead.Open(nil, backupNonce(d.prefix, d.counter, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: wrong key or tampered archive", errBackupCorrupt)
+	}
+	d.counter++
+	d.buf, d.done = chunk, last
+	return nil
+}
+
+// truncatedBackup reports an archive ending early as corrupt and passes
+// other read errors, like a body over the size limit, through.
+func truncatedBackup(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", errBackupCorrupt, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A snapshot backup reads every collection at the time its first read was
+// at, however many writes land meanwhile, and says so in its manifest; where
+// MongoDB can't read at a snapshot the backup falls back to reading the
+// collections as they are, and the manifest says best_effort.
+func TestDumpBackupConsistency(t *testing.T) {
+	tests := []struct {
+		name       string
+		replicaSet bool
+		asked      string
+		want       string
+	}{
+		{"snapshot", true, backupConsistencySnapshot, backupConsistencySnapshot},
+		{"snapshot on a standalone server", false, backupConsistencySnapshot, backupConsistencyBestEffort},
+		{"best effort", true, backupConsistencyBestEffort, backupConsistencyBestEffort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, defaultConfig())
+			mongo := useEmptyDatabase(t)
+			mongo.mu.Lock()
+			mongo.operationTimes = tt.replicaSet
+			mongo.mu.Unlock()
+			mongo.seed(collectionName, newTodoModel("write report", time.Now().UTC()))
+			mongo.commands()
+
+			manifest, dumps, err := dumpBackup(context.Background(), tt.asked)
+			removeDumps(dumps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Consistency != tt.want {
+				t.Errorf("consistency %q, want %q", manifest.Consistency, tt.want)
+			}
+			if len(manifest.Collections) != len(backupCollections) || manifest.Collections[0].Count != 1 {
+				t.Errorf("the manifest lists %+v", manifest.Collections)
+			}
+
+			var reads int
+			var at primitive.Timestamp
+			for _, cmd := range mongo.commands() {
+				if cmd.Name != "find" {
+					continue
+				}
+				reads++
+				level, _ := cmd.Command.Lookup("readConcern", "level").StringValueOK()
+				ts, i, pinned := cmd.Command.Lookup("readConcern", "atClusterTime").TimestampOK()
+				switch {
+				case tt.want != backupConsistencySnapshot:
+					if level == "snapshot" {
+						t.Errorf("a %s backup read %s at a snapshot", tt.want, cmd.Collection)
+					}
+				case reads == 1:
+					// the first read picks the snapshot
+					if level != "snapshot" || pinned {
+						t.Errorf("the first read of %s has read concern %s", cmd.Collection, cmd.Command.Lookup("readConcern"))
+					}
+				case level != "snapshot" || !pinned:
+					t.Errorf("%s was read outside the snapshot: %s", cmd.Collection, cmd.Command.Lookup("readConcern"))
+				case at.IsZero():
+					at = primitive.Timestamp{T: ts, I: i}
+				case !at.Equal(primitive.Timestamp{T: ts, I: i}):
+					t.Errorf("%s was read at %v, the collections before at %v", cmd.Collection, primitive.Timestamp{T: ts, I: i}, at)
+				}
+			}
+			if reads != len(backupCollections)+1 {
+				t.Errorf("the backup sent %d finds, want %d", reads, len(backupCollections)+1)
+			}
+
+			if tt.want == backupConsistencySnapshot {
+				if at.IsZero() {
+					t.Fatal("no read was pinned to the snapshot")
+				}
+				if want := time.Unix(int64(at.T), 0).UTC(); !manifest.SnapshotAt.Equal(want) {
+					t.Errorf("snapshot_at %v, want the snapshot's %v", manifest.SnapshotAt, want)
+				}
+			} else if !manifest.SnapshotAt.Equal(manifest.CreatedAt) {
+				t.Errorf("snapshot_at %v, want the time of the backup %v", manifest.SnapshotAt, manifest.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestGetBackupConsistency(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	useEmptyDatabase(t)
+
+	tests := []struct {
+		query, want string
+		status      int
+	}{
+		{"", backupConsistencyBestEffort, http.StatusOK},
+		{"?consistency=snapshot", backupConsistencyBestEffort, http.StatusOK},
+		{"?consistency=best_effort", backupConsistencyBestEffort, http.StatusOK},
+		{"?consistency=strong", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		getBackup(rw, httptest.NewRequest(http.MethodGet, "/admin/backup"+tt.query, nil))
+		if rw.Code != tt.status || rw.Header().Get("X-Backup-Consistency") != tt.want {
+			t.Errorf("GET /admin/backup%s = %d with X-Backup-Consistency %q, want %d with %q",
+				tt.query, rw.Code, rw.Header().Get("X-Backup-Consistency"), tt.status, tt.want)
+		}
+	}
+}
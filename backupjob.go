@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	backupCollectionName string = "backups"
+
+	// the lock document shares the collection with the records of the runs
+	backupLockID string = "lock"
+	// a run holding the lock longer than this is taken to have crashed
+	backupLease time.Duration = time.Hour
+
+	// backup run states
+	backupRunning     string = "running"
+	backupSucceeded   string = "succeeded"
+	backupFailed      string = "failed"
+	backupInterrupted string = "interrupted"
+
+	// event type of a scheduled backup that failed
+	eventBackupFailed string = "backup.failed"
+)
+
+var errBackupTooLarge = errors.New("backup is larger than backup.max_restore_size")
+
+var backupRuns = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_backup_runs_total",
+		Help: "Scheduled backup runs by outcome: succeeded, failed or interrupted.",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(backupRuns)
+}
+
+type (
+	// a scheduled backup run, as stored and as listed by the admin API
+	BackupRun struct {
+		ID            primitive.ObjectID `bson:"_id" json:"id"`
+		Status        string             `bson:"status" json:"status"`
+		StartedAt     time.Time          `bson:"started_at" json:"started_at"`
+		FinishedAt    *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+		DurationMS    int64              `bson:"duration_ms" json:"duration_ms"`
+		Location      string             `bson:"location,omitempty" json:"location,omitempty"`
+		Size          int64              `bson:"size" json:"size"`
+		Documents     int64              `bson:"documents" json:"documents"`
+		SchemaVersion int                `bson:"schema_version" json:"schema_version"`
+		Error         string             `bson:"error,omitempty" json:"error,omitempty"`
+	}
+	// the backups endpoint response
+	GetBackupsResponse struct {
+		Message string      `json:"message"`
+		Data    []BackupRun `json:"data"`
+		Page    int64       `json:"page"`
+		Limit   int64       `json:"limit"`
+		Total   int64       `json:"total"`
+	}
+)
+
+// backupJob backs up every tenant, see runScheduledBackup. Shutdown
+// interrupts a run in progress, which is recorded as interrupted.
+func backupJob(tenants []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, tenantCtx := range tenantContexts(ctx, tenants) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := runScheduledBackup(tenantCtx); err != nil {
+				errs = append(errs, fmt.Errorf("back up %s: %w", tenantDB(tenantCtx).Name(), err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// runScheduledBackup backs up the tenant of ctx and records the run. It
+// holds the backup lock while it runs, so with several instances on the same
+// schedule only one makes the backup. A failure is counted and returned, and
+// with webhooks a backup.failed event carrying the run is queued.
+func runScheduledBackup(ctx context.Context) error {
+	coll := tenantDB(ctx).Collection(backupCollectionName)
+	owner := lockOwner()
+	if err := takeLock(ctx, coll, backupLockID, owner, backupLease); err != nil {
+		if errors.Is(err, errLockHeld) {
+			log.Printf("skipping the backup of %s, another run holds the lock\n", tenantDB(ctx).Name())
+			return nil
+		}
+		return fmt.Errorf("take the backup lock: %w", err)
+	}
+	defer releaseLock(ctx, coll, backupLockID, owner)
+
+	run := BackupRun{
+		ID:        primitive.NewObjectID(),
+		Status:    backupRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	if _, err := coll.InsertOne(ctx, run); err != nil {
+		return fmt.Errorf("record the backup: %w", err)
+	}
+
+	err := storeBackup(ctx, &run)
+	finished := time.Now().UTC()
+	run.FinishedAt = &finished
+	run.DurationMS = finished.Sub(run.StartedAt).Milliseconds()
+	switch {
+	case err == nil:
+		run.Status = backupSucceeded
+		log.Printf("backed up %s to %s\n", tenantDB(ctx).Name(), run.Location)
+	case ctx.Err() != nil:
+		run.Status = backupInterrupted
+		run.Error = "interrupted by shutdown"
+	default:
+		run.Status = backupFailed
+		run.Error = err.Error()
+	}
+	backupRuns.WithLabelValues(run.Status).Inc()
+
+	// the outcome is stored even when shutdown interrupted the run
+	ctx = context.WithoutCancel(ctx)
+	if _, err := coll.ReplaceOne(ctx, bson.M{"_id": run.ID}, run); err != nil {
+		log.Printf("failed to record the backup of %s: %v\n", tenantDB(ctx).Name(), err)
+	}
+	if run.Status == backupFailed && webhooksEnabled() {
+		if err := queueEvent(ctx, WebhookEvent{Type: eventBackupFailed, Backup: &run}); err != nil {
+			log.Printf("failed to record %s event: %v\n", eventBackupFailed, err)
+		}
+	}
+	return err
+}
+
+// storeBackup makes the archive of the tenant of ctx and stores it in
+// backup.s3.bucket or else backup.dir, filling in run as it goes.
+func storeBackup(ctx context.Context, run *BackupRun) error {
+	cfg := currentConfig().Backup
+	manifest, dumps, err := dumpBackup(ctx, backupConsistencyBestEffort)
+	defer removeDumps(dumps)
+	if err != nil {
+		return err
+	}
+	run.SchemaVersion = manifest.SchemaVersion
+	run.Documents = manifest.documents()
+
+	// a local archive is written next to its final name, so renaming it
+	// into place can't fail half way
+	tempDir := ""
+	if cfg.S3.Bucket == "" {
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return err
+		}
+		tempDir = cfg.Dir
+	}
+	archive, err := os.CreateTemp(tempDir, ".todo-backup-*.part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		archive.Close()
+		os.Remove(archive.Name())
+	}()
+
+	digest := sha256.New()
+	out := &limitedWriter{w: io.MultiWriter(archive, digest), remaining: cfg.MaxRestoreSize}
+	if err := writeBackup(out, cfg.Key, manifest, dumps); err != nil {
+		return err
+	}
+	run.Size = cfg.MaxRestoreSize - out.remaining
+	filename := backupFilename(manifest, cfg.Key != "")
+
+	if cfg.S3.Bucket != "" {
+		if _, err := archive.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		run.Location, err = putS3Object(ctx, cfg.S3, cfg.S3.Prefix+filename, archive, run.Size, digest.Sum(nil))
+		return err
+	}
+
+	if err := archive.Sync(); err != nil {
+		return err
+	}
+	path := filepath.Join(cfg.Dir, filename)
+	if err := os.Rename(archive.Name(), path); err != nil {
+		return err
+	}
+	run.Location = path
+	if cfg.Keep > 0 {
+		if err := rotateBackups(cfg.Dir, manifest.Tenant, int(cfg.Keep)); err != nil {
+			return fmt.Errorf("the backup was stored but older ones were not removed: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotateBackups removes all but the keep newest archives of tenant from dir.
+func rotateBackups(dir, tenant string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isBackupOf(entry.Name(), tenant) {
+			names = append(names, entry.Name())
+		}
+	}
+	// the names end in the time of the backup, so they sort oldest first
+	slices.Sort(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// isBackupOf reports whether name is that of an archive of tenant as made
+// by backupFilename.
+func isBackupOf(name, tenant string) bool {
+	prefix := "todo-backup-"
+	if tenant != "" {
+		prefix += tenant + "-"
+	}
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	stamp, suffix, _ := strings.Cut(rest, ".")
+	if suffix != "tar.gz" && suffix != "tar.gz.enc" {
+		return false
+	}
+	_, err := time.Parse("20060102T150405Z", stamp)
+	return err == nil
+}
+
+// limitedWriter fails with errBackupTooLarge once more than remaining bytes
+// were written to it.
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, errBackupTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// getBackups lists the scheduled backup runs of the tenant newest first,
+// with ?page, ?limit and ?status.
+func getBackups(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, limit, err := parsePagination(query.Get("page"), query.Get("limit"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_pagination", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	statuses := []string{backupRunning, backupSucceeded, backupFailed, backupInterrupted}
+	filter := bson.M{"_id": bson.M{"$type": "objectId"}}
+	if status := query.Get("status"); status != "" {
+		if !slices.Contains(statuses, status) {
+			writeError(rw, r, http.StatusBadRequest, "invalid_backup_status", renderer.M{
+				"allowed": strings.Join(statuses, ", "),
+			})
+			return
+		}
+		filter["status"] = status
+	}
+
+	coll := tenantDB(r.Context()).Collection(backupCollectionName)
+	total, err := coll.CountDocuments(r.Context(), filter)
+	if err != nil {
+		logRequestError(r, "failed to count backup runs: %v\n", err)
+		writeDBError(rw, r, err, "backups_fetch_failed")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := coll.Find(r.Context(), filter, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch backup runs: %v\n", err)
+		writeDBError(rw, r, err, "backups_fetch_failed")
+		return
+	}
+	runs := []BackupRun{}
+	if err := cursor.All(r.Context(), &runs); err != nil {
+		logRequestError(r, "failed to decode backup runs: %v\n", err)
+		writeDBError(rw, r, err, "backups_fetch_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetBackupsResponse{
+		Message: localize(r, "backups_retrieved"),
+		Data:    runs,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+	})
+}
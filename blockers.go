@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// event type of a todo whose last open blocker was completed or deleted
+	eventTodoUnblocked string = "todo.unblocked"
+
+	maxBlockersPerTodo = 50
+	// the cycle check gives up on dependency chains longer than this
+	maxBlockerDepth = 100
+)
+
+var (
+	errBlockerCycle = errors.New("blocker cycle")
+	errBlockerDepth = errors.New("blocker chain too long")
+)
+
+// BlockersResponse reports the blockers of a todo after a change.
+type BlockersResponse struct {
+	Message   string   `json:"message"`
+	BlockedBy []string `json:"blocked_by"`
+	Blocked   bool     `json:"blocked"`
+}
+
+// addBlocker makes the todo {id} wait for the todo {blockerId}.
+func addBlocker(rw http.ResponseWriter, r *http.Request) {
+	id, blockerID, ok := parseBlockerIDs(rw, r)
+	if !ok {
+		return
+	}
+	todos := tenantDB(r.Context()).Collection(collectionName)
+
+	var blocker TodoModel
+	err := todos.FindOne(r.Context(), bson.M{"id": blockerID}, options.FindOne().SetProjection(bson.M{"completed": 1})).Decode(&blocker)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "blocker_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", blockerID.Hex(), err)
+		writeDBError(rw, r, err, "blocker_add_failed")
+		return
+	}
+
+	switch err := checkBlockerCycle(r.Context(), id, blockerID); {
+	case errors.Is(err, errBlockerCycle):
+		writeError(rw, r, http.StatusConflict, "blocker_cycle", nil)
+		return
+	case errors.Is(err, errBlockerDepth):
+		writeError(rw, r, http.StatusConflict, "blocker_chain_too_long", renderer.M{
+			"max": maxBlockerDepth,
+		})
+		return
+	case err != nil:
+		logRequestError(r, "failed to check the blockers of %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "blocker_add_failed")
+		return
+	}
+
+	add := bson.M{"blocked_by": blockerID}
+	if !blocker.Completed {
+		add["open_blockers"] = blockerID
+	}
+	update := bumpVersion(bson.M{"$addToSet": add, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	filter := bson.M{"id": id, "blocked_by." + strconv.Itoa(maxBlockersPerTodo-1): bson.M{"$exists": false}}
+	var td TodoModel
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		if err := tenantDB(ctx).Collection(collectionName).FindOneAndUpdate(ctx, filter, update, opts).Decode(&td); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// either there is no such todo or it has all the blockers it may have
+		if count, err := todos.CountDocuments(r.Context(), bson.M{"id": id}); err == nil && count > 0 {
+			writeError(rw, r, http.StatusConflict, "too_many_blockers", renderer.M{
+				"max": maxBlockersPerTodo,
+			})
+			return
+		}
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "blocker_add_failed")
+		return
+	}
+
+	writeBlockers(rw, r, td)
+}
+
+// removeBlocker stops the todo {id} from waiting for the todo {blockerId}.
+func removeBlocker(rw http.ResponseWriter, r *http.Request) {
+	id, blockerID, ok := parseBlockerIDs(rw, r)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"id": id, "blocked_by": blockerID}
+	update := bumpVersion(bson.M{
+		"$pull": bson.M{"blocked_by": blockerID, "open_blockers": blockerID},
+		"$set":  bson.M{"updated_at": time.Now().UTC()},
+	})
+	var td TodoModel
+	err := runInTransaction(r.Context(), func(ctx context.Context) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		if err := tenantDB(ctx).Collection(collectionName).FindOneAndUpdate(ctx, filter, update, opts).Decode(&td); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "blocker_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "blocker_remove_failed")
+		return
+	}
+
+	writeBlockers(rw, r, td)
+}
+
+func parseBlockerIDs(rw http.ResponseWriter, r *http.Request) (id, blockerID primitive.ObjectID, ok bool) {
+	id, err := parseTodoID(r)
+	if err == nil {
+		blockerID, err = parseID(chi.URLParam(r, "blockerId"))
+	}
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return id, blockerID, false
+	}
+	return id, blockerID, true
+}
+
+func writeBlockers(rw http.ResponseWriter, r *http.Request, td TodoModel) {
+	rw.Header().Set("ETag", todoETag(r, td))
+	renderJSON(rw, r, http.StatusOK, BlockersResponse{
+		Message:   localize(r, "todo_updated"),
+		BlockedBy: formatIDs(td.BlockedBy),
+		Blocked:   len(td.OpenBlockers) > 0,
+	})
+}
+
+// ensureBlockerIndexes indexes the todos by the todos blocking them, which
+// completing or deleting a todo looks for.
+func ensureBlockerIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(collectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "blocked_by", Value: 1}}, Options: options.Index().SetName("blocked_by").SetSparse(true)},
+		{Keys: bson.D{{Key: "open_blockers", Value: 1}}, Options: options.Index().SetName("open_blockers").SetSparse(true)},
+	})
+	return err
+}
+
+// formatIDs formats every id with formatID.
+func formatIDs(ids []primitive.ObjectID) []string {
+	formatted := make([]string, len(ids))
+	for i, id := range ids {
+		formatted[i] = formatID(id)
+	}
+	return formatted
+}
+
+// checkBlockerCycle reports errBlockerCycle when id blocked by blockerID
+// would close a cycle, that is when id already blocks blockerID directly or
+// through other todos. It walks the blockers breadth first, one query per
+// level, up to maxBlockerDepth levels.
+func checkBlockerCycle(ctx context.Context, id, blockerID primitive.ObjectID) error {
+	if id == blockerID {
+		return errBlockerCycle
+	}
+	todos := tenantDB(ctx).Collection(collectionName)
+	seen := map[primitive.ObjectID]bool{blockerID: true}
+	frontier := []primitive.ObjectID{blockerID}
+	opts := options.Find().SetProjection(bson.M{"blocked_by": 1})
+
+	for depth := 0; len(frontier) > 0; depth++ {
+		if depth == maxBlockerDepth {
+			return errBlockerDepth
+		}
+		filter := bson.M{"id": bson.M{"$in": frontier}, "blocked_by.0": bson.M{"$exists": true}}
+		cursor, err := todos.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		var level []TodoModel
+		if err := cursor.All(ctx, &level); err != nil {
+			return err
+		}
+
+		frontier = nil
+		for _, td := range level {
+			for _, next := range td.BlockedBy {
+				if next == id {
+					return errBlockerCycle
+				}
+				if !seen[next] {
+					seen[next] = true
+					frontier = append(frontier, next)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// syncBlocked updates the todos blocked by id after id was completed or
+// reopened. Completing it queues a todo.unblocked event for every todo that
+// was waiting for it alone.
+func syncBlocked(ctx context.Context, id primitive.ObjectID, completed bool) error {
+	if completed {
+		return unblock(ctx, []primitive.ObjectID{id}, false)
+	}
+	_, err := tenantDB(ctx).Collection(collectionName).UpdateMany(ctx,
+		bson.M{"blocked_by": id, "open_blockers": bson.M{"$ne": id}},
+		bumpVersion(bson.M{"$addToSet": bson.M{"open_blockers": id}}))
+	return err
+}
+
+// unblock drops ids from the open blockers of every todo, and also from its
+// blockers when forget is set because they were deleted. The todos left
+// without open blockers get a todo.unblocked event.
+func unblock(ctx context.Context, ids []primitive.ObjectID, forget bool) error {
+	todos := tenantDB(ctx).Collection(collectionName)
+
+	var unblocked []TodoModel
+	filter := bson.M{"open_blockers": bson.M{
+		"$elemMatch": bson.M{"$in": ids},
+		"$not":       bson.M{"$elemMatch": bson.M{"$nin": ids}},
+	}}
+	cursor, err := todos.Find(ctx, filter, options.Find().SetProjection(bson.M{"id": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &unblocked)
+	}
+	if err != nil {
+		return err
+	}
+
+	pull := bson.M{"open_blockers": bson.M{"$in": ids}}
+	referencing := bson.M{"open_blockers": bson.M{"$in": ids}}
+	if forget {
+		pull["blocked_by"] = bson.M{"$in": ids}
+		referencing = bson.M{"blocked_by": bson.M{"$in": ids}}
+	}
+	if _, err := todos.UpdateMany(ctx, referencing, bumpVersion(bson.M{"$pull": pull})); err != nil {
+		return err
+	}
+	for _, td := range unblocked {
+		if err := recordTodoEvent(ctx, eventTodoUnblocked, td.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// days of the burndown when ?from isn't given, today included
+	defaultBurndownDays = 14
+	// the longest range a burndown covers
+	maxBurndownDays = 366
+)
+
+type (
+	// one day of a burndown in the request's zone; a todo created and
+	// completed that day counts in both but was never open at its end
+	BurndownDay struct {
+		Date      string `json:"date"`
+		Open      int64  `json:"open"`
+		Created   int64  `json:"created"`
+		Completed int64  `json:"completed"`
+	}
+	// the burndown endpoint response
+	GetBurndownResponse struct {
+		Message  string        `json:"message"`
+		Timezone string        `json:"timezone"`
+		Data     []BurndownDay `json:"data"`
+	}
+)
+
+// getBurndown reports, for every day from ?from to ?to (YYYY-MM-DD, both
+// included), the todos open at its end and those created and completed on
+// it. It covers the last defaultBurndownDays days up to today by default.
+func getBurndown(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+	start, end, err := burndownRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), time.Now().In(loc))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_burndown_range", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	days, err := burndown(r.Context(), start, end)
+	if err != nil {
+		logRequestError(r, "failed to compute the burndown: %v\n", err)
+		writeDBError(rw, r, err, "burndown_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetBurndownResponse{
+		Message:  localize(r, "burndown_computed"),
+		Timezone: loc.String(),
+		Data:     days,
+	})
+}
+
+// burndownRange parses the days of ?from and ?to in the location of now and
+// returns midnight of the first and of the day after the last.
+func burndownRange(from, to string, now time.Time) (start, end time.Time, err error) {
+	loc := now.Location()
+	last := startOfDay(now)
+	if to != "" {
+		if last, err = time.ParseInLocation(time.DateOnly, to, loc); err != nil {
+			return start, end, fmt.Errorf("to must be a date like 2024-05-31")
+		}
+	}
+	start = last.AddDate(0, 0, 1-defaultBurndownDays)
+	if from != "" {
+		if start, err = time.ParseInLocation(time.DateOnly, from, loc); err != nil {
+			return start, end, fmt.Errorf("from must be a date like 2024-05-01")
+		}
+	}
+	end = last.AddDate(0, 0, 1)
+	switch {
+	case !start.Before(end):
+		return start, end, errors.New("from must not be after to")
+	case start.AddDate(0, 0, maxBurndownDays).Before(end):
+		return start, end, fmt.Errorf("the range must not be longer than %d days", maxBurndownDays)
+	}
+	return start, end, nil
+}
+
+// burndown computes the days from start up to end, in start's location, with
+// a single aggregation. Deleted todos are gone and count nowhere.
+func burndown(ctx context.Context, start, end time.Time) ([]BurndownDay, error) {
+	loc := start.Location()
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"created_at": bson.M{"$lt": end}}},
+		bson.M{"$addFields": bson.M{"done_at": bson.M{"$cond": bson.A{"$completed", completedAtExpr, nil}}}},
+		bson.M{"$facet": bson.M{
+			// still open when the range starts
+			"open": bson.A{
+				bson.M{"$match": bson.M{
+					"created_at": bson.M{"$lt": start},
+					"$or":        bson.A{bson.M{"done_at": nil}, bson.M{"done_at": bson.M{"$gte": start}}},
+				}},
+				bson.M{"$count": "count"},
+			},
+			"created": bson.A{
+				bson.M{"$match": bson.M{"created_at": bson.M{"$gte": start}}},
+				bson.M{"$group": bson.M{"_id": dayOfExpr("$created_at", loc), "count": bson.M{"$sum": 1}}},
+			},
+			"completed": bson.A{
+				bson.M{"$match": bson.M{"done_at": bson.M{"$gte": start, "$lt": end}}},
+				bson.M{"$group": bson.M{"_id": dayOfExpr("$done_at", loc), "count": bson.M{"$sum": 1}}},
+			},
+		}},
+	}
+
+	cursor, err := tenantDB(ctx).Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	type dayCount struct {
+		Date  string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	var results []struct {
+		Open []struct {
+			Count int64 `bson:"count"`
+		} `bson:"open"`
+		Created   []dayCount `bson:"created"`
+		Completed []dayCount `bson:"completed"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	var open int64
+	if len(results[0].Open) > 0 {
+		open = results[0].Open[0].Count
+	}
+	created, completed := map[string]int64{}, map[string]int64{}
+	for _, c := range results[0].Created {
+		created[c.Date] = c.Count
+	}
+	for _, c := range results[0].Completed {
+		completed[c.Date] = c.Count
+	}
+	return computeBurndown(open, created, completed, start, end), nil
+}
+
+// computeBurndown sweeps the days from start up to end, starting with open
+// todos and moving them by the todos created and completed each day, keyed
+// by YYYY-MM-DD. It steps through calendar dates, so days of 23 or 25 hours
+// around a DST change count once like any other.
+func computeBurndown(open int64, created, completed map[string]int64, start, end time.Time) []BurndownDay {
+	days := []BurndownDay{}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		open += created[date] - completed[date]
+		days = append(days, BurndownDay{
+			Date:      date,
+			Open:      open,
+			Created:   created[date],
+			Completed: completed[date],
+		})
+	}
+	return days
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// burndownTimeline is a handcrafted history in America/New_York, around the
+// start of DST on March 10, 2024:
+//
+//	A created Mar 5, still open
+//	B created Mar 8, completed Mar 10
+//	C created Mar 9 at 09:00, completed at 17:00 the same day
+//	D created Mar 10 at 23:30, completed Mar 11 at 00:15
+//	E created Mar 11, completed Mar 11
+//
+// A and B are open when the range starts on March 9.
+var burndownTimeline = struct {
+	open               int64
+	created, completed map[string]int64
+	want               []BurndownDay
+}{
+	open:      2,
+	created:   map[string]int64{"2024-03-09": 1, "2024-03-10": 1, "2024-03-11": 1},
+	completed: map[string]int64{"2024-03-09": 1, "2024-03-10": 1, "2024-03-11": 2},
+	want: []BurndownDay{
+		// C counts in both and is not open at the end of the day
+		{Date: "2024-03-09", Open: 2, Created: 1, Completed: 1},
+		// B completed, D created late on the 23 hour day
+		{Date: "2024-03-10", Open: 2, Created: 1, Completed: 1},
+		{Date: "2024-03-11", Open: 1, Created: 1, Completed: 2},
+		{Date: "2024-03-12", Open: 1},
+	},
+}
+
+func TestComputeBurndown(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tl := burndownTimeline
+	start := time.Date(2024, time.March, 9, 0, 0, 0, 0, loc)
+	days := computeBurndown(tl.open, tl.created, tl.completed, start, start.AddDate(0, 0, len(tl.want)))
+	if fmt.Sprint(days) != fmt.Sprint(tl.want) {
+		t.Errorf("burndown = %v, want %v", days, tl.want)
+	}
+}
+
+func TestBurndownFromAggregation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+	tl := burndownTimeline
+	facet := bson.M{"open": bson.A{bson.M{"count": tl.open}}, "created": bson.A{}, "completed": bson.A{}}
+	for date, count := range tl.created {
+		facet["created"] = append(facet["created"].(bson.A), bson.M{"_id": date, "count": count})
+	}
+	for date, count := range tl.completed {
+		facet["completed"] = append(facet["completed"].(bson.A), bson.M{"_id": date, "count": count})
+	}
+	mongo.seed(collectionName, facet)
+
+	start := time.Date(2024, time.March, 9, 0, 0, 0, 0, loc)
+	days, err := burndown(context.Background(), start, start.AddDate(0, 0, len(tl.want)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(days) != fmt.Sprint(tl.want) {
+		t.Errorf("burndown = %v, want %v", days, tl.want)
+	}
+
+	// nothing open before and nothing since
+	mongo.seed(collectionName, bson.M{"open": bson.A{}, "created": bson.A{}, "completed": bson.A{}})
+	if days, err = burndown(context.Background(), start, start.AddDate(0, 0, 2)); err != nil || fmt.Sprint(days) != fmt.Sprint([]BurndownDay{{Date: "2024-03-09"}, {Date: "2024-03-10"}}) {
+		t.Errorf("empty burndown = %v, %v", days, err)
+	}
+}
+
+func TestBurndownRange(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2024, time.March, 10, 23, 30, 0, 0, loc)
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, loc) }
+	tests := []struct {
+		name      string
+		from, to  string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{"default", "", "", day(time.February, 26), day(time.March, 11), false},
+		{"from only", "2024-03-01", "", day(time.March, 1), day(time.March, 11), false},
+		{"one day", "2024-03-10", "2024-03-10", day(time.March, 10), day(time.March, 11), false},
+		{"longest", "2023-03-11", "2024-03-10", day(time.March, 11).AddDate(-1, 0, 0), day(time.March, 11), false},
+		{"too long", "2023-03-10", "2024-03-10", time.Time{}, time.Time{}, true},
+		{"reversed", "2024-03-10", "2024-03-09", time.Time{}, time.Time{}, true},
+		{"bad from", "March 1", "", time.Time{}, time.Time{}, true},
+		{"bad to", "", "2024-13-01", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := burndownRange(tt.from, tt.to, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("burndownRange() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd)) {
+				t.Errorf("burndownRange() = %s to %s, want %s to %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
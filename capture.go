@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var capturedBodiesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_http_captured_bodies_total",
+		Help: "Number of bodies logged by debug.capture_bodies, by request or response.",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(capturedBodiesTotal)
+}
+
+const redacted string = "[REDACTED]"
+
+var (
+	// headers that carry credentials
+	secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Admin-Key"}
+	// string values of JSON keys that look like credentials; the closing quote
+	// is optional so a value cut by the size cap is redacted too
+	secretFields = regexp.MustCompile(`(?i)("[^"]*(?:password|passwd|secret|token|key|authorization|credential)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+)
+
+// capBuffer keeps the first max bytes written to it and counts the rest.
+type capBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *capBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(b.Len()); int64(len(p)) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *capBuffer) String() string {
+	s := redactBody(b.Buffer.String())
+	if b.truncated {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+// captureBodies logs the body of each request and, when the response is not
+// a 2xx, of the response, so rejected requests can be reproduced. It is off
+// unless debug.capture_bodies is set because bodies hold user data; credentials
+// in headers and JSON fields are redacted. The request body is teed while the
+// handler reads it, so only what the handler consumed is logged. Multipart
+// uploads and attachment downloads are left alone.
+func captureBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig().Debug
+		if !cfg.CaptureBodies || !capturable(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		reqBody := &capBuffer{max: cfg.CaptureLimit}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		respBody := &capBuffer{max: cfg.CaptureLimit}
+		ww.Tee(writerFunc(func(p []byte) (int, error) {
+			if ww.Status() >= 200 && ww.Status() < 300 {
+				return len(p), nil
+			}
+			return respBody.Write(p)
+		}))
+
+		next.ServeHTTP(ww, r)
+
+		attrs := []any{
+			"request_id", middleware.GetReqID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.RequestURI(),
+			"status", ww.Status(),
+			"request_headers", redactHeaders(r.Header),
+		}
+		if reqBody.Len() > 0 {
+			capturedBodiesTotal.WithLabelValues("request").Inc()
+			attrs = append(attrs, "request_body", reqBody.String())
+		}
+		if respBody.Len() > 0 {
+			capturedBodiesTotal.WithLabelValues("response").Inc()
+			attrs = append(attrs, "response_body", respBody.String())
+		}
+		slog.Info("captured http bodies", attrs...)
+	})
+}
+
+// capturable reports whether r's bodies may be buffered: uploads and file
+// downloads are streamed and not worth logging.
+func capturable(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") || mediaType == "application/octet-stream" {
+		return false
+	}
+	// GET /api/v1/attachment/{id} and its deprecated alias stream the file
+	return !(r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/attachment/"))
+}
+
+// redactHeaders returns the headers of a request with credentials replaced.
+func redactHeaders(header http.Header) http.Header {
+	clean := header.Clone()
+	for _, name := range secretHeaders {
+		if clean.Get(name) != "" {
+			clean.Set(name, redacted)
+		}
+	}
+	return clean
+}
+
+// redactBody replaces the values of JSON fields named like credentials.
+func redactBody(body string) string {
+	return secretFields.ReplaceAllString(body, `$1"`+redacted+`"`)
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"password", `{"user":"ana","password":"hunter2"}`, `{"user":"ana","password":"[REDACTED]"}`},
+		{"any case and spacing", `{"API_Key" : "abc"}`, `{"API_Key" : "[REDACTED]"}`},
+		{"escaped quote", `{"token":"a\"b","title":"x"}`, `{"token":"[REDACTED]","title":"x"}`},
+		{"cut by the cap", `{"title":"x","secret":"abcd`, `{"title":"x","secret":"[REDACTED]"`},
+		{"nested", `{"auth":{"client_secret":"s"}}`, `{"auth":{"client_secret":"[REDACTED]"}}`},
+		{"nothing secret", `{"title":"buy milk","tags":["key"]}`, `{"title":"buy milk","tags":["key"]}`},
+		{"not JSON", `title=buy+milk`, `title=buy+milk`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactBody(tt.body); got != tt.want {
+				t.Errorf("redactBody(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer abc")
+	header.Set("X-Admin-Key", "admin")
+	header.Set("Cookie", "session=1")
+	header.Set("Accept", "application/json")
+
+	clean := redactHeaders(header)
+	for _, name := range []string{"Authorization", "X-Admin-Key", "Cookie"} {
+		if got := clean.Get(name); got != redacted {
+			t.Errorf("%s = %q, want it redacted", name, got)
+		}
+	}
+	if got := clean.Get("Accept"); got != "application/json" {
+		t.Errorf("Accept = %q, want it kept", got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("the request's Authorization became %q", got)
+	}
+}
+
+func TestCapBuffer(t *testing.T) {
+	b := &capBuffer{max: 8}
+	for _, part := range []string{"abcde", "fghij", "klm"} {
+		if n, err := b.Write([]byte(part)); n != len(part) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v, want everything accepted", part, n, err)
+		}
+	}
+	if got := b.String(); got != "abcdefgh...(truncated)" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestCapturable(t *testing.T) {
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		want        bool
+	}{
+		{http.MethodPost, "/api/v1/todo", "application/json", true},
+		{http.MethodPost, "/api/v1/todo", "application/x-www-form-urlencoded", true},
+		{http.MethodPost, "/api/v1/todo/1/attachment", "multipart/form-data; boundary=x", false},
+		{http.MethodPut, "/api/v1/todo/1", "application/octet-stream", false},
+		{http.MethodGet, "/api/v1/attachment/1", "", false},
+		{http.MethodGet, "/attachment/1", "", false},
+		{http.MethodDelete, "/api/v1/attachment/1", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Content-Type", tt.contentType)
+		if got := capturable(r); got != tt.want {
+			t.Errorf("capturable(%s %s, %q) = %v, want %v", tt.method, tt.path, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCaptureBodies(t *testing.T) {
+	var logged bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	t.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+	// the handler still reads the whole body and answers with it
+	var read string
+	handler := captureBodies(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		read = string(body)
+		status := http.StatusCreated
+		if strings.Contains(read, "reject") {
+			status = http.StatusUnprocessableEntity
+		}
+		rw.WriteHeader(status)
+		rw.Write(body)
+	}))
+	send := func(body string) map[string]interface{} {
+		logged.Reset()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todo", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer abc")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if read != body {
+			t.Errorf("handler read %q, want %q", read, body)
+		}
+		if logged.Len() == 0 {
+			return nil
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(logged.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	cfg := defaultConfig()
+	useConfig(t, cfg)
+	if entry := send(`{"title":"x"}`); entry != nil {
+		t.Errorf("logged %v with debug.capture_bodies off", entry)
+	}
+
+	cfg.Debug.CaptureBodies = true
+	cfg.Debug.CaptureLimit = 64
+	useConfig(t, cfg)
+	requests := metricValue(t, "todo_http_captured_bodies_total", map[string]string{"kind": "request"})
+	responses := metricValue(t, "todo_http_captured_bodies_total", map[string]string{"kind": "response"})
+
+	entry := send(`{"title":"reject","password":"hunter2"}`)
+	want := `{"title":"reject","password":"[REDACTED]"}`
+	if entry["request_body"] != want || entry["response_body"] != want {
+		t.Errorf("logged bodies %q and %q, want %q", entry["request_body"], entry["response_body"], want)
+	}
+	if headers, _ := entry["request_headers"].(map[string]interface{}); headers == nil || headers["Authorization"].([]interface{})[0] != redacted {
+		t.Errorf("logged headers %v, want Authorization redacted", entry["request_headers"])
+	}
+
+	entry = send(`{"title":"accept"}`)
+	if entry["request_body"] != `{"title":"accept"}` || entry["response_body"] != nil {
+		t.Errorf("logged %v for a 201, want the request body only", entry)
+	}
+
+	if got := metricValue(t, "todo_http_captured_bodies_total", map[string]string{"kind": "request"}) - requests; got != 2 {
+		t.Errorf("counted %v request bodies, want 2", got)
+	}
+	if got := metricValue(t, "todo_http_captured_bodies_total", map[string]string{"kind": "response"}) - responses; got != 1 {
+		t.Errorf("counted %v response bodies, want 1", got)
+	}
+}
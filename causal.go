@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the header a client passes back so its next request observes its writes
+const causalTokenHeader string = "X-Causal-Token"
+
+// causalSessions is set at startup when mongo.causal_consistency is on and
+// MongoDB is a replica set or sharded cluster; a standalone server has no
+// secondaries to lag behind.
+var causalSessions atomic.Bool
+
+// what a causal token carries: the times the session of a request ended at
+type causalToken struct {
+	ClusterTime   bson.Raw            `bson:"c"`
+	OperationTime primitive.Timestamp `bson:"o"`
+}
+
+// causalWriter sends the causal token of the session as the headers go out,
+// when every operation of the handler before the first byte has run.
+type causalWriter struct {
+	http.ResponseWriter
+	session     mongo.Session
+	wroteHeader bool
+}
+
+func (w *causalWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if token := encodeCausalToken(w.session); token != "" {
+			w.Header().Set(causalTokenHeader, token)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *causalWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *causalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// causalSession runs each request in a causally consistent session, so its
+// reads observe its own writes even when they go to a secondary. Passing
+// the X-Causal-Token of a response back with the next request carries that
+// over to it. Without causalSessions requests run as before.
+func causalSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !causalSessions.Load() {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		var token *causalToken
+		if value := strings.TrimSpace(r.Header.Get(causalTokenHeader)); value != "" {
+			var err error
+			if token, err = decodeCausalToken(value); err != nil {
+				writeError(rw, r, http.StatusBadRequest, "invalid_causal_token", nil)
+				return
+			}
+		}
+
+		session, err := client.StartSession(options.Session().SetCausalConsistency(true))
+		if err != nil {
+			log.Printf("failed to start a causally consistent session: %v\n", err)
+			next.ServeHTTP(rw, r)
+			return
+		}
+		defer session.EndSession(context.WithoutCancel(r.Context()))
+		if token != nil {
+			if err := session.AdvanceClusterTime(token.ClusterTime); err != nil {
+				writeError(rw, r, http.StatusBadRequest, "invalid_causal_token", nil)
+				return
+			}
+			if err := session.AdvanceOperationTime(&token.OperationTime); err != nil {
+				writeError(rw, r, http.StatusBadRequest, "invalid_causal_token", nil)
+				return
+			}
+		}
+
+		ctx := mongo.NewSessionContext(r.Context(), session)
+		next.ServeHTTP(&causalWriter{ResponseWriter: rw, session: session}, r.WithContext(ctx))
+	})
+}
+
+// advanceSession advances to to the times from has seen, so what to reads
+// next observes the writes of from.
+func advanceSession(to, from mongo.Session) {
+	if clusterTime := from.ClusterTime(); clusterTime != nil {
+		to.AdvanceClusterTime(clusterTime)
+	}
+	if operationTime := from.OperationTime(); operationTime != nil {
+		to.AdvanceOperationTime(operationTime)
+	}
+}
+
+// encodeCausalToken returns the causal token of session, empty before it
+// has talked to MongoDB.
+func encodeCausalToken(session mongo.Session) string {
+	clusterTime, operationTime := session.ClusterTime(), session.OperationTime()
+	if clusterTime == nil || operationTime == nil {
+		return ""
+	}
+	b, err := bson.Marshal(causalToken{ClusterTime: clusterTime, OperationTime: *operationTime})
+	if err != nil {
+		log.Printf("failed to encode the causal token: %v\n", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCausalToken parses a token made by encodeCausalToken.
+func decodeCausalToken(value string) (*causalToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var token causalToken
+	if err := bson.Unmarshal(b, &token); err != nil {
+		return nil, err
+	}
+	if token.ClusterTime == nil || token.OperationTime.IsZero() {
+		return nil, errors.New("causal token without times")
+	}
+	return &token, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// useCausalSessions turns causalSessions on for the test.
+func useCausalSessions(t *testing.T) {
+	t.Helper()
+	prev := causalSessions.Load()
+	causalSessions.Store(true)
+	t.Cleanup(func() { causalSessions.Store(prev) })
+}
+
+// afterClusterTime returns the time the read cmd waits for, zero when it
+// doesn't.
+func afterClusterTime(cmd mongoCommand) primitive.Timestamp {
+	t, i, _ := cmd.Command.Lookup("readConcern", "afterClusterTime").TimestampOK()
+	return primitive.Timestamp{T: t, I: i}
+}
+
+func TestDecodeCausalToken(t *testing.T) {
+	encode := func(v interface{}) string {
+		b, err := bson.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	clusterTime, err := bson.Marshal(bson.M{"$clusterTime": bson.M{"clusterTime": primitive.Timestamp{T: 1, I: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := causalToken{ClusterTime: clusterTime, OperationTime: primitive.Timestamp{T: 1, I: 2}}
+	tests := []struct {
+		name, value string
+		ok          bool
+	}{
+		{"valid", encode(token), true},
+		{"not base64", "!!", false},
+		{"not bson", base64.RawURLEncoding.EncodeToString([]byte("token")), false},
+		{"no operation time", encode(bson.M{"c": token.ClusterTime}), false},
+		{"no cluster time", encode(bson.M{"o": token.OperationTime}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeCausalToken(tt.value)
+			if (err == nil) != tt.ok {
+				t.Fatalf("decodeCausalToken() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !decoded.OperationTime.Equal(token.OperationTime) {
+				t.Errorf("operation time %v, want %v", decoded.OperationTime, token.OperationTime)
+			}
+		})
+	}
+}
+
+// A read sent with the token of a write waits for that write, while one
+// without a token or with causal sessions off doesn't.
+func TestCausalSession(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	mongo.mu.Lock()
+	mongo.operationTimes = true
+	mongo.mu.Unlock()
+
+	serve := func(method, target, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", jsonContentType)
+		if token != "" {
+			r.Header.Set(causalTokenHeader, token)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw
+	}
+	// reads returns the time each find on the todos waited for
+	reads := func() []primitive.Timestamp {
+		var waited []primitive.Timestamp
+		for _, cmd := range mongo.commands() {
+			if cmd.Name == "find" && cmd.Collection == collectionName {
+				waited = append(waited, afterClusterTime(cmd))
+			}
+		}
+		return waited
+	}
+
+	if rw := serve(http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, ""); rw.Header().Get(causalTokenHeader) != "" {
+		t.Errorf("without causal sessions a response carries %s", causalTokenHeader)
+	}
+
+	useCausalSessions(t)
+	rw := serve(http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, "")
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rw.Code, rw.Body)
+	}
+	token, err := decodeCausalToken(rw.Header().Get(causalTokenHeader))
+	if err != nil {
+		t.Fatalf("the create answered %s %q: %v", causalTokenHeader, rw.Header().Get(causalTokenHeader), err)
+	}
+	mongo.commands()
+
+	rw = serve(http.MethodGet, "/api/v1/todo", "", rw.Header().Get(causalTokenHeader))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("list = %d: %s", rw.Code, rw.Body)
+	}
+	waited := reads()
+	if len(waited) == 0 {
+		t.Fatal("the list read no todos")
+	}
+	for _, ts := range waited {
+		if ts.Before(token.OperationTime) {
+			t.Errorf("the list waited for %v, before the create at %v", ts, token.OperationTime)
+		}
+	}
+	next, err := decodeCausalToken(rw.Header().Get(causalTokenHeader))
+	if err != nil || !token.OperationTime.Before(next.OperationTime) {
+		t.Errorf("the list answered %s of %v, want one after %v", causalTokenHeader, next, token.OperationTime)
+	}
+
+	serve(http.MethodGet, "/api/v1/todo", "", "")
+	for _, ts := range reads() {
+		if !ts.IsZero() {
+			t.Errorf("a list without a token waited for %v", ts)
+		}
+	}
+
+	rw = serve(http.MethodGet, "/api/v1/todo", "", "not-a-token")
+	if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), `"invalid_causal_token"`) {
+		t.Errorf("a bad token = %d: %s", rw.Code, rw.Body)
+	}
+}
+
+// Against the replica set of TODO_TEST_REPLICA_SET, whose connection string
+// should read from secondaries, every todo is found right after its create
+// when the read carries the token of the create.
+func TestCausalReadYourWritesReplicaSet(t *testing.T) {
+	uri := os.Getenv("TODO_TEST_REPLICA_SET")
+	if uri == "" {
+		t.Skip("TODO_TEST_REPLICA_SET is not set")
+	}
+	cfg, _, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+	useRenderer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevClient, prevDB := client, db
+	client, db = c, c.Database(dbName+"_causal_test")
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		c.Disconnect(context.Background())
+		client, db = prevClient, prevDB
+	})
+	if !detectTransactions(ctx) {
+		t.Skip("TODO_TEST_REPLICA_SET is not a replica set")
+	}
+	useCausalSessions(t)
+	router := newRouter(cfg, &assetManifest{})
+
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todo", strings.NewReader(`{"title":"write report"}`))
+		r.Header.Set("Content-Type", jsonContentType)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		var created CreateTodoResponse
+		if rw.Code != http.StatusCreated || json.Unmarshal(rw.Body.Bytes(), &created) != nil {
+			t.Fatalf("create = %d: %s", rw.Code, rw.Body)
+		}
+
+		r = httptest.NewRequest(http.MethodGet, "/api/v1/todo/"+created.ID, nil)
+		r.Header.Set(causalTokenHeader, rw.Header().Get(causalTokenHeader))
+		rw = httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("get %d right after its create = %d: %s", i, rw.Code, rw.Body)
+		}
+	}
+}
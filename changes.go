@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	deletionCollectionName string = "deletions"
+	deletionIndexName      string = "deleted_at_ttl"
+	// names a create so that sending it again creates nothing
+	idempotencyKeyHeader string = "Idempotency-Key"
+)
+
+// the longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+type (
+	// struct to db model: a deleted todo, or with Reset a restore after
+	// which every todo may have changed
+	DeletionModel struct {
+		ID         primitive.ObjectID `bson:"_id"`
+		TodoID     primitive.ObjectID `bson:"todo_id,omitempty"`
+		MergedInto primitive.ObjectID `bson:"merged_into,omitempty"`
+		Reset      bool               `bson:"reset,omitempty"`
+		DeletedAt  time.Time          `bson:"deleted_at"`
+	}
+	// a todo deleted since the cursor, or merged into another one
+	DeletedTodo struct {
+		ID         string    `json:"id"`
+		DeletedAt  time.Time `json:"deleted_at"`
+		MergedInto string    `json:"merged_into,omitempty"`
+	}
+	// the todos changed and deleted since the cursor of the request
+	GetChangesResponse struct {
+		Message string        `json:"message"`
+		Data    []Todo        `json:"data"`
+		Deleted []DeletedTodo `json:"deleted"`
+		// passed as ?since to get the next page or, once HasMore is false,
+		// the changes of the next sync
+		Cursor             string `json:"cursor"`
+		HasMore            bool   `json:"has_more"`
+		FullResyncRequired bool   `json:"full_resync_required"`
+	}
+)
+
+// changesCursor is a position in the stream of changes, todos by updated_at
+// and deletions by deleted_at, both then by id. Clients get it as opaque
+// base64. Floor is where the next sync starts again, set from the first
+// page of a sync on; Initial marks the pages of a sync without ?since, which
+// need no deletions.
+type changesCursor struct {
+	At      int64  `json:"a"`
+	ID      string `json:"i,omitempty"`
+	Floor   int64  `json:"f,omitempty"`
+	Initial bool   `json:"n,omitempty"`
+}
+
+func (c changesCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeChangesCursor(value string) (changesCursor, primitive.ObjectID, error) {
+	var c changesCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.At < 0 {
+		return c, primitive.NilObjectID, errInvalidCursor
+	}
+	id := primitive.NilObjectID
+	if c.ID != "" {
+		if id, err = primitive.ObjectIDFromHex(c.ID); err != nil {
+			return c, primitive.NilObjectID, errInvalidCursor
+		}
+	}
+	return c, id, nil
+}
+
+// change is an entry of the stream of changes: a todo or a deletion.
+type change struct {
+	at      time.Time
+	id      primitive.ObjectID
+	todo    *TodoModel
+	deleted *DeletionModel
+}
+
+// compareChanges orders changes as MongoDB sorts them by time and id.
+func compareChanges(a, b change) int {
+	if n := a.at.Compare(b.at); n != 0 {
+		return n
+	}
+	return bytes.Compare(a.id[:], b.id[:])
+}
+
+// getChanges answers with the todos changed and deleted after ?since, a page
+// of at most ?limit of them, for clients keeping a copy of the todos. Without
+// ?since every todo is sent. The cursor is a timestamp, updated_at as set
+// by the instance making the change, rather than a sequence: writes stamped
+// before a read may commit after it, and instances' clocks drift apart, so
+// every sync starts again sync.overlap before the first read of the last
+// one. Clients get a change twice now and then and apply them by id, with
+// version telling which copy is newer. A cursor older than
+// sync.tombstone_retention, or from before a backup restore, gets
+// full_resync_required instead, as deletions since then may be forgotten.
+func getChanges(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	problems := newFieldErrors(r)
+	var cursor changesCursor
+	after := primitive.NilObjectID
+	if value := query.Get("since"); value != "" {
+		var err error
+		if cursor, after, err = decodeChangesCursor(value); err != nil {
+			problems.addError("since", "invalid_cursor", nil, err)
+		}
+	} else {
+		cursor.Initial = true
+	}
+	if _, _, err := parsePagination("", query.Get("limit")); err != nil {
+		problems.addError("limit", "invalid_pagination", nil, err)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+	_, limit, _ := parsePagination("", query.Get("limit"))
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	cfg := currentConfig().Sync
+	now := time.Now().UTC()
+	since := time.UnixMilli(cursor.At).UTC()
+	if cursor.Floor == 0 {
+		// the first page of a sync: the next one starts again from here
+		cursor.Floor = now.Add(-cfg.Overlap).UnixMilli()
+	}
+
+	resp := GetChangesResponse{
+		Message: localize(r, "todo_changes_retrieved"),
+		Data:    []Todo{},
+		Deleted: []DeletedTodo{},
+	}
+	if !cursor.Initial {
+		resync, err := needsFullResync(r.Context(), since, now)
+		if err != nil {
+			logRequestError(r, "failed to check the sync cursor: %v\n", err)
+			writeDBError(rw, r, err, "todo_changes_failed")
+			return
+		}
+		if resync {
+			resp.FullResyncRequired = true
+			renderJSON(rw, r, http.StatusOK, resp)
+			return
+		}
+	}
+
+	changes, hasMore, err := changesAfter(r.Context(), since, after, limit, !cursor.Initial)
+	if err != nil {
+		logRequestError(r, "failed to fetch changes: %v\n", err)
+		writeDBError(rw, r, err, "todo_changes_failed")
+		return
+	}
+	for _, c := range changes {
+		switch {
+		case c.todo != nil:
+			resp.Data = append(resp.Data, c.todo.toTodo(loc))
+		case c.deleted != nil:
+			deleted := DeletedTodo{ID: formatID(c.deleted.TodoID), DeletedAt: c.deleted.DeletedAt.In(loc)}
+			if !c.deleted.MergedInto.IsZero() {
+				deleted.MergedInto = formatID(c.deleted.MergedInto)
+			}
+			resp.Deleted = append(resp.Deleted, deleted)
+		}
+	}
+
+	resp.HasMore = hasMore
+	if hasMore {
+		last := changes[len(changes)-1]
+		cursor.At, cursor.ID = last.at.UnixMilli(), last.id.Hex()
+		resp.Cursor = changesCursor{At: cursor.At, ID: cursor.ID, Floor: cursor.Floor, Initial: cursor.Initial}.encode()
+	} else {
+		resp.Cursor = changesCursor{At: cursor.Floor}.encode()
+	}
+	renderJSON(rw, r, http.StatusOK, resp)
+}
+
+// needsFullResync reports whether deletions after since may have been
+// forgotten, or a restore since may have changed todos behind their
+// updated_at.
+func needsFullResync(ctx context.Context, since, now time.Time) (bool, error) {
+	if retention := currentConfig().Sync.TombstoneRetention; retention > 0 && since.Before(now.Add(-retention)) {
+		return true, nil
+	}
+	count, err := tenantDB(ctx).Collection(deletionCollectionName).CountDocuments(ctx,
+		bson.M{"reset": true, "deleted_at": bson.M{"$gte": since}}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// changesAfter returns the first limit changes after the todo or deletion
+// at and id, and whether more follow. Both collections are read limit+1
+// entries ahead in the same order and merged, so neither can hold an entry
+// sorting before the last one returned that wasn't read. Deletions of todos
+// that still exist, which deleteCompletedTodos records for todos reopened
+// meanwhile, take their place in the order but are left out.
+func changesAfter(ctx context.Context, at time.Time, id primitive.ObjectID, limit int64, withDeletions bool) ([]change, bool, error) {
+	db := tenantDB(ctx)
+	var changes []change
+
+	todoFilter := bson.M{"$or": bson.A{
+		bson.M{"updated_at": bson.M{"$gt": at}},
+		bson.M{"updated_at": at, "id": bson.M{"$gt": id}},
+	}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updated_at", Value: 1}, {Key: "id", Value: 1}}).
+		SetLimit(limit + 1)
+	cursor, err := db.Collection(collectionName).Find(ctx, todoFilter, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var td TodoModel
+		if err := cursor.Decode(&td); err != nil {
+			skipMalformed(collectionName, cursor.Current, err)
+			// still a step in the order, sent as nothing
+			id, _ := cursor.Current.Lookup("id").ObjectIDOK()
+			at, _ := cursor.Current.Lookup("updated_at").TimeOK()
+			changes = append(changes, change{at: at, id: id})
+			continue
+		}
+		changes = append(changes, change{at: td.UpdatedAt, id: td.ID, todo: &td})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if withDeletions {
+		filter := bson.M{"reset": bson.M{"$ne": true}, "$or": bson.A{
+			bson.M{"deleted_at": bson.M{"$gt": at}},
+			bson.M{"deleted_at": at, "todo_id": bson.M{"$gt": id}},
+		}}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "deleted_at", Value: 1}, {Key: "todo_id", Value: 1}}).
+			SetLimit(limit + 1)
+		var deletions []DeletionModel
+		cursor, err := db.Collection(deletionCollectionName).Find(ctx, filter, opts)
+		if err == nil {
+			err = cursor.All(ctx, &deletions)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		existing, err := existingTodos(ctx, deletions)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := range deletions {
+			c := change{at: deletions[i].DeletedAt, id: deletions[i].TodoID}
+			if !existing[deletions[i].TodoID] {
+				c.deleted = &deletions[i]
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	slices.SortFunc(changes, compareChanges)
+	if int64(len(changes)) > limit {
+		return changes[:limit], true, nil
+	}
+	return changes, false, nil
+}
+
+// existingTodos returns which of the todos of deletions exist.
+func existingTodos(ctx context.Context, deletions []DeletionModel) (map[primitive.ObjectID]bool, error) {
+	existing := map[primitive.ObjectID]bool{}
+	if len(deletions) == 0 {
+		return existing, nil
+	}
+	ids := make([]primitive.ObjectID, len(deletions))
+	for i, d := range deletions {
+		ids[i] = d.TodoID
+	}
+	var found []TodoModel
+	cursor, err := tenantDB(ctx).Collection(collectionName).Find(ctx,
+		bson.M{"id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"id": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &found)
+	}
+	for _, td := range found {
+		existing[td.ID] = true
+	}
+	return existing, err
+}
+
+// recordDeletions keeps a tombstone of each of the todos ids for
+// GET /todo/changes, naming the todo they were merged into unless into is
+// the zero id. Like recordTodoEvent it fails a transaction it is part of;
+// outside one the todos are already gone, so a failure is only logged.
+func recordDeletions(ctx context.Context, ids []primitive.ObjectID, into primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	tombstones := make([]interface{}, len(ids))
+	for i, id := range ids {
+		tombstones[i] = DeletionModel{ID: primitive.NewObjectID(), TodoID: id, MergedInto: into, DeletedAt: now}
+	}
+	_, err := tenantDB(ctx).Collection(deletionCollectionName).InsertMany(ctx, tombstones)
+	if err != nil && mongo.SessionFromContext(ctx) == nil {
+		log.Printf("failed to record the deletion of %d todos: %v\n", len(ids), err)
+		return nil
+	}
+	return err
+}
+
+// recordSyncReset makes every sync cursor from before now need a full
+// resync, after a restore changed todos without touching their updated_at.
+func recordSyncReset(ctx context.Context) {
+	_, err := tenantDB(ctx).Collection(deletionCollectionName).InsertOne(ctx, DeletionModel{
+		ID:        primitive.NewObjectID(),
+		Reset:     true,
+		DeletedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("failed to record the restore for syncing clients: %v\n", err)
+	}
+}
+
+// idempotencyKey returns the Idempotency-Key of r, empty when it has none.
+// Clients pick one for each todo they create, a UUID say, and send it again
+// with every retry. A key that is too long or holds control characters is
+// answered with 400 and ok false.
+func idempotencyKey(rw http.ResponseWriter, r *http.Request) (key string, ok bool) {
+	key = r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength || strings.ContainsFunc(key, unicode.IsControl) {
+		writeError(rw, r, http.StatusBadRequest, "invalid_idempotency_key", renderer.M{
+			"max_length": maxIdempotencyKeyLength,
+		})
+		return "", false
+	}
+	return key, true
+}
+
+// replayCreate answers a create whose Idempotency-Key a todo was already
+// created with: 200 with that todo's id and Idempotent-Replayed, whatever the
+// body says this time. It returns false, having answered nothing, when no
+// todo has the key, which a deleted or merged todo no longer does.
+func replayCreate(rw http.ResponseWriter, r *http.Request, key string) bool {
+	var td TodoModel
+	err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"idempotency_key": key}).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false
+	}
+	if err != nil {
+		logRequestError(r, "failed to look up the todo of an idempotency key: %v\n", err)
+		writeDBError(rw, r, err, "todo_create_failed")
+		return true
+	}
+	rw.Header().Set("Idempotent-Replayed", "true")
+	rw.Header().Set("ETag", todoETag(r, td))
+	resp := CreateTodoResponse{Message: localize(r, "todo_already_created")}
+	resp.setID(rw, currentConfig(), formatID(td.ID))
+	renderJSON(rw, r, http.StatusOK, resp)
+	return true
+}
+
+// backfillUpdatedAt gives todos from before updated_at was always set the
+// time they were created, so GET /todo/changes finds them in its order.
+func backfillUpdatedAt(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(collectionName).UpdateMany(ctx,
+		bson.M{"updated_at": bson.M{"$exists": false}},
+		bson.A{bson.M{"$set": bson.M{"updated_at": bson.M{"$ifNull": bson.A{"$created_at", "$$NOW"}}}}})
+	return err
+}
+
+// ensureSyncIndexes indexes the order GET /todo/changes reads todos and
+// deletions in and the idempotency keys, unique, and drops deletions after
+// retention, or keeps them forever when it is zero.
+func ensureSyncIndexes(ctx context.Context, retention time.Duration) error {
+	db := tenantDB(ctx)
+	_, err := db.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updated_at", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetName("sync_order"),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "idempotency_key", Value: 1}},
+		Options: options.Index().SetName("idempotency_key").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	deletions := db.Collection(deletionCollectionName).Indexes()
+	if _, err := deletions.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}, {Key: "todo_id", Value: 1}},
+		Options: options.Index().SetName("sync_order"),
+	}); err != nil {
+		return err
+	}
+
+	if retention <= 0 {
+		_, err := deletions.DropOne(ctx, deletionIndexName)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound" {
+			return nil
+		}
+		return err
+	}
+	expireAfter := int32(retention.Seconds())
+	_, err = deletions.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+		Options: options.Index().SetName(deletionIndexName).SetExpireAfterSeconds(expireAfter),
+	})
+	// the retention changed since the index was created: update it in place
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "IndexOptionsConflict" {
+		return db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: deletionCollectionName},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: deletionIndexName},
+				{Key: "expireAfterSeconds", Value: expireAfter},
+			}},
+		}).Err()
+	}
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// objectID returns the id of hex, padded to its length with zeros first.
+func objectID(t *testing.T, hex string) primitive.ObjectID {
+	t.Helper()
+	for len(hex) < 24 {
+		hex = "0" + hex
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDecodeChangesCursor(t *testing.T) {
+	id := primitive.NewObjectID()
+	valid := changesCursor{At: 1700000000000, ID: id.Hex(), Floor: 1699999990000}
+	decoded, after, err := decodeChangesCursor(valid.encode())
+	if err != nil || decoded != valid || after != id {
+		t.Errorf("round trip of %+v = %+v, %s, %v", valid, decoded, after, err)
+	}
+	if _, after, err := decodeChangesCursor(changesCursor{At: 1}.encode()); err != nil || !after.IsZero() {
+		t.Errorf("a cursor without id = %s, %v, want the zero id", after, err)
+	}
+
+	for _, value := range []string{
+		"!!",
+		base64.RawURLEncoding.EncodeToString([]byte("[1]")),
+		changesCursor{At: -1}.encode(),
+		changesCursor{At: 1, ID: "not-an-id"}.encode(),
+	} {
+		if _, _, err := decodeChangesCursor(value); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeChangesCursor(%q) error = %v, want errInvalidCursor", value, err)
+		}
+	}
+}
+
+// A page ends on the limit whichever collection its last change comes
+// from, with ties on the time broken by id, and its cursor resumes after
+// that change; the last page hands back the floor the sync started from.
+func TestGetChangesBoundaries(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.Sync.Overlap = time.Minute
+		cfg.Sync.TombstoneRetention = 24 * time.Hour
+	})
+	at := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	todo := func(hex string, updated time.Time) TodoModel {
+		td := newTodoModel("todo "+hex, updated)
+		td.ID = objectID(t, hex)
+		return td
+	}
+	deletion := func(hex string, deleted time.Time) DeletionModel {
+		return DeletionModel{ID: primitive.NewObjectID(), TodoID: objectID(t, hex), DeletedAt: deleted}
+	}
+	// "3" was deleted, then reopened by an undo of deleteCompletedTodos
+	mongo.seed(collectionName, todo("2", at), todo("4", at), todo("3", at.Add(time.Second)))
+	mongo.seed(deletionCollectionName, deletion("1", at), deletion("3", at), deletion("5", at.Add(time.Second)))
+
+	changes := func(t *testing.T, query string) GetChangesResponse {
+		t.Helper()
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo/changes"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("changes%s = %d: %s", query, rw.Code, rw.Body)
+		}
+		var resp GetChangesResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	ids := func(resp GetChangesResponse) (todos, deleted []string) {
+		for _, td := range resp.Data {
+			todos = append(todos, td.ID)
+		}
+		for _, d := range resp.Deleted {
+			deleted = append(deleted, d.ID)
+		}
+		return todos, deleted
+	}
+	hexes := func(hex ...string) []string {
+		var formatted []string
+		for _, h := range hex {
+			formatted = append(formatted, formatID(objectID(t, h)))
+		}
+		return formatted
+	}
+	since := changesCursor{At: at.Add(-time.Minute).UnixMilli()}.encode()
+
+	tests := []struct {
+		name          string
+		limit         string
+		todos         []string
+		deleted       []string
+		hasMore       bool
+		cursorAt      time.Time
+		cursorAfterID string
+	}{
+		// 1 deleted, 2 changed, the deletion of 3 left out as it exists, 4 changed
+		{"page ends on a todo", "4", hexes("2", "4"), hexes("1"), true, at, "4"},
+		{"page ends on a deletion", "1", nil, hexes("1"), true, at, "1"},
+		{"page ends on a left out deletion", "3", hexes("2"), hexes("1"), true, at, "3"},
+		{"everything", "10", hexes("2", "4", "3"), hexes("1", "5"), false, time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := changes(t, "?since="+since+"&limit="+tt.limit)
+			todos, deleted := ids(resp)
+			if !slices.Equal(todos, tt.todos) || !slices.Equal(deleted, tt.deleted) {
+				t.Errorf("changes %q, deleted %q, want %q and %q", todos, deleted, tt.todos, tt.deleted)
+			}
+			if resp.HasMore != tt.hasMore || resp.FullResyncRequired {
+				t.Errorf("has_more %v, full_resync_required %v", resp.HasMore, resp.FullResyncRequired)
+			}
+			cursor, after, err := decodeChangesCursor(resp.Cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			floor := time.UnixMilli(cursor.Floor)
+			if !tt.hasMore {
+				// the next sync starts again sync.overlap before this one
+				floor = time.UnixMilli(cursor.At)
+				if cursor.ID != "" || cursor.Initial {
+					t.Errorf("the last page answered cursor %+v", cursor)
+				}
+			} else if cursor.At != tt.cursorAt.UnixMilli() || after != objectID(t, tt.cursorAfterID) {
+				t.Errorf("cursor at %v after %s, want %v after %s", time.UnixMilli(cursor.At).UTC(), after.Hex(), tt.cursorAt, tt.cursorAfterID)
+			}
+			if ago := time.Since(floor); ago < time.Minute || ago > time.Minute+10*time.Second {
+				t.Errorf("the floor is %v ago, want a minute", ago)
+			}
+		})
+	}
+
+	t.Run("floor kept across pages", func(t *testing.T) {
+		floor := at.Add(-30 * time.Minute).UnixMilli()
+		next := changesCursor{At: at.UnixMilli(), ID: objectID(t, "1").Hex(), Floor: floor}.encode()
+		resp := changes(t, "?since="+next+"&limit=10")
+		cursor, _, err := decodeChangesCursor(resp.Cursor)
+		if err != nil || cursor.At != floor {
+			t.Errorf("the last page of a sync answered %+v, want it at the floor %d", cursor, floor)
+		}
+	})
+
+	t.Run("initial sync", func(t *testing.T) {
+		mongo.commands()
+		resp := changes(t, "?limit=10")
+		if _, deleted := ids(resp); len(deleted) != 0 || len(resp.Data) != 3 {
+			t.Errorf("the first sync answered %d todos and deletions %q", len(resp.Data), deleted)
+		}
+		for _, cmd := range mongo.commands() {
+			if cmd.Collection == deletionCollectionName {
+				t.Errorf("the first sync sent %s on the deletions", cmd.Name)
+			}
+		}
+	})
+
+	t.Run("cursor older than the tombstones", func(t *testing.T) {
+		old := changesCursor{At: time.Now().Add(-25 * time.Hour).UnixMilli()}.encode()
+		resp := changes(t, "?since="+old)
+		if !resp.FullResyncRequired || len(resp.Data) != 0 || len(resp.Deleted) != 0 {
+			t.Errorf("a cursor past the retention answered %+v", resp)
+		}
+	})
+
+	t.Run("restored since", func(t *testing.T) {
+		mongo.seed(deletionCollectionName, DeletionModel{ID: primitive.NewObjectID(), Reset: true, DeletedAt: at})
+		if resp := changes(t, "?since="+since); !resp.FullResyncRequired {
+			t.Errorf("a cursor from before a restore answered %+v", resp)
+		}
+	})
+}
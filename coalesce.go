@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// reads in flight at once that others can join; past it they go to the
+	// database on their own
+	maxCoalescedReads = 1000
+	// bounds a shared read, which no single request's cancellation may end
+	coalescedReadTimeout = 30 * time.Second
+)
+
+var coalescedQueries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_coalesced_queries_total",
+		Help: "List and stats reads by query and outcome: direct, leader of a shared read, or coalesced into one.",
+	},
+	[]string{"query", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(coalescedQueries)
+}
+
+// reads are the database reads in flight that identical ones join.
+var reads = struct {
+	group    singleflight.Group
+	mu       sync.Mutex
+	inFlight int
+}{}
+
+// coalesce runs fn once for concurrent calls with the same key and gives each
+// the result; the callers must not modify it. The key has to hold everything
+// the result depends on, the tenant database first, so no caller gets another
+// one's data. query names the read in the metrics.
+//
+// The read runs detached from the callers, each of which still stops waiting
+// when its own context ends.
+func coalesce[T any](ctx context.Context, query, key string, fn func(context.Context) (T, error)) (T, error) {
+	// a read shared with others may have started before the writes of a
+	// causally consistent session
+	if mongo.SessionFromContext(ctx) != nil {
+		coalescedQueries.WithLabelValues(query, "direct").Inc()
+		return fn(ctx)
+	}
+	key = tenantDB(ctx).Name() + "|" + query + "|" + key
+
+	reads.mu.Lock()
+	full := reads.inFlight >= maxCoalescedReads
+	if !full {
+		reads.inFlight++
+	}
+	reads.mu.Unlock()
+	if full {
+		coalescedQueries.WithLabelValues(query, "direct").Inc()
+		return fn(ctx)
+	}
+	defer func() {
+		reads.mu.Lock()
+		reads.inFlight--
+		reads.mu.Unlock()
+	}()
+
+	// only the caller whose fn runs leads, the channel orders the write
+	led := false
+	result := reads.group.DoChan(key, func() (interface{}, error) {
+		led = true
+		coalescedQueries.WithLabelValues(query, "leader").Inc()
+		readCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), coalescedReadTimeout)
+		defer cancel()
+		return fn(readCtx)
+	})
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case res := <-result:
+		if !led {
+			coalescedQueries.WithLabelValues(query, "coalesced").Inc()
+		}
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	}
+}
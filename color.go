@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type (
+	// a named color of the palette
+	PaletteColor struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		Hex         string `json:"hex"`
+	}
+	// the palette endpoint response
+	GetColorsResponse struct {
+		Message string         `json:"message"`
+		Data    []PaletteColor `json:"data"`
+	}
+)
+
+// colorPalette lists the named colors in display order.
+var colorPalette = []PaletteColor{
+	{Name: "red", DisplayName: "Red", Hex: "#e53935"},
+	{Name: "orange", DisplayName: "Orange", Hex: "#fb8c00"},
+	{Name: "yellow", DisplayName: "Yellow", Hex: "#fdd835"},
+	{Name: "green", DisplayName: "Green", Hex: "#43a047"},
+	{Name: "teal", DisplayName: "Teal", Hex: "#00897b"},
+	{Name: "blue", DisplayName: "Blue", Hex: "#1e88e5"},
+	{Name: "purple", DisplayName: "Purple", Hex: "#8e24aa"},
+	{Name: "pink", DisplayName: "Pink", Hex: "#d81b60"},
+	{Name: "gray", DisplayName: "Gray", Hex: "#757575"},
+}
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// normalizeColor validates a palette name or #RRGGBB value and returns it in
+// lower case. The empty string means no color.
+func normalizeColor(color string) (string, error) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color == "" || hexColorPattern.MatchString(color) {
+		return color, nil
+	}
+	for _, c := range colorPalette {
+		if c.Name == color {
+			return color, nil
+		}
+	}
+
+	names := make([]string, len(colorPalette))
+	for i, c := range colorPalette {
+		names[i] = c.Name
+	}
+	return "", fmt.Errorf("invalid color %q, expected one of %s or a #RRGGBB hex value", color, strings.Join(names, ", "))
+}
+
+// getColors returns the palette so the frontend doesn't have to hardcode it.
+func getColors(rw http.ResponseWriter, r *http.Request) {
+	renderJSON(rw, r, http.StatusOK, GetColorsResponse{
+		Message: localize(r, "colors_retrieved"),
+		Data:    colorPalette,
+	})
+}
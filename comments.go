@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	commentCollectionName string = "comments"
+
+	maxCommentLength = 2000
+)
+
+type (
+	// struct to db model
+	CommentModel struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty"`
+		TodoID    primitive.ObjectID `bson:"todo_id"`
+		Text      string             `bson:"text"`
+		CreatedAt time.Time          `bson:"created_at"`
+	}
+	// a comment as returned by the API
+	Comment struct {
+		ID        string    `json:"id"`
+		TodoID    string    `json:"todo_id"`
+		Text      string    `json:"text"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	// create comment
+	CreateComment struct {
+		Text string `json:"text"`
+	}
+	// a created comment
+	CreateCommentResponse struct {
+		Message string  `json:"message"`
+		Data    Comment `json:"data"`
+	}
+	// the paginated comment thread of a todo
+	GetCommentsResponse struct {
+		Message string    `json:"message"`
+		Data    []Comment `json:"data"`
+		Page    int64     `json:"page"`
+		Limit   int64     `json:"limit"`
+		Total   int64     `json:"total"`
+	}
+)
+
+// ensureCommentIndexes indexes comments by todo, newest first.
+func ensureCommentIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(commentCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "todo_id", Value: 1}, {Key: "created_at", Value: -1}},
+	})
+	return err
+}
+
+// createComment adds a comment to a todo and bumps its comment_count.
+func createComment(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var commentReq CreateComment
+	if err := decodeJSON(r, &commentReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	text := strings.TrimSpace(cleanText(commentReq.Text, true))
+	if text == "" {
+		writeError(rw, r, http.StatusBadRequest, "comment_text_required", nil)
+		return
+	}
+	if utf8.RuneCountInString(text) > maxCommentLength {
+		writeError(rw, r, http.StatusBadRequest, "comment_too_long", renderer.M{
+			"max_length": maxCommentLength,
+		})
+		return
+	}
+
+	// counting first doubles as the existence check of the todo
+	todos := tenantDB(r.Context()).Collection(collectionName)
+	data, err := todos.UpdateOne(r.Context(), bson.M{"id": todoID}, bumpVersion(bson.M{"$inc": bson.M{"comment_count": 1}}))
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "comment_add_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+
+	comment := CommentModel{
+		ID:        primitive.NewObjectID(),
+		TodoID:    todoID,
+		Text:      text,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := tenantDB(r.Context()).Collection(commentCollectionName).InsertOne(r.Context(), comment); err != nil {
+		log.Printf("failed to insert comment into the db: %v\n", err.Error())
+		// undo the count so it keeps matching the stored comments
+		if _, err := todos.UpdateOne(context.WithoutCancel(r.Context()), bson.M{"id": todoID}, bumpVersion(bson.M{"$inc": bson.M{"comment_count": -1}})); err != nil {
+			log.Printf("failed to restore comment_count of %s: %v\n", todoID.Hex(), err)
+		}
+		writeDBError(rw, r, err, "comment_add_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusCreated, CreateCommentResponse{
+		Message: localize(r, "comment_created"),
+		Data:    comment.toComment(),
+	})
+}
+
+// getComments lists the comments of a todo, newest first, with ?page and ?limit.
+func getComments(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	page, limit, err := parsePagination(r.URL.Query().Get("page"), r.URL.Query().Get("limit"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_pagination", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	comments := tenantDB(r.Context()).Collection(commentCollectionName)
+	filter := bson.M{"todo_id": todoID}
+	total, err := comments.CountDocuments(r.Context(), filter)
+	if err != nil {
+		logRequestError(r, "failed to count comments: %v\n", err)
+		writeDBError(rw, r, err, "comments_fetch_failed")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := comments.Find(r.Context(), filter, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch comments: %v\n", err)
+		writeDBError(rw, r, err, "comments_fetch_failed")
+		return
+	}
+
+	var commentsFromDB []CommentModel
+	if err := cursor.All(r.Context(), &commentsFromDB); err != nil {
+		logRequestError(r, "failed to decode comments: %v\n", err)
+		writeDBError(rw, r, err, "comments_fetch_failed")
+		return
+	}
+
+	commentList := []Comment{}
+	for _, c := range commentsFromDB {
+		commentList = append(commentList, c.toComment())
+	}
+	renderJSON(rw, r, http.StatusOK, GetCommentsResponse{
+		Message: localize(r, "comments_retrieved"),
+		Data:    commentList,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+	})
+}
+
+// deleteComment removes a comment and decrements the todo's comment_count.
+func deleteComment(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	commentID, err := parseID(chi.URLParam(r, "commentId"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_comment_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data, err := tenantDB(r.Context()).Collection(commentCollectionName).DeleteOne(r.Context(), bson.M{"_id": commentID, "todo_id": todoID})
+	if err != nil {
+		logRequestError(r, "could not delete comment from database: %v\n", err.Error())
+		writeDBError(rw, r, err, "comment_delete_failed")
+		return
+	}
+	if data.DeletedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "comment_not_found", nil)
+		return
+	}
+
+	update := bumpVersion(bson.M{"$inc": bson.M{"comment_count": -1}})
+	if _, err := tenantDB(r.Context()).Collection(collectionName).UpdateOne(r.Context(), bson.M{"id": todoID}, update); err != nil {
+		log.Printf("failed to decrement comment_count of %s: %v\n", todoID.Hex(), err)
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "comment_deleted"),
+	})
+}
+
+// deleteTodoComments removes every comment of a deleted todo.
+func deleteTodoComments(ctx context.Context, todoID primitive.ObjectID) error {
+	_, err := tenantDB(ctx).Collection(commentCollectionName).DeleteMany(ctx, bson.M{"todo_id": todoID})
+	return err
+}
+
+func (c CommentModel) toComment() Comment {
+	return Comment{
+		ID:        formatID(c.ID),
+		TodoID:    formatID(c.TodoID),
+		Text:      c.Text,
+		CreatedAt: c.CreatedAt,
+	}
+}
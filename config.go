@@ -0,0 +1,885 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings read at startup. Every setting can be given, from
+// lowest to highest precedence, as
+//
+//  1. its default (see defaultConfig),
+//  2. a key in the YAML file passed with -config,
+//  3. the environment variable named by its env tag,
+//  4. a command line flag named after its YAML path, e.g. -mongo.uri.
+//
+// Fields tagged secret are redacted by -print-config, fields tagged
+// reload:"restart" keep their value when the configuration is reloaded.
+type Config struct {
+	LogLevel string      `yaml:"log_level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+	Mongo    MongoConfig `yaml:"mongo"`
+	HTTP     HTTPConfig  `yaml:"http"`
+	Admin    AdminConfig `yaml:"admin"`
+	Auth     AuthConfig  `yaml:"auth"`
+	ReadOnly bool        `yaml:"read_only" env:"READ_ONLY" help:"start in read-only mode"`
+	Audit    AuditConfig `yaml:"audit"`
+
+	Attachments AttachmentConfig  `yaml:"attachments"`
+	Backup      BackupConfig      `yaml:"backup"`
+	Collation   CollationConfig   `yaml:"collation"`
+	Debug       DebugConfig       `yaml:"debug"`
+	Destructive DestructiveConfig `yaml:"destructive"`
+	Encryption  EncryptionConfig  `yaml:"encryption"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Quota       QuotaConfig       `yaml:"quota"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Push        PushConfig        `yaml:"push"`
+	Share       ShareConfig       `yaml:"share"`
+	Sync        SyncConfig        `yaml:"sync"`
+	Webhooks    WebhooksConfig    `yaml:"webhooks"`
+
+	// rejects a second open todo with the same title instead of only hinting at it
+	UniqueTitles bool `yaml:"unique_titles" env:"UNIQUE_TITLES" reload:"restart" help:"reject duplicate titles among open todos"`
+	// requests can ask for another threshold with ?stale_after_days
+	StaleAfterDays int64 `yaml:"stale_after_days" env:"STALE_AFTER_DAYS" help:"days an open todo sits before it is stale"`
+	// used when Accept-Language names no language we have messages for
+	DefaultLanguage string `yaml:"default_language" env:"DEFAULT_LANGUAGE" help:"language of API messages, en or pt"`
+	// clients can ask for problem documents with Accept either way
+	ErrorFormat string `yaml:"error_format" env:"ERROR_FORMAT" help:"body of error responses, simple or problem (RFC 7807)"`
+	// hex stays the default so existing clients keep working; both forms are always accepted
+	IDFormat string `yaml:"id_format" env:"ID_FORMAT" help:"form of ids in responses, hex or short"`
+	// each tenant gets a database of its own; requests must name one with X-Tenant
+	Tenants []string `yaml:"tenants" env:"TENANTS" reload:"restart" help:"tenants allowed in X-Tenant, enables multi-tenant mode"`
+	// off by default so clients sending extra parameters keep working
+	StrictQuery bool `yaml:"strict_query" env:"STRICT_QUERY" help:"reject unknown query parameters of the list endpoints"`
+	// routes answered with 503 unless switched back on by POST /admin/routes/enable
+	DisabledRoutes []string `yaml:"disabled_routes" env:"DISABLED_ROUTES" help:"routes answered with 503, as \"METHOD /pattern\""`
+	// zone plain dates and day boundaries are read in unless a request sends ?tz=
+	Timezone string `yaml:"timezone" env:"TIMEZONE" help:"IANA time zone used when a request names none"`
+
+	HTMLDir   string `yaml:"html_dir" env:"HTML_DIR" reload:"restart" help:"directory holding the .html templates"`
+	StaticDir string `yaml:"static_dir" env:"STATIC_DIR" reload:"restart" help:"directory served under /static"`
+
+	// derived from the settings above by loadConfig
+	trustedProxies []*net.IPNet
+	logLevel       slog.Level
+	location       *time.Location
+	backupSchedule *cronSchedule
+	vapidKey       *ecdsa.PrivateKey
+	legacySunset   time.Time
+}
+
+type (
+	// MongoConfig ...
+	MongoConfig struct {
+		URI                string        `yaml:"uri" env:"MONGO_URI" secret:"uri" reload:"restart" help:"MongoDB connection string"`
+		ConnectTimeout     time.Duration `yaml:"connect_timeout" env:"MONGO_CONNECT_TIMEOUT" reload:"restart" help:"how long to wait for MongoDB at startup"`
+		SlowQueryThreshold time.Duration `yaml:"slow_query_threshold" env:"MONGO_SLOW_QUERY_THRESHOLD" help:"log commands slower than this"`
+		SchemaValidation   string        `yaml:"schema_validation" env:"MONGO_SCHEMA_VALIDATION" reload:"restart" help:"what the todos collection does with invalid writes: off, warn or error"`
+		CausalConsistency  bool          `yaml:"causal_consistency" env:"MONGO_CAUSAL_CONSISTENCY" reload:"restart" help:"run API requests in causally consistent sessions, see X-Causal-Token"`
+	}
+	// HTTPConfig ...
+	HTTPConfig struct {
+		// a TCP address (":9000", "127.0.0.1:9000") or a unix socket ("unix:///run/todo.sock")
+		Addr           string        `yaml:"addr" env:"HTTP_ADDR" reload:"restart" help:"address of the main listener"`
+		AdminAddr      string        `yaml:"admin_addr" env:"ADMIN_ADDR" reload:"restart" help:"optional listener for /metrics, /debug and /healthz"`
+		SocketMode     fs.FileMode   `yaml:"socket_mode" env:"HTTP_SOCKET_MODE" reload:"restart" help:"permissions of unix sockets"`
+		TrustedProxies []string      `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" help:"CIDRs allowed to set X-Forwarded-For"`
+		DrainTimeout   time.Duration `yaml:"drain_timeout" env:"HTTP_DRAIN_TIMEOUT" help:"how long shutdown waits for in-flight requests"`
+		MaxBodyBytes   int64         `yaml:"max_body_bytes" env:"HTTP_MAX_BODY_BYTES" help:"largest request body of the API in bytes, attachment uploads aside"`
+		// Cache-Control of GET /todo/{id}; a change is visible through the ETag at once
+		TodoMaxAge               time.Duration `yaml:"todo_max_age" env:"HTTP_TODO_MAX_AGE" help:"how long caches may keep a todo without revalidating"`
+		TodoStaleWhileRevalidate time.Duration `yaml:"todo_stale_while_revalidate" env:"HTTP_TODO_STALE_WHILE_REVALIDATE" help:"how long caches may serve a stale todo while revalidating it"`
+		// sent as Sunset by the unversioned aliases, see deprecatedAlias
+		LegacySunset string `yaml:"legacy_sunset" env:"HTTP_LEGACY_SUNSET" help:"day (YYYY-MM-DD) the unversioned /todo and /attachment paths and the legacy fields go away, empty when undecided"`
+		// legacy response fields, see legacyFields; both until clients have moved
+		CompatibilityMode string `yaml:"compatibility_mode" env:"HTTP_COMPATIBILITY_MODE" help:"legacy response fields: old, both or new"`
+	}
+	// AdminConfig ...
+	AdminConfig struct {
+		Key          string        `yaml:"key" env:"ADMIN_KEY" secret:"true" help:"key required by the /admin endpoints"`
+		FormTokenTTL time.Duration `yaml:"form_token_ttl" env:"ADMIN_FORM_TOKEN_TTL" help:"how long the create form of /admin/todos can be submitted"`
+	}
+	// AuthConfig ...
+	AuthConfig struct {
+		APIKeys []string   `yaml:"api_keys" env:"AUTH_API_KEYS" secret:"true" help:"keys clients send as X-API-Key or a bearer token"`
+		Policy  AuthPolicy `yaml:"policy"`
+	}
+	// AuthPolicy ...
+	AuthPolicy struct {
+		// the defaults keep the API open and /admin behind admin.key
+		Anonymous []string `yaml:"anonymous" env:"AUTH_POLICY_ANONYMOUS" help:"permissions of requests without a key: read, write and admin"`
+		APIKey    []string `yaml:"api_key" env:"AUTH_POLICY_API_KEY" help:"permissions of requests with one of auth.api_keys"`
+		AdminKey  []string `yaml:"admin_key" env:"AUTH_POLICY_ADMIN_KEY" help:"permissions of requests with admin.key"`
+	}
+	// AuditConfig ...
+	AuditConfig struct {
+		Retention time.Duration `yaml:"retention" env:"AUDIT_RETENTION" reload:"restart" help:"how long audit entries are kept, 0 keeps them forever"`
+	}
+	// AttachmentConfig ...
+	AttachmentConfig struct {
+		MaxSize      int64    `yaml:"max_size" env:"ATTACHMENT_MAX_SIZE" help:"largest accepted upload in bytes"`
+		ContentTypes []string `yaml:"content_types" env:"ATTACHMENT_CONTENT_TYPES" help:"content types accepted as attachments"`
+	}
+	// BackupConfig ...
+	BackupConfig struct {
+		// restoring an encrypted archive needs the key it was made with
+		Key string `yaml:"key" env:"BACKUP_KEY" secret:"true" help:"key encrypting backups with AES-GCM, backups are plain without it"`
+		// scheduled backups larger than this fail, as they couldn't be restored
+		MaxRestoreSize int64          `yaml:"max_restore_size" env:"BACKUP_MAX_RESTORE_SIZE" help:"largest archive accepted by a restore in bytes"`
+		Schedule       string         `yaml:"schedule" env:"BACKUP_SCHEDULE" reload:"restart" help:"cron expression or @daily, @weekly etc. of automatic backups, enables them"`
+		Dir            string         `yaml:"dir" env:"BACKUP_DIR" help:"directory automatic backups are written to unless s3.bucket is set"`
+		Keep           int64          `yaml:"keep" env:"BACKUP_KEEP" help:"automatic backups kept in dir for each tenant, 0 keeps all"`
+		S3             BackupS3Config `yaml:"s3"`
+	}
+	// BackupS3Config ...
+	BackupS3Config struct {
+		Endpoint  string `yaml:"endpoint" env:"BACKUP_S3_ENDPOINT" help:"URL of the S3 compatible API"`
+		Region    string `yaml:"region" env:"BACKUP_S3_REGION" help:"region requests are signed for"`
+		Bucket    string `yaml:"bucket" env:"BACKUP_S3_BUCKET" help:"bucket automatic backups are uploaded to instead of dir"`
+		Prefix    string `yaml:"prefix" env:"BACKUP_S3_PREFIX" help:"prefix of the uploaded object keys"`
+		AccessKey string `yaml:"access_key" env:"BACKUP_S3_ACCESS_KEY" secret:"true" help:"access key id of the uploads"`
+		SecretKey string `yaml:"secret_key" env:"BACKUP_S3_SECRET_KEY" secret:"true" help:"secret access key of the uploads"`
+		// MinIO and most other S3 compatible stores want this
+		PathStyle bool `yaml:"path_style" env:"BACKUP_S3_PATH_STYLE" help:"name the bucket in the path instead of the host"`
+	}
+	// DestructiveConfig ...
+	DestructiveConfig struct {
+		MaxCount   int64 `yaml:"max_count" env:"DESTRUCTIVE_MAX_COUNT" help:"bulk operations affecting more todos need ?confirm=<count>, 0 disables"`
+		MaxPercent int64 `yaml:"max_percent" env:"DESTRUCTIVE_MAX_PERCENT" help:"bulk operations affecting more than this percentage need ?confirm=<count>, 0 disables"`
+	}
+	// EncryptionConfig ...
+	EncryptionConfig struct {
+		// the first key encrypts, all of them decrypt, so a new key goes
+		// first and the old one stays until the reencrypt job has run
+		Keys []string `yaml:"keys" env:"ENCRYPTION_KEYS" secret:"true" help:"keys encrypting todo titles at rest with AES-GCM, titles are stored plain without them"`
+	}
+	// LimitsConfig ...
+	LimitsConfig struct {
+		Aggregations int64         `yaml:"aggregations" env:"LIMIT_AGGREGATIONS" reload:"restart" help:"stats and review aggregations allowed to run at once"`
+		QueueTimeout time.Duration `yaml:"queue_timeout" env:"LIMIT_QUEUE_TIMEOUT" help:"how long a request waits for a slot before a 429"`
+	}
+	// QuotaConfig ...
+	QuotaConfig struct {
+		MaxTodos int64 `yaml:"max_todos" env:"QUOTA_MAX_TODOS" help:"todos a tenant may have, 0 disables"`
+	}
+	// RateLimitConfig ...
+	RateLimitConfig struct {
+		Requests int64         `yaml:"requests" env:"RATE_LIMIT_REQUESTS" help:"requests per client and window advertised in RateLimit headers, 0 disables"`
+		Window   time.Duration `yaml:"window" env:"RATE_LIMIT_WINDOW" help:"length of a rate limit window"`
+		Enforce  bool          `yaml:"enforce" env:"RATE_LIMIT_ENFORCE" help:"answer 429 to clients over their budget instead of only telling them"`
+	}
+	// ShareConfig ...
+	ShareConfig struct {
+		// the first key signs, all of them verify, so a new key goes first
+		// and the old one stays until its links have expired
+		Keys      []string      `yaml:"keys" env:"SHARE_KEYS" secret:"true" help:"keys signing share links, enables sharing"`
+		TTL       time.Duration `yaml:"ttl" env:"SHARE_TTL" help:"how long a share link is valid unless the request says otherwise"`
+		MaxTTL    time.Duration `yaml:"max_ttl" env:"SHARE_MAX_TTL" help:"longest validity a share link may be given"`
+		BaseURL   string        `yaml:"base_url" env:"SHARE_BASE_URL" help:"public URL share links start with, defaults to the request's host"`
+		RateLimit int64         `yaml:"rate_limit" env:"SHARE_RATE_LIMIT" help:"requests per client and minute to the public share links"`
+	}
+	// PushConfig ...
+	PushConfig struct {
+		// the outbox dispatcher is only started with it
+		VAPIDPrivateKey string        `yaml:"vapid_private_key" env:"PUSH_VAPID_PRIVATE_KEY" secret:"true" reload:"restart" help:"private VAPID key reminders are pushed to browsers with, from todo vapid-keys; push is off without it"`
+		Subject         string        `yaml:"subject" env:"PUSH_SUBJECT" help:"mailto: or https: contact of the operator, sent to the push services"`
+		TTL             time.Duration `yaml:"ttl" env:"PUSH_TTL" help:"how long push services keep a notification for a browser that is offline"`
+	}
+	// SyncConfig ...
+	SyncConfig struct {
+		// the TTL index of the deletions is built for it
+		TombstoneRetention time.Duration `yaml:"tombstone_retention" env:"SYNC_TOMBSTONE_RETENTION" reload:"restart" help:"how long deletions are kept for GET /todo/changes, older cursors need a full resync; 0 keeps them forever"`
+		// covers writes committed after a sync read past them and clock skew between instances
+		Overlap time.Duration `yaml:"overlap" env:"SYNC_OVERLAP" help:"how far before its first read the next sync of a client starts again"`
+	}
+	// WebhooksConfig ...
+	WebhooksConfig struct {
+		URLs         []string      `yaml:"urls" env:"WEBHOOK_URLS" reload:"restart" help:"URLs todo events are POSTed to, enables the outbox"`
+		MaxAttempts  int64         `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" help:"delivery attempts before an event is dead"`
+		PollInterval time.Duration `yaml:"poll_interval" env:"WEBHOOK_POLL_INTERVAL" reload:"restart" help:"how often the outbox is checked for due events"`
+	}
+	// CollationConfig ...
+	CollationConfig struct {
+		// the title index is built for it, so changing it needs a restart
+		Locale    string   `yaml:"locale" env:"COLLATION_LOCALE" reload:"restart" help:"ICU locale titles are sorted in"`
+		Strength  int64    `yaml:"strength" env:"COLLATION_STRENGTH" reload:"restart" help:"ICU comparison level from 1 to 5, 2 ignores case"`
+		CaseLevel bool     `yaml:"case_level" env:"COLLATION_CASE_LEVEL" reload:"restart" help:"tell case apart at strength 1 or 2"`
+		Locales   []string `yaml:"locales" env:"COLLATION_LOCALES" help:"other locales a request may sort titles in with ?collation="`
+	}
+	// DebugConfig ...
+	DebugConfig struct {
+		// bodies hold user data, so this stays off unless someone is debugging
+		CaptureBodies bool  `yaml:"capture_bodies" env:"DEBUG_CAPTURE_BODIES" help:"log request bodies and failed response bodies, exposes user data"`
+		CaptureLimit  int64 `yaml:"capture_limit" env:"DEBUG_CAPTURE_LIMIT" help:"bytes of each body logged by capture_bodies"`
+		Routes        bool  `yaml:"routes" env:"DEBUG_ROUTES" help:"serve the route table at /debug/routes"`
+		// for development; ?pretty=true does the same for a single request
+		PrettyJSON bool `yaml:"pretty_json" env:"DEBUG_PRETTY_JSON" help:"indent every JSON response"`
+		// for development, the templates are parsed once otherwise
+		ReloadTemplates bool `yaml:"reload_templates" env:"DEBUG_RELOAD_TEMPLATES" reload:"restart" help:"parse the HTML templates again when they change"`
+	}
+)
+
+// activeConfig is the configuration in effect; it is replaced as a whole on reload.
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig returns a consistent snapshot of the configuration. Callers
+// must not modify it.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// defaultConfig returns the settings used when nothing else is configured.
+func defaultConfig() Config {
+	return Config{
+		LogLevel:        "info",
+		DefaultLanguage: fallbackLanguage,
+		ErrorFormat:     errorFormatSimple,
+		Timezone:        "UTC",
+		IDFormat:        idFormatHex,
+		StaleAfterDays:  14,
+		Mongo: MongoConfig{
+			URI:                "mongodb://localhost:27017",
+			ConnectTimeout:     10 * time.Second,
+			SlowQueryThreshold: 250 * time.Millisecond,
+			SchemaValidation:   schemaValidationWarn,
+		},
+		HTTP: HTTPConfig{
+			Addr:         ":9000",
+			SocketMode:   0660,
+			DrainTimeout: 30 * time.Second,
+			MaxBodyBytes: 1 << 20,
+			// short enough that a change made elsewhere shows within seconds
+			TodoMaxAge:               5 * time.Second,
+			TodoStaleWhileRevalidate: 30 * time.Second,
+			CompatibilityMode:        compatBoth,
+		},
+		Audit: AuditConfig{
+			Retention: 90 * 24 * time.Hour,
+		},
+		Attachments: AttachmentConfig{
+			MaxSize: 10 << 20,
+			ContentTypes: []string{
+				"application/pdf",
+				"image/gif",
+				"image/jpeg",
+				"image/png",
+				"image/webp",
+				"text/plain",
+			},
+		},
+		Backup: BackupConfig{
+			MaxRestoreSize: 1 << 30,
+			Keep:           7,
+			S3: BackupS3Config{
+				Region: "us-east-1",
+			},
+		},
+		Destructive: DestructiveConfig{
+			MaxCount:   100,
+			MaxPercent: 10,
+		},
+		Limits: LimitsConfig{
+			Aggregations: 4,
+			QueueTimeout: 500 * time.Millisecond,
+		},
+		RateLimit: RateLimitConfig{
+			Window: time.Minute,
+		},
+		Admin: AdminConfig{
+			FormTokenTTL: time.Hour,
+		},
+		Auth: AuthConfig{
+			Policy: AuthPolicy{
+				Anonymous: []string{permRead, permWrite},
+				APIKey:    []string{permRead, permWrite},
+				AdminKey:  []string{permRead, permWrite, permAdmin},
+			},
+		},
+		Share: ShareConfig{
+			TTL:       7 * 24 * time.Hour,
+			MaxTTL:    30 * 24 * time.Hour,
+			RateLimit: 30,
+		},
+		Sync: SyncConfig{
+			TombstoneRetention: 30 * 24 * time.Hour,
+			Overlap:            10 * time.Second,
+		},
+		Push: PushConfig{
+			TTL: time.Hour,
+		},
+		Webhooks: WebhooksConfig{
+			MaxAttempts:  8,
+			PollInterval: 2 * time.Second,
+		},
+		Collation: CollationConfig{
+			Locale:   "en",
+			Strength: 2,
+			Locales:  []string{"de", "es", "fr", "pt", "sv"},
+		},
+		Debug: DebugConfig{
+			CaptureLimit: 4 << 10,
+		},
+		HTMLDir:   "html",
+		StaticDir: "static",
+	}
+}
+
+// validate checks the settings that can't be verified by their type alone
+// and fills in the derived fields.
+func (c *Config) validate() error {
+	var errs []error
+	if err := c.logLevel.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: invalid value %q, expected debug, info, warn or error", c.LogLevel))
+	}
+	if _, ok := catalogs[c.DefaultLanguage]; !ok {
+		errs = append(errs, fmt.Errorf("default_language: no messages for %q", c.DefaultLanguage))
+	}
+	if c.HTTP.Addr == "" {
+		errs = append(errs, errors.New("http.addr: must not be empty"))
+	}
+	if !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+		errs = append(errs, errors.New("mongo.uri: expected a mongodb:// or mongodb+srv:// connection string"))
+	}
+	if !slices.Contains(schemaValidations, c.Mongo.SchemaValidation) {
+		errs = append(errs, fmt.Errorf("mongo.schema_validation: invalid value %q, expected off, warn or error", c.Mongo.SchemaValidation))
+	}
+	if c.HTTP.DrainTimeout <= 0 {
+		errs = append(errs, errors.New("http.drain_timeout: must be positive"))
+	}
+	if c.HTTP.MaxBodyBytes <= 0 {
+		errs = append(errs, errors.New("http.max_body_bytes: must be positive"))
+	}
+	if c.HTTP.TodoMaxAge < 0 {
+		errs = append(errs, errors.New("http.todo_max_age: must not be negative"))
+	}
+	if c.HTTP.TodoStaleWhileRevalidate < 0 {
+		errs = append(errs, errors.New("http.todo_stale_while_revalidate: must not be negative"))
+	}
+	if c.Attachments.MaxSize <= 0 {
+		errs = append(errs, errors.New("attachments.max_size: must be positive"))
+	}
+	if c.Backup.Key != "" && len(c.Backup.Key) < minBackupKeyLength {
+		errs = append(errs, fmt.Errorf("backup.key: must be at least %d characters", minBackupKeyLength))
+	}
+	if c.Backup.MaxRestoreSize <= 0 {
+		errs = append(errs, errors.New("backup.max_restore_size: must be positive"))
+	}
+	if c.Backup.Schedule != "" {
+		schedule, err := parseSchedule(c.Backup.Schedule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("backup.schedule: %w", err))
+		}
+		c.backupSchedule = schedule
+		if c.Backup.Dir == "" && c.Backup.S3.Bucket == "" {
+			errs = append(errs, errors.New("backup.schedule: needs backup.dir or backup.s3.bucket to store the backups in"))
+		}
+	}
+	if c.Backup.Keep < 0 {
+		errs = append(errs, errors.New("backup.keep: must not be negative"))
+	}
+	if c.Backup.S3.Bucket != "" {
+		if parsed, err := url.Parse(c.Backup.S3.Endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("backup.s3.endpoint: invalid URL %q, expected http:// or https://", c.Backup.S3.Endpoint))
+		}
+		if c.Backup.S3.AccessKey == "" || c.Backup.S3.SecretKey == "" {
+			errs = append(errs, errors.New("backup.s3.access_key: needed with backup.s3.secret_key to upload to backup.s3.bucket"))
+		}
+	}
+	if c.Destructive.MaxCount < 0 {
+		errs = append(errs, errors.New("destructive.max_count: must not be negative"))
+	}
+	if c.Destructive.MaxPercent < 0 || c.Destructive.MaxPercent > 100 {
+		errs = append(errs, errors.New("destructive.max_percent: expected a percentage between 0 and 100"))
+	}
+	if c.Limits.Aggregations <= 0 {
+		errs = append(errs, errors.New("limits.aggregations: must be positive"))
+	}
+	if c.StaleAfterDays < 1 || c.StaleAfterDays > maxStaleAfterDays {
+		errs = append(errs, fmt.Errorf("stale_after_days: expected a number of days between 1 and %d", maxStaleAfterDays))
+	}
+	if c.Quota.MaxTodos < 0 {
+		errs = append(errs, errors.New("quota.max_todos: must not be negative"))
+	}
+	if c.RateLimit.Requests < 0 {
+		errs = append(errs, errors.New("rate_limit.requests: must not be negative"))
+	}
+	if c.RateLimit.Window < time.Second {
+		errs = append(errs, errors.New("rate_limit.window: must be at least 1s"))
+	}
+	if c.Sync.TombstoneRetention < 0 {
+		errs = append(errs, errors.New("sync.tombstone_retention: must not be negative"))
+	}
+	if c.Sync.Overlap <= 0 {
+		errs = append(errs, errors.New("sync.overlap: must be positive"))
+	} else if c.Sync.TombstoneRetention > 0 && c.Sync.Overlap >= c.Sync.TombstoneRetention {
+		errs = append(errs, errors.New("sync.overlap: must be shorter than sync.tombstone_retention"))
+	}
+	for _, route := range c.DisabledRoutes {
+		if method, pattern, _ := strings.Cut(route, " "); method == "" || !strings.HasPrefix(pattern, "/") {
+			errs = append(errs, fmt.Errorf("disabled_routes: invalid route %q, expected \"METHOD /pattern\"", route))
+		}
+	}
+	if c.Admin.FormTokenTTL <= 0 {
+		errs = append(errs, errors.New("admin.form_token_ttl: must be positive"))
+	}
+	for _, key := range c.Auth.APIKeys {
+		if key == "" {
+			errs = append(errs, errors.New("auth.api_keys: keys must not be empty"))
+			break
+		}
+	}
+	for _, policy := range []struct {
+		path    string
+		granted []string
+	}{
+		{"auth.policy.anonymous", c.Auth.Policy.Anonymous},
+		{"auth.policy.api_key", c.Auth.Policy.APIKey},
+		{"auth.policy.admin_key", c.Auth.Policy.AdminKey},
+	} {
+		for _, permission := range policy.granted {
+			if !slices.Contains(permissions, permission) {
+				errs = append(errs, fmt.Errorf("%s: unknown permission %q, expected %s", policy.path, permission, strings.Join(permissions, ", ")))
+			}
+		}
+	}
+	for _, key := range c.Encryption.Keys {
+		if len(key) < minEncryptionKeyLength {
+			errs = append(errs, fmt.Errorf("encryption.keys: keys must be at least %d characters", minEncryptionKeyLength))
+			break
+		}
+	}
+	for _, key := range c.Share.Keys {
+		if len(key) < minShareKeyLength {
+			errs = append(errs, fmt.Errorf("share.keys: keys must be at least %d characters", minShareKeyLength))
+			break
+		}
+	}
+	if c.Share.TTL <= 0 || c.Share.MaxTTL < c.Share.TTL {
+		errs = append(errs, errors.New("share.ttl: must be positive and at most share.max_ttl"))
+	}
+	if c.Share.RateLimit <= 0 {
+		errs = append(errs, errors.New("share.rate_limit: must be positive"))
+	}
+	if c.Share.BaseURL != "" {
+		if parsed, err := url.Parse(c.Share.BaseURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("share.base_url: invalid URL %q, expected http:// or https://", c.Share.BaseURL))
+		}
+	}
+	if c.Push.VAPIDPrivateKey != "" {
+		key, err := parseVAPIDKey(c.Push.VAPIDPrivateKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("push.vapid_private_key: %w, expected a P-256 key in base64url as todo vapid-keys prints", err))
+		}
+		c.vapidKey = key
+		if !strings.HasPrefix(c.Push.Subject, "mailto:") && !strings.HasPrefix(c.Push.Subject, "https://") {
+			errs = append(errs, errors.New("push.subject: required with push.vapid_private_key, expected a mailto: or https:// URL"))
+		}
+	}
+	if c.Push.TTL < 0 {
+		errs = append(errs, errors.New("push.ttl: must not be negative"))
+	}
+	for _, u := range c.Webhooks.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("webhooks.urls: invalid URL %q, expected http:// or https://", u))
+		}
+	}
+	if c.Webhooks.MaxAttempts <= 0 {
+		errs = append(errs, errors.New("webhooks.max_attempts: must be positive"))
+	}
+	if c.Webhooks.PollInterval <= 0 {
+		errs = append(errs, errors.New("webhooks.poll_interval: must be positive"))
+	}
+	for _, locale := range append([]string{c.Collation.Locale}, c.Collation.Locales...) {
+		if !collationLocalePattern.MatchString(locale) {
+			errs = append(errs, fmt.Errorf("collation: invalid locale %q, expected an ICU locale such as en or de_AT", locale))
+		}
+	}
+	if c.Collation.Strength < 1 || c.Collation.Strength > 5 {
+		errs = append(errs, errors.New("collation.strength: must be between 1 and 5"))
+	}
+	if c.Debug.CaptureLimit <= 0 {
+		errs = append(errs, errors.New("debug.capture_limit: must be positive"))
+	}
+	if c.ErrorFormat != errorFormatSimple && c.ErrorFormat != errorFormatProblem {
+		errs = append(errs, fmt.Errorf("error_format: invalid value %q, expected %s or %s", c.ErrorFormat, errorFormatSimple, errorFormatProblem))
+	}
+	if c.IDFormat != idFormatHex && c.IDFormat != idFormatShort {
+		errs = append(errs, fmt.Errorf("id_format: invalid value %q, expected %s or %s", c.IDFormat, idFormatHex, idFormatShort))
+	}
+	for _, tenant := range c.Tenants {
+		if !tenantPattern.MatchString(tenant) {
+			errs = append(errs, fmt.Errorf("tenants: invalid tenant %q, expected lower case letters, digits and dashes", tenant))
+		}
+	}
+	loc, err := loadTimezone(c.Timezone)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("timezone: %w, expected %s", err, expectedTimezone))
+	}
+	c.location = loc
+	proxies, err := parseTrustedProxies(c.HTTP.TrustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("http.trusted_proxies: %w", err))
+	}
+	c.trustedProxies = proxies
+	if c.HTTP.LegacySunset != "" {
+		sunset, err := time.Parse(time.DateOnly, c.HTTP.LegacySunset)
+		if err != nil {
+			errs = append(errs, errors.New("http.legacy_sunset: expected a day such as 2025-06-30"))
+		}
+		c.legacySunset = sunset
+	}
+	switch c.HTTP.CompatibilityMode {
+	case compatOld, compatBoth, compatNew:
+	default:
+		errs = append(errs, fmt.Errorf("http.compatibility_mode: invalid value %q, expected %s, %s or %s", c.HTTP.CompatibilityMode, compatOld, compatBoth, compatNew))
+	}
+	return errors.Join(errs...)
+}
+
+// configSetting is one leaf of the Config struct.
+type configSetting struct {
+	path  string // YAML path such as "mongo.uri", also the flag name
+	field reflect.StructField
+	value reflect.Value
+}
+
+// configSettings flattens the leaves of cfg in declaration order.
+func configSettings(cfg *Config) []configSetting {
+	var settings []configSetting
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			path := prefix + field.Tag.Get("yaml")
+			if field.Type.Kind() == reflect.Struct {
+				walk(path+".", v.Field(i))
+				continue
+			}
+			settings = append(settings, configSetting{path: path, field: field, value: v.Field(i)})
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return settings
+}
+
+// configFlags registers a flag for every setting and returns a function
+// yielding the values given on the command line once flags has been parsed.
+func configFlags(flags *flag.FlagSet) func() map[string]string {
+	defaults := defaultConfig()
+	for _, s := range configSettings(&defaults) {
+		flags.Var(&settingFlag{isBool: s.value.Kind() == reflect.Bool}, s.path, s.field.Tag.Get("help"))
+	}
+
+	return func() map[string]string {
+		values := map[string]string{}
+		flags.Visit(func(f *flag.Flag) {
+			if sf, ok := f.Value.(*settingFlag); ok {
+				values[f.Name] = sf.value
+			}
+		})
+		return values
+	}
+}
+
+// settingFlag records the raw command line value of a setting.
+type settingFlag struct {
+	isBool bool
+	value  string
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
+
+// loadConfig builds the configuration from the defaults, the optional YAML
+// file at path, the environment and the command line flags, in that order of
+// precedence. Unknown keys in the file are returned as warnings; invalid
+// values are all reported together, each naming its key and expected type.
+func loadConfig(path string, flagValues map[string]string) (Config, []string, error) {
+	cfg := defaultConfig()
+	settings := configSettings(&cfg)
+
+	var warnings []string
+	var errs []error
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("config file: %w", err)
+		}
+		warnings, errs = applyConfigFile(data, settings)
+	}
+
+	for _, s := range settings {
+		key := s.field.Tag.Get("env")
+		if value, ok := os.LookupEnv(key); ok && value != "" {
+			if err := setSetting(s, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s (from %s): %w", s.path, key, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flagValues[s.path]; ok {
+			if err := setSetting(s, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s (from -%s): %w", s.path, s.path, err))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, cfg.validate())
+	}
+	return cfg, warnings, errors.Join(errs...)
+}
+
+// envReference matches ${ENV_VAR} references inside config file values.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// applyConfigFile decodes the YAML document onto settings.
+func applyConfigFile(data []byte, settings []configSetting) (warnings []string, errs []error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, []error{fmt.Errorf("config file: %w", err)}
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	byPath := map[string]configSetting{}
+	for _, s := range settings {
+		byPath[s.path] = s
+	}
+
+	var walk func(prefix string, node *yaml.Node)
+	walk = func(prefix string, node *yaml.Node) {
+		if node.Kind != yaml.MappingNode {
+			errs = append(errs, fmt.Errorf("%s (line %d): expected a mapping", strings.TrimSuffix(prefix, "."), node.Line))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			path := prefix + key.Value
+
+			if s, ok := byPath[path]; ok {
+				if err := setSettingFromNode(s, value); err != nil {
+					errs = append(errs, fmt.Errorf("%s (line %d): %w", path, value.Line, err))
+				}
+				continue
+			}
+			if isConfigSection(path, settings) {
+				walk(path+".", value)
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("unknown config key %q (line %d)", path, key.Line))
+		}
+	}
+	walk("", doc.Content[0])
+	return warnings, errs
+}
+
+func isConfigSection(path string, settings []configSetting) bool {
+	for _, s := range settings {
+		if strings.HasPrefix(s.path, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// setSettingFromNode sets a setting from a YAML scalar or, for lists, a sequence.
+func setSettingFromNode(s configSetting, node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode && s.value.Kind() == reflect.Slice {
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := expandEnvReferences(item.Value)
+			if err != nil {
+				return err
+			}
+			items = append(items, value)
+		}
+		s.value.Set(reflect.ValueOf(items))
+		return nil
+	}
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("expected %s", describeSetting(s))
+	}
+
+	value, err := expandEnvReferences(node.Value)
+	if err != nil {
+		return err
+	}
+	return setSetting(s, value)
+}
+
+// expandEnvReferences replaces ${ENV_VAR} references, failing on unset variables.
+func expandEnvReferences(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// setSetting parses raw into the setting according to its type.
+func setSetting(s configSetting, raw string) error {
+	switch s.value.Interface().(type) {
+	case string:
+		s.value.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected %s", raw, describeSetting(s))
+		}
+		s.value.SetBool(b)
+	case int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected %s", raw, describeSetting(s))
+		}
+		s.value.SetInt(n)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected %s", raw, describeSetting(s))
+		}
+		s.value.Set(reflect.ValueOf(d))
+	case fs.FileMode:
+		mode, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid value %q, expected %s", raw, describeSetting(s))
+		}
+		s.value.Set(reflect.ValueOf(fs.FileMode(mode)))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
+
+// describeSetting names the expected type of a setting for error messages.
+func describeSetting(s configSetting) string {
+	switch s.value.Interface().(type) {
+	case bool:
+		return "true or false"
+	case int64:
+		return "an integer"
+	case time.Duration:
+		return "a duration such as 250ms or 24h"
+	case fs.FileMode:
+		return "an octal file mode such as 0660"
+	case []string:
+		return "a list of strings"
+	default:
+		return "a string"
+	}
+}
+
+// printConfig writes the effective configuration as YAML with secrets redacted.
+func printConfig(out io.Writer, cfg Config) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := map[string]*yaml.Node{"": root}
+
+	for _, s := range configSettings(&cfg) {
+		parent := root
+		section, name, nested := strings.Cut(s.path, ".")
+		if nested {
+			if sections[section] == nil {
+				sections[section] = &yaml.Node{Kind: yaml.MappingNode}
+				root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: section}, sections[section])
+			}
+			parent = sections[section]
+		} else {
+			name = section
+		}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, settingNode(s))
+	}
+
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// settingNode renders a setting's value, redacting secrets.
+func settingNode(s configSetting) *yaml.Node {
+	switch v := settingValue(s).(type) {
+	case []string:
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, item := range v {
+			seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+		}
+		return seq
+	case fs.FileMode:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprintf("%04o", uint32(v)), Style: yaml.DoubleQuotedStyle}
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(v)}
+	}
+}
+
+// settingValue returns a setting's value with its secrets redacted.
+func settingValue(s configSetting) interface{} {
+	switch v := s.value.Interface().(type) {
+	case []string:
+		if s.field.Tag.Get("secret") != "true" {
+			return v
+		}
+		redacted := make([]string, len(v))
+		for i := range v {
+			redacted[i] = "[redacted]"
+		}
+		return redacted
+	case string:
+		switch s.field.Tag.Get("secret") {
+		case "uri":
+			return redactMongoURI(v)
+		case "true":
+			if v != "" {
+				return "[redacted]"
+			}
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a YAML config file for the test and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "stale_after_days: 20\nlog_level: warn\nhttp:\n  drain_timeout: 7s\n  trusted_proxies: [10.0.0.0/8]\n")
+
+	tests := []struct {
+		name  string
+		file  bool
+		env   map[string]string
+		flags map[string]string
+		want  func(Config) bool
+	}{
+		{
+			name: "defaults",
+			want: func(c Config) bool { return c.StaleAfterDays == 14 && c.LogLevel == defaultConfig().LogLevel },
+		},
+		{
+			name: "file over defaults",
+			file: true,
+			want: func(c Config) bool {
+				return c.StaleAfterDays == 20 && c.LogLevel == "warn" && c.HTTP.DrainTimeout == 7*time.Second &&
+					slices.Equal(c.HTTP.TrustedProxies, []string{"10.0.0.0/8"}) && len(c.trustedProxies) == 1
+			},
+		},
+		{
+			name: "environment over file",
+			file: true,
+			env:  map[string]string{"STALE_AFTER_DAYS": "30", "TRUSTED_PROXIES": "10.0.0.1, 10.0.0.2"},
+			want: func(c Config) bool {
+				return c.StaleAfterDays == 30 && c.LogLevel == "warn" && slices.Equal(c.HTTP.TrustedProxies, []string{"10.0.0.1", "10.0.0.2"})
+			},
+		},
+		{
+			name:  "flags over environment",
+			file:  true,
+			env:   map[string]string{"STALE_AFTER_DAYS": "30"},
+			flags: map[string]string{"stale_after_days": "40", "http.drain_timeout": "9s"},
+			want:  func(c Config) bool { return c.StaleAfterDays == 40 && c.HTTP.DrainTimeout == 9*time.Second },
+		},
+		{
+			name: "empty environment variable is ignored",
+			file: true,
+			env:  map[string]string{"STALE_AFTER_DAYS": ""},
+			want: func(c Config) bool { return c.StaleAfterDays == 20 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			path := ""
+			if tt.file {
+				path = file
+			}
+			cfg, warnings, err := loadConfig(path, tt.flags)
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if len(warnings) > 0 {
+				t.Errorf("loadConfig() warnings = %q", warnings)
+			}
+			if !tt.want(cfg) {
+				t.Errorf("loadConfig() = %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigProblems(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		flags   map[string]string
+		errs    []string
+		warning string
+	}{
+		{
+			name:    "unknown key warns",
+			content: "stale_after_dayz: 3\n",
+			warning: `unknown config key "stale_after_dayz" (line 1)`,
+		},
+		{
+			name:    "every bad value at once",
+			content: "stale_after_days: many\nhttp:\n  drain_timeout: soon\n",
+			errs:    []string{"stale_after_days (line 1)", "http.drain_timeout (line 3)", "a duration"},
+		},
+		{
+			name: "bad environment value names the variable",
+			env:  map[string]string{"STRICT_QUERY": "maybe"},
+			errs: []string{"strict_query (from STRICT_QUERY)", "true or false"},
+		},
+		{
+			name:  "bad flag value names the flag",
+			flags: map[string]string{"stale_after_days": "x"},
+			errs:  []string{"stale_after_days (from -stale_after_days)", "an integer"},
+		},
+		{
+			name:    "missing environment reference",
+			content: "admin:\n  key: ${TODO_TEST_UNSET_VARIABLE}\n",
+			errs:    []string{"TODO_TEST_UNSET_VARIABLE is not set"},
+		},
+		{
+			name:  "validation",
+			flags: map[string]string{"stale_after_days": "0"},
+			errs:  []string{"stale_after_days: expected a number of days"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			path := ""
+			if tt.content != "" {
+				path = writeConfigFile(t, tt.content)
+			}
+			_, warnings, err := loadConfig(path, tt.flags)
+			if tt.warning != "" && !slices.Contains(warnings, tt.warning) {
+				t.Errorf("loadConfig() warnings = %q, want %q", warnings, tt.warning)
+			}
+			if len(tt.errs) == 0 && err != nil {
+				t.Errorf("loadConfig() error = %v", err)
+			}
+			for _, want := range tt.errs {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("loadConfig() error = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Error("loadConfig() accepted a missing file")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// a confirmed count may be off by this many documents, or by 1% of the
+// affected ones if that is more, so a concurrent write doesn't void it
+const confirmTolerance = 5
+
+// confirmDestructive guards an operation that is about to remove or replace
+// affected of the total documents of a collection. Above the configured
+// thresholds the client has to echo the count with ?confirm=<count> or an
+// X-Confirm-Destructive header, otherwise the request is answered with 428
+// and the count to confirm. It reports whether the operation may go ahead.
+func confirmDestructive(rw http.ResponseWriter, r *http.Request, affected, total int64) bool {
+	if !needsConfirmation(currentConfig().Destructive, affected, total) {
+		return true
+	}
+
+	value := r.URL.Query().Get("confirm")
+	if value == "" {
+		value = r.Header.Get("X-Confirm-Destructive")
+	}
+	fields := renderer.M{"count": affected, "total": total}
+	if value == "" {
+		writeError(rw, r, http.StatusPreconditionRequired, "confirmation_required", fields)
+		return false
+	}
+
+	confirmed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_confirm", renderer.M{
+			"error": err.Error(),
+		})
+		return false
+	}
+	tolerance := max(confirmTolerance, affected/100)
+	if confirmed < affected-tolerance || confirmed > affected+tolerance {
+		writeError(rw, r, http.StatusPreconditionRequired, "confirmation_mismatch", fields)
+		return false
+	}
+	return true
+}
+
+// needsConfirmation applies the thresholds of cfg. The share of the
+// collection only counts once it holds more than max_count documents,
+// otherwise emptying a small list would always need a confirmation.
+func needsConfirmation(cfg DestructiveConfig, affected, total int64) bool {
+	if cfg.MaxCount > 0 && affected > cfg.MaxCount {
+		return true
+	}
+	return cfg.MaxPercent > 0 && total > cfg.MaxCount && affected*100 > total*cfg.MaxPercent
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// listCursor is the position after the last todo of a page: the values of
+// its sort key and a checksum of the query it was issued for. Clients get it
+// as opaque base64.
+type listCursor struct {
+	Starred bool            `json:"s"`
+	Key     json.RawMessage `json:"k"`
+	ID      string          `json:"i"`
+	Query   string          `json:"q"`
+}
+
+// the title index of the list is named this followed by its collation
+const titleOrderIndexPrefix string = "title_order"
+
+// listChecksum sums the view and the parameters that select and order the
+// todos, so a cursor can't continue a different list. Pagination parameters
+// are left out.
+func listChecksum(query url.Values, view string) string {
+	h := sha256.New()
+	h.Write([]byte("view=" + view + "\n"))
+	for _, param := range append([]string{"filter", "tz", "days", "collation"}, listParams...) {
+		h.Write([]byte(param + "=" + query.Get(param) + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// encodeCursor returns the cursor continuing after td in the list with the
+// given checksum, sorted by field.
+func encodeCursor(td TodoModel, field, checksum string) (string, error) {
+	var key interface{}
+	switch field {
+	case "title":
+		key = string(td.Title)
+	case "completed":
+		key = td.Completed
+	case "due_date":
+		key = td.DueDate
+	default:
+		key = td.CreatedAt
+	}
+	rawKey, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(listCursor{
+		Starred: td.Starred,
+		Key:     rawKey,
+		ID:      td.ID.Hex(),
+		Query:   checksum,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// cursorFilter decodes value and returns the filter selecting the todos after
+// it in the order of sort, as built by listSort. The filter is a range on the
+// compound sort key, so it can use an index on it. A cursor issued for a list
+// with another checksum, that is other filters or another order, is rejected.
+func cursorFilter(value, checksum string, sort bson.D) (bson.M, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+	if c.Query != checksum {
+		return nil, errors.New("the cursor was issued for other filters or another sort")
+	}
+	id, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	field, order := sort[1].Key, sort[1].Value.(int)
+	after := "$gt"
+	if order < 0 {
+		after = "$lt"
+	}
+
+	var key interface{}
+	switch field {
+	case "title":
+		var title string
+		err = json.Unmarshal(c.Key, &title)
+		key = title
+	case "completed":
+		var completed bool
+		err = json.Unmarshal(c.Key, &completed)
+		key = completed
+	default:
+		var t *time.Time
+		err = json.Unmarshal(c.Key, &t)
+		if t != nil {
+			key = *t
+		}
+	}
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	// todos without a due date come first in ascending order and last in
+	// descending order, and a range on null matches nothing
+	sameKey := bson.M{field: key}
+	var keyAfter bson.M
+	switch {
+	case key == nil && order > 0:
+		keyAfter = bson.M{field: bson.M{"$ne": nil}}
+	case key == nil:
+	case field == "due_date" && order < 0:
+		keyAfter = bson.M{"$or": bson.A{bson.M{field: bson.M{"$lt": key}}, bson.M{field: nil}}}
+	default:
+		keyAfter = bson.M{field: bson.M{after: key}}
+	}
+
+	// starred todos come first; todos from before starring have no flag
+	sameStarred := bson.M{"starred": bson.M{"$ne": true}}
+	if c.Starred {
+		sameStarred = bson.M{"starred": true}
+	}
+	or := bson.A{bson.M{"$and": bson.A{sameStarred, sameKey, bson.M{"id": bson.M{after: id}}}}}
+	if keyAfter != nil {
+		or = append(or, bson.M{"$and": bson.A{sameStarred, keyAfter}})
+	}
+	if c.Starred {
+		or = append(or, bson.M{"starred": bson.M{"$ne": true}})
+	}
+	return bson.M{"$or": or}, nil
+}
+
+// ensureListIndexes indexes the default order of the list, which cursors
+// continue with a range on it.
+func ensureListIndexes(ctx context.Context) error {
+	indexes := tenantDB(ctx).Collection(collectionName).Indexes()
+	_, err := indexes.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "starred", Value: -1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetName("list_order"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// a sort only uses an index built with its collation, so the title index
+	// is named after it and replaces the one of a former configuration
+	cfg := currentConfig().Collation
+	name := fmt.Sprintf("%s_%s_%d", titleOrderIndexPrefix, cfg.Locale, cfg.Strength)
+	if cfg.CaseLevel {
+		name += "_case"
+	}
+	cursor, err := indexes.List(ctx)
+	if err != nil {
+		return err
+	}
+	var existing []struct {
+		Name string `bson:"name"`
+	}
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	for _, index := range existing {
+		if strings.HasPrefix(index.Name, titleOrderIndexPrefix) && index.Name != name {
+			if _, err := indexes.DropOne(ctx, index.Name); err != nil {
+				return err
+			}
+		}
+	}
+	collation, _ := listCollation(url.Values{})
+	_, err = indexes.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "starred", Value: -1}, {Key: "title", Value: 1}, {Key: "id", Value: 1}},
+		Options: options.Index().SetName(name).SetCollation(collation),
+	})
+	return err
+}
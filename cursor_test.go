@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := primitive.NewObjectID()
+	created := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	due := time.Date(2026, 11, 1, 3, 0, 0, 0, time.UTC)
+	after := bson.M{"id": bson.M{"$gt": id}}
+	before := bson.M{"id": bson.M{"$lt": id}}
+	unstarred := bson.M{"starred": bson.M{"$ne": true}}
+	starred := bson.M{"starred": true}
+
+	tests := []struct {
+		name  string
+		td    TodoModel
+		field string
+		order int
+		want  bson.M
+	}{
+		{
+			name:  "created_at ascending",
+			td:    TodoModel{ID: id, CreatedAt: created},
+			field: "created_at",
+			order: 1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"created_at": created}, after}},
+				bson.M{"$and": bson.A{unstarred, bson.M{"created_at": bson.M{"$gt": created}}}},
+			}},
+		},
+		{
+			name:  "starred todo continues into the unstarred ones",
+			td:    TodoModel{ID: id, Starred: true, CreatedAt: created},
+			field: "created_at",
+			order: -1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{starred, bson.M{"created_at": created}, before}},
+				bson.M{"$and": bson.A{starred, bson.M{"created_at": bson.M{"$lt": created}}}},
+				unstarred,
+			}},
+		},
+		{
+			name:  "title",
+			td:    TodoModel{ID: id, Title: "buy milk"},
+			field: "title",
+			order: 1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"title": "buy milk"}, after}},
+				bson.M{"$and": bson.A{unstarred, bson.M{"title": bson.M{"$gt": "buy milk"}}}},
+			}},
+		},
+		{
+			name:  "completed",
+			td:    TodoModel{ID: id, Completed: true},
+			field: "completed",
+			order: 1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"completed": true}, after}},
+				bson.M{"$and": bson.A{unstarred, bson.M{"completed": bson.M{"$gt": true}}}},
+			}},
+		},
+		{
+			name:  "no due date ascending comes before every date",
+			td:    TodoModel{ID: id},
+			field: "due_date",
+			order: 1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"due_date": nil}, after}},
+				bson.M{"$and": bson.A{unstarred, bson.M{"due_date": bson.M{"$ne": nil}}}},
+			}},
+		},
+		{
+			name:  "no due date descending is last",
+			td:    TodoModel{ID: id},
+			field: "due_date",
+			order: -1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"due_date": nil}, before}},
+			}},
+		},
+		{
+			name:  "due date descending continues into no due date",
+			td:    TodoModel{ID: id, DueDate: &due},
+			field: "due_date",
+			order: -1,
+			want: bson.M{"$or": bson.A{
+				bson.M{"$and": bson.A{unstarred, bson.M{"due_date": due}, before}},
+				bson.M{"$and": bson.A{unstarred, bson.M{"$or": bson.A{
+					bson.M{"due_date": bson.M{"$lt": due}},
+					bson.M{"due_date": nil},
+				}}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := encodeCursor(tt.td, tt.field, "sum")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort := bson.D{{Key: "starred", Value: -1}, {Key: tt.field, Value: tt.order}, {Key: "id", Value: tt.order}}
+			got, err := cursorFilter(cursor, "sum", sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cursorFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorFilterRejects(t *testing.T) {
+	valid, err := encodeCursor(TodoModel{ID: primitive.NewObjectID(), CreatedAt: time.Now()}, "created_at", "sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort := bson.D{{Key: "starred", Value: -1}, {Key: "created_at", Value: 1}, {Key: "id", Value: 1}}
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name     string
+		cursor   string
+		checksum string
+		invalid  bool
+	}{
+		{"not base64", "!!!", "sum", true},
+		{"not json", encode("nope"), "sum", true},
+		{"bad id", encode(`{"k":"2026-10-15T12:00:00Z","i":"xyz","q":"sum"}`), "sum", true},
+		{"bad key", encode(`{"k":"yesterday","i":"652f1c2e9b1e8a0001a1b2c3","q":"sum"}`), "sum", true},
+		{"other list", valid, "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cursorFilter(tt.cursor, tt.checksum, sort)
+			if err == nil {
+				t.Fatal("cursorFilter() accepted the cursor")
+			}
+			if errors.Is(err, errInvalidCursor) != tt.invalid {
+				t.Errorf("cursorFilter() error = %v, want errInvalidCursor %v", err, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestListChecksum(t *testing.T) {
+	base := listChecksum(url.Values{"completed": {"false"}, "sort": {"title"}}, "")
+	tests := []struct {
+		name  string
+		query url.Values
+		view  string
+		same  bool
+	}{
+		{"same query", url.Values{"completed": {"false"}, "sort": {"title"}}, "", true},
+		{"pagination left out", url.Values{"completed": {"false"}, "sort": {"title"}, "limit": {"5"}, "page": {"2"}}, "", true},
+		{"other filter", url.Values{"completed": {"true"}, "sort": {"title"}}, "", false},
+		{"other sort", url.Values{"completed": {"false"}, "sort": {"-title"}}, "", false},
+		{"other view", url.Values{"completed": {"false"}, "sort": {"title"}}, "today", false},
+		{"other zone", url.Values{"completed": {"false"}, "sort": {"title"}, "tz": {"UTC"}}, "", false},
+	}
+	for _, tt := range tests {
+		if got := listChecksum(tt.query, tt.view); (got == base) != tt.same {
+			t.Errorf("%s: listChecksum() = %s, base %s, want same %v", tt.name, got, base, tt.same)
+		}
+	}
+}
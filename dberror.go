@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// how long clients are asked to wait when the database is unavailable
+const dbRetryAfter string = "5"
+
+// writeDBError responds to a failed database operation. Handlers answer
+// invalid input themselves; an error from the database is the server's
+// problem unless it says otherwise:
+//
+//   - a missing document is a 404 and a duplicate key a 409,
+//   - an unreachable or timed out database a 503 with Retry-After,
+//   - anything else a 500.
+func writeDBError(rw http.ResponseWriter, r *http.Request, err error, code string) {
+	status := dbErrorStatus(err)
+	if status == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", dbRetryAfter)
+	}
+	writeError(rw, r, status, code, renderer.M{
+		"error": err.Error(),
+	})
+}
+
+// dbErrorStatus picks the HTTP status for a database error.
+func dbErrorStatus(err error) int {
+	var selectionErr topology.ServerSelectionError
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments), errors.Is(err, gridfs.ErrFileNotFound):
+		return http.StatusNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return http.StatusConflict
+	case mongo.IsTimeout(err), mongo.IsNetworkError(err), errors.As(err, &selectionErr),
+		errors.Is(err, mongo.ErrClientDisconnected):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
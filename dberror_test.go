@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestDBErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no documents", mongo.ErrNoDocuments, http.StatusNotFound},
+		{"no documents, wrapped", fmt.Errorf("find todo: %w", mongo.ErrNoDocuments), http.StatusNotFound},
+		{"file not found", gridfs.ErrFileNotFound, http.StatusNotFound},
+		{"duplicate key", errDuplicate, http.StatusConflict},
+		{"deadline exceeded", context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{"network error", mongo.CommandError{Labels: []string{"NetworkError"}}, http.StatusServiceUnavailable},
+		{"no server selected", topology.ServerSelectionError{Wrapped: errors.New("no primary")}, http.StatusServiceUnavailable},
+		{"client disconnected", mongo.ErrClientDisconnected, http.StatusServiceUnavailable},
+		{"unauthorized", mongo.CommandError{Code: 13, Name: "Unauthorized"}, http.StatusInternalServerError},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := dbErrorStatus(tt.err); got != tt.want {
+			t.Errorf("%s: dbErrorStatus(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDBError(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"unavailable", mongo.ErrClientDisconnected, http.StatusServiceUnavailable, dbRetryAfter},
+		{"not found", mongo.ErrNoDocuments, http.StatusNotFound, ""},
+		{"failed", errors.New("boom"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			writeDBError(rw, httptest.NewRequest(http.MethodGet, "/todo", nil), tt.err, "todo_fetch_failed")
+			if rw.Code != tt.status {
+				t.Errorf("status = %d, want %d", rw.Code, tt.status)
+			}
+			if got := rw.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			var body struct{ Code, Error string }
+			if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != "todo_fetch_failed" || body.Error != tt.err.Error() {
+				t.Errorf("body = %+v, want code todo_fetch_failed and error %q", body, tt.err)
+			}
+		})
+	}
+}
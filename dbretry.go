@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	// attempts after the first of an operation failing transiently
+	dbRetries = 2
+	// the first retry waits this plus up to half as much again, each next
+	// one twice as long, so retrying adds at most about 225ms
+	dbRetryBackoff time.Duration = 50 * time.Millisecond
+)
+
+// server error codes of a replica set changing its primary or a node going
+// away, which the operation can be sent again after
+var transientDBCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+var dbRetriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_db_retries_total",
+		Help: "Database operations sent again after a transient failure, by operation.",
+	},
+	[]string{"operation"},
+)
+
+func init() {
+	prometheus.MustRegister(dbRetriesTotal)
+}
+
+// retryDB runs op and, should it fail transiently, up to dbRetries more
+// times after a short jittered wait, as long as ctx leaves time for it. This
+// is what a primary stepping down looks like for a moment, beyond the single
+// retry of the driver. op must be safe to run twice: a read, a delete by id,
+// an insert carrying an idempotency key, or an update only matching the
+// version it bumps, see updateTodoOnce. Bare inserts aren't retried.
+// operation names op in todo_db_retries_total.
+func retryDB(ctx context.Context, operation string, op func() error) error {
+	backoff := dbRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt == dbRetries || !transientDBError(err) {
+			return err
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff/2)))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		dbRetriesTotal.WithLabelValues(operation).Inc()
+		backoff *= 2
+	}
+}
+
+// transientDBError reports whether err is the kind of failure the same
+// operation may well not meet a moment later: no server to select, a
+// dropped connection, or a node that stepped down or is shutting down. Those
+// of the context itself are final.
+func transientDBError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) || mongo.IsNetworkError(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range transientDBCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+var (
+	errStepDown  = mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}
+	errDuplicate = mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "duplicate key"}}}
+)
+
+func TestTransientDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"primary stepped down", errStepDown, true},
+		{"not writable primary", mongo.CommandError{Code: 10107}, true},
+		{"interrupted by a replica set change", mongo.CommandError{Code: 11602}, true},
+		{"retryable write label", mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}, true},
+		{"transient transaction label", mongo.CommandError{Code: 251, Labels: []string{"TransientTransactionError"}}, true},
+		{"network error", mongo.CommandError{Labels: []string{"NetworkError"}}, true},
+		{"shutting down, in a write concern error", mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Code: 91}}, true},
+		{"no server selected", topology.ServerSelectionError{Wrapped: errors.New("no primary")}, true},
+		{"wrapped", fmt.Errorf("update todo: %w", errStepDown), true},
+		{"duplicate key", errDuplicate, false},
+		{"unauthorized", mongo.CommandError{Code: 13, Name: "Unauthorized"}, false},
+		{"no documents", mongo.ErrNoDocuments, false},
+		{"canceled", context.Canceled, false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"deadline exceeded around a transient error", errors.Join(context.DeadlineExceeded, errStepDown), false},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := transientDBError(tt.err); got != tt.want {
+			t.Errorf("%s: transientDBError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// sameError reports whether err is want. The driver's errors hold slices,
+// so errors.Is can't compare them.
+func sameError(err, want error) bool {
+	if err == nil || want == nil {
+		return err == want
+	}
+	return err.Error() == want.Error()
+}
+
+// failingOp returns an op failing with the errors in turn, then succeeding,
+// and the number of times it ran.
+func failingOp(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetryDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		errs    []error
+		timeout time.Duration
+		calls   int
+		err     error
+	}{
+		{name: "success", calls: 1},
+		{name: "recovers from a transient failure", errs: []error{errStepDown}, calls: 2},
+		{name: "recovers on the last attempt", errs: []error{errStepDown, errStepDown}, calls: dbRetries + 1},
+		{name: "gives up after dbRetries", errs: []error{errStepDown, errStepDown, errStepDown, errStepDown}, calls: dbRetries + 1, err: errStepDown},
+		{name: "final errors aren't retried", errs: []error{errDuplicate}, calls: 1, err: errDuplicate},
+		{name: "no time left for a wait", errs: []error{errStepDown}, timeout: time.Millisecond, calls: 1, err: errStepDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			op, calls := failingOp(tt.errs...)
+			err := retryDB(ctx, "test", op)
+			if !sameError(err, tt.err) {
+				t.Errorf("retryDB() error = %v, want %v", err, tt.err)
+			}
+			if *calls != tt.calls {
+				t.Errorf("op ran %d times, want %d", *calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryDBCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	op, calls := failingOp(errStepDown, errStepDown)
+	go func() {
+		time.Sleep(dbRetryBackoff / 5)
+		cancel()
+	}()
+	if err := retryDB(ctx, "test", op); !sameError(err, errStepDown) {
+		t.Errorf("retryDB() error = %v, want the failure of the op", err)
+	}
+	if *calls != 1 {
+		t.Errorf("op ran %d times after the context was canceled, want 1", *calls)
+	}
+}
+
+// The handlers wrapped in retryDB ride out a transient failure of the
+// database; a create is only sent again when its Idempotency-Key keeps it
+// from creating the todo twice.
+func TestHandlersRetryTransientFailures(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	td := newTodoModel("write report", time.Now().UTC())
+	// a state change like a step down would have the driver wait for the
+	// server to be checked again
+	const timeout, internal int32 = 89, 1
+
+	tests := []struct {
+		name, method, target, body, key string
+		command                         string
+		failures                        []int32
+		status, sent                    int
+	}{
+		{"keyed create", http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, "key-1", "insert", []int32{timeout}, http.StatusCreated, 2},
+		{"keyed create failing on", http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, "key-2", "insert",
+			[]int32{timeout, timeout, timeout, timeout}, http.StatusInternalServerError, dbRetries + 1},
+		{"bare create", http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, "", "insert", []int32{timeout}, http.StatusInternalServerError, 1},
+		{"keyed create final failure", http.MethodPost, "/api/v1/todo", `{"title":"write report"}`, "key-3", "insert", []int32{internal}, http.StatusInternalServerError, 1},
+		{"list", http.MethodGet, "/api/v1/todo", "", "", "find", []int32{timeout, timeout}, http.StatusOK, 3},
+		{"get", http.MethodGet, "/api/v1/todo/" + formatID(td.ID), "", "", "find", []int32{timeout, timeout}, http.StatusOK, 3},
+		{"delete", http.MethodDelete, "/api/v1/todo/" + formatID(td.ID), "", "", "findAndModify", []int32{timeout}, http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongo.seed(collectionName)
+			if tt.method != http.MethodPost {
+				mongo.seed(collectionName, td)
+			}
+			mongo.failNext(tt.command, tt.failures...)
+			t.Cleanup(func() {
+				mongo.mu.Lock()
+				defer mongo.mu.Unlock()
+				mongo.failures = nil
+			})
+			mongo.commands()
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", jsonContentType)
+			if tt.key != "" {
+				r.Header.Set(idempotencyKeyHeader, tt.key)
+			}
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if rw.Code != tt.status {
+				t.Fatalf("%s %s = %d: %s, want %d", tt.method, tt.target, rw.Code, rw.Body, tt.status)
+			}
+			var sent int
+			for _, cmd := range mongo.commands() {
+				if strings.EqualFold(cmd.Name, tt.command) && cmd.Collection == collectionName {
+					sent++
+				}
+			}
+			if sent != tt.sent {
+				t.Errorf("%s sent %d times, want %d", tt.command, sent, tt.sent)
+			}
+		})
+	}
+}
+
+// An update sent again after a transient failure only matches the version
+// the todo had before the first attempt, and an attempt that went through
+// with its answer lost isn't applied twice.
+func TestUpdateRetry(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	td := newTodoModel("write report", time.Now().UTC())
+	td.Version = 4
+	const timeout int32 = 89
+
+	tests := []struct {
+		name     string
+		fail     func()
+		status   int
+		modifies int
+	}{
+		{"failed before the write", func() { mongo.failNext("findAndModify", timeout) }, http.StatusOK, 2},
+		{"answer lost after the write", func() { mongo.loseNext("findAndModify", timeout) }, http.StatusOK, 2},
+		{"failing on", func() { mongo.failNext("findAndModify", timeout, timeout, timeout) }, http.StatusInternalServerError, dbRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongo.seed(collectionName, td)
+			tt.fail()
+			t.Cleanup(func() {
+				mongo.mu.Lock()
+				defer mongo.mu.Unlock()
+				mongo.failures, mongo.lost = nil, nil
+			})
+			mongo.commands()
+
+			r := httptest.NewRequest(http.MethodPut, "/api/v1/todo/"+formatID(td.ID), strings.NewReader(`{"title":"write the report"}`))
+			r.Header.Set("Content-Type", jsonContentType)
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if rw.Code != tt.status {
+				t.Fatalf("PUT = %d: %s, want %d", rw.Code, rw.Body, tt.status)
+			}
+
+			var modifies int
+			for _, cmd := range mongo.commands() {
+				if !strings.EqualFold(cmd.Name, "findAndModify") || cmd.Collection != collectionName {
+					continue
+				}
+				modifies++
+				if version, ok := cmd.Command.Lookup("query", "version").AsInt64OK(); !ok || version != td.Version {
+					t.Errorf("attempt %d matches version %s, want %d", modifies, cmd.Command.Lookup("query", "version"), td.Version)
+				}
+			}
+			if modifies != tt.modifies {
+				t.Errorf("findAndModify sent %d times, want %d", modifies, tt.modifies)
+			}
+		})
+	}
+}
+
+func TestDeleteRetryFindingTodoGone(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	td := newTodoModel("write report", time.Now().UTC())
+	mongo.seed(collectionName, td)
+	mongo.loseNext("findAndModify", 89)
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/todo/"+formatID(td.ID), nil)
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, r)
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d: %s, want %d", rw.Code, rw.Body, http.StatusNoContent)
+	}
+	if rw.Body.Len() != 0 {
+		t.Errorf("DELETE answered %q, want no body", rw.Body)
+	}
+
+	var deletes int
+	for _, cmd := range mongo.commands() {
+		if strings.EqualFold(cmd.Name, "findAndModify") && cmd.Collection == collectionName {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("findAndModify sent %d times, want 2", deletes)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// a deferral from now such as "12h", "3d" or "2w"
+var deferDurationPattern = regexp.MustCompile(`^(\d{1,4})([hdw])$`)
+
+type (
+	// defer todo; Until is a date, a timestamp or a duration from now
+	DeferTodo struct {
+		Until string `json:"until"`
+		// IANA name plain dates are read in, ?tz= or the configured timezone by default
+		Timezone string `json:"timezone"`
+	}
+	// a deferred todo, DeferredUntil is absent when the date given had passed
+	DeferResponse struct {
+		Message       string     `json:"message"`
+		DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+	}
+)
+
+// deferredFilter matches the open todos deferred past now, or with deferred
+// unset every other todo: those never deferred surface along with those
+// whose date has passed, without anything having to clear it.
+func deferredFilter(deferred bool, now time.Time) bson.M {
+	parked := bson.M{"completed": false, "deferred_until": bson.M{"$gt": now}}
+	if deferred {
+		return parked
+	}
+	return bson.M{"$nor": bson.A{parked}}
+}
+
+// parseDeferUntil resolves until as of now: a duration counts from now, in
+// calendar days for days and weeks, and a plain date is midnight in loc.
+func parseDeferUntil(until string, now time.Time, loc *time.Location) (time.Time, bool) {
+	if m := deferDurationPattern.FindStringSubmatch(strings.ToLower(until)); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "h":
+			return now.Add(time.Duration(n) * time.Hour).UTC(), true
+		case "w":
+			n *= 7
+		}
+		return now.In(loc).AddDate(0, 0, n).UTC(), true
+	}
+	date := DateInput{raw: until}
+	if !date.Valid() {
+		return time.Time{}, false
+	}
+	return date.In(loc), true
+}
+
+// deferTodo parks an open todo until a date or for a duration, leaving it
+// out of the lists, views and overdue filter until then. Deferring to a time
+// already past takes the deferral back.
+func deferTodo(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var deferReq DeferTodo
+	if err := decodeJSON(r, &deferReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	// report every problem of the body at once
+	problems := newFieldErrors(r)
+	if deferReq.Timezone != "" {
+		if bodyLoc, err := loadTimezone(deferReq.Timezone); err != nil {
+			problems.add("timezone", "invalid_timezone", nil)
+		} else {
+			loc = bodyLoc
+		}
+	}
+	now := time.Now()
+	value := strings.TrimSpace(deferReq.Until)
+	until, ok := parseDeferUntil(value, now, loc)
+	switch {
+	case value == "":
+		problems.add("until", "defer_until_required", nil)
+	case !ok:
+		problems.add("until", "invalid_defer_until", nil)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	// a completed todo matches nothing and is told apart below
+	filter := bson.M{"id": id, "completed": false}
+	update := bson.M{"$set": bson.M{"deferred_until": until, "updated_at": now.UTC()}}
+	deferred := until.After(now)
+	if !deferred {
+		update = bson.M{"$unset": bson.M{"deferred_until": ""}, "$set": bson.M{"updated_at": now.UTC()}}
+	}
+	var data *mongo.UpdateResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, bumpVersion(update))
+		if err != nil || data.MatchedCount == 0 {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_defer_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeDeferRejection(rw, r, id)
+		return
+	}
+
+	setTodoETag(rw, r, id)
+	response := DeferResponse{Message: localize(r, "todo_undeferred")}
+	if deferred {
+		inZone := until.In(loc)
+		response = DeferResponse{Message: localize(r, "todo_deferred"), DeferredUntil: &inZone}
+	}
+	renderJSON(rw, r, http.StatusOK, response)
+}
+
+// writeDeferRejection explains why the todo id couldn't be deferred: it
+// doesn't exist or is completed.
+func writeDeferRejection(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	opts := options.FindOne().SetProjection(bson.M{"completed": 1})
+	err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}, opts).Err()
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+	case err != nil:
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "todo_defer_failed")
+	default:
+		writeError(rw, r, http.StatusConflict, "defer_todo_completed", nil)
+	}
+}
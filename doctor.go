@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// the doctor writes and removes a document here to prove write access
+const scratchCollectionName string = "doctor_scratch"
+
+var errSkipped = errors.New("skipped")
+
+// checkResult is one row of the doctor report.
+type checkResult struct {
+	name   string
+	detail string
+	err    error
+}
+
+// runDoctor runs every startup check, prints a PASS/FAIL table to out and
+// reports whether all of them passed.
+func runDoctor(out io.Writer, cfg Config, cfgErr error, timeout time.Duration) bool {
+	results := []checkResult{{name: "config", err: cfgErr}}
+
+	mongoClient, err := connectMongo(cfg, timeout)
+	results = append(results, checkResult{name: "mongo connection", detail: redactMongoURI(cfg.Mongo.URI), err: err})
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = checkDatabase(ctx, mongoClient.Database(dbName), true)
+		cancel()
+		mongoClient.Disconnect(context.Background())
+	} else {
+		err = errSkipped
+	}
+	results = append(results, checkResult{name: "mongo read/write", detail: dbName, err: err})
+
+	results = append(results,
+		checkResult{name: "templates", detail: cfg.HTMLDir, err: checkTemplates(cfg.HTMLDir)},
+		checkResult{name: "static files", detail: cfg.StaticDir, err: checkDir(cfg.StaticDir)},
+		checkResult{name: "listen address", detail: cfg.HTTP.Addr, err: checkListen(cfg.HTTP.Addr)},
+	)
+	if cfg.HTTP.AdminAddr != "" {
+		results = append(results, checkResult{name: "admin listen address", detail: cfg.HTTP.AdminAddr, err: checkListen(cfg.HTTP.AdminAddr)})
+	}
+
+	ok := true
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, res := range results {
+		status, detail := "PASS", res.detail
+		if res.err != nil {
+			ok = false
+			status = "FAIL"
+			if detail != "" {
+				detail += ": "
+			}
+			detail += res.err.Error()
+		}
+		// keep multi-line errors (e.g. several bad settings) on one row
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.name, status, strings.ReplaceAll(detail, "\n", "; "))
+	}
+	tw.Flush()
+
+	return ok
+}
+
+// checkDatabase pings the primary and reads from a scratch collection. With
+// write set it also inserts and deletes a document there. /readyz uses the
+// read-only variant.
+func checkDatabase(ctx context.Context, database *mongo.Database, write bool) error {
+	if err := database.Client().Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+
+	scratch := database.Collection(scratchCollectionName)
+	if !write {
+		err := scratch.FindOne(ctx, bson.M{}).Err()
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("read: %w", err)
+		}
+		return nil
+	}
+
+	id := primitive.NewObjectID()
+	if _, err := scratch.InsertOne(ctx, bson.M{"_id": id, "checked_at": time.Now()}); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := scratch.FindOne(ctx, bson.M{"_id": id}).Err(); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if _, err := scratch.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
+}
+
+// checkTemplates verifies the template directory holds at least one .html file.
+func checkTemplates(dir string) error {
+	if err := checkDir(dir); err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return errors.New("no .html templates found")
+	}
+	return nil
+}
+
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	return nil
+}
+
+// checkListen verifies addr can be bound. A unix socket that something is
+// still serving on counts as in use, while a stale one is fine since it gets
+// replaced at startup.
+func checkListen(addr string) error {
+	if path := socketPath(addr); path != "" {
+		if _, err := os.Lstat(path); err == nil {
+			conn, err := net.DialTimeout("unix", path, time.Second)
+			if err == nil {
+				conn.Close()
+				return errors.New("address already in use")
+			}
+			return nil
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		return ln.Close()
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// redactMongoURI hides the password of a connection string.
+func redactMongoURI(uri string) string {
+	scheme, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return uri
+	}
+	userinfo, hosts, found := strings.Cut(rest, "@")
+	if !found {
+		return uri
+	}
+	if user, _, hasPassword := strings.Cut(userinfo, ":"); hasPassword {
+		userinfo = user + ":xxxxx"
+	}
+	return scheme + "://" + userinfo + "@" + hosts
+}
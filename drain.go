@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// draining is set between POST /admin/drain and /admin/undrain, see
+	// setDraining.
+	draining atomic.Bool
+	// drainableServer is the server of http.addr, whose keep-alives a drain
+	// switches off; nil until main sets it.
+	drainableServer *http.Server
+
+	drainingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_draining",
+		Help: "1 while the instance is drained ahead of a shutdown, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(drainingGauge)
+}
+
+// the state of the drain after a switch
+type DrainResponse struct {
+	Message  string `json:"message"`
+	Draining bool   `json:"draining"`
+}
+
+// setDraining drains the instance or stops draining it. While it drains,
+// /readyz answers 503 so load balancers move new connections elsewhere,
+// connections are closed after their response instead of being kept alive
+// and the background jobs skip their scheduled runs. Requests keep being
+// served until the actual shutdown.
+func setDraining(enabled bool) {
+	draining.Store(enabled)
+	if drainableServer != nil {
+		drainableServer.SetKeepAlivesEnabled(!enabled)
+	}
+	if enabled {
+		drainingGauge.Set(1)
+	} else {
+		drainingGauge.Set(0)
+	}
+}
+
+// closeWhileDraining asks clients to close their connection after the
+// response while the instance drains, so connections kept alive before the
+// drain move over too.
+func closeWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			rw.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// drainHandler drains the instance when enabled is set and stops draining
+// it otherwise.
+func drainHandler(enabled bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		action := "drain.disable"
+		if enabled {
+			action = "drain.enable"
+		}
+		auditID, err := beginAudit(r, action)
+		if err != nil {
+			logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+			writeDBError(rw, r, err, "audit_failed_drain")
+			return
+		}
+
+		setDraining(enabled)
+		finishAudit(r.Context(), auditID, 0, nil)
+		log.Printf("draining set to %t by %s\n", enabled, clientIP(r))
+
+		renderJSON(rw, r, http.StatusOK, DrainResponse{
+			Message:  localize(r, "drain_updated"),
+			Draining: enabled,
+		})
+	}
+}
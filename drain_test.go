@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+// A drain closes kept-alive connections after their response and turns the
+// instance unready, while it goes on serving; an undrain reverses both.
+func TestDrain(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	srv := httptest.NewUnstartedServer(router)
+	prevServer := drainableServer
+	drainableServer = srv.Config
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		drainableServer = prevServer
+		setDraining(false)
+	})
+	prevListening := listening.Load()
+	listening.Store(true)
+	t.Cleanup(func() { listening.Store(prevListening) })
+	ops := adminHandlers()
+
+	// send makes a request, reporting whether it went over a connection kept
+	// alive from an earlier one
+	send := func(method, path string) (*http.Response, bool) {
+		t.Helper()
+		var reused bool
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		r, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+		r.Header.Set("X-Admin-Key", testAdminKey)
+		resp, err := srv.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp, reused
+	}
+	ready := func() int {
+		rw := httptest.NewRecorder()
+		ops.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rw.Code
+	}
+
+	send(http.MethodGet, "/healthz")
+	if _, reused := send(http.MethodGet, "/healthz"); !reused || ready() != http.StatusOK {
+		t.Fatalf("before the drain: connection reused %v, /readyz %d", reused, ready())
+	}
+
+	if resp, _ := send(http.MethodPost, "/admin/drain"); resp.StatusCode != http.StatusOK || !resp.Close {
+		t.Fatalf("POST /admin/drain = %d, closing %v", resp.StatusCode, resp.Close)
+	}
+	for i := 0; i < 2; i++ {
+		resp, reused := send(http.MethodGet, "/healthz")
+		if resp.StatusCode != http.StatusOK || !resp.Close || reused {
+			t.Errorf("while draining: %d, closing %v, connection reused %v, want served on a new connection closed after", resp.StatusCode, resp.Close, reused)
+		}
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining = %d, want 503", got)
+	}
+	if got := metricValue(t, "todo_draining", nil); got != 1 {
+		t.Errorf("todo_draining = %v while draining", got)
+	}
+
+	if resp, _ := send(http.MethodPost, "/admin/undrain"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /admin/undrain = %d", resp.StatusCode)
+	}
+	send(http.MethodGet, "/healthz")
+	if resp, reused := send(http.MethodGet, "/healthz"); resp.Close || !reused || ready() != http.StatusOK {
+		t.Errorf("after the undrain: closing %v, connection reused %v, /readyz %d", resp.Close, reused, ready())
+	}
+	if got := metricValue(t, "todo_draining", nil); got != 0 {
+		t.Errorf("todo_draining = %v after the undrain", got)
+	}
+}
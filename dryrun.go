@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how many of the affected todos a dry run lists
+const dryRunSample = 20
+
+// the response of a bulk operation run with ?dry_run=true
+type DryRunResponse struct {
+	Message       string   `json:"message"`
+	DryRun        bool     `json:"dry_run"`
+	AffectedCount int64    `json:"affected_count"`
+	Sample        []string `json:"sample"`
+	// whether the real operation would have to be confirmed, see confirmDestructive
+	ConfirmationRequired bool `json:"confirmation_required,omitempty"`
+}
+
+// parseDryRun reads ?dry_run, with which a bulk operation does everything up
+// to its first write and answers with what it would have changed instead.
+// An invalid value is answered with 400 and ok is false.
+func parseDryRun(rw http.ResponseWriter, r *http.Request) (dryRun, ok bool) {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, true
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_dry_run", nil)
+		return false, false
+	}
+	return dryRun, true
+}
+
+// writeDryRun answers a dry run that would have affected the todos ids.
+func writeDryRun(rw http.ResponseWriter, r *http.Request, ids []primitive.ObjectID, confirm bool) {
+	renderJSON(rw, r, http.StatusOK, DryRunResponse{
+		Message:              localize(r, "dry_run_completed"),
+		DryRun:               true,
+		AffectedCount:        int64(len(ids)),
+		Sample:               formatIDs(ids[:min(len(ids), dryRunSample)]),
+		ConfirmationRequired: confirm,
+	})
+}
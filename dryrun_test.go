@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mutations are the commands that change documents.
+var mutations = map[string]bool{"insert": true, "update": true, "delete": true, "findAndModify": true}
+
+// A dry run goes through everything a bulk operation does up to its first
+// write and changes nothing, audit log included.
+func TestDryRunWritesNothing(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	now := time.Now().UTC()
+	first, second := newTodoModel("write report", now), newTodoModel("call ana", now)
+	mongo.seed(collectionName, first, second)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"delete completed", http.MethodDelete, "/api/v1/todo/completed", ""},
+		{"rename tag", http.MethodPost, "/api/v1/todo/tags/rename", `{"from":"work","to":"job"}`},
+		{"merge tags", http.MethodPost, "/api/v1/todo/tags/merge", `{"sources":["work","office"],"target":"job"}`},
+		{"delete tag", http.MethodDelete, "/api/v1/todo/tags/work", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serve := func(query string) (*httptest.ResponseRecorder, int) {
+				r := httptest.NewRequest(tt.method, tt.path+query, strings.NewReader(tt.body))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("X-Confirm-Destructive", "2")
+				rw := httptest.NewRecorder()
+				mongo.commands()
+				router.ServeHTTP(rw, r)
+				writes := 0
+				for _, cmd := range mongo.commands() {
+					if mutations[cmd.Name] {
+						writes++
+					}
+				}
+				return rw, writes
+			}
+
+			rw, writes := serve("?dry_run=true")
+			if rw.Code != http.StatusOK {
+				t.Fatalf("dry run = %d: %s", rw.Code, rw.Body)
+			}
+			if writes != 0 {
+				t.Errorf("dry run sent %d writes", writes)
+			}
+			var resp DryRunResponse
+			if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := formatID(first.ID) + " " + formatID(second.ID)
+			if !resp.DryRun || resp.AffectedCount != 2 || strings.Join(resp.Sample, " ") != want {
+				t.Errorf("dry run answered %+v, want the 2 seeded todos", resp)
+			}
+
+			// the same request for real does write
+			if _, writes := serve(""); writes == 0 {
+				t.Error("the operation sent no writes, so the dry run proves nothing")
+			}
+		})
+	}
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/api/v1/todo/completed?dry_run=maybe", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("dry_run=maybe = %d, want 400", rw.Code)
+	}
+}
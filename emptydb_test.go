@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// wire protocol opcodes
+const (
+	opReply int32 = 1
+	opQuery int32 = 2004
+	opMsg   int32 = 2013
+)
+
+// emptyMongo is a MongoDB server on a local port holding no documents at
+// all. It answers the commands the handlers send as a standalone server with
+// empty collections would, enough to see what they make of nothing, and
+// records them.
+type emptyMongo struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	received []mongoCommand
+	// what find, aggregate and findAndModify answer on a collection instead
+	// of nothing, and how many findAndModify matched
+	seeded   map[string]bson.A
+	modified map[string]int
+	// called with the collection once a findAndModify matched, to change
+	// what the next commands find as a concurrent writer would
+	afterModify func(collection string)
+	// set to answer as a replica set member: replies carry an operationTime
+	// and $clusterTime, which tick with every command, and snapshot reads
+	// the time they read at
+	operationTimes bool
+	clock          uint32
+	// error codes the next commands of a name fail with, one each
+	failures map[string][]int32
+	// error codes the next commands of a name answer with after taking
+	// effect, one each
+	lost map[string][]int32
+}
+
+// failNext makes the next commands named name fail with codes, one each.
+func (m *emptyMongo) failNext(name string, codes ...int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures == nil {
+		m.failures = map[string][]int32{}
+	}
+	m.failures[strings.ToLower(name)] = append(m.failures[strings.ToLower(name)], codes...)
+}
+
+// loseNext makes the next commands named name take effect and then answer
+// with codes, one each, as a reply lost on the way back would.
+func (m *emptyMongo) loseNext(name string, codes ...int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lost == nil {
+		m.lost = map[string][]int32{}
+	}
+	m.lost[strings.ToLower(name)] = append(m.lost[strings.ToLower(name)], codes...)
+}
+
+// seed makes find and aggregate on collection answer docs, whatever their
+// filter or pipeline, and a count those its equality conditions match, so a
+// test can hand a handler the documents a query would have found.
+// findAndModify matches each of them once, in order, as if its update made
+// the document stop matching.
+func (m *emptyMongo) seed(collection string, docs ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seeded == nil {
+		m.seeded, m.modified = map[string]bson.A{}, map[string]int{}
+	}
+	m.seeded[collection] = append(bson.A{}, docs...)
+	m.modified[collection] = 0
+}
+
+// mongoCommand is a command an emptyMongo received.
+type mongoCommand struct {
+	Name, Database, Collection string
+	Command                    bson.Raw
+}
+
+// commands returns the commands received since the last call.
+func (m *emptyMongo) commands() []mongoCommand {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	received := m.received
+	m.received = nil
+	return received
+}
+
+func newEmptyMongo(t *testing.T) *emptyMongo {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on a local port: %v", err)
+	}
+	m := &emptyMongo{listener: listener}
+	go m.accept()
+	t.Cleanup(func() { listener.Close() })
+	return m
+}
+
+func (m *emptyMongo) accept() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.serve(conn)
+	}
+}
+
+// serve answers the messages of one connection until the driver closes it.
+func (m *emptyMongo) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int32(binary.LittleEndian.Uint32(header))
+		requestID := int32(binary.LittleEndian.Uint32(header[4:]))
+		opcode := int32(binary.LittleEndian.Uint32(header[12:]))
+		body := make([]byte, length-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var reply []byte
+		switch opcode {
+		case opQuery:
+			// flags, then the collection name, skip and limit before the command
+			name := bytes.IndexByte(body[4:], 0)
+			doc := body[4+name+1+8:]
+			reply = binary.LittleEndian.AppendUint32(nil, 0)   // response flags
+			reply = binary.LittleEndian.AppendUint64(reply, 0) // cursor id
+			reply = binary.LittleEndian.AppendUint32(reply, 0) // starting from
+			reply = binary.LittleEndian.AppendUint32(reply, 1) // documents
+			reply = append(reply, m.answer(bson.Raw(doc))...)
+			opcode = opReply
+		case opMsg:
+			// flags, then a body section and the document sequences
+			reply = binary.LittleEndian.AppendUint32(nil, 0)
+			reply = append(reply, 0)
+			reply = append(reply, m.answer(msgCommand(body))...)
+		default:
+			return
+		}
+
+		out := binary.LittleEndian.AppendUint32(nil, uint32(16+len(reply)))
+		out = binary.LittleEndian.AppendUint32(out, 0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(requestID))
+		out = binary.LittleEndian.AppendUint32(out, uint32(opcode))
+		if _, err := conn.Write(append(out, reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// msgCommand returns the command of an OP_MSG body, with the documents of
+// its sequences, such as those of an insert, as array fields of the command
+// like the driver would have sent them without sequences.
+func msgCommand(body []byte) bson.Raw {
+	cmd := bson.Raw(body[5:])
+	size := len(cmd)
+	if doc, _, ok := bsoncore.ReadDocument(body[5:]); ok {
+		size = len(doc)
+	}
+	rest := body[5+size:]
+	if binary.LittleEndian.Uint32(body)&1 != 0 {
+		// the checksum
+		rest = rest[:len(rest)-4]
+	}
+	if len(rest) == 0 {
+		return cmd
+	}
+
+	var fields bson.D
+	if err := bson.Unmarshal(cmd[:size], &fields); err != nil {
+		return cmd
+	}
+	for len(rest) > 5 && rest[0] == 1 {
+		length := int(binary.LittleEndian.Uint32(rest[1:]))
+		section := rest[5 : 1+length]
+		name := bytes.IndexByte(section, 0)
+		docs := bson.A{}
+		for section = section[name+1:]; len(section) > 0; {
+			doc, next, ok := bsoncore.ReadDocument(section)
+			if !ok {
+				break
+			}
+			docs = append(docs, bson.Raw(doc))
+			section = next
+		}
+		fields = append(fields, bson.E{Key: string(rest[5 : 5+name]), Value: docs})
+		rest = rest[1+length:]
+	}
+	merged, err := bson.Marshal(fields)
+	if err != nil {
+		return cmd
+	}
+	return merged
+}
+
+// answer replies to the command cmd.
+func (m *emptyMongo) answer(cmd bson.Raw) []byte {
+	elements, _ := cmd.Elements()
+	name := ""
+	if len(elements) > 0 {
+		name = elements[0].Key()
+	}
+	collection, _ := elements[0].Value().StringValueOK()
+	database, _ := cmd.Lookup("$db").StringValueOK()
+	ns := database + "." + collection
+	m.mu.Lock()
+	m.received = append(m.received, mongoCommand{
+		Name: name, Database: database, Collection: collection,
+		Command: slices.Clone(cmd),
+	})
+	seeded, isSeeded := m.seeded[collection]
+	var failure int32
+	if codes := m.failures[strings.ToLower(name)]; len(codes) > 0 {
+		failure, m.failures[strings.ToLower(name)] = codes[0], codes[1:]
+	}
+	var modified interface{}
+	if failure == 0 && strings.EqualFold(name, "findAndModify") && m.modified[collection] < len(seeded) {
+		modified = seeded[m.modified[collection]]
+		m.modified[collection]++
+	}
+	if codes := m.lost[strings.ToLower(name)]; failure == 0 && len(codes) > 0 {
+		failure, m.lost[strings.ToLower(name)] = codes[0], codes[1:]
+	}
+	afterModify := m.afterModify
+	var operationTime primitive.Timestamp
+	if m.operationTimes {
+		m.clock++
+		operationTime = primitive.Timestamp{T: 1700000000, I: m.clock}
+	}
+	m.mu.Unlock()
+	if modified != nil && afterModify != nil {
+		afterModify(collection)
+	}
+
+	if failure != 0 {
+		data, err := bson.Marshal(bson.M{"ok": 0, "code": failure, "errmsg": "injected failure"})
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+
+	reply := bson.M{"ok": 1}
+	switch strings.ToLower(name) {
+	case "hello", "ismaster":
+		reply = bson.M{
+			"ok": 1, "ismaster": true, "isWritablePrimary": true, "helloOk": true,
+			"maxBsonObjectSize": 16 * 1024 * 1024, "maxMessageSizeBytes": 48000000, "maxWriteBatchSize": 100000,
+			"localTime": time.Now(), "logicalSessionTimeoutMinutes": 30, "connectionId": 1,
+			"minWireVersion": 0, "maxWireVersion": 17,
+		}
+		if !operationTime.IsZero() {
+			reply["setName"] = "rs0"
+		}
+	case "find", "listcollections", "listindexes":
+		if !isSeeded {
+			seeded = bson.A{}
+		}
+		reply["cursor"] = bson.M{"id": int64(0), "ns": ns, "firstBatch": seeded}
+	case "aggregate":
+		switch {
+		case !isSeeded:
+			seeded = emptyAggregation(cmd)
+		case countsDocuments(cmd):
+			seeded = bson.A{bson.M{"_id": 1, "n": countMatching(cmd, seeded)}}
+		}
+		reply["cursor"] = bson.M{"id": int64(0), "ns": ns, "firstBatch": seeded}
+	case "count":
+		reply["n"] = 0
+	case "distinct":
+		reply["values"] = bson.A{}
+	case "insert", "update", "delete":
+		reply["n"] = 0
+		reply["nModified"] = 0
+	case "findandmodify":
+		reply["value"] = modified
+	}
+	if cursor, ok := reply["cursor"].(bson.M); ok && !operationTime.IsZero() {
+		if level, _ := cmd.Lookup("readConcern", "level").StringValueOK(); level == "snapshot" {
+			// a snapshot is read at the time asked for, else now
+			at := operationTime
+			if t, i, ok := cmd.Lookup("readConcern", "atClusterTime").TimestampOK(); ok {
+				at = primitive.Timestamp{T: t, I: i}
+			}
+			cursor["atClusterTime"] = at
+		}
+	}
+	if !operationTime.IsZero() {
+		reply["operationTime"] = operationTime
+		reply["$clusterTime"] = bson.M{
+			"clusterTime": operationTime,
+			"signature":   bson.M{"hash": primitive.Binary{Data: make([]byte, 20)}, "keyId": int64(0)},
+		}
+	}
+	data, err := bson.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// emptyAggregation returns what the pipeline of cmd yields without any
+// document: nothing, except that a $facet always yields one document, with
+// no results in each of its facets.
+func emptyAggregation(cmd bson.Raw) bson.A {
+	stages, _ := cmd.Lookup("pipeline").Array().Values()
+	for _, stage := range stages {
+		facet, ok := stage.Document().Lookup("$facet").DocumentOK()
+		if !ok {
+			continue
+		}
+		facets, _ := facet.Elements()
+		doc := bson.M{}
+		for _, f := range facets {
+			doc[f.Key()] = bson.A{}
+		}
+		return bson.A{doc}
+	}
+	return bson.A{}
+}
+
+// countsDocuments reports whether cmd is the aggregation of CountDocuments,
+// which ends by grouping everything into n.
+func countsDocuments(cmd bson.Raw) bool {
+	stages, _ := cmd.Lookup("pipeline").Array().Values()
+	if len(stages) == 0 {
+		return false
+	}
+	group, ok := stages[len(stages)-1].Document().Lookup("$group").DocumentOK()
+	if !ok {
+		return false
+	}
+	_, counts := group.Lookup("n").DocumentOK()
+	return counts
+}
+
+// countMatching returns how many of docs the $match of the CountDocuments
+// aggregation cmd matches, going by the fields it compares for equality
+// alone; operators are taken to match.
+func countMatching(cmd bson.Raw, docs bson.A) int {
+	stages, _ := cmd.Lookup("pipeline").Array().Values()
+	match, _ := stages[0].Document().Lookup("$match").DocumentOK()
+	conditions, _ := match.Elements()
+	var n int
+	for _, doc := range docs {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			panic(err)
+		}
+		matches := true
+		for _, c := range conditions {
+			if strings.HasPrefix(c.Key(), "$") {
+				continue
+			}
+			if d, ok := c.Value().DocumentOK(); ok {
+				if first, err := d.IndexErr(0); err == nil && strings.HasPrefix(first.Key(), "$") {
+					continue
+				}
+			}
+			if !bson.Raw(raw).Lookup(c.Key()).Equal(c.Value()) {
+				matches = false
+			}
+		}
+		if matches {
+			n++
+		}
+	}
+	return n
+}
+
+// useEmptyDatabase points the handlers at an emptyMongo.
+func useEmptyDatabase(t *testing.T) *emptyMongo {
+	t.Helper()
+	m := newEmptyMongo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+m.listener.Addr().String()).SetDirect(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevClient, prevDB := client, db
+	client, db = c, c.Database(dbName)
+	t.Cleanup(func() {
+		c.Disconnect(context.Background())
+		client, db = prevClient, prevDB
+	})
+	return m
+}
+
+// the query parameters some routes require
+var requiredParams = map[string]string{
+	"/grouped": "?by=tag",
+	"/search":  "?q=milk",
+}
+
+// emptyDatabasePaths returns the path of every GET route of routes with
+// its parameters filled in, one for each view.
+func emptyDatabasePaths(routes []Route) []string {
+	var paths []string
+	for _, route := range routes {
+		if !slices.Contains(route.Methods, http.MethodGet) {
+			continue
+		}
+		switch {
+		case strings.Contains(route.Pattern, "*"), route.Pattern == "/metrics":
+			// static files and Prometheus, no database behind them
+		case strings.Contains(route.Pattern, "{view}"):
+			for view := range todoViews {
+				paths = append(paths, strings.Replace(route.Pattern, "{view}", view, 1))
+			}
+		default:
+			path := strings.ReplaceAll(route.Pattern, "{id}", primitive.NewObjectID().Hex())
+			path = strings.ReplaceAll(path, "{token}", "none")
+			for suffix, query := range requiredParams {
+				if strings.HasSuffix(path, suffix) {
+					path += query
+				}
+			}
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// findNulls returns the JSON paths of the nulls in v.
+func findNulls(path string, v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return []string{path}
+	case map[string]interface{}:
+		var nulls []string
+		for name, value := range v {
+			nulls = append(nulls, findNulls(path+"."+name, value)...)
+		}
+		return nulls
+	case []interface{}:
+		var nulls []string
+		for _, value := range v {
+			nulls = append(nulls, findNulls(path+"[]", value)...)
+		}
+		return nulls
+	}
+	return nil
+}
+
+// emptyDatabaseRouter returns the router of the default configuration, with
+// testAdminKey as admin key and changed by configure, in front of an
+// emptyMongo, its GET paths and the emptyMongo.
+func emptyDatabaseRouter(t *testing.T, configure ...func(*Config)) (*chi.Mux, []string, *emptyMongo) {
+	t.Helper()
+	cfg, _, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Admin.Key = testAdminKey
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	useConfig(t, cfg)
+	useRenderer(t, nil)
+	m := useEmptyDatabase(t)
+	prevLimit := aggregationLimit
+	aggregationLimit = newConcurrencyLimiter("aggregation", cfg.Limits.Aggregations)
+	t.Cleanup(func() { aggregationLimit = prevLimit })
+
+	router := newRouter(cfg, &assetManifest{})
+	routes, err := routeTable(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, emptyDatabasePaths(routes), m
+}
+
+// Every GET route answers an empty database without a server error, with
+// [] for its lists and zeros for its counts rather than null.
+func TestEmptyDatabase(t *testing.T) {
+	router, paths, _ := emptyDatabaseRouter(t)
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("X-Admin-Key", testAdminKey)
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if rw.Code >= http.StatusInternalServerError {
+				t.Fatalf("GET %s = %d: %s", path, rw.Code, rw.Body)
+			}
+			if !strings.HasPrefix(rw.Header().Get("Content-Type"), "application/json") {
+				return
+			}
+			var body interface{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			for _, null := range findNulls("", body) {
+				t.Errorf("GET %s has null at %s", path, null)
+			}
+		})
+	}
+}
+
+// A todo, a template and what quick-add parsed list nothing as [].
+func TestEmptyLists(t *testing.T) {
+	useConfig(t, defaultConfig())
+	tests := []struct {
+		name   string
+		v      interface{}
+		fields []string
+	}{
+		{"todo", TodoModel{}.toTodo(time.UTC), []string{"tags", "reminders", "blocked_by"}},
+		{"quick-add", parseQuickAdd("buy milk", time.Now()), []string{"tags"}},
+		{"template item", TodoTemplateModel{Items: []TemplateItem{{Title: "pack"}}}.toTemplate().Items[0], []string{"tags"}},
+		{"template", TodoTemplateModel{}.toTemplate(), []string{"items"}},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range tt.fields {
+			if got := string(fields[field]); got != "[]" {
+				t.Errorf("%s: %s = %q, want []", tt.name, field, got)
+			}
+		}
+	}
+}
+
+// HEAD answers every GET route as GET does, without a body where the
+// handler knows it is HEAD.
+func TestHeadRequests(t *testing.T) {
+	router, paths, _ := emptyDatabaseRouter(t)
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("X-Admin-Key", testAdminKey)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw
+	}
+	for _, path := range paths {
+		get, head := serve(http.MethodGet, path), serve(http.MethodHead, path)
+		if head.Code != get.Code {
+			t.Errorf("HEAD %s = %d, GET = %d", path, head.Code, get.Code)
+		}
+	}
+
+	for _, path := range []string{"/api/v1/todo", "/api/v1/todo/views/today"} {
+		rw := serve(http.MethodHead, path)
+		if rw.Code != http.StatusOK || rw.Body.Len() != 0 {
+			t.Errorf("HEAD %s = %d with %d bytes, want 200 without a body", path, rw.Code, rw.Body.Len())
+		}
+		if got := rw.Header().Get("X-Total-Count"); got != "0" {
+			t.Errorf("HEAD %s: X-Total-Count = %q, want 0", path, got)
+		}
+	}
+	if rw := serve(http.MethodHead, "/api/v1/todo/"+primitive.NewObjectID().Hex()); rw.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a missing todo = %d, want 404", rw.Code)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// an encrypted title is stored as this, the id of its key, a colon and
+	// the base64 of the nonce and the ciphertext; title indexes as this and
+	// the hex of their HMAC
+	sealedPrefix string = "enc:"
+
+	// encryption keys shorter than this are refused by the configuration
+	minEncryptionKeyLength = 32
+	// todos the reencrypt job rewrites per round trip
+	reencryptBatchSize = 500
+)
+
+var (
+	errUnknownTitleKey = errors.New("title encrypted with a key missing from encryption.keys")
+	// the database only holds ciphertext to search and sort
+	errTitlesEncrypted = errors.New("titles are encrypted at rest")
+)
+
+// sealedText is a todo or template item title as stored. With encryption.keys it is written
+// encrypted with AES-GCM under the first key and read back with the key it
+// names, so everything above the driver sees the plain title.
+type sealedText string
+
+func (t sealedText) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	stored, err := sealTitle(string(t), currentConfig().Encryption.Keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(stored)
+}
+
+func (t *sealedText) UnmarshalBSONValue(typ bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: typ, Value: data}
+	if typ == bsontype.Null || typ == bsontype.Undefined {
+		*t = ""
+		return nil
+	}
+	stored, ok := raw.StringValueOK()
+	if !ok {
+		return fmt.Errorf("cannot decode %v into a title", typ)
+	}
+	title, err := openTitle(stored, currentConfig().Encryption.Keys)
+	if err != nil {
+		return err
+	}
+	*t = sealedText(title)
+	return nil
+}
+
+// titlesEncrypted reports whether titles are written encrypted, which rules
+// out searching and sorting by them in the database.
+func titlesEncrypted() bool {
+	return len(currentConfig().Encryption.Keys) > 0
+}
+
+// titleKeyID names key in the titles it encrypts, without giving it away.
+func titleKeyID(key string) string {
+	sum := sha256.Sum256([]byte("title key id\x00" + key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// sealTitle encrypts title under the first of keys with a random nonce,
+// binding it to the key id. Without keys the title is stored as it is.
+func sealTitle(title string, keys []string) (string, error) {
+	if len(keys) == 0 {
+		return title, nil
+	}
+	// the same AES-256-GCM construction as the backups
+	aead, err := backupAEAD(keys[0])
+	if err != nil {
+		return "", err
+	}
+	id := titleKeyID(keys[0])
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(title), []byte(id))
+	return sealedPrefix + id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openTitle decrypts a title sealTitle encrypted with one of keys. Titles
+// written before encryption was turned on are returned as they are.
+func openTitle(stored string, keys []string) (string, error) {
+	id, data, ok := parseSealed(stored)
+	if !ok {
+		return stored, nil
+	}
+	for _, key := range keys {
+		if titleKeyID(key) != id {
+			continue
+		}
+		aead, err := backupAEAD(key)
+		if err != nil {
+			return "", err
+		}
+		if len(data) < aead.NonceSize() {
+			return "", errors.New("encrypted title is truncated")
+		}
+		title, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(id))
+		if err != nil {
+			return "", fmt.Errorf("decrypt title: %w", err)
+		}
+		return string(title), nil
+	}
+	return "", fmt.Errorf("%w: key id %s", errUnknownTitleKey, id)
+}
+
+// parseSealed splits an encrypted title into its key id and sealed bytes.
+func parseSealed(stored string) (id string, data []byte, ok bool) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return "", nil, false
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok || len(id) != 8 {
+		return "", nil, false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", nil, false
+	}
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, false
+	}
+	return id, data, true
+}
+
+// titleIndex is what normalized_title holds for title: its normalizeTitle
+// form, or with encryption.keys an HMAC of it under the first key, which
+// still finds duplicates but not substrings.
+func titleIndex(title string) string {
+	normalized := normalizeTitle(title)
+	keys := currentConfig().Encryption.Keys
+	if len(keys) == 0 {
+		return normalized
+	}
+	mac := hmac.New(sha256.New, []byte(keys[0]))
+	mac.Write([]byte(normalized))
+	return sealedPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// reencryptJob brings the titles of every tenant, those of template items
+// included, under the first of encryption.keys, see reencryptTitles. It runs when asked to through
+// /admin/jobs.
+func reencryptJob(tenants []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, tenantCtx := range tenantContexts(ctx, tenants) {
+			for _, name := range []string{collectionName, mergedCollectionName} {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				count, err := reencryptTitles(tenantCtx, name)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("reencrypt %s.%s: %w", tenantDB(tenantCtx).Name(), name, err))
+				}
+				if count > 0 {
+					log.Printf("reencrypted %d titles in %s.%s\n", count, tenantDB(tenantCtx).Name(), name)
+				}
+			}
+			count, err := reencryptTemplates(tenantCtx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("reencrypt %s.%s: %w", tenantDB(tenantCtx).Name(), templateCollectionName, err))
+			}
+			if count > 0 {
+				log.Printf("reencrypted %d templates in %s.%s\n", count, tenantDB(tenantCtx).Name(), templateCollectionName)
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// reencryptTitles rewrites the titles, former titles and title indexes of
+// the todos in the collection name that aren't under the first of
+// encryption.keys, a batch at a time: encrypting plain ones, moving those of
+// a former key to it and, without keys, decrypting them all. A todo changed
+// since its batch was read is left for the next run. It returns how many
+// todos it rewrote.
+func reencryptTitles(ctx context.Context, name string) (int64, error) {
+	coll := tenantDB(ctx).Collection(name)
+	stale := staleTitleFilter(currentConfig().Encryption.Keys)
+	var count int64
+	for {
+		cursor, err := coll.Find(ctx, stale, options.Find().SetLimit(reencryptBatchSize))
+		if err != nil {
+			return count, err
+		}
+		var batch []bson.Raw
+		if err := cursor.All(ctx, &batch); err != nil {
+			return count, err
+		}
+		if len(batch) == 0 {
+			return count, nil
+		}
+
+		models := make([]mongo.WriteModel, 0, len(batch))
+		for _, doc := range batch {
+			var td struct {
+				ID             primitive.ObjectID `bson:"id"`
+				Title          sealedText         `bson:"title"`
+				PreviousTitles []PreviousTitle    `bson:"previous_titles"`
+			}
+			if err := bson.Unmarshal(doc, &td); err != nil {
+				return count, fmt.Errorf("todo %s: %w", doc.Lookup("id"), err)
+			}
+			for i := range td.PreviousTitles {
+				td.PreviousTitles[i].Normalized = titleIndex(string(td.PreviousTitles[i].Title))
+			}
+			set := bson.M{"title": td.Title, "normalized_title": titleIndex(string(td.Title))}
+			if td.PreviousTitles != nil {
+				set["previous_titles"] = td.PreviousTitles
+			}
+			// matching the stored title leaves a todo renamed meanwhile alone
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"id": td.ID, "title": doc.Lookup("title")}).
+				SetUpdate(bson.M{"$set": set}))
+		}
+		result, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			count += result.ModifiedCount
+		}
+		if err != nil {
+			return count, err
+		}
+		if result.ModifiedCount == 0 {
+			// every todo of the batch changed under us, the next run gets them
+			return count, nil
+		}
+	}
+}
+
+// staleTitleFilter matches the todos with a title or former title not under
+// the first of keys, or not plain without keys.
+func staleTitleFilter(keys []string) bson.M {
+	stale := staleTitle(keys)
+	return bson.M{"$or": bson.A{
+		bson.M{"title": stale},
+		bson.M{"previous_titles": bson.M{"$elemMatch": bson.M{"title": stale}}},
+	}}
+}
+
+// staleTitle matches a stored title not under the first of keys, or not plain
+// without keys.
+func staleTitle(keys []string) bson.M {
+	if len(keys) == 0 {
+		return bson.M{"$type": "string", "$regex": "^" + regexp.QuoteMeta(sealedPrefix)}
+	}
+	current := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(sealedPrefix+titleKeyID(keys[0])+":")}
+	return bson.M{"$type": "string", "$not": current}
+}
+
+// reencryptTemplates rewrites the items of the templates with an item title
+// not under the first of encryption.keys, as reencryptTitles does for todos.
+// It returns how many templates it rewrote.
+func reencryptTemplates(ctx context.Context) (int64, error) {
+	coll := tenantDB(ctx).Collection(templateCollectionName)
+	stale := bson.M{"items": bson.M{"$elemMatch": bson.M{"title": staleTitle(currentConfig().Encryption.Keys)}}}
+	var count int64
+	for {
+		cursor, err := coll.Find(ctx, stale, options.Find().SetLimit(reencryptBatchSize))
+		if err != nil {
+			return count, err
+		}
+		var batch []bson.Raw
+		if err := cursor.All(ctx, &batch); err != nil {
+			return count, err
+		}
+		if len(batch) == 0 {
+			return count, nil
+		}
+
+		models := make([]mongo.WriteModel, 0, len(batch))
+		for _, doc := range batch {
+			var tmpl TodoTemplateModel
+			if err := bson.Unmarshal(doc, &tmpl); err != nil {
+				return count, fmt.Errorf("template %s: %w", doc.Lookup("_id"), err)
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": tmpl.ID, "items": doc.Lookup("items")}).
+				SetUpdate(bson.M{"$set": bson.M{"items": tmpl.Items}}))
+		}
+		result, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			count += result.ModifiedCount
+		}
+		if err != nil {
+			return count, err
+		}
+		if result.ModifiedCount == 0 {
+			return count, nil
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSealTitle(t *testing.T) {
+	oldKey := strings.Repeat("o", minEncryptionKeyLength)
+	newKey := strings.Repeat("n", minEncryptionKeyLength)
+	otherKey := strings.Repeat("x", minEncryptionKeyLength)
+	seal := func(title string, keys ...string) string {
+		stored, err := sealTitle(title, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	sealedOld := seal("buy milk", oldKey)
+	sealedNew := seal("buy milk", newKey)
+	id, data, _ := parseSealed(sealedNew)
+
+	tests := []struct {
+		name   string
+		stored string
+		keys   []string
+		want   string
+		err    bool
+	}{
+		{name: "round trip", stored: sealedNew, keys: []string{newKey}, want: "buy milk"},
+		{name: "unicode round trip", stored: seal("café ☕ 日本", newKey), keys: []string{newKey}, want: "café ☕ 日本"},
+		{name: "empty title", stored: seal("", newKey), keys: []string{newKey}, want: ""},
+		{name: "after rotation", stored: sealedOld, keys: []string{newKey, oldKey}, want: "buy milk"},
+		{name: "rotated out key", stored: sealedOld, keys: []string{newKey}, err: true},
+		{name: "wrong key", stored: sealedNew, keys: []string{otherKey}, err: true},
+		{name: "no keys", stored: sealedNew, err: true},
+		{name: "plain title from before encryption", stored: "buy milk", keys: []string{newKey}, want: "buy milk"},
+		{name: "plain title without keys", stored: "buy milk", want: "buy milk"},
+		{name: "prefix alone stays plain", stored: "enc: not really", keys: []string{newKey}, want: "enc: not really"},
+		{name: "tampered", stored: sealedPrefix + id + ":" + tamper(data), keys: []string{newKey}, err: true},
+		{name: "truncated", stored: sealedPrefix + id + ":AAAA", keys: []string{newKey}, err: true},
+		{name: "moved to another key id", stored: strings.Replace(sealedOld, titleKeyID(oldKey), titleKeyID(newKey), 1), keys: []string{newKey}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := openTitle(tt.stored, tt.keys)
+			if (err != nil) != tt.err {
+				t.Fatalf("openTitle() error = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("openTitle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// tamper flips a bit of the ciphertext and encodes it as sealTitle does.
+func tamper(data []byte) string {
+	changed := append([]byte{}, data...)
+	changed[len(changed)-1] ^= 1
+	return base64.RawStdEncoding.EncodeToString(changed)
+}
+
+func TestSealTitleWithoutKeys(t *testing.T) {
+	stored, err := sealTitle("buy milk", nil)
+	if err != nil || stored != "buy milk" {
+		t.Errorf("sealTitle() = %q, %v, want the title as it is", stored, err)
+	}
+}
+
+func TestSealTitleNonce(t *testing.T) {
+	keys := []string{strings.Repeat("k", minEncryptionKeyLength)}
+	a, _ := sealTitle("buy milk", keys)
+	b, _ := sealTitle("buy milk", keys)
+	if a == b {
+		t.Error("sealTitle() gave the same ciphertext twice")
+	}
+	if strings.Contains(a, "milk") {
+		t.Errorf("sealTitle() = %q holds the plain title", a)
+	}
+}
+
+func TestUnknownTitleKey(t *testing.T) {
+	stored, _ := sealTitle("buy milk", []string{strings.Repeat("o", minEncryptionKeyLength)})
+	_, err := openTitle(stored, []string{strings.Repeat("n", minEncryptionKeyLength)})
+	if !errors.Is(err, errUnknownTitleKey) {
+		t.Errorf("openTitle() error = %v, want errUnknownTitleKey", err)
+	}
+}
+
+func TestSealedTextBSON(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Encryption.Keys = []string{strings.Repeat("k", minEncryptionKeyLength)}
+	useConfig(t, cfg)
+
+	doc, err := bson.Marshal(bson.M{"title": sealedText("buy milk")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := bson.Raw(doc).Lookup("title").StringValue(); !strings.HasPrefix(stored, sealedPrefix) {
+		t.Errorf("stored title = %q, want it encrypted", stored)
+	}
+	var decoded struct {
+		Title sealedText `bson:"title"`
+	}
+	if err := bson.Unmarshal(doc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Title != "buy milk" {
+		t.Errorf("decoded title = %q, want %q", decoded.Title, "buy milk")
+	}
+}
+
+func TestTitleIndex(t *testing.T) {
+	useConfig(t, defaultConfig())
+	plain := titleIndex("Buy  Milk")
+
+	cfg := defaultConfig()
+	cfg.Encryption.Keys = []string{strings.Repeat("k", minEncryptionKeyLength)}
+	useConfig(t, cfg)
+	keyed := titleIndex("Buy  Milk")
+	if keyed == plain || !strings.HasPrefix(keyed, sealedPrefix) {
+		t.Errorf("titleIndex() = %q with a key, want an HMAC", keyed)
+	}
+	if titleIndex("buy milk") != keyed {
+		t.Error("titleIndex() tells titles apart that normalize the same")
+	}
+}
+
+func TestTemplateItemTitleSealed(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Encryption.Keys = []string{strings.Repeat("k", minEncryptionKeyLength)}
+	useConfig(t, cfg)
+
+	doc, err := bson.Marshal(TodoTemplateModel{Name: "trip", Items: []TemplateItem{{Title: "pack"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := bson.Raw(doc).Lookup("items", "0", "title").StringValue()
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		t.Errorf("stored item title = %q, want it encrypted", stored)
+	}
+	var decoded TodoTemplateModel
+	if err := bson.Unmarshal(doc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Items[0].Title; got != "pack" {
+		t.Errorf("decoded item title = %q, want %q", got, "pack")
+	}
+}
+
+// reencryptTemplates rewrites the items of a template whose titles are plain
+// or under a former key, and only if the items are still those it read.
+func TestReencryptTemplates(t *testing.T) {
+	key := strings.Repeat("k", minEncryptionKeyLength)
+	former := strings.Repeat("f", minEncryptionKeyLength)
+	cfg := defaultConfig()
+	cfg.Encryption.Keys = []string{key, former}
+	useConfig(t, cfg)
+	mongo := useEmptyDatabase(t)
+
+	sealed, err := sealTitle("book hotel", []string{former})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	items := bson.A{bson.M{"title": "pack"}, bson.M{"title": sealed}}
+	mongo.seed(templateCollectionName, bson.M{"_id": id, "name": "trip", "items": items})
+	mongo.commands()
+
+	if _, err := reencryptTemplates(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var updates []mongoCommand
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "update" {
+			updates = append(updates, cmd)
+		}
+	}
+	if len(updates) != 1 {
+		t.Fatalf("reencryptTemplates sent %d updates, want 1", len(updates))
+	}
+	var cmd struct {
+		Updates []struct {
+			Q bson.Raw `bson:"q"`
+			U bson.Raw `bson:"u"`
+		} `bson:"updates"`
+	}
+	if err := bson.Unmarshal(updates[0].Command, &cmd); err != nil {
+		t.Fatal(err)
+	}
+	update := cmd.Updates[0]
+	if got := update.Q.Lookup("_id").ObjectID(); got != id {
+		t.Errorf("filter _id = %s, want %s", got.Hex(), id.Hex())
+	}
+	if got := update.Q.Lookup("items", "1", "title").StringValue(); got != sealed {
+		t.Errorf("filter item title = %q, want the stored %q", got, sealed)
+	}
+
+	current := sealedPrefix + titleKeyID(key) + ":"
+	for i, want := range []string{"pack", "book hotel"} {
+		stored := update.U.Lookup("$set", "items", strconv.Itoa(i), "title").StringValue()
+		if !strings.HasPrefix(stored, current) {
+			t.Errorf("item %d title = %q, want it under the first key", i, stored)
+			continue
+		}
+		if got, err := openTitle(stored, cfg.Encryption.Keys); err != nil || got != want {
+			t.Errorf("item %d title opens to %q, %v, want %q", i, got, err, want)
+		}
+	}
+}
+
+func TestStaleTitle(t *testing.T) {
+	key := strings.Repeat("k", minEncryptionKeyLength)
+	other := strings.Repeat("o", minEncryptionKeyLength)
+	sealed := func(keys ...string) string {
+		stored, err := sealTitle("pack", keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	tests := []struct {
+		name   string
+		keys   []string
+		stored string
+		want   bool
+	}{
+		{"plain without keys", nil, "pack", false},
+		{"sealed without keys", nil, sealed(key), true},
+		{"plain with keys", []string{key}, "pack", true},
+		{"under the first key", []string{key, other}, sealed(key), false},
+		{"under a former key", []string{key, other}, sealed(other), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond := staleTitle(tt.keys)
+			var got bool
+			if re, ok := cond["$regex"].(string); ok {
+				got = regexp.MustCompile(re).MatchString(tt.stored)
+			} else {
+				got = !regexp.MustCompile(cond["$not"].(primitive.Regex).Pattern).MatchString(tt.stored)
+			}
+			if got != tt.want {
+				t.Errorf("staleTitle(%d keys) matches %q = %v, want %v", len(tt.keys), tt.stored, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// respondCacheable writes v as JSON with an ETag, Content-Length and, when
+// lastModified is set, Last-Modified header. Requests whose If-None-Match
+// matches get a 304, and HEAD requests get the headers without the body.
+func respondCacheable(rw http.ResponseWriter, r *http.Request, v interface{}, lastModified time.Time) {
+	body, err := marshalJSON(r, v)
+	if err != nil {
+		log.Printf("failed to encode response: %v\n", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	respondWithETag(rw, r, body, `"`+hex.EncodeToString(sum[:16])+`"`, lastModified)
+}
+
+// respondWithETag is respondCacheable for a body whose ETag is known.
+func respondWithETag(rw http.ResponseWriter, r *http.Request, body []byte, etag string, lastModified time.Time) {
+	if clientClosed(r) {
+		return
+	}
+	header := rw.Header()
+	header.Set("ETag", etag)
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", "application/json; charset=UTF-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		rw.Write(body)
+	}
+}
+
+// todoETag is the strong ETag of td as rendered for r. It derives from the
+// version of the todo, which every change increments, and from what else
+// shapes the body: the language, the zone, the id format and indentation.
+// Reading a todo leaves it alone.
+func todoETag(r *http.Request, td TodoModel) string {
+	loc, err := requestLocation(r)
+	if err != nil {
+		loc = currentConfig().location
+	}
+	// the computed age changes the todo shown without a write
+	age := Todo{CreatedAt: td.CreatedAt, Completed: td.Completed}
+	age.setAge(time.Duration(currentConfig().StaleAfterDays)*24*time.Hour, time.Now())
+	// stored times have millisecond precision
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%s|%s|%s|%t|%d|%t", td.ID.Hex(), td.Version, td.UpdatedAt.UnixMilli(),
+		requestLanguage(r), loc, currentConfig().IDFormat, prettyJSON(r), age.AgeDays, age.Stale)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// setTodoETag sends the ETag the todo id has after a change, so clients can
+// update their caches without fetching it again.
+func setTodoETag(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var td TodoModel
+	opts := options.FindOne().SetProjection(bson.M{"id": 1, "version": 1, "updated_at": 1, "created_at": 1, "completed": 1})
+	if err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}, opts).Decode(&td); err != nil {
+		log.Printf("failed to fetch the version of %s: %v\n", id.Hex(), err)
+		return
+	}
+	rw.Header().Set("ETag", todoETag(r, td))
+}
+
+// setTodoCaching lets caches keep a todo for http.todo_max_age and serve it
+// stale for http.todo_stale_while_revalidate while they revalidate it.
+func setTodoCaching(rw http.ResponseWriter) {
+	cfg := currentConfig().HTTP
+	header := rw.Header()
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d",
+		int(cfg.TodoMaxAge.Seconds()), int(cfg.TodoStaleWhileRevalidate.Seconds())))
+	// Accept may ask for indented JSON
+	vary := "Accept, Accept-Language"
+	if len(currentConfig().Tenants) > 0 {
+		vary += ", X-Tenant"
+	}
+	header.Add("Vary", vary)
+}
+
+// bumpVersion makes update, a map of update operators, also increment the
+// version of the todos it changes, which changes their ETags, and set their
+// updated_at unless it sets it itself, which GET /todo/changes goes by.
+func bumpVersion(update bson.M) bson.M {
+	inc, ok := update["$inc"].(bson.M)
+	if !ok {
+		inc = bson.M{}
+		update["$inc"] = inc
+	}
+	inc["version"] = 1
+	set, ok := update["$set"].(bson.M)
+	if !ok {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	if _, ok := set["updated_at"]; !ok {
+		set["updated_at"] = time.Now().UTC()
+	}
+	return update
+}
+
+// versionStage is bumpVersion for update pipelines.
+var versionStage = bson.M{"$set": bson.M{
+	"version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+}}
+
+// etagMatches implements the weak comparison If-None-Match asks for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
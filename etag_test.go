@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz",W/"abc"`, true},
+		{"*", true},
+		{`"xyz"`, false},
+		{`abc`, false},
+		{`"abcd"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, etag, got, tt.want)
+		}
+	}
+}
+
+func TestBumpVersion(t *testing.T) {
+	updatedAt := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	update := bumpVersion(bson.M{
+		"$set": bson.M{"title": "buy milk", "updated_at": updatedAt},
+		"$inc": bson.M{"reopen_count": 1},
+	})
+	inc := update["$inc"].(bson.M)
+	set := update["$set"].(bson.M)
+	if inc["version"] != 1 || inc["reopen_count"] != 1 {
+		t.Errorf("$inc = %v, want version and reopen_count incremented", inc)
+	}
+	if set["updated_at"] != updatedAt || set["title"] != "buy milk" {
+		t.Errorf("$set = %v, want the updated_at it had", set)
+	}
+
+	before := time.Now().UTC()
+	update = bumpVersion(bson.M{"$unset": bson.M{"due_date": ""}})
+	if update["$inc"].(bson.M)["version"] != 1 {
+		t.Errorf("$inc = %v, want version incremented", update["$inc"])
+	}
+	if at, ok := update["$set"].(bson.M)["updated_at"].(time.Time); !ok || at.Before(before) {
+		t.Errorf("$set = %v, want updated_at now", update["$set"])
+	}
+	if _, ok := update["$unset"]; !ok {
+		t.Error("$unset was dropped")
+	}
+}
+
+func TestTodoETag(t *testing.T) {
+	useConfig(t, defaultConfig())
+	td := TodoModel{ID: primitive.NewObjectID(), Version: 3, CreatedAt: time.Now().UTC(), UpdatedAt: time.Now().UTC()}
+	get := func(lang string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/todo/"+td.ID.Hex(), nil)
+		r.Header.Set("Accept-Language", lang)
+		return r
+	}
+	etag := todoETag(get("en"), td)
+	if etag != todoETag(get("en"), td) {
+		t.Error("todoETag() changes between reads")
+	}
+	if etag == todoETag(get("pt"), td) {
+		t.Error("todoETag() is the same in another language")
+	}
+	changed := td
+	changed.Version++
+	if etag == todoETag(get("en"), changed) {
+		t.Error("todoETag() is the same after a change")
+	}
+}
+
+func TestRespondCacheable(t *testing.T) {
+	useConfig(t, defaultConfig())
+	lastModified := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	v := MessageResponse{Message: "ok"}
+
+	rw := httptest.NewRecorder()
+	respondCacheable(rw, httptest.NewRequest(http.MethodGet, "/todo/stats", nil), v, lastModified)
+	etag := rw.Header().Get("ETag")
+	if rw.Code != http.StatusOK || etag == "" || rw.Body.String() != `{"message":"ok"}` {
+		t.Fatalf("GET = %d, ETag %q, %s", rw.Code, etag, rw.Body)
+	}
+	if got := rw.Header().Get("Last-Modified"); got != "Thu, 15 Oct 2026 12:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", got)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		ifNoneMatch string
+		status      int
+		body        string
+	}{
+		{"revalidated", http.MethodGet, etag, http.StatusNotModified, ""},
+		{"revalidated weakly", http.MethodGet, "W/" + etag, http.StatusNotModified, ""},
+		{"changed", http.MethodGet, `"other"`, http.StatusOK, `{"message":"ok"}`},
+		{"head", http.MethodHead, "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/todo/stats", nil)
+		if tt.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		rw := httptest.NewRecorder()
+		respondCacheable(rw, r, v, lastModified)
+		if rw.Code != tt.status || rw.Body.String() != tt.body || rw.Header().Get("ETag") != etag {
+			t.Errorf("%s: %d, ETag %q, %q, want %d, ETag %q, %q", tt.name, rw.Code, rw.Header().Get("ETag"), rw.Body, tt.status, etag, tt.body)
+		}
+	}
+}
+
+func TestSetTodoCaching(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Tenants = []string{"acme"}
+	useConfig(t, cfg)
+	rw := httptest.NewRecorder()
+	setTodoCaching(rw)
+	if got := rw.Header().Get("Cache-Control"); got != "max-age=5, stale-while-revalidate=30" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got := rw.Header().Get("Vary"); got != "Accept, Accept-Language, X-Tenant" {
+		t.Errorf("Vary = %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const filterCollectionName string = "filters"
+
+type (
+	// struct to db model
+	FilterModel struct {
+		ID         primitive.ObjectID `bson:"_id,omitempty"`
+		Name       string             `bson:"name"`
+		Definition map[string]string  `bson:"definition"`
+		CreatedAt  time.Time          `bson:"created_at"`
+	}
+	// a saved filter as returned by the API
+	Filter struct {
+		ID         string            `json:"id"`
+		Name       string            `json:"name"`
+		Definition map[string]string `json:"definition"`
+		CreatedAt  time.Time         `json:"created_at"`
+	}
+	// create filter; the definition holds list query parameters by name,
+	// e.g. {"completed": "false", "tag": "work", "sort": "due_date"}
+	CreateFilter struct {
+		Name       string            `json:"name"`
+		Definition map[string]string `json:"definition"`
+	}
+	// a saved filter
+	CreateFilterResponse struct {
+		Message string `json:"message"`
+		Data    Filter `json:"data"`
+	}
+	// the saved filters endpoint response
+	GetFiltersResponse struct {
+		Message string   `json:"message"`
+		Data    []Filter `json:"data"`
+	}
+)
+
+// createFilter saves a list query under a name. The definition goes through
+// the parsers of the list endpoint so applying it later can't fail.
+func createFilter(rw http.ResponseWriter, r *http.Request) {
+	var filterReq CreateFilter
+	if err := decodeJSON(r, &filterReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	name := cleanTitle(filterReq.Name)
+	if name == "" {
+		writeError(rw, r, http.StatusBadRequest, "filter_name_required", nil)
+		return
+	}
+
+	definition := map[string]string{}
+	query := url.Values{}
+	for param, value := range filterReq.Definition {
+		if !slices.Contains(listParams, param) {
+			writeError(rw, r, http.StatusBadRequest, "unknown_filter_param", renderer.M{
+				"param":   param,
+				"allowed": strings.Join(listParams, ", "),
+			})
+			return
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			definition[param] = value
+			query.Set(param, value)
+		}
+	}
+	if _, err := listFilter(query, time.UTC); err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_filter", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, err := listSort(query); err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_sort", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := FilterModel{
+		ID:         primitive.NewObjectID(),
+		Name:       name,
+		Definition: definition,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if _, err := tenantDB(r.Context()).Collection(filterCollectionName).InsertOne(r.Context(), filter); err != nil {
+		logRequestError(r, "failed to insert filter into the db: %v\n", err.Error())
+		writeDBError(rw, r, err, "filter_save_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusCreated, CreateFilterResponse{
+		Message: localize(r, "filter_saved"),
+		Data:    filter.toFilter(),
+	})
+}
+
+// getFilters lists the saved filters by name.
+func getFilters(rw http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := tenantDB(r.Context()).Collection(filterCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch filters: %v\n", err)
+		writeDBError(rw, r, err, "filters_fetch_failed")
+		return
+	}
+
+	var filtersFromDB []FilterModel
+	if err := cursor.All(r.Context(), &filtersFromDB); err != nil {
+		logRequestError(r, "failed to decode filters: %v\n", err)
+		writeDBError(rw, r, err, "filters_fetch_failed")
+		return
+	}
+
+	filterList := []Filter{}
+	for _, f := range filtersFromDB {
+		filterList = append(filterList, f.toFilter())
+	}
+	renderJSON(rw, r, http.StatusOK, GetFiltersResponse{
+		Message: localize(r, "filters_retrieved"),
+		Data:    filterList,
+	})
+}
+
+// deleteFilter removes a saved filter.
+func deleteFilter(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_filter_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data, err := tenantDB(r.Context()).Collection(filterCollectionName).DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		logRequestError(r, "could not delete filter from database: %v\n", err.Error())
+		writeDBError(rw, r, err, "filter_delete_failed")
+		return
+	}
+	if data.DeletedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "filter_not_found", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "filter_deleted"),
+	})
+}
+
+// errFilterNotFound is returned by applySavedFilter for an unknown filter id.
+var errFilterNotFound = errors.New("filter not found")
+
+// applySavedFilter returns query with the saved filter named by ?filter
+// filled in. Parameters present in query win over the saved ones.
+func applySavedFilter(r *http.Request, query url.Values) (url.Values, error) {
+	value := strings.TrimSpace(query.Get("filter"))
+	if value == "" {
+		return query, nil
+	}
+	id, err := parseID(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFilterNotFound, err)
+	}
+
+	var saved FilterModel
+	err = tenantDB(r.Context()).Collection(filterCollectionName).FindOne(r.Context(), bson.M{"_id": id}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errFilterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	merged := url.Values{}
+	for param, value := range saved.Definition {
+		merged.Set(param, value)
+	}
+	for param, values := range query {
+		merged[param] = values
+	}
+	return merged, nil
+}
+
+func (f FilterModel) toFilter() Filter {
+	definition := f.Definition
+	if definition == nil {
+		definition = map[string]string{}
+	}
+	return Filter{
+		ID:         formatID(f.ID),
+		Name:       f.Name,
+		Definition: definition,
+		CreatedAt:  f.CreatedAt,
+	}
+}
+
+// filterHandlers serves the saved filters.
+func filterHandlers(version apiVersion) http.Handler {
+	router := chi.NewRouter()
+	router.Use(withAPIVersion(version), limitBody, routeOptions)
+	router.Get("/", getFilters)
+	router.Head("/", getFilters)
+	router.Post("/", createFilter)
+	router.Delete("/{id}", deleteFilter)
+
+	return router
+}
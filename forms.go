@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const formContentType string = "application/x-www-form-urlencoded"
+
+// isFormRequest reports whether the body of r is an urlencoded HTML form
+// rather than JSON, the default.
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == formContentType
+}
+
+// decodeCreateTodo reads the body of a todo creation, JSON or a form with
+// the same field names; tags may be repeated.
+func decodeCreateTodo(r *http.Request, todoReq *CreateTodo) error {
+	if !isFormRequest(r) {
+		return decodeJSON(r, todoReq)
+	}
+	// ParseForm caps the body at 10MB, far above anything valid
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	for _, values := range r.PostForm {
+		for _, value := range values {
+			if !utf8.ValidString(value) {
+				return errInvalidUTF8
+			}
+		}
+	}
+
+	form := r.PostForm
+	todoReq.Title = form.Get("title")
+	todoReq.Color = form.Get("color")
+	todoReq.Tags = form["tags"]
+	todoReq.Priority = form.Get("priority")
+	todoReq.Timezone = form.Get("timezone")
+	if value := form.Get("due_date"); value != "" {
+		todoReq.DueDate = &DateInput{raw: value}
+	}
+	if value := form.Get("estimate_minutes"); value != "" {
+		minutes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("estimate_minutes must be a whole number")
+		}
+		todoReq.EstimateMinutes = minutes
+	}
+	var err error
+	if todoReq.QuickAdd, err = formCheckbox(form.Get("quick_add")); err != nil {
+		return fmt.Errorf("quick_add %w", err)
+	}
+	if todoReq.Completed, err = formCheckbox(form.Get("completed")); err != nil {
+		return fmt.Errorf("completed %w", err)
+	}
+	return nil
+}
+
+// formCheckbox reads a checkbox, which browsers send as "on" when ticked and
+// leave out otherwise.
+func formCheckbox(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "1":
+		return true, nil
+	case "", "off", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("must be on, true or 1 when checked")
+}
+
+// formRedirect returns where to send the browser after a form submission:
+// the redirect_to field, when it is a path on this server and the client
+// didn't ask for JSON in Accept. It is "" otherwise.
+func formRedirect(r *http.Request) string {
+	if !isFormRequest(r) {
+		return ""
+	}
+	target := r.PostForm.Get("redirect_to")
+	// a path of this server only, "//host" would leave it
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, `\`) {
+		return ""
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == "application/json" {
+			return ""
+		}
+	}
+	return target
+}
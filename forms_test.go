@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFormCheckbox(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{"on", true, false},
+		{"ON", true, false},
+		{"true", true, false},
+		{"1", true, false},
+		{"", false, false},
+		{"off", false, false},
+		{"0", false, false},
+		{"yes", false, true},
+	}
+	for _, tt := range tests {
+		got, err := formCheckbox(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("formCheckbox(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// insertedTodo returns the todo the last insert into the todos stored,
+// without what differs between any two todos.
+func insertedTodo(t *testing.T, sent []mongoCommand) bson.M {
+	t.Helper()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].Name != "insert" || sent[i].Collection != collectionName {
+			continue
+		}
+		var cmd struct {
+			Documents []bson.M `bson:"documents"`
+		}
+		if err := bson.Unmarshal(sent[i].Command, &cmd); err != nil || len(cmd.Documents) != 1 {
+			t.Fatalf("insert %s: %v", sent[i].Command, err)
+		}
+		todo := cmd.Documents[0]
+		for _, field := range []string{"_id", "id", "created_at", "updated_at", "completed_at", "idempotency_key"} {
+			delete(todo, field)
+		}
+		return todo
+	}
+	t.Fatal("no todo was inserted")
+	return nil
+}
+
+// The same todo sent as JSON or as a form is stored the same.
+func TestCreateTodoFormMatchesJSON(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	create := func(contentType, body string, status int) bson.M {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/todo", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		rw := httptest.NewRecorder()
+		mongo.commands()
+		router.ServeHTTP(rw, r)
+		if rw.Code != status {
+			t.Fatalf("create as %s = %d, want %d: %s", contentType, rw.Code, status, rw.Body)
+		}
+		return insertedTodo(t, mongo.commands())
+	}
+
+	fromJSON := create("application/json", `{"title":"  Write report ","tags":["work","q1"],"priority":"high","color":"#FF0000","due_date":"2026-03-10","timezone":"Europe/Lisbon","estimate_minutes":45,"completed":true}`, http.StatusCreated)
+	fromForm := create(formContentType+"; charset=utf-8", url.Values{
+		"title":            {"  Write report "},
+		"tags":             {"work", "q1"},
+		"priority":         {"high"},
+		"color":            {"#FF0000"},
+		"due_date":         {"2026-03-10"},
+		"timezone":         {"Europe/Lisbon"},
+		"estimate_minutes": {"45"},
+		"completed":        {"on"},
+		"redirect_to":      {"/"},
+	}.Encode(), http.StatusSeeOther)
+
+	if !reflect.DeepEqual(fromForm, fromJSON) {
+		t.Errorf("the form stored\n%v\nthe JSON\n%v", fromForm, fromJSON)
+	}
+	if fromJSON["completed"] != true {
+		t.Errorf("stored %v, want the todo completed", fromJSON)
+	}
+}
+
+func TestFormRedirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   string
+	}{
+		{"page of this server", "/todos?page=2", "text/html", "/todos?page=2"},
+		{"JSON asked for", "/todos", "text/html, application/json", ""},
+		{"other host", "//evil.example.com/", "text/html", ""},
+		{"absolute URL", "https://evil.example.com/", "text/html", ""},
+		{"backslash", `/\evil.example.com`, "text/html", ""},
+		{"none", "", "text/html", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/todo", strings.NewReader(url.Values{"redirect_to": {tt.target}}.Encode()))
+			r.Header.Set("Content-Type", formContentType)
+			r.Header.Set("Accept", tt.accept)
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			if got := formRedirect(r); got != tt.want {
+				t.Errorf("formRedirect() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the one-time tokens of the rendered create forms
+const formTokenCollectionName string = "form_tokens"
+
+var errFormTokenExpired = errors.New("expired form token")
+
+// errFormTokenUsed is returned by claimFormToken for a token already
+// submitted. todoID is the todo the first submission created, zero while it
+// is still being created.
+type errFormTokenUsed struct {
+	todoID primitive.ObjectID
+}
+
+func (e errFormTokenUsed) Error() string {
+	return "form token already used"
+}
+
+// a form token; UsedAt is set by the submission that claims it
+type formTokenModel struct {
+	Token     string              `bson:"token"`
+	ExpiresAt time.Time           `bson:"expires_at"`
+	UsedAt    *time.Time          `bson:"used_at,omitempty"`
+	TodoID    *primitive.ObjectID `bson:"todo_id,omitempty"`
+}
+
+// issueFormToken stores a new token for a form rendered at now, valid for
+// admin.form_token_ttl.
+func issueFormToken(ctx context.Context, now time.Time) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	_, err := tenantDB(ctx).Collection(formTokenCollectionName).InsertOne(ctx, formTokenModel{
+		Token:     token,
+		ExpiresAt: now.Add(currentConfig().Admin.FormTokenTTL).UTC(),
+	})
+	return token, err
+}
+
+// claimFormToken marks token as used by a submission at now. Only one of
+// concurrent submissions of the same form claims it: the others get
+// errFormTokenUsed. A token that expired or was never issued gets
+// errFormTokenExpired.
+func claimFormToken(ctx context.Context, token string, now time.Time) error {
+	if token == "" {
+		return errFormTokenExpired
+	}
+	tokens := tenantDB(ctx).Collection(formTokenCollectionName)
+	err := tokens.FindOneAndUpdate(ctx,
+		bson.M{"token": token, "used_at": bson.M{"$exists": false}, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"used_at": now.UTC()}},
+	).Err()
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	var claimed formTokenModel
+	err = tokens.FindOne(ctx, bson.M{"token": token}).Decode(&claimed)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return errFormTokenExpired
+	case err != nil:
+		return err
+	case claimed.UsedAt == nil:
+		return errFormTokenExpired
+	case claimed.TodoID != nil:
+		return errFormTokenUsed{todoID: *claimed.TodoID}
+	}
+	return errFormTokenUsed{}
+}
+
+// settleFormToken records the todo id created by the submission that claimed
+// token.
+func settleFormToken(ctx context.Context, token string, id primitive.ObjectID) error {
+	_, err := tenantDB(ctx).Collection(formTokenCollectionName).UpdateOne(ctx,
+		bson.M{"token": token}, bson.M{"$set": bson.M{"todo_id": id}})
+	return err
+}
+
+// releaseFormToken gives back token after its submission failed, so the form
+// can be sent again.
+func releaseFormToken(ctx context.Context, token string) error {
+	_, err := tenantDB(ctx).Collection(formTokenCollectionName).UpdateOne(ctx,
+		bson.M{"token": token, "todo_id": bson.M{"$exists": false}}, bson.M{"$unset": bson.M{"used_at": ""}})
+	return err
+}
+
+// ensureFormTokenIndexes makes tokens unique and has the database remove
+// them once expired. Until it does, claimFormToken checks expiry itself.
+func ensureFormTokenIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(formTokenCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token", Value: 1}},
+			Options: options.Index().SetName("token").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// adminFormPost is a submission of the create form of the admin list with
+// the form token token.
+func adminFormPost(title, token string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/admin/todos", nil)
+	form := url.Values{
+		"title":      {title},
+		"form_token": {token},
+		"csrf_token": {adminCSRFToken(r, time.Now())},
+	}
+	r = httptest.NewRequest(http.MethodPost, "/admin/todos", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", formContentType)
+	return r
+}
+
+// adminNotice returns the notice an admin response left for the list.
+func adminNotice(rw *httptest.ResponseRecorder) string {
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == adminNoticeCookie {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// A form sent many times at once, as by a double click, creates its todo
+// once; the other submissions go back to the list with a notice.
+func TestAdminCreateTodoDoubleSubmit(t *testing.T) {
+	_, _, mongo := emptyDatabaseRouter(t)
+	now := time.Now()
+	// the database answers the claim of the token once; after that the token
+	// is found used
+	mongo.seed(formTokenCollectionName, formTokenModel{Token: "tok", ExpiresAt: now.Add(time.Hour), UsedAt: &now})
+
+	const submissions = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	notices := map[string]int{}
+	mongo.commands()
+	for i := 0; i < submissions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			adminCreateTodo(rw, adminFormPost("write report", "tok"))
+			mu.Lock()
+			defer mu.Unlock()
+			if rw.Code != http.StatusSeeOther {
+				t.Errorf("submission = %d, want a redirect to the list: %s", rw.Code, rw.Body)
+			}
+			notices[adminNotice(rw)]++
+		}()
+	}
+	wg.Wait()
+
+	inserts := 0
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "insert" && cmd.Collection == collectionName {
+			inserts++
+		}
+	}
+	if inserts != 1 {
+		t.Errorf("inserted %d todos, want 1", inserts)
+	}
+	if notices["todo_created"] != 1 || notices["form_already_submitted"] != submissions-1 {
+		t.Errorf("notices %v, want one todo_created and the rest form_already_submitted", notices)
+	}
+}
+
+// A form whose token expired is shown again with what was typed in.
+func TestAdminCreateTodoExpiredToken(t *testing.T) {
+	_, _, mongo := emptyDatabaseRouter(t)
+	capture := &captureRenderer{}
+	useTemplates(t, capture)
+	mongo.seed(formTokenCollectionName)
+
+	rw := httptest.NewRecorder()
+	mongo.commands()
+	adminCreateTodo(rw, adminFormPost("write report", "expired"))
+	if len(capture.calls) != 1 || capture.calls[0].status != http.StatusBadRequest {
+		t.Fatalf("expired form rendered %+v, want the form again with 400", capture.calls)
+	}
+	page, ok := capture.calls[0].value.(AdminTodosPage)
+	if !ok || page.NewTitle != "write report" || len(page.Errors) != 1 || page.FormToken == "" {
+		t.Errorf("rendered %+v, want the title kept, the problem and a new token", capture.calls[0].value)
+	}
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "insert" && cmd.Collection == collectionName {
+			t.Error("an expired form created a todo")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// todos returned per group unless ?limit says otherwise
+	defaultGroupItems = 10
+	maxGroupItems     = 100
+
+	// due buckets
+	bucketOverdue  string = "overdue"
+	bucketToday    string = "today"
+	bucketThisWeek string = "this_week"
+	bucketLater    string = "later"
+	bucketNone     string = "none"
+)
+
+// groupings of the grouped list endpoint, by ?by
+var groupings = []string{"tag", "priority", "due_bucket"}
+
+type (
+	// todos sharing a key; Todos holds the first of them in list order
+	TodoGroup struct {
+		Key   string `json:"key"`
+		Count int64  `json:"count"`
+		Todos []Todo `json:"todos"`
+	}
+	// the grouped list endpoint response
+	GetGroupedResponse struct {
+		Message string      `json:"message"`
+		By      string      `json:"by"`
+		Data    []TodoGroup `json:"data"`
+	}
+)
+
+// getGroupedTodos lists the todos grouped by ?by=tag|priority|due_bucket,
+// each group with its count and its first ?limit todos. It takes the filters
+// and the sort of the list endpoint. Untagged todos and todos without a
+// priority are grouped under an empty key.
+func getGroupedTodos(rw http.ResponseWriter, r *http.Request) {
+	q, err := parseGroupedQuery(r)
+	if err != nil {
+		writeListQueryError(rw, r, err)
+		return
+	}
+
+	groups, err := groupTodos(r.Context(), q.GroupBy, q.Filter, q.Sort, q.GroupItems, q.Location)
+	if err != nil {
+		logRequestError(r, "failed to group todos: %v\n", err)
+		writeDBError(rw, r, err, "todos_group_failed")
+		return
+	}
+	now := time.Now()
+	for _, group := range groups {
+		for i := range group.Todos {
+			group.Todos[i].setAge(q.StaleAfter, now)
+		}
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetGroupedResponse{
+		Message: localize(r, "todos_grouped"),
+		By:      q.GroupBy,
+		Data:    groups,
+	})
+}
+
+// groupTodos groups the todos matching filter in a single aggregation. The
+// todos are sorted before they are pushed, so every group keeps its first
+// items todos in list order. Tags are grouped by count; priorities and due
+// buckets in their natural order, with empty groups left out.
+func groupTodos(ctx context.Context, by string, filter bson.M, sort bson.D, items int, loc *time.Location) ([]TodoGroup, error) {
+	pipeline := bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$sort": sort},
+	}
+	var key interface{}
+	var order []string
+	switch by {
+	case "tag":
+		// a todo with several tags is in several groups
+		pipeline = append(pipeline, bson.M{"$unwind": bson.M{"path": "$tags", "preserveNullAndEmptyArrays": true}})
+		key = bson.M{"$ifNull": bson.A{"$tags", ""}}
+	case "priority":
+		key = bson.M{"$ifNull": bson.A{"$priority", ""}}
+		// highest first, then the todos without one
+		order = slices.Clone(priorities)
+		slices.Reverse(order)
+		order = append(order, "")
+	case "due_bucket":
+		key = dueBucket(time.Now().In(loc))
+		order = []string{bucketOverdue, bucketToday, bucketThisWeek, bucketLater, bucketNone}
+	default:
+		return nil, errors.New("unknown grouping " + by)
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{
+			"_id":   key,
+			"count": bson.M{"$sum": 1},
+			"todos": bson.M{"$push": "$$ROOT"},
+		}},
+		bson.M{"$project": bson.M{
+			"count": 1,
+			"todos": bson.M{"$slice": bson.A{"$todos", items}},
+		}},
+		bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+	)
+
+	cursor, err := tenantDB(ctx).Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Key   string      `bson:"_id"`
+		Count int64       `bson:"count"`
+		Todos []TodoModel `bson:"todos"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	groups := make([]TodoGroup, 0, len(results))
+	for _, result := range results {
+		group := TodoGroup{Key: result.Key, Count: result.Count, Todos: []Todo{}}
+		for _, td := range result.Todos {
+			group.Todos = append(group.Todos, td.toTodo(loc))
+		}
+		groups = append(groups, group)
+	}
+	if order != nil {
+		slices.SortStableFunc(groups, func(a, b TodoGroup) int {
+			return slices.Index(order, a.Key) - slices.Index(order, b.Key)
+		})
+	}
+	return groups, nil
+}
+
+// dueBucket is the expression putting a todo into a due bucket as of now:
+// overdue before today, then today, the rest of the ISO week and later.
+func dueBucket(now time.Time) bson.M {
+	today := startOfDay(now)
+	tomorrow := today.AddDate(0, 0, 1)
+	nextWeek := startOfISOWeek(now).AddDate(0, 0, 7)
+
+	// a missing due_date is null, which sorts before every date
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$lte": bson.A{"$due_date", nil}}, "then": bucketNone},
+			bson.M{"case": bson.M{"$lt": bson.A{"$due_date", today}}, "then": bucketOverdue},
+			bson.M{"case": bson.M{"$lt": bson.A{"$due_date", tomorrow}}, "then": bucketToday},
+			bson.M{"case": bson.M{"$lt": bson.A{"$due_date", nextWeek}}, "then": bucketThisWeek},
+		},
+		"default": bucketLater,
+	}}
+}
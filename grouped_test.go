@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// groupResult is a group as the aggregation of groupTodos yields it.
+func groupResult(key string, count int, titles ...string) bson.M {
+	todos := bson.A{}
+	for _, title := range titles {
+		todos = append(todos, newTodoModel(title, time.Now().UTC()))
+	}
+	return bson.M{"_id": key, "count": count, "todos": todos}
+}
+
+func TestGroupTodosOrder(t *testing.T) {
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+	// as the aggregation sorts them: by count, then by key
+	mongo.seed(collectionName,
+		groupResult("low", 5, "a", "b"),
+		groupResult("", 3, "c"),
+		groupResult("urgent", 2, "d", "e"),
+		groupResult("medium", 1),
+	)
+
+	tests := []struct {
+		by   string
+		want []string
+	}{
+		{"tag", []string{"low", "", "urgent", "medium"}},
+		{"priority", []string{"urgent", "medium", "low", ""}},
+	}
+	for _, tt := range tests {
+		groups, err := groupTodos(context.Background(), tt.by, bson.M{}, bson.D{{Key: "created_at", Value: -1}}, 10, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, group := range groups {
+			keys = append(keys, group.Key)
+		}
+		if !slices.Equal(keys, tt.want) {
+			t.Errorf("by %s: groups %q, want %q", tt.by, keys, tt.want)
+		}
+	}
+
+	if _, err := groupTodos(context.Background(), "color", bson.M{}, bson.D{}, 10, time.UTC); err == nil {
+		t.Error("groupTodos() accepted an unknown grouping")
+	}
+}
+
+func TestGroupedHandler(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	mongo.seed(collectionName,
+		groupResult("work", 3, "write report", "call ana"),
+		groupResult("home", 1, "buy milk"),
+		groupResult("", 1),
+	)
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo/grouped?by=tag&limit=2", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET grouped = %d: %s", rw.Code, rw.Body)
+	}
+	var resp struct {
+		By   string `json:"by"`
+		Data []struct {
+			Key   string            `json:"key"`
+			Count int64             `json:"count"`
+			Todos []json.RawMessage `json:"todos"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.By != "tag" || len(resp.Data) != 3 {
+		t.Fatalf("response = %s, want 3 groups by tag", rw.Body)
+	}
+	for i, want := range []struct {
+		key          string
+		count, todos int
+	}{{"work", 3, 2}, {"home", 1, 1}, {"", 1, 0}} {
+		group := resp.Data[i]
+		if group.Key != want.key || group.Count != int64(want.count) || len(group.Todos) != want.todos || group.Todos == nil {
+			t.Errorf("group %d = %q with %d, %d todos, want %q with %d, %d todos", i, group.Key, group.Count, len(group.Todos), want.key, want.count, want.todos)
+		}
+	}
+}
+
+func TestDueBucket(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name                      string
+		now                       time.Time
+		today, tomorrow, nextWeek string
+	}{
+		{
+			name:     "sunday night",
+			now:      time.Date(2024, time.March, 10, 23, 30, 0, 0, loc),
+			today:    "2024-03-10T00:00:00-03:00",
+			tomorrow: "2024-03-11T00:00:00-03:00",
+			nextWeek: "2024-03-11T00:00:00-03:00",
+		},
+		{
+			name:     "monday just after midnight",
+			now:      time.Date(2024, time.March, 11, 0, 5, 0, 0, loc),
+			today:    "2024-03-11T00:00:00-03:00",
+			tomorrow: "2024-03-12T00:00:00-03:00",
+			nextWeek: "2024-03-18T00:00:00-03:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			branches := dueBucket(tt.now)["$switch"].(bson.M)["branches"].(bson.A)
+			bound := func(i int, op string) string {
+				return branches[i].(bson.M)["case"].(bson.M)[op].(bson.A)[1].(time.Time).Format(time.RFC3339)
+			}
+			if got := bound(1, "$lt"); got != tt.today {
+				t.Errorf("overdue before %s, want %s", got, tt.today)
+			}
+			if got := bound(2, "$lt"); got != tt.tomorrow {
+				t.Errorf("today before %s, want %s", got, tt.tomorrow)
+			}
+			if got := bound(3, "$lt"); got != tt.nextWeek {
+				t.Errorf("this week before %s, want %s", got, tt.nextWeek)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+const (
+	// fallbackLanguage has every message; other catalogs may be incomplete.
+	fallbackLanguage string = "en"
+
+	// the cookie keeping the language picked with ?lang on the HTML pages
+	languageCookie string = "lang"
+	// how long the language cookie keeps it
+	languageCookieMaxAge = 365 * 24 * 60 * 60
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs maps a language to its messages, keyed by message code.
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]map[string]string{}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+	return catalogs
+}
+
+// translate returns the message for code in lang with each {name} placeholder
+// replaced by params[name]. Missing translations fall back to English and
+// unknown codes to the code itself.
+func translate(lang, code string, params renderer.M) string {
+	message, ok := catalogs[lang][code]
+	if !ok {
+		message, ok = catalogs[fallbackLanguage][code]
+	}
+	if !ok {
+		return code
+	}
+	for name, value := range params {
+		message = strings.ReplaceAll(message, "{"+name+"}", fmt.Sprint(value))
+	}
+	return message
+}
+
+// localize returns the message for code in the language of the request.
+func localize(r *http.Request, code string) string {
+	return translate(requestLanguage(r), code, nil)
+}
+
+// writeError responds with a message in the language of the request. The code
+// and the extra fields stay the same in every language so clients can branch
+// on them; the fields also fill the message placeholders. The body is a
+// problem document instead when wantsProblem says so.
+func writeError(rw http.ResponseWriter, r *http.Request, status int, code string, fields renderer.M) {
+	lang := requestLanguage(r)
+	rw.Header().Set("Content-Language", lang)
+	message := translate(lang, code, fields)
+	fields = compatErrorFields(rw, currentConfig(), fields)
+	if wantsProblem(r) {
+		writeProblem(rw, r, status, code, lang, message, fields)
+		return
+	}
+	resp := renderer.M{
+		"message": message,
+		"code":    code,
+		"lang":    lang,
+	}
+	for name, value := range fields {
+		resp[name] = value
+	}
+	renderJSON(rw, r, status, resp)
+}
+
+// compatErrorFields returns the fields of an error response without the
+// legacy error string once http.compatibility_mode is new, and marks the
+// response as carrying it otherwise.
+func compatErrorFields(rw http.ResponseWriter, cfg *Config, fields renderer.M) renderer.M {
+	if _, ok := fields["error"].(string); !ok {
+		return fields
+	}
+	if cfg.HTTP.CompatibilityMode != compatNew {
+		deprecateField(rw, cfg, "error")
+		return fields
+	}
+	kept := make(renderer.M, len(fields)-1)
+	for name, value := range fields {
+		if name != "error" {
+			kept[name] = value
+		}
+	}
+	return kept
+}
+
+// notFound answers requests for unknown routes in the shape of every other error.
+func notFound(rw http.ResponseWriter, r *http.Request) {
+	writeError(rw, r, http.StatusNotFound, "route_not_found", nil)
+}
+
+// methodNotAllowed answers known routes requested with an unsupported method.
+func methodNotAllowed(rw http.ResponseWriter, r *http.Request) {
+	writeError(rw, r, http.StatusMethodNotAllowed, "method_not_allowed", renderer.M{
+		"method": r.Method,
+	})
+}
+
+// requestLanguage picks the catalog for r from its Accept-Language header,
+// falling back to the configured default language.
+func requestLanguage(r *http.Request) string {
+	def := currentConfig().DefaultLanguage
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if tag == "*" {
+			return def
+		}
+		if _, ok := catalogs[tag]; ok {
+			return tag
+		}
+		if base, _, found := strings.Cut(tag, "-"); found {
+			if _, ok := catalogs[base]; ok {
+				return base
+			}
+		}
+	}
+	return def
+}
+
+// pageLanguage picks the catalog for an HTML page answering r: the one ?lang
+// names, else the one the language cookie keeps, else as requestLanguage
+// does. Forms posted from a page carry no ?lang and so keep the language
+// picked before.
+func pageLanguage(r *http.Request) string {
+	if lang := strings.ToLower(r.URL.Query().Get("lang")); catalogs[lang] != nil {
+		return lang
+	}
+	if cookie, err := r.Cookie(languageCookie); err == nil && catalogs[cookie.Value] != nil {
+		return cookie.Value
+	}
+	return requestLanguage(r)
+}
+
+// localizePage returns the message for code in the language of the HTML
+// page answering r.
+func localizePage(r *http.Request, code string) string {
+	return translate(pageLanguage(r), code, nil)
+}
+
+// PageLocale is the language an HTML page renders in and the links of its
+// language switcher. The data of every page embeds it.
+type PageLocale struct {
+	Lang      string
+	Languages []LanguageLink
+}
+
+// LanguageLink leads to the same page in another language.
+type LanguageLink struct {
+	Lang    string
+	Name    string
+	URL     string
+	Current bool
+}
+
+// newPageLocale negotiates the language of the HTML page answering r, see
+// pageLanguage, and keeps a ?lang in the language cookie for the pages after.
+// The switcher links lead to path with query and each ?lang; being plain
+// links they leave the forms of the page and their tokens alone.
+func newPageLocale(rw http.ResponseWriter, r *http.Request, path string, query url.Values) PageLocale {
+	lang := pageLanguage(r)
+	if strings.ToLower(r.URL.Query().Get("lang")) == lang {
+		http.SetCookie(rw, &http.Cookie{
+			Name:     languageCookie,
+			Value:    lang,
+			Path:     "/",
+			MaxAge:   languageCookieMaxAge,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	rw.Header().Set("Content-Language", lang)
+	rw.Header().Add("Vary", "Accept-Language, Cookie")
+
+	locale := PageLocale{Lang: lang}
+	for code := range catalogs {
+		linked := url.Values{}
+		for name, values := range query {
+			linked[name] = values
+		}
+		linked.Set("lang", code)
+		locale.Languages = append(locale.Languages, LanguageLink{
+			Lang:    code,
+			Name:    translate(code, "language_name", nil),
+			URL:     path + "?" + linked.Encode(),
+			Current: code == lang,
+		})
+	}
+	sort.Slice(locale.Languages, func(i, j int) bool { return locale.Languages[i].Lang < locale.Languages[j].Lang })
+	return locale
+}
+
+// parseAcceptLanguage returns the lower-cased language tags of an
+// Accept-Language header by decreasing quality, dropping those with q=0 and
+// keeping the header order among equal qualities. Malformed entries are ignored.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, entry := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(entry, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"pt-BR", []string{"pt-br"}},
+		{"en;q=0.5, pt", []string{"pt", "en"}},
+		{"fr, pt;q=0.9, en;q=0.9", []string{"fr", "pt", "en"}},
+		{"pt;q=0, en", []string{"en"}},
+		{"pt;q=abc, en;q=2, de;q=-1, fr;q=0.1", []string{"fr"}},
+		{" , *;q=0.1, ,", []string{"*"}},
+	}
+	for _, tt := range tests {
+		if got := parseAcceptLanguage(tt.header); !slices.Equal(got, tt.want) {
+			t.Errorf("parseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRequestLanguage(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DefaultLanguage = "pt"
+	useConfig(t, cfg)
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "pt"},
+		{"en", "en"},
+		{"en-GB", "en"},
+		{"pt-BR, en;q=0.8", "pt"},
+		{"fr, en;q=0.5", "en"},
+		{"fr", "pt"},
+		{"*, en;q=0.5", "pt"},
+		{"EN", "en"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/todo", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Language", tt.header)
+		}
+		if got := requestLanguage(r); got != tt.want {
+			t.Errorf("requestLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	catalogs["xx"] = map[string]string{"todo_not_found": "xx {id}"}
+	t.Cleanup(func() { delete(catalogs, "xx") })
+
+	tests := []struct {
+		lang, code string
+		params     renderer.M
+		want       string
+	}{
+		{"en", "todo_not_found", nil, "Todo not found"},
+		{"pt", "todo_not_found", nil, "Tarefa não encontrada"},
+		{"en", "title_too_long", renderer.M{"max_length": 500}, "titles are limited to 500 characters"},
+		{"xx", "todo_not_found", renderer.M{"id": "abc"}, "xx abc"},
+		{"xx", "title_too_long", renderer.M{"max_length": 500}, "titles are limited to 500 characters"},
+		{"en", "no_such_message", nil, "no_such_message"},
+	}
+	for _, tt := range tests {
+		if got := translate(tt.lang, tt.code, tt.params); got != tt.want {
+			t.Errorf("translate(%q, %q) = %q, want %q", tt.lang, tt.code, got, tt.want)
+		}
+	}
+}
+
+// Every catalog translates the messages of the fallback one and nothing else.
+func TestCatalogsComplete(t *testing.T) {
+	for lang, messages := range catalogs {
+		for code := range catalogs[fallbackLanguage] {
+			if _, ok := messages[code]; !ok {
+				t.Errorf("locales/%s.json misses %s", lang, code)
+			}
+		}
+		for code := range messages {
+			if _, ok := catalogs[fallbackLanguage][code]; !ok {
+				t.Errorf("locales/%s.json has %s, unknown to locales/%s.json", lang, code, fallbackLanguage)
+			}
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		lang    string
+		status  int
+		code    string
+		message string
+	}{
+		{"unknown route", notFound, http.MethodGet, "", http.StatusNotFound, "route_not_found", translate("en", "route_not_found", nil)},
+		{"unknown route in Portuguese", notFound, http.MethodGet, "pt-BR", http.StatusNotFound, "route_not_found", translate("pt", "route_not_found", nil)},
+		{"method not allowed", methodNotAllowed, http.MethodPut, "pt", http.StatusMethodNotAllowed, "method_not_allowed", "PUT não é permitido aqui"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/nowhere", nil)
+			if tt.lang != "" {
+				r.Header.Set("Accept-Language", tt.lang)
+			}
+			rw := httptest.NewRecorder()
+			tt.handler(rw, r)
+			if rw.Code != tt.status {
+				t.Errorf("status = %d, want %d", rw.Code, tt.status)
+			}
+			var body struct{ Code, Message, Lang string }
+			if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != tt.code || body.Message != tt.message {
+				t.Errorf("body = %+v, want code %s and message %q", body, tt.code, tt.message)
+			}
+			if got := rw.Header().Get("Content-Language"); got != body.Lang {
+				t.Errorf("Content-Language = %q, want %q", got, body.Lang)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// forms of an ObjectID in responses, chosen by id_format
+const (
+	idFormatHex   string = "hex"
+	idFormatShort string = "short"
+)
+
+// short ids are the 12 bytes of an ObjectID in unpadded base64url, which
+// makes 16 characters instead of 24 hex digits
+var shortIDEncoding = base64.RawURLEncoding
+
+// parseID reads an id in either form. Hex is tried first, so a string valid
+// in both alphabets is read as hex; the lengths differ anyway.
+func parseID(value string) (primitive.ObjectID, error) {
+	value = strings.TrimSpace(value)
+	if id, err := primitive.ObjectIDFromHex(value); err == nil {
+		return id, nil
+	}
+	var id primitive.ObjectID
+	if b, err := shortIDEncoding.DecodeString(value); err == nil && len(b) == len(id) {
+		copy(id[:], b)
+		return id, nil
+	}
+	return primitive.NilObjectID, fmt.Errorf("invalid id %q, expected 24 hex characters or a 16 character short id", value)
+}
+
+// formatID writes id in the form selected by id_format.
+func formatID(id primitive.ObjectID) string {
+	if currentConfig().IDFormat == idFormatShort {
+		return shortIDEncoding.EncodeToString(id[:])
+	}
+	return id.Hex()
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// documents an integrity check scans per request unless ?limit says otherwise
+	defaultIntegrityLimit int64 = 1000
+	maxIntegrityLimit     int64 = 10000
+	// documents read from the server at a time
+	integrityBatchSize int32 = 200
+	// ids listed for each kind of issue
+	integritySample = 10
+
+	// kinds of integrity issues
+	issueMissingID        string = "missing_id"
+	issueDuplicateID      string = "duplicate_id"
+	issueMissingCreatedAt string = "missing_created_at"
+	issueEmptyTitle       string = "empty_title"
+	issueInvalidTags      string = "invalid_tags"
+	issueDanglingBlocker  string = "dangling_blocker"
+)
+
+// the kinds of integrity issues in the order they are reported
+var integrityIssueTypes = []string{
+	issueMissingID, issueDuplicateID, issueMissingCreatedAt,
+	issueEmptyTitle, issueInvalidTags, issueDanglingBlocker,
+}
+
+type (
+	// the documents with one kind of issue; Sample holds their _id
+	IntegrityIssue struct {
+		Type     string   `json:"type"`
+		Count    int64    `json:"count"`
+		Repaired int64    `json:"repaired"`
+		Sample   []string `json:"sample"`
+	}
+	// the outcome of checking one batch of todos. Next is the _id to pass as
+	// ?after to check the following batch, empty after the last one.
+	IntegrityReport struct {
+		Scanned int64            `json:"scanned"`
+		Repair  bool             `json:"repair"`
+		Issues  []IntegrityIssue `json:"issues"`
+		Next    string           `json:"next,omitempty"`
+	}
+	// the integrity check endpoint response
+	IntegrityCheckResponse struct {
+		Message string          `json:"message"`
+		Data    IntegrityReport `json:"data"`
+	}
+)
+
+// integrityCheck holds the state of a check while it walks its batch.
+type integrityCheck struct {
+	repair bool
+	// copied into the audit entry of each repair
+	auditor AuditEntry
+	issues  map[string]*IntegrityIssue
+}
+
+// postIntegrityCheck checks the todos of the tenant in _id order, at most
+// ?limit of them starting after ?after, and with ?repair=true fixes what can
+// be fixed safely. Each request is bounded; clients resume with the next of
+// the report until it is empty.
+func postIntegrityCheck(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	after := primitive.NilObjectID
+	if value := query.Get("after"); value != "" {
+		var err error
+		if after, err = primitive.ObjectIDFromHex(value); err != nil {
+			writeError(rw, r, http.StatusBadRequest, "invalid_after", nil)
+			return
+		}
+	}
+	limit := defaultIntegrityLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.ParseInt(value, 10, 64); err != nil || limit < 1 || limit > maxIntegrityLimit {
+			writeError(rw, r, http.StatusBadRequest, "invalid_integrity_limit", renderer.M{
+				"max": maxIntegrityLimit,
+			})
+			return
+		}
+	}
+	repair := false
+	if value := query.Get("repair"); value != "" {
+		var err error
+		if repair, err = strconv.ParseBool(value); err != nil {
+			writeError(rw, r, http.StatusBadRequest, "invalid_repair", nil)
+			return
+		}
+	}
+	// checking only reads, so it is allowed while read-only
+	if repair && readOnly.Load() {
+		writeError(rw, r, http.StatusServiceUnavailable, "read_only", nil)
+		return
+	}
+
+	auditor := AuditEntry{Actor: actor(r), Route: r.Method + " " + r.URL.Path, ClientIP: clientIP(r)}
+	report, err := checkIntegrity(r.Context(), after, limit, repair, auditor)
+	if err != nil {
+		logRequestError(r, "failed to check the integrity of the todos: %v\n", err)
+		writeDBError(rw, r, err, "integrity_check_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, IntegrityCheckResponse{
+		Message: localize(r, "integrity_checked"),
+		Data:    report,
+	})
+}
+
+// checkIntegrity checks up to limit todos with an _id greater than after.
+func checkIntegrity(ctx context.Context, after primitive.ObjectID, limit int64, repair bool, auditor AuditEntry) (IntegrityReport, error) {
+	check := &integrityCheck{repair: repair, auditor: auditor, issues: map[string]*IntegrityIssue{}}
+	report := IntegrityReport{Repair: repair, Issues: []IntegrityIssue{}}
+
+	// documents written with a non-ObjectID _id sort apart and are skipped
+	filter := bson.M{"_id": bson.M{"$gt": after, "$type": "objectId"}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit).
+		SetBatchSize(integrityBatchSize)
+	cursor, err := tenantDB(ctx).Collection(collectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+
+	var batch []bson.Raw
+	var last primitive.ObjectID
+	for cursor.Next(ctx) {
+		doc := make(bson.Raw, len(cursor.Current))
+		copy(doc, cursor.Current)
+		batch = append(batch, doc)
+		last = doc.Lookup("_id").ObjectID()
+		report.Scanned++
+		if len(batch) == int(integrityBatchSize) {
+			if err := check.run(ctx, batch); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return report, err
+	}
+	if err := check.run(ctx, batch); err != nil {
+		return report, err
+	}
+
+	if report.Scanned == limit {
+		report.Next = last.Hex()
+	}
+	for _, issueType := range integrityIssueTypes {
+		if issue, ok := check.issues[issueType]; ok {
+			report.Issues = append(report.Issues, *issue)
+		}
+	}
+	return report, nil
+}
+
+// run checks a batch of todos and repairs them when asked to. The checks
+// that need other documents, duplicates and blockers, take one query each
+// for the whole batch.
+func (c *integrityCheck) run(ctx context.Context, batch []bson.Raw) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	todos := tenantDB(ctx).Collection(collectionName)
+
+	var ids, references []primitive.ObjectID
+	for _, doc := range batch {
+		if id, ok := doc.Lookup("id").ObjectIDOK(); ok {
+			ids = append(ids, id)
+		}
+		for _, field := range []string{"blocked_by", "open_blockers"} {
+			references = append(references, objectIDs(doc.Lookup(field))...)
+		}
+	}
+
+	// ids held by more than one todo, this batch or not
+	duplicated := map[primitive.ObjectID]bool{}
+	if len(ids) > 0 {
+		pipeline := bson.A{
+			bson.M{"$match": bson.M{"id": bson.M{"$in": ids}}},
+			bson.M{"$group": bson.M{"_id": "$id", "count": bson.M{"$sum": 1}}},
+			bson.M{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+		}
+		cursor, err := todos.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		var groups []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &groups); err != nil {
+			return err
+		}
+		for _, group := range groups {
+			duplicated[group.ID] = true
+		}
+	}
+
+	// blockers that still exist
+	existing := map[primitive.ObjectID]bool{}
+	if len(references) > 0 {
+		var found []TodoModel
+		cursor, err := todos.Find(ctx, bson.M{"id": bson.M{"$in": references}}, options.Find().SetProjection(bson.M{"id": 1}))
+		if err == nil {
+			err = cursor.All(ctx, &found)
+		}
+		if err != nil {
+			return err
+		}
+		for _, td := range found {
+			existing[td.ID] = true
+		}
+	}
+
+	for _, doc := range batch {
+		if err := c.checkTodo(ctx, doc, duplicated, existing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTodo reports the issues of one todo and repairs those that are safe
+// to repair: a missing id is taken from _id unless another todo has it, a
+// missing created_at from the time in the id, tags are cleaned as on
+// create, and blockers that no longer exist are dropped. Duplicated ids and
+// empty titles need a person to decide and are only reported.
+func (c *integrityCheck) checkTodo(ctx context.Context, doc bson.Raw, duplicated, existing map[primitive.ObjectID]bool) error {
+	docID := doc.Lookup("_id").ObjectID()
+	set, unset, pull := bson.M{}, bson.M{}, bson.M{}
+	var fixes []string
+
+	id, hasID := doc.Lookup("id").ObjectIDOK()
+	if !hasID {
+		repairable := false
+		if c.repair {
+			taken, err := tenantDB(ctx).Collection(collectionName).CountDocuments(ctx, bson.M{"id": docID})
+			if err != nil {
+				return err
+			}
+			repairable = taken == 0
+		}
+		c.found(issueMissingID, docID, repairable)
+		if repairable {
+			set["id"] = docID
+			fixes = append(fixes, "id set from _id")
+		}
+		id = docID
+	} else if duplicated[id] {
+		c.found(issueDuplicateID, docID, false)
+	}
+
+	if doc.Lookup("created_at").Type != bson.TypeDateTime {
+		c.found(issueMissingCreatedAt, docID, c.repair)
+		set["created_at"] = id.Timestamp().UTC()
+		fixes = append(fixes, "created_at backfilled from the id")
+	}
+
+	if title, ok := doc.Lookup("title").StringValueOK(); !ok || strings.TrimSpace(title) == "" {
+		c.found(issueEmptyTitle, docID, false)
+	}
+
+	if tags, err := doc.LookupErr("tags"); err == nil {
+		if cleaned, valid := cleanRawTags(tags); !valid {
+			c.found(issueInvalidTags, docID, c.repair)
+			if len(cleaned) > 0 {
+				set["tags"] = cleaned
+			} else {
+				unset["tags"] = ""
+			}
+			fixes = append(fixes, "tags normalized")
+		}
+	}
+
+	var dangling []primitive.ObjectID
+	for _, field := range []string{"blocked_by", "open_blockers"} {
+		for _, blocker := range objectIDs(doc.Lookup(field)) {
+			if !existing[blocker] {
+				dangling = append(dangling, blocker)
+			}
+		}
+	}
+	if len(dangling) > 0 {
+		c.found(issueDanglingBlocker, docID, c.repair)
+		pull["blocked_by"] = bson.M{"$in": dangling}
+		pull["open_blockers"] = bson.M{"$in": dangling}
+		fixes = append(fixes, "dropped blockers "+strings.Join(formatIDs(dangling), ", "))
+	}
+
+	if !c.repair || len(set)+len(unset)+len(pull) == 0 {
+		return nil
+	}
+	update := bumpVersion(bson.M{})
+	for op, fields := range map[string]bson.M{"$set": set, "$unset": unset, "$pull": pull} {
+		if len(fields) > 0 {
+			update[op] = fields
+		}
+	}
+	entry := c.auditor
+	entry.ID = primitive.NewObjectID()
+	entry.Action = "integrity.repair"
+	entry.Affected = 1
+	entry.Outcome = auditSucceeded
+	entry.Timestamp = time.Now().UTC()
+	entry.Target = docID.Hex()
+	entry.Detail = strings.Join(fixes, "; ")
+	// the change and its audit entry are written together
+	return runInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := tenantDB(ctx).Collection(collectionName).UpdateByID(ctx, docID, update); err != nil {
+			return err
+		}
+		if _, err := tenantDB(ctx).Collection(auditCollectionName).InsertOne(ctx, entry); err != nil {
+			return err
+		}
+		if _, ok := set["id"]; ok || hasID {
+			return recordTodoEvent(ctx, eventTodoUpdated, id)
+		}
+		return nil
+	})
+}
+
+// found counts an issue of the todo with _id docID.
+func (c *integrityCheck) found(issueType string, docID primitive.ObjectID, repaired bool) {
+	issue, ok := c.issues[issueType]
+	if !ok {
+		issue = &IntegrityIssue{Type: issueType, Sample: []string{}}
+		c.issues[issueType] = issue
+	}
+	issue.Count++
+	if repaired {
+		issue.Repaired++
+	}
+	if len(issue.Sample) < integritySample {
+		issue.Sample = append(issue.Sample, docID.Hex())
+	}
+}
+
+// cleanRawTags returns the tags of a stored tags field as create would have
+// stored them, and whether the field already was that way. A single string
+// becomes a one tag array; values that aren't strings are dropped.
+func cleanRawTags(value bson.RawValue) ([]string, bool) {
+	if tag, ok := value.StringValueOK(); ok {
+		return cleanTags([]string{tag}), false
+	}
+	array, ok := value.ArrayOK()
+	if !ok {
+		return nil, false
+	}
+	values, err := array.Values()
+	if err != nil {
+		return nil, false
+	}
+	var tags []string
+	valid := true
+	for _, v := range values {
+		if tag, ok := v.StringValueOK(); ok {
+			tags = append(tags, tag)
+		} else {
+			valid = false
+		}
+	}
+	cleaned := cleanTags(tags)
+	if len(cleaned) != len(tags) {
+		valid = false
+	}
+	for i := range cleaned {
+		if valid && cleaned[i] != tags[i] {
+			valid = false
+		}
+	}
+	return cleaned, valid
+}
+
+// objectIDs returns the ObjectIDs in an array value, ignoring anything else.
+func objectIDs(value bson.RawValue) []primitive.ObjectID {
+	array, ok := value.ArrayOK()
+	if !ok {
+		return nil
+	}
+	values, err := array.Values()
+	if err != nil {
+		return nil
+	}
+	var ids []primitive.ObjectID
+	for _, v := range values {
+		if id, ok := v.ObjectIDOK(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// runIntegrityCommand is the integrity-check subcommand: it checks every
+// todo of every tenant batch by batch, pausing in between, and prints the
+// issues found. It reports whether none are left unrepaired.
+func runIntegrityCommand(out io.Writer, args []string, tenants []string) (bool, error) {
+	flags := flag.NewFlagSet("integrity-check", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the issues that can be fixed safely")
+	limit := flags.Int64("batch", defaultIntegrityLimit, "todos checked per batch")
+	pause := flags.Duration("pause", 100*time.Millisecond, "pause between batches")
+	if err := flags.Parse(args); err != nil {
+		return false, err
+	}
+	if *limit < 1 || *limit > maxIntegrityLimit {
+		return false, fmt.Errorf("-batch must be between 1 and %d", maxIntegrityLimit)
+	}
+
+	clean := true
+	auditor := AuditEntry{Actor: "cli", Route: "integrity-check"}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tISSUE\tCOUNT\tREPAIRED\tSAMPLE")
+	for _, ctx := range tenantContexts(context.Background(), tenants) {
+		totals := map[string]*IntegrityIssue{}
+		after := primitive.NilObjectID
+		for {
+			report, err := checkIntegrity(ctx, after, *limit, *repair, auditor)
+			if err != nil {
+				return false, fmt.Errorf("%s: %w", tenantDB(ctx).Name(), err)
+			}
+			for _, issue := range report.Issues {
+				total, ok := totals[issue.Type]
+				if !ok {
+					total = &IntegrityIssue{Type: issue.Type}
+					totals[issue.Type] = total
+				}
+				total.Count += issue.Count
+				total.Repaired += issue.Repaired
+				for _, id := range issue.Sample {
+					if len(total.Sample) < integritySample {
+						total.Sample = append(total.Sample, id)
+					}
+				}
+			}
+			if report.Next == "" {
+				break
+			}
+			after, _ = primitive.ObjectIDFromHex(report.Next)
+			time.Sleep(*pause)
+		}
+		for _, issueType := range integrityIssueTypes {
+			if issue, ok := totals[issueType]; ok {
+				clean = clean && issue.Repaired == issue.Count
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", tenantDB(ctx).Name(), issue.Type, issue.Count, issue.Repaired, strings.Join(issue.Sample, " "))
+			}
+		}
+	}
+	return clean, tw.Flush()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	concurrencyInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "todo_concurrency_in_use",
+			Help: "Requests holding a slot of a concurrency limited route group.",
+		},
+		[]string{"group"},
+	)
+	concurrencyLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "todo_concurrency_limit",
+			Help: "Slots of a concurrency limited route group.",
+		},
+		[]string{"group"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyInUse, concurrencyLimit)
+}
+
+// aggregationLimit caps the concurrent stats and review aggregations so they
+// can't take every Mongo connection from interactive requests. It is set up
+// by main from limits.aggregations.
+var aggregationLimit *concurrencyLimiter
+
+// concurrencyLimiter lets a fixed number of requests of a route group run at
+// once. Requests beyond that wait up to limits.queue_timeout for a slot and
+// are then refused with 429.
+type concurrencyLimiter struct {
+	group string
+	slots chan struct{}
+}
+
+func newConcurrencyLimiter(group string, limit int64) *concurrencyLimiter {
+	concurrencyLimit.WithLabelValues(group).Set(float64(limit))
+	return &concurrencyLimiter{group: group, slots: make(chan struct{}, limit)}
+}
+
+// limit is the middleware applying l. The slot is released when the handler
+// returns, panics included; a client that hangs up while waiting gives up its
+// place in the queue.
+func (l *concurrencyLimiter) limit(next http.Handler) http.Handler {
+	inUse := concurrencyInUse.WithLabelValues(l.group)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		timer := time.NewTimer(currentConfig().Limits.QueueTimeout)
+		defer timer.Stop()
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			rw.Header().Set("Retry-After", "1")
+			writeError(rw, r, http.StatusTooManyRequests, "too_busy", nil)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		inUse.Inc()
+		defer func() {
+			inUse.Dec()
+			<-l.slots
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
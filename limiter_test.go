@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterCap(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.QueueTimeout = 5 * time.Second
+	useConfig(t, cfg)
+	useRenderer(t, nil)
+
+	const limit, requests = 3, 30
+	var running, most atomic.Int64
+	handler := newConcurrencyLimiter("test_cap", limit).limit(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := most.Load()
+			if now <= seen || most.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+		// a slow aggregation
+		time.Sleep(5 * time.Millisecond)
+	}))
+
+	var wg sync.WaitGroup
+	var refused atomic.Int64
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/todo/stats", nil))
+			if rw.Code != http.StatusOK {
+				refused.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := most.Load(); got != limit {
+		t.Errorf("%d requests ran at once, want %d", got, limit)
+	}
+	if got := refused.Load(); got != 0 {
+		t.Errorf("%d requests were refused within the queue timeout", got)
+	}
+	if got := metricValue(t, "todo_concurrency_in_use", map[string]string{"group": "test_cap"}); got != 0 {
+		t.Errorf("todo_concurrency_in_use = %v after the requests, want 0", got)
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits.QueueTimeout = 20 * time.Millisecond
+	useConfig(t, cfg)
+	useRenderer(t, nil)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	limiter := newConcurrencyLimiter("test_queue", 1)
+	handler := limiter.limit(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("aggregation failed")
+		}
+		close(started)
+		<-release
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+
+	// a panic gives its slot back
+	func() {
+		defer func() { recover() }()
+		serve("/panic")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve("/slow")
+	}()
+	<-started
+	rw := serve("/waiting")
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("request beyond the limit = %d, Retry-After %q, want 429 after 1s", rw.Code, rw.Header().Get("Retry-After"))
+	}
+	close(release)
+	<-done
+}
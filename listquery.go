@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the query parameters every endpoint takes
+var commonParams = []string{"tz", "pretty"}
+
+// ListQuery is the query of an endpoint listing todos, the list with its
+// views and the grouped list, as parsed by parseListQuery.
+type ListQuery struct {
+	// the query with the parameters of a saved filter merged in, which
+	// cursors and coalesced reads are keyed by
+	Values   url.Values
+	Location *time.Location
+	View     string
+	// the filters and the view, not the cursor
+	Filter bson.M
+	Sort   bson.D
+	// nil unless the list is sorted by title
+	Collation *options.Collation
+
+	// a page is asked for, by ?cursor or by ?page and ?limit; a cursor wins
+	// over a page number and After continues the list after it
+	Paginated bool
+	Page      int64
+	Limit     int64
+	After     bson.M
+
+	// how old open todos are stale, for ?stale and the stale of each todo
+	StaleAfter time.Duration
+
+	// the grouping of the grouped list and the todos shown per group
+	GroupBy    string
+	GroupItems int
+}
+
+// listQueryProblems is returned by parseListQuery with every problem of a
+// query, answered as field errors.
+type listQueryProblems struct {
+	problems *fieldErrors
+}
+
+func (e listQueryProblems) Error() string {
+	return "invalid list query"
+}
+
+// parseListQuery parses the query of the list and its view {view}.
+func parseListQuery(r *http.Request) (ListQuery, error) {
+	return parseTodosQuery(r, false)
+}
+
+// parseGroupedQuery parses the query of the grouped list, which takes ?by
+// and a ?limit of todos per group instead of pages.
+func parseGroupedQuery(r *http.Request) (ListQuery, error) {
+	return parseTodosQuery(r, true)
+}
+
+// parseTodosQuery applies the saved ?filter of r and parses the parameters of
+// the list, or of the grouped list, in one place with their defaults and
+// caps. Every problem is reported at once, unknown parameters included, see
+// checkUnknownParams.
+func parseTodosQuery(r *http.Request, grouped bool) (ListQuery, error) {
+	q := ListQuery{View: chi.URLParam(r, "view"), Location: currentConfig().location}
+	problems := newFieldErrors(r)
+	if loc, err := requestLocation(r); err != nil {
+		problems.addError("tz", "invalid_timezone", renderer.M{"expected": expectedTimezone}, err)
+	} else {
+		q.Location = loc
+	}
+	query, err := applySavedFilter(r, r.URL.Query())
+	if err != nil {
+		return q, err
+	}
+	q.Values = query
+
+	checkUnknownParams(problems, r.URL.Query(), listQueryParams(grouped, q.View))
+
+	q.Filter, err = listFilter(query, q.Location)
+	var invalid paramErrors
+	if errors.As(err, &invalid) {
+		for _, problem := range invalid {
+			problems.addError(problem.param, "invalid_filter", nil, problem.err)
+		}
+	}
+	if q.View != "" {
+		viewFilter, err := todoViews[q.View](query, time.Now().In(q.Location))
+		if err != nil {
+			problems.addError("days", "invalid_filter", nil, err)
+		} else if q.Filter != nil {
+			q.Filter = bson.M{"$and": bson.A{q.Filter, viewFilter}}
+		}
+	}
+	// a bad ?stale_after_days is reported by listFilter
+	q.StaleAfter, _ = staleAfter(query)
+	if q.Sort, err = listSort(query); err != nil {
+		problems.addError("sort", "invalid_sort", nil, err)
+	}
+
+	if grouped {
+		q.GroupBy = query.Get("by")
+		if !slices.Contains(groupings, q.GroupBy) {
+			problems.add("by", "invalid_group_by", renderer.M{"allowed": strings.Join(groupings, ", ")})
+		}
+		q.GroupItems = defaultGroupItems
+		if value := query.Get("limit"); value != "" {
+			if q.GroupItems, err = strconv.Atoi(value); err != nil || q.GroupItems < 1 || q.GroupItems > maxGroupItems {
+				problems.add("limit", "invalid_group_limit", renderer.M{"max": maxGroupItems})
+			}
+		}
+	} else {
+		// titles sort as people expect in the language, other fields as stored
+		if q.Collation, err = listCollation(query); err != nil {
+			problems.addError("collation", "invalid_collation", nil, err)
+		}
+		if q.Sort == nil || q.Sort[1].Key != "title" {
+			q.Collation = nil
+		}
+
+		q.Paginated = query.Has("cursor") || query.Has("page") || query.Has("limit")
+		if _, _, err := parsePagination(query.Get("page"), ""); err != nil {
+			problems.addError("page", "invalid_pagination", nil, err)
+		}
+		if _, _, err := parsePagination("", query.Get("limit")); err != nil {
+			problems.addError("limit", "invalid_pagination", nil, err)
+		}
+		q.Page, q.Limit, _ = parsePagination(query.Get("page"), query.Get("limit"))
+		if value := query.Get("cursor"); value != "" && q.Sort != nil {
+			if q.After, err = cursorFilter(value, listChecksum(query, q.View), q.Sort); err != nil {
+				problems.addError("cursor", "invalid_cursor", nil, err)
+			}
+		}
+	}
+
+	if len(problems.errs) > 0 {
+		return q, listQueryProblems{problems: problems}
+	}
+	return q, nil
+}
+
+// listQueryParams returns the query parameters of the list with the view
+// view, or of the grouped list.
+func listQueryParams(grouped bool, view string) []string {
+	allowed := append(slices.Clone(commonParams), "filter")
+	allowed = append(allowed, listParams...)
+	if grouped {
+		allowed = append(allowed, "by", "limit")
+	} else {
+		allowed = append(allowed, "collation", "page", "limit", "cursor")
+	}
+	if view == "upcoming" {
+		allowed = append(allowed, "days")
+	}
+	return allowed
+}
+
+// checkUnknownParams adds a problem for every parameter of query that isn't
+// allowed, with strict_query set, so a typo such as ?competed isn't ignored.
+func checkUnknownParams(problems *fieldErrors, query url.Values, allowed []string) {
+	if !currentConfig().StrictQuery {
+		return
+	}
+	var unknown []string
+	for param := range query {
+		if !slices.Contains(allowed, param) {
+			unknown = append(unknown, param)
+		}
+	}
+	slices.Sort(unknown)
+	for _, param := range unknown {
+		problems.add(param, "unknown_param", renderer.M{"param": param, "allowed": strings.Join(allowed, ", ")})
+	}
+}
+
+// writeListQueryError answers a query parseListQuery refused: with its
+// problems, or as for an unknown or unreadable saved filter.
+func writeListQueryError(rw http.ResponseWriter, r *http.Request, err error) {
+	var invalid listQueryProblems
+	switch {
+	case errors.As(err, &invalid):
+		invalid.problems.write(rw, r)
+	case errors.Is(err, errFilterNotFound):
+		writeError(rw, r, http.StatusNotFound, "filter_not_found", nil)
+	default:
+		logRequestError(r, "failed to fetch the saved filter: %v\n", err)
+		writeDBError(rw, r, err, "filters_fetch_failed")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		page, limit string
+		wantPage    int64
+		wantLimit   int64
+		err         bool
+	}{
+		{"", "", 1, defaultPageLimit, false},
+		{"3", "20", 3, 20, false},
+		{"", "1", 1, 1, false},
+		{"", "200", 1, maxPageLimit, false},
+		{"", "201", 0, 0, true},
+		{"", "0", 0, 0, true},
+		{"", "-1", 0, 0, true},
+		{"", "ten", 0, 0, true},
+		{"0", "", 0, 0, true},
+		{"1.5", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		page, limit, err := parsePagination(tt.page, tt.limit)
+		if (err != nil) != tt.err || page != tt.wantPage || limit != tt.wantLimit {
+			t.Errorf("parsePagination(%q, %q) = %d, %d, %v, want %d, %d, error %v",
+				tt.page, tt.limit, page, limit, err, tt.wantPage, tt.wantLimit, tt.err)
+		}
+	}
+}
+
+// problemFields returns the fields err, returned by parseListQuery, has
+// problems with.
+func problemFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var invalid listQueryProblems
+	if !errors.As(err, &invalid) {
+		t.Fatalf("error = %v, want the problems of the query", err)
+	}
+	var fields []string
+	for _, e := range invalid.problems.errs {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
+
+func TestParseListQuery(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StrictQuery = true
+	useConfig(t, cfg)
+
+	tests := []struct {
+		query     string
+		paginated bool
+		page      int64
+		limit     int64
+		problems  []string
+	}{
+		{query: "", page: 1, limit: defaultPageLimit},
+		{query: "limit=10", paginated: true, page: 1, limit: 10},
+		{query: "page=2&limit=200", paginated: true, page: 2, limit: 200},
+		{query: "limit=201", paginated: true, problems: []string{"limit"}},
+		{query: "limit=0&page=0", paginated: true, problems: []string{"page", "limit"}},
+		{query: "limit=abc&sort=nope&competed=true", paginated: true, problems: []string{"competed", "sort", "limit"}},
+		{query: "tz=Mars/Olympus", page: 1, limit: defaultPageLimit, problems: []string{"tz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/todo?"+tt.query, nil))
+			if got := problemFields(t, err); !slices.Equal(got, tt.problems) {
+				t.Fatalf("problems with %v, want %v", got, tt.problems)
+			}
+			if q.Paginated != tt.paginated {
+				t.Errorf("Paginated = %v, want %v", q.Paginated, tt.paginated)
+			}
+			if err == nil && (q.Page != tt.page || q.Limit != tt.limit) {
+				t.Errorf("page %d of %d, want page %d of %d", q.Page, q.Limit, tt.page, tt.limit)
+			}
+		})
+	}
+}
+
+func TestParseGroupedQuery(t *testing.T) {
+	useConfig(t, defaultConfig())
+
+	tests := []struct {
+		query    string
+		items    int
+		problems []string
+	}{
+		{query: "by=priority", items: defaultGroupItems},
+		{query: "by=priority&limit=100", items: 100},
+		{query: "by=priority&limit=101", problems: []string{"limit"}},
+		{query: "by=colour&limit=0", problems: []string{"by", "limit"}},
+	}
+	for _, tt := range tests {
+		q, err := parseGroupedQuery(httptest.NewRequest(http.MethodGet, "/todo/grouped?"+tt.query, nil))
+		if got := problemFields(t, err); !slices.Equal(got, tt.problems) {
+			t.Errorf("%s: problems with %v, want %v", tt.query, got, tt.problems)
+		} else if err == nil && q.GroupItems != tt.items {
+			t.Errorf("%s: %d todos per group, want %d", tt.query, q.GroupItems, tt.items)
+		}
+	}
+}
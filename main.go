@@ -2,90 +2,251 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
+	"html/template"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/thedevsaddam/renderer"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 var (
-	rnd    *renderer.Render
+	rnd    Renderer
 	client *mongo.Client
 	db     *mongo.Database
+
+	// false when html_dir holds no templates and pages fall back to fallbackPage
+	haveTemplates bool
+
+	// flushes the trace exporter on shutdown
+	shutdownTracing func(context.Context) error
 )
 
 const (
 	dbName         string = "golang-todo"
 	collectionName string = "todo"
+
+	defaultPageLimit int64 = 50
+	maxPageLimit           = 200
 )
 
 type (
 	// struct to db model
 	TodoModel struct {
-		ID        primitive.ObjectID `bson:"id,omitempty"`
-		Title     string             `bson:"title"`
-		Completed bool               `bson:"completed"`
-		CreatedAt time.Time          `bson:"created_at"`
+		ID primitive.ObjectID `bson:"id,omitempty"`
+		// encrypted at rest with encryption.keys
+		Title sealedText `bson:"title"`
+		// titleIndex(Title), indexed to find duplicates
+		NormalizedTitle string     `bson:"normalized_title"`
+		Completed       bool       `bson:"completed"`
+		Starred         bool       `bson:"starred"`
+		Color           string     `bson:"color,omitempty"`
+		Tags            []string   `bson:"tags,omitempty"`
+		Priority        string     `bson:"priority,omitempty"`
+		DueDate         *time.Time `bson:"due_date,omitempty"`
+		// maintained with $inc as comments are added and removed
+		CommentCount int64      `bson:"comment_count"`
+		CreatedAt    time.Time  `bson:"created_at"`
+		UpdatedAt    time.Time  `bson:"updated_at,omitempty"`
+		CompletedAt  *time.Time `bson:"completed_at,omitempty"`
+		// sent ones are kept so firing stays idempotent
+		Reminders []ReminderModel `bson:"reminders,omitempty"`
+		// the todos this one waits for, and those of them still open
+		BlockedBy    []primitive.ObjectID `bson:"blocked_by,omitempty"`
+		OpenBlockers []primitive.ObjectID `bson:"open_blockers,omitempty"`
+		// 0 is no estimate; spent_minutes is derived from work_log
+		EstimateMinutes int64          `bson:"estimate_minutes,omitempty"`
+		SpentMinutes    int64          `bson:"spent_minutes,omitempty"`
+		WorkLog         []WorkInterval `bson:"work_log,omitempty"`
+		TimerStartedAt  *time.Time     `bson:"timer_started_at,omitempty"`
+		// hidden from the lists while in the future, see deferredFilter
+		DeferredUntil *time.Time `bson:"deferred_until,omitempty"`
+		// incremented by every change, see bumpVersion; the ETag derives from it
+		Version int64 `bson:"version"`
+		// the titles before the last renames, oldest first, see recordRename
+		PreviousTitles []PreviousTitle `bson:"previous_titles,omitempty"`
+		// the Idempotency-Key the todo was created with, see createdWithKey
+		IdempotencyKey string `bson:"idempotency_key,omitempty"`
+	}
+	// a former title and its normalizeTitle form, which searches match
+	PreviousTitle struct {
+		Title      sealedText `bson:"title"`
+		Normalized string     `bson:"normalized"`
 	}
 	// that the Frontend will display
 	Todo struct {
-		ID        string    `json:"id"`
-		Title     string    `json:"title"`
-		Completed bool      `json:"completed"`
-		CreatedAt time.Time `json:"created_at"`
+		ID           string     `json:"id"`
+		Title        string     `json:"title"`
+		Completed    bool       `json:"completed"`
+		Starred      bool       `json:"starred"`
+		Color        string     `json:"color,omitempty"`
+		Tags         []string   `json:"tags"`
+		Priority     string     `json:"priority,omitempty"`
+		DueDate      *time.Time `json:"due_date,omitempty"`
+		CommentCount int64      `json:"comment_count"`
+		CreatedAt    time.Time  `json:"created_at"`
+		UpdatedAt    time.Time  `json:"updated_at"`
+		CompletedAt  *time.Time `json:"completed_at,omitempty"`
+		// the unsent ones, soonest first
+		Reminders []Reminder `json:"reminders"`
+		BlockedBy []string   `json:"blocked_by"`
+		// whether any of BlockedBy is still open
+		Blocked         bool       `json:"blocked"`
+		EstimateMinutes int64      `json:"estimate_minutes,omitempty"`
+		SpentMinutes    int64      `json:"spent_minutes"`
+		TimerStartedAt  *time.Time `json:"timer_started_at,omitempty"`
+		// absent once the todo is no longer deferred
+		DeferredUntil *time.Time `json:"deferred_until,omitempty"`
+		Version       int64      `json:"version"`
+		// computed as the todo is rendered, see setAge
+		AgeDays int64 `json:"age_days"`
+		Stale   bool  `json:"stale"`
+		// only shown by GET /todo/{id}, oldest first
+		PreviousTitles []string `json:"previous_titles,omitempty"`
 	}
-	// the structure of the JSON response data returned
+	// the structure of the JSON response data returned; NextCursor continues
+	// a paginated list and is absent on its last page
 	GetTodoResponse struct {
+		Message    string `json:"message"`
+		View       string `json:"view,omitempty"`
+		Data       []Todo `json:"data"`
+		NextCursor string `json:"next_cursor,omitempty"`
+		// documents of the page that aren't valid todos, see findTodoPage
+		Skipped int `json:"skipped,omitempty"`
+	}
+	// a single todo
+	GetOneTodoResponse struct {
+		Message string `json:"message"`
+		Data    Todo   `json:"data"`
+	}
+	// a created todo; Parsed is what quick-add extracted, DuplicateOf an
+	// identical open todo when titles needn't be unique
+	CreateTodoResponse struct {
+		Message string `json:"message"`
+		ID      string `json:"id,omitempty"`
+		// the id under its name from before /api/v1, see setID
+		LegacyID    string    `json:"ID,omitempty"`
+		Parsed      *QuickAdd `json:"parsed,omitempty"`
+		DuplicateOf string    `json:"duplicate_of,omitempty"`
+	}
+	// an update of one todo
+	UpdateTodoResponse struct {
+		Message       string `json:"message"`
+		ModifiedCount int64  `json:"modified_count"`
+		// the todo as the update left it
+		Data *Todo `json:"data,omitempty"`
+	}
+	// a deletion of one or more todos
+	DeleteTodoResponse struct {
+		Message      string `json:"message"`
+		DeletedCount int64  `json:"deleted_count"`
+		// the todo as it was, when only one was deleted
+		Data *Todo `json:"data,omitempty"`
+	}
+	// a response carrying nothing but its message
+	MessageResponse struct {
 		Message string `json:"message"`
-		Data    []Todo `json:"data"`
 	}
-	// create todo
+	// create todo, with quick_add the title is parsed by parseQuickAdd
 	CreateTodo struct {
-		Title string `json:"title"`
+		Title    string     `json:"title"`
+		Color    string     `json:"color"`
+		Tags     []string   `json:"tags"`
+		Priority string     `json:"priority"`
+		DueDate  *DateInput `json:"due_date"`
+		// minutes of work the todo is expected to take
+		EstimateMinutes int64 `json:"estimate_minutes"`
+		QuickAdd        bool  `json:"quick_add"`
+		// the todo is created already done, as when logging finished work
+		Completed bool `json:"completed"`
+		// IANA name plain dates are read in, ?tz= or the configured timezone by default
+		Timezone string `json:"timezone"`
 	}
-	// update todo
+	// update todo, the color and estimate are left unchanged when absent
 	UpdateTodo struct {
-		Title     string `json:"title"`
-		Completed bool   `json:"completed"`
+		Title           string  `json:"title"`
+		Completed       bool    `json:"completed"`
+		Color           *string `json:"color"`
+		EstimateMinutes *int64  `json:"estimate_minutes"`
+	}
+	// partially update todo, absent fields are left unchanged
+	PatchTodo struct {
+		Title           *string `json:"title"`
+		Completed       *bool   `json:"completed"`
+		Starred         *bool   `json:"starred"`
+		Color           *string `json:"color"`
+		EstimateMinutes *int64  `json:"estimate_minutes"`
 	}
 )
 
-func init() {
-	fmt.Println("init func running")
-
-	rnd = renderer.New(
-		renderer.Options{
-			/* This option allows us to look for files inside the HTML folder
-			with the “.html” extension and render them as templates.*/
-			ParseGlobPattern: "html/*.html", // HTML parsing option
-		},
-	)
-	var err error
+// newRenderer parses the templates found in htmlDir, again whenever they
+// change with reload. Their asset URLs come from assets. It reports whether
+// there were any templates: the renderer exits the process on a missing
+// directory, so it is only given a glob that matches something.
+func newRenderer(htmlDir string, assets *assetManifest, reload bool) (Renderer, bool) {
+	opts := renderer.Options{
+		FuncMap: []template.FuncMap{templateFuncs(assets)},
+	}
+	pattern := filepath.Join(htmlDir, "*.html")
+	if matches, _ := filepath.Glob(pattern); len(matches) == 0 {
+		slog.Warn("no HTML templates found, serving a built-in page instead", "html_dir", htmlDir)
+		return renderer.New(opts), false
+	}
+	if reload {
+		return newTemplateReloader(renderer.New(opts), pattern, templateFuncs(assets)), true
+	}
+	/* This option allows us to look for files inside the HTML folder
+	with the “.html” extension and render them as templates.*/
+	opts.ParseGlobPattern = pattern // HTML parsing option
+	return renderer.New(opts), true
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// connectMongo connects to MongoDB and pings the primary, giving up after timeout.
+func connectMongo(cfg Config, timeout time.Duration) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	checkError(err)
+	// record per-command metrics, log slow operations and trace every command for every handler
+	monitor := multiCommandMonitor(
+		newCommandMonitor(func() time.Duration { return currentConfig().Mongo.SlowQueryThreshold }),
+		otelmongo.NewMonitor(),
+	)
 
-	err = client.Ping(ctx, readpref.Primary())
-	checkError(err)
+	mongoClient, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Mongo.URI).SetMonitor(monitor))
+	if err != nil {
+		return nil, err
+	}
 
-	db = client.Database(dbName)
+	if err := mongoClient.Ping(ctx, readpref.Primary()); err != nil {
+		mongoClient.Disconnect(context.Background())
+		return nil, err
+	}
+	return mongoClient, nil
+}
+
+// IndexPage is the data of the todo list page, which loads the todos itself.
+type IndexPage struct {
+	PageLocale
 }
 
 func homeHandler(rw http.ResponseWriter, r *http.Request) {
@@ -93,88 +254,358 @@ func homeHandler(rw http.ResponseWriter, r *http.Request) {
 	// FileView - renders the readme file
 	// err := rnd.FileView(rw, http.StatusOK, filePath, "readme.md")
 
+	if !haveTemplates {
+		writeFallbackPage(rw)
+		return
+	}
 	// it returns the indexPage in the HTML template.
-	err := rnd.HTML(rw, http.StatusOK, "indexPage", nil)
-	checkError(err)
+	renderHTML(rw, r, http.StatusOK, "indexPage", IndexPage{
+		PageLocale: newPageLocale(rw, r, "/", url.Values{}),
+	})
 }
 
 // getTodos ...
 func getTodos(rw http.ResponseWriter, r *http.Request) {
-	var todoListFromDB = []TodoModel{}
-	filter := bson.D{}
-
-	cursor, err := db.Collection(collectionName).Find(context.Background(), filter)
+	listTodos(rw, r, "")
+}
 
+// listTodos answers with the todos matching the list parameters of r and,
+// unless view is empty, the filter of that view.
+func listTodos(rw http.ResponseWriter, r *http.Request, view string) {
+	q, err := parseListQuery(r)
 	if err != nil {
-		log.Printf("failed to fetch todo records from the db: %v\n", err)
-		rnd.JSON(rw, http.StatusBadRequest, renderer.M{
-			"message": "Could not fetch the todo collection",
-			"error":   err.Error(),
+		writeListQueryError(rw, r, err)
+		return
+	}
+	query, loc, filter, sort := q.Values, q.Location, q.Filter, q.Sort
+
+	// HEAD only reports the number of matching todos
+	if r.Method == http.MethodHead {
+		total, err := tenantDB(r.Context()).Collection(collectionName).CountDocuments(r.Context(), filter)
+		if err != nil {
+			logRequestError(r, "failed to count todo records: %v\n", err)
+			writeDBError(rw, r, err, "todos_count_failed")
+			return
+		}
+		rw.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// the whole list unless a page is asked for
+	var skip, limit int64
+	if q.Paginated {
+		limit = q.Limit
+		countFilter := filter
+		total, err := coalesce(r.Context(), "list_count", listReadKey(query, view, loc), func(ctx context.Context) (total int64, err error) {
+			err = retryDB(ctx, "todo_count", func() error {
+				total, err = tenantDB(ctx).Collection(collectionName).CountDocuments(ctx, countFilter)
+				return err
+			})
+			return total, err
 		})
+		if err != nil {
+			logRequestError(r, "failed to count todo records: %v\n", err)
+			writeDBError(rw, r, err, "todos_count_failed")
+			return
+		}
+		rw.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
 
+		if q.After != nil {
+			filter = bson.M{"$and": bson.A{filter, q.After}}
+		} else {
+			skip = (q.Page - 1) * limit
+		}
+	}
+
+	pageKey := listReadKey(query, view, loc) + "|skip=" + strconv.FormatInt(skip, 10) +
+		"|limit=" + strconv.FormatInt(limit, 10) + "|cursor=" + query.Get("cursor")
+	read, err := coalesce(r.Context(), "list", pageKey, func(ctx context.Context) (page todoPage, err error) {
+		err = retryDB(ctx, "todo_list", func() error {
+			page, err = findTodoPage(ctx, filter, sort, q.Collation, skip, limit)
+			return err
+		})
+		return page, err
+	})
+	todoListFromDB, more := read.todos, read.more
+	if err != nil {
+		logRequestError(r, "failed to fetch todo records from the db: %v\n", err)
+		writeDBError(rw, r, err, "todos_fetch_failed")
 		return
 	}
 
 	todoList := []Todo{}
-	if err := cursor.All(context.Background(), &todoListFromDB); err != nil {
-		checkError(err)
+	var nextCursor string
+	// a page of malformed documents only has nothing to go on from
+	if more && len(todoListFromDB) > 0 {
+		nextCursor, err = encodeCursor(todoListFromDB[len(todoListFromDB)-1], sort[1].Key, listChecksum(query, view))
+		if err != nil {
+			log.Printf("failed to encode the list cursor: %v\n", err)
+		}
 	}
 
 	// loop through the database list, convert TodoModel to JSON and append to the todoList array.
+	now := time.Now()
 	for _, td := range todoListFromDB {
-		todoList = append(todoList, Todo{
-			ID:        td.ID.Hex(),
-			Title:     td.Title,
-			Completed: td.Completed,
-			CreatedAt: td.CreatedAt,
+		todo := td.toTodo(loc)
+		todo.setAge(q.StaleAfter, now)
+		todoList = append(todoList, todo)
+	}
+	if !q.Paginated {
+		rw.Header().Set("X-Total-Count", strconv.Itoa(len(todoList)))
+	}
+	renderJSON(rw, r, http.StatusOK, GetTodoResponse{
+		Message:    localize(r, "todos_retrieved"),
+		View:       view,
+		Data:       todoList,
+		NextCursor: nextCursor,
+		Skipped:    read.skipped,
+	})
+}
+
+// getTodo returns a single todo with its ETag and Last-Modified, so HEAD
+// works as a cheap existence check. Caches may keep it briefly, see
+// setTodoCaching.
+func getTodo(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
 		})
+		return
 	}
-	rnd.JSON(rw, http.StatusOK, GetTodoResponse{
-		Message: "All todos retrieved",
-		Data:    todoList,
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	var td TodoModel
+	err = retryDB(r.Context(), "todo_get", func() error {
+		return tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}).Decode(&td)
 	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if into, merged := mergedInto(r.Context(), id); merged {
+			writeError(rw, r, http.StatusGone, "todo_merged", renderer.M{
+				"merged_into": formatID(into),
+			})
+			return
+		}
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "todo_fetch_failed")
+		return
+	}
+
+	// the former titles are left out of lists, which stay slim
+	todo := td.toTodo(loc)
+	for _, previous := range td.PreviousTitles {
+		todo.PreviousTitles = append(todo.PreviousTitles, string(previous.Title))
+	}
+	body, err := marshalJSON(r, GetOneTodoResponse{
+		Message: localize(r, "todo_retrieved"),
+		Data:    todo,
+	})
+	if err != nil {
+		log.Printf("failed to encode response: %v\n", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	lastModified := td.UpdatedAt
+	if lastModified.IsZero() {
+		lastModified = td.CreatedAt
+	}
+	setTodoCaching(rw)
+	respondWithETag(rw, r, body, todoETag(r, td), lastModified)
 }
 
 // createTodo ...
 func createTodo(rw http.ResponseWriter, r *http.Request) {
 	var todoReq CreateTodo
-	if err := json.NewDecoder(r.Body).Decode(&todoReq); err != nil {
-		log.Printf("failed to decode json data: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusBadRequest, renderer.M{
-			"message": "could not decode data",
+	if err := decodeCreateTodo(r, &todoReq); err != nil {
+		log.Printf("failed to decode the todo: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
 		})
 		return
 	}
+	todoReq.Title = cleanTitle(todoReq.Title)
+	todoReq.Tags = cleanTags(todoReq.Tags)
+	key, ok := idempotencyKey(rw, r)
+	if !ok {
+		return
+	}
 
-	if todoReq.Title == "" {
-		log.Printf("no title added to response body")
-		rnd.JSON(rw, http.StatusBadRequest, renderer.M{
-			"message": "please add a title",
-		})
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
 		return
 	}
 
-	todoModel := TodoModel{
-		ID:        primitive.NewObjectID(),
-		Title:     todoReq.Title,
-		Completed: false,
-		CreatedAt: time.Now(),
+	// report every problem of the body at once
+	problems := newFieldErrors(r)
+	if todoReq.Timezone != "" {
+		if bodyLoc, err := loadTimezone(todoReq.Timezone); err != nil {
+			problems.add("timezone", "invalid_timezone", nil)
+		} else {
+			loc = bodyLoc
+		}
+	}
+	var dueDate *time.Time
+	if todoReq.DueDate != nil {
+		if todoReq.DueDate.Valid() {
+			due := todoReq.DueDate.In(loc)
+			dueDate = &due
+		} else {
+			problems.add("due_date", "invalid_date", renderer.M{"param": "due_date"})
+		}
+	}
+
+	// quick-add: pull tags, priority and due date out of the title
+	var parsed *QuickAdd
+	if todoReq.QuickAdd || r.URL.Query().Get("parse") == "true" {
+		quick := parseQuickAdd(todoReq.Title, time.Now().In(loc))
+		parsed = &quick
+
+		todoReq.Title = quick.Title
+		for _, tag := range quick.Tags {
+			if !slices.Contains(todoReq.Tags, tag) {
+				todoReq.Tags = append(todoReq.Tags, tag)
+			}
+		}
+		// explicit fields win over the parsed ones
+		if todoReq.Priority == "" {
+			todoReq.Priority = quick.Priority
+		}
+		if dueDate == nil && quick.DueDate != nil {
+			due := quick.DueDate.UTC()
+			dueDate = &due
+		}
 	}
 
-	// add the todo to the db
-	data, err := db.Collection(collectionName).InsertOne(r.Context(), todoModel)
+	if code, params := titleProblem(todoReq.Title); code != "" {
+		problems.add("title", code, params)
+	}
+	for _, tag := range todoReq.Tags {
+		if code := tagProblem(tag); code != "" {
+			problems.add("tags", code, renderer.M{"tag": tag})
+		}
+	}
+	priority, ok := normalizePriority(todoReq.Priority)
+	if !ok {
+		problems.add("priority", "invalid_priority", renderer.M{
+			"allowed": strings.Join(priorities, ", "),
+		})
+	}
+	color, err := normalizeColor(todoReq.Color)
 	if err != nil {
-		log.Printf("failed to insert data into the db: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusInternalServerError, renderer.M{
-			"message": "Failed to insert data into db",
-			"error":   err.Error(),
+		problems.add("color", "invalid_color", nil)
+	}
+	if code, params := estimateProblem(todoReq.EstimateMinutes); code != "" {
+		problems.add("estimate_minutes", code, params)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+	// a create sent again, say by a client replaying what it did offline
+	if key != "" && replayCreate(rw, r, key) {
+		return
+	}
+	if !checkQuota(rw, r, 1) {
+		return
+	}
+
+	now := time.Now().UTC()
+	todoModel := newTodoModel(todoReq.Title, now)
+	todoModel.IdempotencyKey = key
+	todoModel.Color = color
+	todoModel.Tags = todoReq.Tags
+	todoModel.Priority = priority
+	todoModel.DueDate = dueDate
+	todoModel.EstimateMinutes = todoReq.EstimateMinutes
+	if todoReq.Completed {
+		todoModel.Completed = true
+		todoModel.CompletedAt = &now
+	}
+
+	// add the todo to the db, even when the client hangs up from here on
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	if key != "" {
+		// a second attempt finds the todo of the first one by its key
+		err = retryDB(writeCtx, "todo_create", func() error {
+			return insertTodo(writeCtx, todoModel)
 		})
+	} else {
+		err = insertTodo(writeCtx, todoModel)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		// the same create may have come in twice at once
+		if key != "" && replayCreate(rw, r, key) {
+			return
+		}
+		writeDuplicateTitle(rw, r, todoModel.NormalizedTitle, todoModel.ID)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to insert data into the db: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_create_failed")
+		return
+	}
+	rw.Header().Set("ETag", todoETag(r, todoModel))
+	// echo what quick-add extracted so the UI can confirm it
+	resp := CreateTodoResponse{
+		Message: localize(r, "todo_created"),
+		Parsed:  parsed,
+	}
+	// without unique titles, let the UI warn about an identical open todo
+	if !currentConfig().UniqueTitles {
+		duplicate, err := findOpenDuplicate(r.Context(), todoModel.NormalizedTitle, todoModel.ID)
+		if err != nil {
+			log.Printf("failed to look up duplicates of %s: %v\n", todoModel.ID.Hex(), err)
+		}
+		if !duplicate.IsZero() {
+			resp.DuplicateOf = formatID(duplicate)
+		}
+	}
+	// the server-rendered form goes back to the page it was posted from
+	if target := formRedirect(r); target != "" {
+		http.Redirect(rw, r, target, http.StatusSeeOther)
 		return
 	}
-	rnd.JSON(rw, http.StatusCreated, renderer.M{
-		"message": "Todo created successfully",
-		"ID":      data.InsertedID,
+	resp.setID(rw, currentConfig(), formatID(todoModel.ID))
+	renderJSON(rw, r, http.StatusCreated, resp)
+}
+
+// setID sets the id of the created todo under the names
+// http.compatibility_mode asks for: "ID" alone when old, "id" alone when new.
+func (resp *CreateTodoResponse) setID(rw http.ResponseWriter, cfg *Config, id string) {
+	if cfg.HTTP.CompatibilityMode != compatOld {
+		resp.ID = id
+	}
+	if cfg.HTTP.CompatibilityMode != compatNew {
+		resp.LegacyID = id
+		deprecateField(rw, cfg, "ID")
+	}
+}
+
+// insertTodo adds td to the db with its created event and counts it in the
+// quota.
+func insertTodo(ctx context.Context, td TodoModel) error {
+	err := runInTransaction(ctx, func(ctx context.Context) error {
+		if _, err := tenantDB(ctx).Collection(collectionName).InsertOne(ctx, td); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoCreated, td.ID)
 	})
+	if err == nil {
+		addQuotaUsage(ctx, 1)
+	}
+	return err
 }
 
 // updateTodo
@@ -182,46 +613,316 @@ func updateTodo(rw http.ResponseWriter, r *http.Request) {
 	// get the id from the url params
 	id := strings.TrimSpace(chi.URLParam(r, "id"))
 
-	res, err := primitive.ObjectIDFromHex(id)
+	res, err := parseID(id)
 	if err != nil {
 		log.Printf("the id param is not a valid a hex value: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusInternalServerError, renderer.M{
-			"message": "The id is Invalid",
-			"error":   err.Error(),
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
 		})
 		return
 	}
 
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
 	// store the user input sent through the request body
 	var updateTodoReq UpdateTodo
 
-	if err := json.NewDecoder(r.Body).Decode(&updateTodoReq); err != nil {
+	if err := decodeJSON(r, &updateTodoReq); err != nil {
 		log.Printf("failed to decode the json response body data: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusBadRequest, err.Error())
-	}
-	if updateTodoReq.Title == "" {
-		rnd.JSON(rw, http.StatusBadRequest, renderer.M{
-			"message": "Title connot be empty",
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
 		})
 		return
 	}
+	updateTodoReq.Title = cleanTitle(updateTodoReq.Title)
+
+	normalized := titleIndex(updateTodoReq.Title)
+	set := bson.M{
+		"title":            sealedText(updateTodoReq.Title),
+		"normalized_title": normalized,
+		"completed":        updateTodoReq.Completed,
+		"updated_at":       time.Now().UTC(),
+	}
+	problems := newFieldErrors(r)
+	if code, params := titleProblem(updateTodoReq.Title); code != "" {
+		problems.add("title", code, params)
+	}
+	if updateTodoReq.Color != nil {
+		color, err := normalizeColor(*updateTodoReq.Color)
+		if err != nil {
+			problems.add("color", "invalid_color", nil)
+		}
+		set["color"] = color
+	}
+	if updateTodoReq.EstimateMinutes != nil {
+		if code, params := estimateProblem(*updateTodoReq.EstimateMinutes); code != "" {
+			problems.add("estimate_minutes", code, params)
+		}
+		set["estimate_minutes"] = *updateTodoReq.EstimateMinutes
+	}
+	if problems.write(rw, r) {
+		return
+	}
 
 	// update the todo in the db
-	filter := bson.M{"id": res}
-	update := bson.M{"$set": bson.M{"title": updateTodoReq.Title, "completed": updateTodoReq.Completed}}
-	data, err := db.Collection(collectionName).UpdateOne(r.Context(), filter, update)
+	update := bumpVersion(bson.M{"$set": set})
+	clearCompletion(update, updateTodoReq.Completed)
+	cancelReminders(update, updateTodoReq.Completed)
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	td, err := updateTodoOnce(writeCtx, res, update, &updateTodoReq.Completed)
+	if mongo.IsDuplicateKeyError(err) {
+		writeDuplicateTitle(rw, r, normalized, res)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_update_failed")
+		return
+	}
+	if td == nil {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	writeUpdatedTodo(rw, r, *td, loc)
+}
 
+// clearCompletion makes update drop completed_at when it reopens a todo.
+func clearCompletion(update bson.M, completed bool) {
+	if !completed {
+		update["$unset"] = bson.M{"completed_at": ""}
+	}
+}
+
+// stampCompletion records when a todo was completed, keeping the time of the
+// first completion when it already was.
+func stampCompletion(ctx context.Context, id primitive.ObjectID) {
+	filter := bson.M{"id": id, "completed": true, "completed_at": bson.M{"$exists": false}}
+	update := bumpVersion(bson.M{"$set": bson.M{"completed_at": time.Now().UTC()}})
+	if _, err := tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, update); err != nil {
+		log.Printf("failed to record the completion of %s: %v\n", id.Hex(), err)
+	}
+}
+
+// patchTodo updates only the fields present in the request body.
+func patchTodo(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
 	if err != nil {
-		log.Printf("failed to update db collection: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusInternalServerError, renderer.M{
-			"message": "Failed to update data in the db",
-			"error":   err.Error(),
+		log.Printf("the id param is not a valid a hex value: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
 		})
 		return
 	}
-	rnd.JSON(rw, http.StatusOK, renderer.M{
-		"message": "Todo updated successfully",
-		"data":    data.ModifiedCount,
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	var patchTodoReq PatchTodo
+	if err := decodeJSON(r, &patchTodoReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	set := bson.M{}
+	problems := newFieldErrors(r)
+	if patchTodoReq.Title != nil {
+		title := cleanTitle(*patchTodoReq.Title)
+		if code, params := titleProblem(title); code != "" {
+			problems.add("title", code, params)
+		}
+		set["title"] = sealedText(title)
+		set["normalized_title"] = titleIndex(title)
+	}
+	if patchTodoReq.Completed != nil {
+		set["completed"] = *patchTodoReq.Completed
+	}
+	if patchTodoReq.Starred != nil {
+		set["starred"] = *patchTodoReq.Starred
+	}
+	if patchTodoReq.Color != nil {
+		color, err := normalizeColor(*patchTodoReq.Color)
+		if err != nil {
+			problems.add("color", "invalid_color", nil)
+		}
+		set["color"] = color
+	}
+	if patchTodoReq.EstimateMinutes != nil {
+		if code, params := estimateProblem(*patchTodoReq.EstimateMinutes); code != "" {
+			problems.add("estimate_minutes", code, params)
+		}
+		set["estimate_minutes"] = *patchTodoReq.EstimateMinutes
+	}
+	if problems.write(rw, r) {
+		return
+	}
+	if len(set) == 0 {
+		writeError(rw, r, http.StatusBadRequest, "nothing_to_update", nil)
+		return
+	}
+	set["updated_at"] = time.Now().UTC()
+
+	update := bumpVersion(bson.M{"$set": set})
+	if patchTodoReq.Completed != nil {
+		clearCompletion(update, *patchTodoReq.Completed)
+		cancelReminders(update, *patchTodoReq.Completed)
+	}
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	td, err := updateTodoOnce(writeCtx, id, update, patchTodoReq.Completed)
+	if mongo.IsDuplicateKeyError(err) {
+		// reopening a todo can clash as well, so the title may come from the db
+		normalized, _ := set["normalized_title"].(string)
+		writeDuplicateTitle(rw, r, normalized, id)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_update_failed")
+		return
+	}
+	if td == nil {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	writeUpdatedTodo(rw, r, *td, loc)
+}
+
+// updateTodoOnce applies update, which must bump the version, to the todo id
+// with applyTodoUpdate, sent again after a transient failure without being
+// applied twice. Every attempt only matches the version the todo had before
+// the first. When a later attempt matches nothing, the first may have gone
+// through with its answer lost, and the todo is looked for as it would have
+// left it: past that version and written no earlier than the updated_at of
+// update. Failing that, another write changed the todo in between, and the
+// update is applied on top of it once more, unretried, as the last write
+// wins. It returns nil when there is no todo id.
+func updateTodoOnce(ctx context.Context, id primitive.ObjectID, update bson.M, completed *bool) (*TodoModel, error) {
+	var current TodoModel
+	opts := options.FindOne().SetProjection(bson.M{"version": 1})
+	err := retryDB(ctx, "todo_version", func() error {
+		return tenantDB(ctx).Collection(collectionName).FindOne(ctx, bson.M{"id": id}, opts).Decode(&current)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	written := update["$set"].(bson.M)["updated_at"]
+	var td *TodoModel
+	attempts := 0
+	err = retryDB(ctx, "todo_update", func() error {
+		attempts++
+		var err error
+		td, err = applyTodoUpdate(ctx, versionFilter(id, current.Version), update, completed)
+		if err != nil || td != nil || attempts == 1 {
+			return err
+		}
+		var applied TodoModel
+		filter := bson.M{"id": id, "version": bson.M{"$gt": current.Version}, "updated_at": bson.M{"$gte": written}}
+		err = tenantDB(ctx).Collection(collectionName).FindOne(ctx, filter).Decode(&applied)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err == nil {
+			td = &applied
+		}
+		return err
+	})
+	if err != nil || td != nil {
+		return td, err
+	}
+	return applyTodoUpdate(ctx, bson.M{"id": id}, update, completed)
+}
+
+// versionFilter matches the todo id at version, which todos stored before
+// versions existed have as none.
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"id": id, "version": bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{"id": id, "version": version}
+}
+
+// applyTodoUpdate applies update to the todo filter matches, by id, in a
+// transaction, with what completing or reopening it entails when completed
+// is set, and records the change and a rename. It returns the todo as the
+// transaction left it, or nil when filter matches no todo.
+func applyTodoUpdate(ctx context.Context, filter bson.M, update bson.M, completed *bool) (*TodoModel, error) {
+	id := filter["id"].(primitive.ObjectID)
+	var td *TodoModel
+	err := runInTransaction(ctx, func(ctx context.Context) error {
+		// the transaction may be retried
+		td = nil
+		if err := recordRename(ctx, id, update); err != nil {
+			return err
+		}
+		updated, err := updateReturning(ctx, filter, update)
+		if err != nil || updated == nil {
+			return err
+		}
+		if completed != nil {
+			if *completed {
+				stampCompletion(ctx, id)
+				if _, _, err := stopTimer(ctx, id, time.Now().UTC()); err != nil {
+					return err
+				}
+				// both of them may have changed it since
+				if err := tenantDB(ctx).Collection(collectionName).FindOne(ctx, bson.M{"id": id}).Decode(updated); err != nil {
+					return err
+				}
+			}
+			if err := syncBlocked(ctx, id, *completed); err != nil {
+				return err
+			}
+		}
+		if err := recordTodoEvent(ctx, eventTodoUpdated, id); err != nil {
+			return err
+		}
+		td = updated
+		return nil
+	})
+	return td, err
+}
+
+// updateReturning applies update to the todo filter matches and returns it
+// as the update left it, or nil when filter matches none. Finding and
+// updating it at once leaves no room for another write to slip in between.
+func updateReturning(ctx context.Context, filter, update bson.M) (*TodoModel, error) {
+	var td TodoModel
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := tenantDB(ctx).Collection(collectionName).FindOneAndUpdate(ctx, filter, update, opts).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &td, nil
+}
+
+// writeUpdatedTodo answers an update with the todo td it left behind and its
+// ETag, so clients needn't fetch it again.
+func writeUpdatedTodo(rw http.ResponseWriter, r *http.Request, td TodoModel, loc *time.Location) {
+	rw.Header().Set("ETag", todoETag(r, td))
+	todo := td.toTodo(loc)
+	// the version bump changes every todo an update finds
+	renderJSON(rw, r, http.StatusOK, UpdateTodoResponse{
+		Message:       localize(r, "todo_updated"),
+		ModifiedCount: 1,
+		Data:          &todo,
 	})
 }
 
@@ -229,92 +930,618 @@ func updateTodo(rw http.ResponseWriter, r *http.Request) {
 func deleteTodo(rw http.ResponseWriter, r *http.Request) {
 	// get the id from the url params
 	id := strings.TrimSpace(chi.URLParam(r, "id"))
-	res, err := primitive.ObjectIDFromHex(id)
+	res, err := parseID(id)
 	if err != nil {
 		log.Printf("invalid id: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusBadRequest, err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
 		return
 	}
 
-	filter := bson.M{"id": res}
-	if data, err := db.Collection(collectionName).DeleteOne(r.Context(), filter); err != nil {
-		log.Printf("could not delete item from database: %v\n", err.Error())
-		rnd.JSON(rw, http.StatusInternalServerError, renderer.M{
-			"message": "an error occured while deleting todo item",
-			"error":   err.Error(),
-		})
-	} else {
-		rnd.JSON(rw, http.StatusOK, renderer.M{
-			"message": "item deleted successfully",
-			"data":    data,
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	deleted, gone, code, err := removeTodo(r, res)
+	if err != nil {
+		logRequestError(r, "could not delete item from database: %v\n", err.Error())
+		writeDBError(rw, r, err, code)
+		return
+	}
+	if gone {
+		// deleted by an attempt that seemed to fail; there is nothing to undo
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if deleted == nil {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+
+	// the deleted todo lets clients offer to undo the deletion
+	todo := deleted.toTodo(loc)
+	renderJSON(rw, r, http.StatusOK, DeleteTodoResponse{
+		Message:      localize(r, "todo_deleted"),
+		DeletedCount: 1,
+		Data:         &todo,
+	})
+}
+
+// removeTodo deletes the todo id, audited and with its comments and
+// attachments, and returns it as it was, or nil when there is no todo id.
+// gone reports a todo a retry found deleted by the attempt before it, which
+// can't be returned as it was. On failure code is the error code to answer
+// with.
+func removeTodo(r *http.Request, id primitive.ObjectID) (deleted *TodoModel, gone bool, code string, err error) {
+	// record the deletion before it happens so it can't go unaudited; from
+	// then on it is carried out even when the client hangs up
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	auditID, err := beginAudit(r.WithContext(writeCtx), "todo.delete")
+	if err != nil {
+		return nil, false, "audit_failed_delete", err
+	}
+
+	// deleting again finds nothing if the first attempt went through after
+	// all, which is still the todo deleted
+	attempts := 0
+	err = retryDB(writeCtx, "todo_delete", func() error {
+		attempts++
+		return runInTransaction(writeCtx, func(ctx context.Context) error {
+			// the transaction may be retried
+			deleted, gone = nil, false
+			var td TodoModel
+			err := tenantDB(ctx).Collection(collectionName).FindOneAndDelete(ctx, bson.M{"id": id}).Decode(&td)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				gone = attempts > 1
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := unblock(ctx, []primitive.ObjectID{id}, true); err != nil {
+				return err
+			}
+			if err := recordDeletions(ctx, []primitive.ObjectID{id}, primitive.NilObjectID); err != nil {
+				return err
+			}
+			if err := recordTodoEvent(ctx, eventTodoDeleted, id); err != nil {
+				return err
+			}
+			deleted = &td
+			return nil
 		})
+	})
+	if err != nil {
+		finishAudit(writeCtx, auditID, 0, err)
+		return nil, false, "todo_delete_failed", err
 	}
+	var count int64
+	if deleted != nil || gone {
+		count = 1
+	}
+	finishAudit(writeCtx, auditID, count, nil)
+	releaseQuota(writeCtx)
+	if count == 0 {
+		return nil, false, "", nil
+	}
+
+	// cascade to the comments and attachments of the deleted todo
+	if err := deleteTodoComments(writeCtx, id); err != nil {
+		log.Printf("failed to delete the comments of %s: %v\n", id.Hex(), err)
+	}
+	if err := deleteTodoAttachments(writeCtx, id); err != nil {
+		log.Printf("failed to delete the attachments of %s: %v\n", id.Hex(), err)
+	}
+	return deleted, gone, "", nil
+}
+
+// deleteCompletedTodos removes every completed todo with its comments and
+// attachments. Removing many at once has to be confirmed, see confirmDestructive,
+// unless it is only previewed with ?dry_run.
+func deleteCompletedTodos(rw http.ResponseWriter, r *http.Request) {
+	dryRun, ok := parseDryRun(rw, r)
+	if !ok {
+		return
+	}
+	todos := tenantDB(r.Context()).Collection(collectionName)
+	filter := bson.M{"completed": true}
+
+	var completed []TodoModel
+	cursor, err := todos.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"id": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &completed)
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch completed todos: %v\n", err)
+		writeDBError(rw, r, err, "todos_fetch_failed")
+		return
+	}
+	total, err := todos.EstimatedDocumentCount(r.Context())
+	if err != nil {
+		logRequestError(r, "failed to count todo records: %v\n", err)
+		writeDBError(rw, r, err, "todos_count_failed")
+		return
+	}
+
+	// only the todos that were counted, not those completed since
+	ids := make([]primitive.ObjectID, len(completed))
+	for i, td := range completed {
+		ids[i] = td.ID
+	}
+	if dryRun {
+		writeDryRun(rw, r, ids, needsConfirmation(currentConfig().Destructive, int64(len(ids)), total))
+		return
+	}
+	if !confirmDestructive(rw, r, int64(len(completed)), total) {
+		return
+	}
+
+	auditID, err := beginAudit(r, "todo.delete_completed")
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_delete")
+		return
+	}
+	var data *mongo.DeleteResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).DeleteMany(ctx, bson.M{"id": bson.M{"$in": ids}, "completed": true})
+		if err != nil {
+			return err
+		}
+		if err := unblock(ctx, ids, true); err != nil {
+			return err
+		}
+		if err := recordDeletions(ctx, ids, primitive.NilObjectID); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := recordTodoEvent(ctx, eventTodoDeleted, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		finishAudit(r.Context(), auditID, 0, err)
+		logRequestError(r, "could not delete items from database: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_delete_failed")
+		return
+	}
+	finishAudit(r.Context(), auditID, data.DeletedCount, nil)
+	releaseQuota(r.Context())
+
+	for _, id := range ids {
+		if err := deleteTodoComments(r.Context(), id); err != nil {
+			log.Printf("failed to delete the comments of %s: %v\n", id.Hex(), err)
+		}
+		if err := deleteTodoAttachments(r.Context(), id); err != nil {
+			log.Printf("failed to delete the attachments of %s: %v\n", id.Hex(), err)
+		}
+	}
+
+	renderJSON(rw, r, http.StatusOK, DeleteTodoResponse{
+		Message:      localize(r, "todos_deleted"),
+		DeletedCount: data.DeletedCount,
+	})
 }
 
 func main() {
-	router := chi.NewRouter()
-	router.Use(middleware.Logger)
-	router.Get("/", homeHandler)
-	router.Mount("/todo", todoHandlers())
+	configPath := flag.String("config", "", "path to a YAML config file")
+	printCfg := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	check := flag.Bool("check", false, "run the startup self-checks, print a report and exit")
+	checkTimeout := flag.Duration("check-timeout", 5*time.Second, "timeout for each self-check")
+	migrateOnly := flag.Bool("migrate-only", false, "apply the pending database migrations and exit")
+	flagValues := configFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, warnings, err := loadConfig(*configPath, flagValues())
+	for _, warning := range warnings {
+		log.Printf("config: %s\n", warning)
+	}
+	activeConfig.Store(&cfg)
+
+	if *printCfg {
+		checkError(err)
+		checkError(printConfig(os.Stdout, cfg))
+		return
+	}
+
+	// "todo vapid-keys" prints a new key pair for push.vapid_private_key
+	if flag.Arg(0) == "vapid-keys" {
+		checkError(printVAPIDKeys(os.Stdout))
+		return
+	}
+
+	// "todo doctor" and "todo check" are aliases for -check
+	if *check || flag.Arg(0) == "doctor" || flag.Arg(0) == "check" {
+		if !runDoctor(os.Stdout, cfg, err, *checkTimeout) {
+			os.Exit(1)
+		}
+		return
+	}
+	checkError(err)
+	logLevel.Set(cfg.logLevel)
+
+	assets, err := loadAssets(cfg.StaticDir)
+	checkError(err)
+	rnd, haveTemplates = newRenderer(cfg.HTMLDir, assets, cfg.Debug.ReloadTemplates)
+
+	shutdownTracing, err = setupTracing(context.Background())
+	checkError(err)
+
+	client, err = connectMongo(cfg, cfg.Mongo.ConnectTimeout)
+	checkError(err)
+	db = client.Database(dbName)
+	logStartupReport(cfg, "connected")
+
+	setReadOnly(cfg.ReadOnly)
+	checkError(loadRouteSwitches(context.Background()))
+
+	// migrate the data of every tenant before anything reads it
+	for _, ctx := range tenantContexts(context.Background(), cfg.Tenants) {
+		checkError(runMigrations(ctx))
+	}
+	if *migrateOnly {
+		checkError(client.Disconnect(context.Background()))
+		log.Println("migrations applied")
+		return
+	}
+	// "todo integrity-check [-repair]" checks the todos of every tenant and exits
+	if flag.Arg(0) == "integrity-check" {
+		clean, err := runIntegrityCommand(os.Stdout, flag.Args()[1:], cfg.Tenants)
+		checkError(client.Disconnect(context.Background()))
+		checkError(err)
+		if !clean {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// every tenant has a database of its own and needs its own indexes
+	for _, ctx := range tenantContexts(context.Background(), cfg.Tenants) {
+		// keep the audit log bounded
+		checkError(ensureAuditIndexes(ctx, cfg.Audit.Retention))
+		checkError(ensureCommentIndexes(ctx))
+		checkError(ensureAttachmentIndexes(ctx))
+		checkError(ensureTitleIndexes(ctx, cfg.UniqueTitles))
+		checkError(ensureTodoSchema(ctx, cfg.Mongo.SchemaValidation))
+		checkError(ensureOutboxIndexes(ctx))
+		checkError(ensureListIndexes(ctx))
+		checkError(ensureReminderIndexes(ctx))
+		checkError(ensureBlockerIndexes(ctx))
+		checkError(ensureMergedIndexes(ctx))
+		checkError(ensureFormTokenIndexes(ctx))
+		checkError(ensureSyncIndexes(ctx, cfg.Sync.TombstoneRetention))
+		checkError(ensurePushIndexes(ctx))
+	}
+
+	// with secondary reads a request may not see the writes before it
+	if cfg.Mongo.CausalConsistency {
+		causalSessions.Store(detectTransactions(context.Background()))
+		if !causalSessions.Load() {
+			log.Println("MongoDB is a standalone server, mongo.causal_consistency has no effect")
+		}
+	}
+
+	transactionsSupported.Store(detectTransactions(context.Background()))
+	if !transactionsSupported.Load() {
+		log.Println("MongoDB doesn't support transactions, template instances and merges are written best-effort")
+	}
+
+	// the background jobs run until the servers have drained; shutdown
+	// interrupts a backup in progress
+	if outboxEnabled() {
+		if !transactionsSupported.Load() {
+			log.Println("MongoDB doesn't support transactions, todo events and reminders are recorded best-effort")
+		}
+		jobs.every("reminders", cfg.Webhooks.PollInterval, remindersJob(cfg.Tenants))
+		jobs.every("webhooks", cfg.Webhooks.PollInterval, webhooksJob(cfg.Tenants))
+	}
+	if cfg.backupSchedule != nil {
+		jobs.cron("backup", cfg.Backup.Schedule, cfg.backupSchedule, backupJob(cfg.Tenants))
+	}
+	// also decrypts every title once encryption.keys is emptied
+	jobs.manual("reencrypt", reencryptJob(cfg.Tenants))
+	jobs.start()
+
+	aggregationLimit = newConcurrencyLimiter("aggregation", cfg.Limits.Aggregations)
 
-	// Serve static files
-	// http.FileServer to serve static files from the 'static' directory on the server
-	fs := http.FileServer(http.Dir("./static"))
-	router.Handle("/static/*", http.StripPrefix("/static/", fs))
+	router := newRouter(cfg, assets)
+
+	// a route shadowed by another is a bug of this code, not of the setup
+	routeMap, err = routeTable(router)
+	checkError(err)
+	logRoutes(routeMap)
+	checkError(auditRoutes(routeMap))
+	checkError(checkTodoFields())
+	for _, route := range cfg.DisabledRoutes {
+		if !knownRoute(route) {
+			log.Printf("disabled_routes: no route %s\n", route)
+		}
+	}
 
 	server := &http.Server{
-		Addr:         ":9000",
 		Handler:      router,
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 	}
+	drainableServer = server
+	servers := map[string]*http.Server{cfg.HTTP.Addr: server}
+	if cfg.HTTP.AdminAddr != "" {
+		servers[cfg.HTTP.AdminAddr] = &http.Server{
+			Handler:      adminHandlers(),
+			ReadTimeout:  60 * time.Second,
+			WriteTimeout: 60 * time.Second,
+		}
+	}
 
 	// create a channel to receive siglan
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	// start the server in a goroutine
-	go func() {
-		fmt.Println("Server started on port", 9000)
-		if err := server.ListenAndServe(); err != nil {
-			log.Printf("listen:%s\n", err)
+	// start the servers, each in its own goroutine; a port that is taken ends
+	// the process here
+	serveFailed := make(chan error, len(servers))
+	for addr, srv := range servers {
+		checkError(serve(srv, addr, cfg.HTTP.SocketMode, serveFailed))
+	}
+	listening.Store(true)
+
+	// under systemd with Type=notify the units after this one start once the
+	// listeners accept and the database answers
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout)
+	checkError(checkDatabase(pingCtx, db, false))
+	cancelPing()
+	notifyState(sdReady)
+	stopWatchdog := func() {}
+	if interval := watchdogInterval(); interval > 0 {
+		stopWatchdog = runWatchdog(interval, func(ctx context.Context) error {
+			return checkDatabase(ctx, db, false)
+		})
+	}
+
+	// wait for a signal to shut down the server, SIGHUP reloads the configuration
+	// instead. A server that stops on its own shuts the others down too.
+	exitCode := 0
+wait:
+	for {
+		select {
+		case err := <-serveFailed:
+			log.Printf("server failed: %v\n", err)
+			exitCode = 1
+			break wait
+		case sig := <-stopChan:
+			log.Printf("signal received: %v\n", sig)
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+			notifyState(sdReloading)
+			if err := reloadConfig(*configPath, flagValues()); err != nil {
+				log.Printf("config reload failed, keeping the current configuration: %v\n", err)
+			}
+			notifyState(sdReady)
 		}
-	}()
+	}
+	notifyState(sdStopping)
+	listening.Store(false)
 
-	// wait for a signal to shut down the server
-	sig := <-stopChan
-	log.Printf("signal received: %v\n", sig)
+	// from here on /healthz answers 503 so load balancers stop sending requests
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig().HTTP.DrainTimeout)
+	defer cancel()
+
+	// shutdown the servers gracefully, closing every listener. The admin
+	// listener goes last so its /healthz keeps reporting the drain.
+	stopReporting := reportDrain(time.Second)
+	shutdownOrder := []string{cfg.HTTP.Addr}
+	if cfg.HTTP.AdminAddr != "" {
+		shutdownOrder = append(shutdownOrder, cfg.HTTP.AdminAddr)
+	}
+	for _, addr := range shutdownOrder {
+		if err := servers[addr].Shutdown(ctx); err != nil {
+			log.Fatalf("Server shutdown failed: %v\n", err)
+		}
+		cleanupSocket(addr)
+	}
+	stopReporting()
+	jobs.stop()
+	stopWatchdog()
 
-	// disconnect mongo client from the database
+	// disconnect mongo client from the database once no request needs it
 	if err := client.Disconnect(context.Background()); err != nil {
 		panic(err)
 	}
-	// create a context with a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
 
-	// shutdown the server gracefully
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server shutdown failed: %v\n", err)
+	// flush any spans still buffered in the exporter
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("failed to flush traces: %v\n", err)
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 	log.Println("Server shutdown gracefully")
 
 }
 
+// newRouter builds the handler of the main listener, which serves the pages,
+// the API and, without an admin listener, the operational endpoints.
+func newRouter(cfg Config, assets *assetManifest) *chi.Mux {
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	// answer HEAD with the GET handler wherever there is no HEAD route; it
+	// takes the root of a mounted router for one, so "/" routes register HEAD
+	router.Use(middleware.GetHead)
+	router.Use(realIPMiddleware)
+	router.Use(tracingMiddleware)
+	router.Use(accessLog)
+	router.Use(captureBodies)
+	router.Use(countInFlight)
+	router.Use(closeWhileDraining)
+	router.Use(routeSwitch)
+	router.Use(authenticate)
+	router.Use(rateLimitMiddleware)
+	router.NotFound(notFound)
+	router.MethodNotAllowed(methodNotAllowed)
+	// what each group needs is granted by auth.policy; /healthz, /static and
+	// the share links, which carry their own token, need nothing
+	router.With(requirePermission(permRead)).Get("/", homeHandler)
+	router.With(requirePermission(permRead), withTenant, aggregationLimit.limit).Get("/stats", statsPageHandler)
+	router.Get("/healthz", healthHandler)
+	router.Route(apiV1.prefix(), func(r chi.Router) {
+		r.Use(requireMethodPermission, withTenant, causalSession)
+		r.With(readOnlyMiddleware).Mount("/todo", todoHandlers(apiV1))
+		r.With(readOnlyMiddleware).Mount("/attachment", attachmentHandlers(apiV1))
+		r.With(readOnlyMiddleware).Mount("/filter", filterHandlers(apiV1))
+		r.With(readOnlyMiddleware).Mount("/template", templateHandlers(apiV1))
+		r.With(readOnlyMiddleware).Mount("/push", pushHandlers())
+	})
+	// the unversioned paths predate /api/v1 and stay as deprecated aliases
+	router.With(requireMethodPermission, withTenant, causalSession, readOnlyMiddleware, deprecatedAlias(apiV1)).Mount("/todo", todoHandlers(apiV1))
+	router.With(requireMethodPermission, withTenant, causalSession, readOnlyMiddleware, deprecatedAlias(apiV1)).Mount("/attachment", attachmentHandlers(apiV1))
+	router.Mount("/admin", adminAPIHandlers())
+	// share links work without credentials or tenant, their token names both
+	router.Route("/t/{token}", func(r chi.Router) {
+		r.Use(shareRateLimit)
+		r.Get("/", withShareToken(getSharedTodo))
+		r.Head("/", withShareToken(getSharedTodo))
+		r.With(readOnlyMiddleware).Post("/complete", withShareToken(completeSharedTodo))
+	})
+
+	// Serve static files, fingerprinted by the asset func of the templates
+	router.Handle("/static/*", http.StripPrefix("/static", staticHandler(cfg.StaticDir, assets)))
+
+	// without a dedicated admin listener the metrics stay on the main router
+	if cfg.HTTP.AdminAddr == "" {
+		router.Handle("/metrics", promhttp.Handler())
+		router.Get("/debug/routes", routesHandler)
+	}
+	return router
+}
+
 // todoHandlers ...
-func todoHandlers() http.Handler {
+func todoHandlers(version apiVersion) http.Handler {
 	router := chi.NewRouter()
+	router.Use(withAPIVersion(version), limitBody, routeOptions)
 	router.Group(
 		func(r chi.Router) {
+			// the literal routes refuse what they don't answer instead of
+			// passing it on to /{id}, see auditRoutes
+			refuseMethods(r, []string{
+				"/stats", "/review", "/grouped", "/streak", "/burndown", "/search", "/changes", "/colors", "/completed",
+				"/views/{view}", "/tags/counts", "/tags/rename", "/tags/merge", "/tags/{tag}",
+			}, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
 			r.Get("/", getTodos)
+			r.Head("/", getTodos)
 			r.Post("/", createTodo)
+			r.With(aggregationLimit.limit).Get("/stats", getStats)
+			r.With(aggregationLimit.limit).Get("/review", getReview)
+			r.With(aggregationLimit.limit).Get("/grouped", getGroupedTodos)
+			r.With(aggregationLimit.limit).Get("/streak", getStreak)
+			r.With(aggregationLimit.limit).Get("/burndown", getBurndown)
+			r.Get("/search", searchTodos)
+			r.Get("/changes", getChanges)
+			r.Get("/views/{view}", getView)
+			r.Get("/reminders/upcoming", getUpcomingReminders)
+			r.With(aggregationLimit.limit).Get("/tags/counts", getTagCounts)
+			r.Post("/tags/rename", renameTag)
+			r.Post("/tags/merge", mergeTags)
+			r.Delete("/tags/{tag}", deleteTag)
+			r.Get("/colors", getColors)
+			r.Delete("/completed", deleteCompletedTodos)
+			r.Get("/{id}", getTodo)
 			r.Put("/{id}", updateTodo)
+			r.Patch("/{id}", patchTodo)
 			r.Delete("/{id}", deleteTodo)
+			r.Post("/{id}/star", starTodo)
+			r.Delete("/{id}/star", unstarTodo)
+			r.Post("/{id}/defer", deferTodo)
+			r.Post("/{id}/comment", createComment)
+			r.Get("/{id}/comments", getComments)
+			r.Delete("/{id}/comment/{commentId}", deleteComment)
+			r.Post("/{id}/attachment", uploadAttachment)
+			r.Get("/{id}/attachments", getAttachments)
+			r.Post("/{id}/share", shareTodo)
+			r.Post("/{id}/reminders", createReminder)
+			r.Delete("/{id}/reminders/{reminderId}", deleteReminder)
+			r.Post("/{id}/blockers/{blockerId}", addBlocker)
+			r.Delete("/{id}/blockers/{blockerId}", removeBlocker)
+			r.Post("/{id}/merge", mergeTodo)
+			r.Post("/{id}/timer/start", startTimer)
+			r.Post("/{id}/timer/stop", stopTimerHandler)
 		})
 
 	return router
 }
 
+// newTodoModel returns a new open todo titled title, created at now, with
+// the fields every todo needs filled in. title must be cleaned already.
+func newTodoModel(title string, now time.Time) TodoModel {
+	return TodoModel{
+		ID:              primitive.NewObjectID(),
+		Title:           sealedText(title),
+		NormalizedTitle: titleIndex(title),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// toTodo converts the db model to what the frontend displays, with times in loc.
+func (td TodoModel) toTodo(loc *time.Location) Todo {
+	var dueDate, completedAt *time.Time
+	if td.DueDate != nil {
+		due := td.DueDate.In(loc)
+		dueDate = &due
+	}
+	if td.CompletedAt != nil {
+		completed := td.CompletedAt.In(loc)
+		completedAt = &completed
+	}
+	var timerStartedAt *time.Time
+	if td.TimerStartedAt != nil {
+		started := td.TimerStartedAt.In(loc)
+		timerStartedAt = &started
+	}
+	var deferredUntil *time.Time
+	if td.DeferredUntil != nil && td.DeferredUntil.After(time.Now()) {
+		until := td.DeferredUntil.In(loc)
+		deferredUntil = &until
+	}
+	// the lists are [] rather than null when empty
+	tags := td.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	todo := Todo{
+		ID:              formatID(td.ID),
+		Title:           string(td.Title),
+		Completed:       td.Completed,
+		Starred:         td.Starred,
+		Color:           td.Color,
+		Tags:            tags,
+		Priority:        td.Priority,
+		DueDate:         dueDate,
+		CommentCount:    td.CommentCount,
+		CreatedAt:       td.CreatedAt.In(loc),
+		UpdatedAt:       td.UpdatedAt.In(loc),
+		CompletedAt:     completedAt,
+		Reminders:       pendingReminders(td.Reminders, loc),
+		BlockedBy:       formatIDs(td.BlockedBy),
+		Blocked:         len(td.OpenBlockers) > 0,
+		EstimateMinutes: td.EstimateMinutes,
+		SpentMinutes:    td.SpentMinutes,
+		TimerStartedAt:  timerStartedAt,
+		DeferredUntil:   deferredUntil,
+		Version:         td.Version,
+	}
+	todo.setAge(time.Duration(currentConfig().StaleAfterDays)*24*time.Hour, time.Now())
+	return todo
+}
+
 // checkError ...
 func checkError(err error) {
 	if err != nil {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// useConfig makes cfg the configuration in effect for the test, restoring
+// the previous one afterwards.
+func useConfig(t *testing.T, cfg Config) {
+	t.Helper()
+	prev := activeConfig.Load()
+	activeConfig.Store(&cfg)
+	t.Cleanup(func() { activeConfig.Store(prev) })
+}
+
+// useRenderer makes r the renderer of the handlers for the test, a plain
+// renderer without templates when r is nil.
+func useRenderer(t *testing.T, r Renderer) {
+	t.Helper()
+	if r == nil {
+		r = renderer.New()
+	}
+	prev := rnd
+	rnd = r
+	t.Cleanup(func() { rnd = prev })
+}
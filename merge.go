@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// the todos absorbed by a merge, kept with a pointer to where they went
+	mergedCollectionName string = "merged_todos"
+
+	// event type of a todo absorbed by another
+	eventTodoMerged string = "todo.merged"
+
+	maxMergeTodos = 50
+)
+
+// errMergeTodoMissing is returned by mergeTodos when a todo to absorb doesn't
+// exist.
+type errMergeTodoMissing struct {
+	id primitive.ObjectID
+}
+
+func (e errMergeTodoMissing) Error() string {
+	return "todo " + e.id.Hex() + " not found"
+}
+
+type (
+	// merge todos into the todo of the path
+	MergeTodos struct {
+		IDs []string `json:"ids"`
+	}
+	// a todo absorbed by a merge
+	MergedTodoModel struct {
+		TodoModel  `bson:",inline"`
+		MergedInto primitive.ObjectID `bson:"merged_into"`
+		MergedAt   time.Time          `bson:"merged_at"`
+	}
+	// the target of a merge after it
+	MergeTodosResponse struct {
+		Message string   `json:"message"`
+		Data    Todo     `json:"data"`
+		Merged  []string `json:"merged"`
+	}
+)
+
+// mergeTodo folds the todos of the body into the todo {id}: it takes their
+// tags, comments and attachments and the earliest creation time, and the
+// todos themselves move to the merged_todos collection.
+func mergeTodo(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	var mergeReq MergeTodos
+	if err := decodeJSON(r, &mergeReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var ids []primitive.ObjectID
+	problems := newFieldErrors(r)
+	for _, value := range mergeReq.IDs {
+		other, err := parseID(value)
+		switch {
+		case err != nil:
+			problems.add("ids", "invalid_id", renderer.M{"error": err.Error()})
+		case other == id:
+			problems.add("ids", "merge_into_itself", nil)
+		case !slices.Contains(ids, other):
+			ids = append(ids, other)
+		}
+	}
+	if len(mergeReq.IDs) == 0 {
+		problems.add("ids", "merge_ids_required", nil)
+	}
+	if len(ids) > maxMergeTodos {
+		problems.add("ids", "too_many_merge_ids", renderer.M{"max": maxMergeTodos})
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	auditID, err := beginAudit(r, "todo.merge")
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_merge")
+		return
+	}
+	writeCtx, cancel := detachWrite(r)
+	defer cancel()
+	td, err := mergeTodos(writeCtx, id, ids)
+	var missing errMergeTodoMissing
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		finishAudit(writeCtx, auditID, 0, err)
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	case errors.As(err, &missing):
+		finishAudit(writeCtx, auditID, 0, err)
+		writeError(rw, r, http.StatusNotFound, "merge_todo_not_found", renderer.M{
+			"id": formatID(missing.id),
+		})
+		return
+	case err != nil:
+		finishAudit(writeCtx, auditID, 0, err)
+		logRequestError(r, "failed to merge todos into %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "todo_merge_failed")
+		return
+	}
+	finishAudit(writeCtx, auditID, int64(len(ids)), nil)
+	releaseQuota(writeCtx)
+
+	rw.Header().Set("ETag", todoETag(r, td))
+	renderJSON(rw, r, http.StatusOK, MergeTodosResponse{
+		Message: localize(r, "todos_merged"),
+		Data:    td.toTodo(loc),
+		Merged:  formatIDs(ids),
+	})
+}
+
+// mergeTodos absorbs the todos ids into the todo id in one transaction and
+// returns it as merged. A standalone server can't run one, and a failure
+// there may leave the merge half done. Its completion is left as it is. Blockers naming an
+// absorbed todo are dropped, as when it is deleted.
+func mergeTodos(ctx context.Context, id primitive.ObjectID, ids []primitive.ObjectID) (TodoModel, error) {
+	var merged TodoModel
+	err := runAtomically(ctx, func(ctx context.Context) error {
+		db := tenantDB(ctx)
+		todos := db.Collection(collectionName)
+
+		var target TodoModel
+		if err := todos.FindOne(ctx, bson.M{"id": id}).Decode(&target); err != nil {
+			return err
+		}
+		var absorbed []TodoModel
+		cursor, err := todos.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+		if err == nil {
+			err = cursor.All(ctx, &absorbed)
+		}
+		if err != nil {
+			return err
+		}
+		for _, other := range ids {
+			if !slices.ContainsFunc(absorbed, func(td TodoModel) bool { return td.ID == other }) {
+				return errMergeTodoMissing{id: other}
+			}
+		}
+
+		tags := target.Tags
+		createdAt := target.CreatedAt
+		for _, td := range absorbed {
+			tags = append(tags, td.Tags...)
+			if td.CreatedAt.Before(createdAt) {
+				createdAt = td.CreatedAt
+			}
+		}
+
+		moved, err := db.Collection(commentCollectionName).UpdateMany(ctx,
+			bson.M{"todo_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"todo_id": id}})
+		if err != nil {
+			return err
+		}
+		bucket, err := attachmentBucket(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := bucket.GetFilesCollection().UpdateMany(ctx,
+			bson.M{"metadata.todo_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"metadata.todo_id": id}}); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		tombstones := make([]interface{}, len(absorbed))
+		for i, td := range absorbed {
+			tombstones[i] = MergedTodoModel{TodoModel: td, MergedInto: id, MergedAt: now}
+			if err := recordMergedEvent(ctx, td, id); err != nil {
+				return err
+			}
+		}
+		if _, err := db.Collection(mergedCollectionName).InsertMany(ctx, tombstones); err != nil {
+			return err
+		}
+		if _, err := todos.DeleteMany(ctx, bson.M{"id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+		if err := recordDeletions(ctx, ids, id); err != nil {
+			return err
+		}
+		if err := unblock(ctx, ids, true); err != nil {
+			return err
+		}
+
+		set := bson.M{"created_at": createdAt, "updated_at": now}
+		if tags = cleanTags(tags); len(tags) > 0 {
+			set["tags"] = tags
+		}
+		update := bumpVersion(bson.M{"$set": set, "$inc": bson.M{"comment_count": moved.ModifiedCount}})
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		if err := todos.FindOneAndUpdate(ctx, bson.M{"id": id}, update, opts).Decode(&merged); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	return merged, err
+}
+
+// recordMergedEvent queues the todo.merged event of td, absorbed by into.
+func recordMergedEvent(ctx context.Context, td TodoModel, into primitive.ObjectID) error {
+	if !webhooksEnabled() {
+		return nil
+	}
+	todo := td.toTodo(time.UTC)
+	return queueEvent(ctx, WebhookEvent{
+		Type:       eventTodoMerged,
+		TodoID:     formatID(td.ID),
+		Todo:       &todo,
+		MergedInto: formatID(into),
+	})
+}
+
+// mergedInto returns the todo the todo id was merged into, if it was.
+func mergedInto(ctx context.Context, id primitive.ObjectID) (primitive.ObjectID, bool) {
+	var tombstone MergedTodoModel
+	err := tenantDB(ctx).Collection(mergedCollectionName).FindOne(ctx, bson.M{"id": id}).Decode(&tombstone)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("failed to look up whether %s was merged: %v\n", id.Hex(), err)
+		}
+		return primitive.NilObjectID, false
+	}
+	return tombstone.MergedInto, true
+}
+
+// ensureMergedIndexes indexes the absorbed todos by their id, which a lookup
+// of one of them goes by.
+func ensureMergedIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(mergedCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetName("id"),
+	})
+	return err
+}
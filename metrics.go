@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	mongoCommandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "todo_mongo_command_duration_seconds",
+			Help:    "Duration of MongoDB commands by command name and collection.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"command", "collection"},
+	)
+	mongoCommandsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_mongo_commands_total",
+			Help: "Number of MongoDB commands by command name, collection and outcome.",
+		},
+		[]string{"command", "collection", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(mongoCommandDuration, mongoCommandsTotal)
+}
+
+// startedCommand is what we remember about a command between its started and finished events.
+type startedCommand struct {
+	collection string
+	requestID  string
+}
+
+// commandMetrics records per-command durations and logs slow operations.
+type commandMetrics struct {
+	slowThreshold func() time.Duration
+	inflight      sync.Map // driver request id -> startedCommand
+}
+
+// newCommandMonitor returns a CommandMonitor feeding the Prometheus collectors.
+// Commands slower than slowThreshold() are logged at WARN; it is consulted on
+// every command so the threshold can change at runtime.
+func newCommandMonitor(slowThreshold func() time.Duration) *event.CommandMonitor {
+	m := &commandMetrics{slowThreshold: slowThreshold}
+	return &event.CommandMonitor{
+		Started:   m.started,
+		Succeeded: m.succeeded,
+		Failed:    m.failed,
+	}
+}
+
+func (m *commandMetrics) started(ctx context.Context, evt *event.CommandStartedEvent) {
+	m.inflight.Store(evt.RequestID, startedCommand{
+		collection: commandCollection(evt.Command, evt.CommandName),
+		requestID:  commandRequestID(ctx, evt.Command),
+	})
+}
+
+func (m *commandMetrics) succeeded(_ context.Context, evt *event.CommandSucceededEvent) {
+	m.finished(evt.CommandFinishedEvent, "succeeded")
+}
+
+func (m *commandMetrics) failed(_ context.Context, evt *event.CommandFailedEvent) {
+	m.finished(evt.CommandFinishedEvent, "failed")
+}
+
+func (m *commandMetrics) finished(evt event.CommandFinishedEvent, outcome string) {
+	var cmd startedCommand
+	if v, ok := m.inflight.LoadAndDelete(evt.RequestID); ok {
+		cmd = v.(startedCommand)
+	}
+
+	mongoCommandDuration.WithLabelValues(evt.CommandName, cmd.collection).Observe(evt.Duration.Seconds())
+	mongoCommandsTotal.WithLabelValues(evt.CommandName, cmd.collection, outcome).Inc()
+
+	if threshold := m.slowThreshold(); threshold > 0 && evt.Duration >= threshold {
+		slog.Warn("slow mongo command",
+			"command", evt.CommandName,
+			"collection", cmd.collection,
+			"duration", evt.Duration,
+			"outcome", outcome,
+			"request_id", cmd.requestID,
+		)
+	}
+}
+
+// commandCollection returns the collection a command targets. For CRUD commands
+// the first element of the command document is {<commandName>: <collection>}.
+func commandCollection(cmd bson.Raw, name string) string {
+	if collection, ok := cmd.Lookup(name).StringValueOK(); ok {
+		return collection
+	}
+	return ""
+}
+
+// commandRequestID prefers the request id set as the command's comment and
+// falls back to the chi request id carried by the operation context.
+func commandRequestID(ctx context.Context, cmd bson.Raw) string {
+	if comment, ok := cmd.Lookup("comment").StringValueOK(); ok {
+		return comment
+	}
+	return middleware.GetReqID(ctx)
+}
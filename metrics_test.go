@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// metricValue returns the value of the counter or gauge name with labels in
+// the default registry, or the sample count of the histogram; 0 when it has
+// not been observed yet.
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if want, ok := labels[pair.GetName()]; ok && want != pair.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestCommandCollection(t *testing.T) {
+	tests := []struct {
+		name    string
+		command bson.D
+		want    string
+	}{
+		{"find", bson.D{{Key: "find", Value: "todos"}, {Key: "filter", Value: bson.D{}}}, "todos"},
+		{"insert", bson.D{{Key: "insert", Value: "comments"}}, "comments"},
+		{"database aggregate", bson.D{{Key: "aggregate", Value: 1}}, ""},
+		{"admin command", bson.D{{Key: "hello", Value: 1}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := bson.Marshal(tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := commandCollection(cmd, tt.command[0].Key); got != tt.want {
+				t.Errorf("commandCollection() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandMonitor(t *testing.T) {
+	var logged bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+	t.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+	monitor := newCommandMonitor(func() time.Duration { return 100 * time.Millisecond })
+	ctx := context.Background()
+	run := func(requestID int64, comment string, took time.Duration, fail bool) {
+		cmd, err := bson.Marshal(bson.D{{Key: "find", Value: "monitor_test"}, {Key: "comment", Value: comment}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		monitor.Started(ctx, &event.CommandStartedEvent{Command: cmd, CommandName: "find", RequestID: requestID})
+		finished := event.CommandFinishedEvent{CommandName: "find", RequestID: requestID, Duration: took}
+		if fail {
+			monitor.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: finished})
+		} else {
+			monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finished})
+		}
+	}
+	labels := func(outcome string) map[string]string {
+		return map[string]string{"command": "find", "collection": "monitor_test", "outcome": outcome}
+	}
+	observed := metricValue(t, "todo_mongo_command_duration_seconds", labels(""))
+	succeeded := metricValue(t, "todo_mongo_commands_total", labels("succeeded"))
+	failed := metricValue(t, "todo_mongo_commands_total", labels("failed"))
+
+	run(1, "fast-request", time.Millisecond, false)
+	run(2, "slow-request", 250*time.Millisecond, false)
+	run(3, "failed-request", time.Millisecond, true)
+
+	if got := metricValue(t, "todo_mongo_command_duration_seconds", labels("")) - observed; got != 3 {
+		t.Errorf("observed %v durations, want 3", got)
+	}
+	if got := metricValue(t, "todo_mongo_commands_total", labels("succeeded")) - succeeded; got != 2 {
+		t.Errorf("counted %v succeeded commands, want 2", got)
+	}
+	if got := metricValue(t, "todo_mongo_commands_total", labels("failed")) - failed; got != 1 {
+		t.Errorf("counted %v failed commands, want 1", got)
+	}
+
+	out := logged.String()
+	if strings.Count(out, "slow mongo command") != 1 || !strings.Contains(out, "request_id=slow-request") {
+		t.Errorf("logged %q, want only the slow command with its request id", out)
+	}
+}
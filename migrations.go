@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	migrationCollectionName string = "schema_migrations"
+
+	// the lock document shares the collection with the int keyed records
+	migrationLockID string = "lock"
+	// a lock held longer than this is taken to belong to a crashed instance
+	migrationLease time.Duration = 10 * time.Minute
+)
+
+// migration changes the stored data of a tenant from one version of the
+// schema to the next. up must be safe to run again after a failure part way
+// through, so it has to be idempotent or guarded by a filter.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context) error
+}
+
+// migrations in the order they are applied. Versions are never reused or
+// reordered once released; add new ones at the end.
+var migrations = []migration{
+	{1, "backfill_normalized_titles", backfillNormalizedTitles},
+	{2, "default_starred_and_comment_count", defaultTodoFlags},
+	{3, "backfill_updated_at", backfillUpdatedAt},
+}
+
+type (
+	// struct to db model
+	MigrationRecord struct {
+		Version    int       `bson:"_id"`
+		Name       string    `bson:"name"`
+		AppliedAt  time.Time `bson:"applied_at"`
+		DurationMS int64     `bson:"duration_ms"`
+	}
+	// a migration as listed by the admin API
+	MigrationStatus struct {
+		Version    int        `json:"version"`
+		Name       string     `json:"name"`
+		Applied    bool       `json:"applied"`
+		AppliedAt  *time.Time `json:"applied_at,omitempty"`
+		DurationMS int64      `json:"duration_ms,omitempty"`
+	}
+	// the migrations endpoint response; Version is the last applied migration
+	GetMigrationsResponse struct {
+		Message string            `json:"message"`
+		Version int               `json:"version"`
+		Pending int               `json:"pending"`
+		Data    []MigrationStatus `json:"data"`
+	}
+)
+
+// defaultTodoFlags gives starred and comment_count to todos from before they
+// existed, so filters on them needn't treat a missing field specially.
+func defaultTodoFlags(ctx context.Context) error {
+	todos := tenantDB(ctx).Collection(collectionName)
+	for field, value := range map[string]interface{}{"starred": false, "comment_count": 0} {
+		filter := bson.M{field: bson.M{"$exists": false}}
+		if _, err := todos.UpdateMany(ctx, filter, bson.M{"$set": bson.M{field: value}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigrations applies the migrations the tenant of ctx hasn't had yet, in
+// order, recording each as it succeeds. It holds the migration lock while it
+// runs, so instances starting side by side apply each migration once.
+func runMigrations(ctx context.Context) error {
+	coll := tenantDB(ctx).Collection(migrationCollectionName)
+	owner, err := acquireMigrationLock(ctx, coll)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(ctx, coll, migrationLockID, owner)
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		log.Printf("applying migration %d %s to %s\n", m.version, m.name, tenantDB(ctx).Name())
+		start := time.Now()
+		if err := m.up(ctx); err != nil {
+			return fmt.Errorf("migration %d %s failed, later migrations were not applied: %w", m.version, m.name, err)
+		}
+		record := MigrationRecord{
+			Version:    m.version,
+			Name:       m.name,
+			AppliedAt:  time.Now().UTC(),
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if _, err := coll.InsertOne(ctx, record); err != nil {
+			return fmt.Errorf("migration %d %s was applied but not recorded: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+// errLockHeld is returned by takeLock while another instance holds the lock.
+var errLockHeld = errors.New("lock is held by another instance")
+
+// lockOwner names this process in the locks it takes.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// takeLock takes the lock document id of coll for lease, or fails with
+// errLockHeld. A lock whose lease ran out is taken over.
+func takeLock(ctx context.Context, coll *mongo.Collection, id, owner string, lease time.Duration) error {
+	now := time.Now().UTC()
+	filter := bson.M{"_id": id, "expires_at": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(lease)}}
+	_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	// a held lock doesn't match, so the upsert clashes with it
+	if mongo.IsDuplicateKeyError(err) {
+		return errLockHeld
+	}
+	return err
+}
+
+// releaseLock drops the lock document id of coll if owner still holds it.
+func releaseLock(ctx context.Context, coll *mongo.Collection, id, owner string) {
+	if _, err := coll.DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": id, "owner": owner}); err != nil {
+		log.Printf("failed to release the lock of %s: %v\n", coll.Name(), err)
+	}
+}
+
+// acquireMigrationLock waits for the migration lock of the tenant of ctx and
+// returns the owner it was taken as. A lock older than migrationLease is
+// taken over.
+func acquireMigrationLock(ctx context.Context, coll *mongo.Collection) (string, error) {
+	owner := lockOwner()
+	deadline := time.Now().Add(migrationLease + time.Minute)
+
+	for {
+		err := takeLock(ctx, coll, migrationLockID, owner, migrationLease)
+		if !errors.Is(err, errLockHeld) {
+			return owner, err
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("another instance holds the migration lock, remove the lock document of schema_migrations if it crashed")
+		}
+		log.Println("waiting for another instance to finish the migrations")
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// appliedMigrations returns the records of the applied migrations by version.
+func appliedMigrations(ctx context.Context) (map[int]MigrationRecord, error) {
+	filter := bson.M{"_id": bson.M{"$type": "number"}}
+	cursor, err := tenantDB(ctx).Collection(migrationCollectionName).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var records []MigrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]MigrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// getMigrations lists the migrations known to this build and which of them
+// the tenant's data has had.
+func getMigrations(rw http.ResponseWriter, r *http.Request) {
+	applied, err := appliedMigrations(r.Context())
+	if err != nil {
+		logRequestError(r, "failed to fetch the applied migrations: %v\n", err)
+		writeDBError(rw, r, err, "migrations_fetch_failed")
+		return
+	}
+
+	resp := GetMigrationsResponse{
+		Message: localize(r, "migrations_retrieved"),
+		Data:    []MigrationStatus{},
+	}
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if record, ok := applied[m.version]; ok {
+			status.Applied = true
+			status.AppliedAt = &record.AppliedAt
+			status.DurationMS = record.DurationMS
+			resp.Version = max(resp.Version, m.version)
+		} else {
+			resp.Pending++
+		}
+		resp.Data = append(resp.Data, status)
+	}
+	renderJSON(rw, r, http.StatusOK, resp)
+}
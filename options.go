@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+)
+
+// the upload route of the API, whose body is the file, below the version
+const attachmentUploadPattern string = "/todo/{id}/attachment"
+
+// request bodies the API reads
+const (
+	jsonContentType      string = "application/json"
+	multipartContentType string = "multipart/form-data"
+)
+
+// the methods OPTIONS looks for a route with, the first one wins
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+type (
+	// what a route of the API accepts, the answer to OPTIONS
+	RouteOptions struct {
+		Route   string                   `json:"route"`
+		Allow   []string                 `json:"allow"`
+		Methods map[string]MethodOptions `json:"methods"`
+		// null while rate_limit.requests is 0
+		RateLimit *RateLimitOptions `json:"rate_limit"`
+	}
+	// what a method of a route accepts; the query parameters are those of
+	// the endpoints checking them, see checkUnknownParams
+	MethodOptions struct {
+		QueryParams  []string `json:"query_params,omitempty"`
+		ContentTypes []string `json:"content_types,omitempty"`
+		MaxBodyBytes int64    `json:"max_body_bytes,omitempty"`
+		// request headers it reads beyond the usual ones
+		Headers []string `json:"headers,omitempty"`
+	}
+	// the budget of rateLimitMiddleware
+	RateLimitOptions struct {
+		Requests      int64 `json:"requests"`
+		WindowSeconds int64 `json:"window_seconds"`
+		Enforced      bool  `json:"enforced"`
+	}
+)
+
+// hasBody reports whether requests with method carry a body the API reads;
+// no DELETE route reads one.
+func hasBody(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// bodyLimit returns the largest body limitBody lets through to the route of
+// method and pattern: http.max_body_bytes, or for uploads the attachment
+// size with room for the multipart framing and the other form fields.
+func bodyLimit(method, pattern string) int64 {
+	if method == http.MethodPost && strings.HasSuffix(pattern, attachmentUploadPattern) {
+		return currentConfig().Attachments.MaxSize + 1<<20
+	}
+	return currentConfig().HTTP.MaxBodyBytes
+}
+
+// bodyContentTypes returns the media types the route of method and pattern
+// reads its body as; todos are created from HTML forms as well.
+func bodyContentTypes(method, pattern string) []string {
+	switch {
+	case method == http.MethodPost && strings.HasSuffix(pattern, attachmentUploadPattern):
+		return []string{multipartContentType}
+	case method == http.MethodPost && strings.HasSuffix(pattern, "/todo"):
+		return []string{jsonContentType, formContentType}
+	}
+	return []string{jsonContentType}
+}
+
+// limitBody refuses request bodies larger than the bodyLimit of their route
+// with 413 when they say so in Content-Length, and cuts those that don't
+// short at the limit, which fails their decoding.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !hasBody(r.Method) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		pattern, _, _ := matchRoute(r, r.Method)
+		limit := bodyLimit(r.Method, pattern)
+		if r.ContentLength > limit {
+			writeError(rw, r, http.StatusRequestEntityTooLarge, "body_too_large", renderer.M{
+				"max_bytes": limit,
+			})
+			return
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, limit)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// routeOptions answers OPTIONS on the routes of the API with Allow and what
+// each method accepts, from the settings the middlewares and handlers
+// enforce. Paths without a route are answered with 404 as before.
+func routeOptions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		route, match, ok := findRoute(r)
+		if !ok {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		options := RouteOptions{Route: route.Pattern, Methods: map[string]MethodOptions{}}
+		for _, method := range route.Methods {
+			if method == http.MethodHead || routeDisabled(routeKey(method, route.Pattern)) {
+				continue
+			}
+			options.Allow = append(options.Allow, method)
+			var methodOptions MethodOptions
+			if method == http.MethodGet {
+				methodOptions.QueryParams = queryParams(route.Pattern, match)
+			}
+			if hasBody(method) {
+				methodOptions.ContentTypes = bodyContentTypes(method, route.Pattern)
+				methodOptions.MaxBodyBytes = bodyLimit(method, route.Pattern)
+			}
+			if method == http.MethodPost && strings.HasSuffix(route.Pattern, "/todo") {
+				methodOptions.Headers = []string{idempotencyKeyHeader}
+			}
+			options.Methods[method] = methodOptions
+		}
+		// GET routes answer HEAD too, see middleware.GetHead
+		if slices.Contains(options.Allow, http.MethodGet) {
+			options.Allow = append(options.Allow, http.MethodHead)
+		}
+		options.Allow = append(options.Allow, http.MethodOptions)
+		slices.Sort(options.Allow)
+
+		if cfg := currentConfig().RateLimit; cfg.Requests > 0 {
+			options.RateLimit = &RateLimitOptions{
+				Requests:      cfg.Requests,
+				WindowSeconds: int64(cfg.Window.Seconds()),
+				Enforced:      cfg.Enforce,
+			}
+		}
+		rw.Header().Set("Allow", strings.Join(options.Allow, ", "))
+		renderJSON(rw, r, http.StatusOK, options)
+	})
+}
+
+// findRoute returns the route of the route table the path of r belongs to,
+// whatever the method, with the context of the match.
+func findRoute(r *http.Request) (Route, *chi.Context, bool) {
+	for _, method := range routeMethods {
+		pattern, match, ok := matchRoute(r, method)
+		if !ok {
+			continue
+		}
+		if len(pattern) > 1 {
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		index := slices.IndexFunc(routeMap, func(route Route) bool {
+			return route.Pattern == pattern && slices.Contains(route.Methods, method)
+		})
+		if index >= 0 {
+			return routeMap[index], match, true
+		}
+	}
+	return Route{}, nil, false
+}
+
+// queryParams returns the query parameters of the GET route with pattern, or
+// nil when it doesn't check them.
+func queryParams(pattern string, match *chi.Context) []string {
+	switch {
+	case strings.HasSuffix(pattern, "/todo"):
+		return listQueryParams(false, "")
+	case strings.HasSuffix(pattern, "/todo/views/{view}"):
+		return listQueryParams(false, match.URLParam("view"))
+	case strings.HasSuffix(pattern, "/todo/grouped"):
+		return listQueryParams(true, "")
+	case strings.HasSuffix(pattern, "/todo/search"):
+		return searchParams
+	}
+	return nil
+}
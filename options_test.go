@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What OPTIONS advertises is what the API enforces: a body of the advertised
+// size goes through and one byte more doesn't, every advertised content type
+// and query parameter is read, and the advertised rate limit refuses the
+// request after the budget.
+func TestAdvertisedLimitsEnforced(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.HTTP.MaxBodyBytes = 512
+		cfg.StrictQuery = true
+		cfg.RateLimit.Requests = 1000
+		cfg.RateLimit.Window = time.Hour
+		cfg.RateLimit.Enforce = true
+	})
+	routes, err := routeTable(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useRouteSwitches(t, routes)
+	prevRequests := clientRequests
+	clientRequests = &rateCounter{}
+	t.Cleanup(func() { clientRequests = prevRequests })
+
+	serve := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw
+	}
+
+	rw := serve(http.MethodOptions, "/api/v1/todo", "", "")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("OPTIONS = %d: %s", rw.Code, rw.Body)
+	}
+	var advertised RouteOptions
+	if err := json.Unmarshal(rw.Body.Bytes(), &advertised); err != nil {
+		t.Fatal(err)
+	}
+	post, get := advertised.Methods[http.MethodPost], advertised.Methods[http.MethodGet]
+	if rw.Header().Get("Allow") != strings.Join(advertised.Allow, ", ") || !slices.Contains(advertised.Allow, http.MethodPost) {
+		t.Fatalf("Allow %q for %v", rw.Header().Get("Allow"), advertised.Allow)
+	}
+
+	t.Run("body size", func(t *testing.T) {
+		// a title padded with spaces, which are trimmed
+		body := func(size int64) string {
+			prefix, suffix := `{"title":"x`, `"}`
+			return prefix + strings.Repeat(" ", int(size)-len(prefix)-len(suffix)) + suffix
+		}
+		if rw := serve(http.MethodPost, "/api/v1/todo", jsonContentType, body(post.MaxBodyBytes)); rw.Code != http.StatusCreated {
+			t.Errorf("body of %d bytes = %d: %s", post.MaxBodyBytes, rw.Code, rw.Body)
+		}
+		if rw := serve(http.MethodPost, "/api/v1/todo", jsonContentType, body(post.MaxBodyBytes+1)); rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("body of %d bytes = %d, want 413", post.MaxBodyBytes+1, rw.Code)
+		}
+	})
+
+	t.Run("content types", func(t *testing.T) {
+		bodies := map[string]string{
+			jsonContentType: `{"title":"write report"}`,
+			formContentType: url.Values{"title": {"write report"}}.Encode(),
+		}
+		for _, contentType := range post.ContentTypes {
+			body, ok := bodies[contentType]
+			if !ok {
+				t.Errorf("no body to try %s with", contentType)
+				continue
+			}
+			if rw := serve(http.MethodPost, "/api/v1/todo", contentType, body); rw.Code != http.StatusCreated {
+				t.Errorf("create as %s = %d: %s", contentType, rw.Code, rw.Body)
+			}
+		}
+	})
+
+	t.Run("query parameters", func(t *testing.T) {
+		if len(get.QueryParams) == 0 {
+			t.Fatal("no query parameters advertised")
+		}
+		for _, param := range get.QueryParams {
+			rw := serve(http.MethodGet, "/api/v1/todo?"+url.Values{param: {"x"}}.Encode(), "", "")
+			if strings.Contains(rw.Body.String(), `"unknown_param"`) {
+				t.Errorf("advertised ?%s is refused as unknown: %s", param, rw.Body)
+			}
+		}
+		rw := serve(http.MethodGet, "/api/v1/todo?competed=true", "", "")
+		if rw.Code != http.StatusUnprocessableEntity || !strings.Contains(rw.Body.String(), `"unknown_param"`) {
+			t.Errorf("?competed = %d: %s, want it refused", rw.Code, rw.Body)
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		if advertised.RateLimit == nil || !advertised.RateLimit.Enforced || advertised.RateLimit.WindowSeconds != 3600 {
+			t.Fatalf("rate limit %+v", advertised.RateLimit)
+		}
+		clientRequests = &rateCounter{}
+		for i := int64(0); i < advertised.RateLimit.Requests; i++ {
+			if rw := serve(http.MethodGet, "/healthz", "", ""); rw.Code != http.StatusOK {
+				t.Fatalf("request %d of the budget = %d", i+1, rw.Code)
+			}
+		}
+		if rw := serve(http.MethodGet, "/healthz", "", ""); rw.Code != http.StatusTooManyRequests {
+			t.Errorf("request beyond the budget = %d, want 429", rw.Code)
+		}
+	})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	outboxCollectionName string = "outbox"
+
+	// outbox states
+	outboxPending   string = "pending"
+	outboxDelivered string = "delivered"
+	outboxDead      string = "dead"
+
+	// event types
+	eventTodoCreated string = "todo.created"
+	eventTodoUpdated string = "todo.updated"
+	eventTodoDeleted string = "todo.deleted"
+
+	// a claimed event is retried after this long should its dispatcher die
+	// while delivering it
+	outboxLease time.Duration = time.Minute
+	// delivered events are kept this long for inspection
+	outboxRetention time.Duration = 7 * 24 * time.Hour
+	// the retry delay doubles with each attempt up to this
+	maxOutboxBackoff time.Duration = time.Hour
+)
+
+var outboxEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_outbox_events_total",
+		Help: "Outbox delivery attempts by outcome: delivered, failed or dead.",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(outboxEvents)
+}
+
+// transactionsSupported is set at startup when MongoDB runs as a replica set
+// or behind mongos, the deployments that support multi-document transactions.
+var transactionsSupported atomic.Bool
+
+type (
+	// struct to db model
+	OutboxModel struct {
+		ID            primitive.ObjectID `bson:"_id"`
+		Type          string             `bson:"type"`
+		Payload       string             `bson:"payload"`
+		Status        string             `bson:"status"`
+		Attempts      int64              `bson:"attempts"`
+		NextAttemptAt time.Time          `bson:"next_attempt_at"`
+		LastError     string             `bson:"last_error,omitempty"`
+		CreatedAt     time.Time          `bson:"created_at"`
+		DeliveredAt   *time.Time         `bson:"delivered_at,omitempty"`
+		// the push subscription the event goes to by Web Push instead of
+		// the webhooks
+		Subscription primitive.ObjectID `bson:"subscription,omitempty"`
+	}
+	// the body POSTed to every webhook; ID stays the same across retries so
+	// receivers can drop events they have already seen. Reminder is the due
+	// reminder of a todo.reminder event, Backup the run of a backup.failed
+	// event, which has no todo.
+	WebhookEvent struct {
+		ID         string     `json:"id"`
+		Type       string     `json:"type"`
+		TodoID     string     `json:"todo_id,omitempty"`
+		Tenant     string     `json:"tenant,omitempty"`
+		OccurredAt time.Time  `json:"occurred_at"`
+		Todo       *Todo      `json:"todo,omitempty"`
+		Reminder   *Reminder  `json:"reminder,omitempty"`
+		Backup     *BackupRun `json:"backup,omitempty"`
+		// the todo a todo.merged event's todo went into
+		MergedInto string `json:"merged_into,omitempty"`
+	}
+	// an outbox event as listed by the admin API
+	OutboxEvent struct {
+		ID            string          `json:"id"`
+		Type          string          `json:"type"`
+		Subscription  string          `json:"subscription,omitempty"`
+		Status        string          `json:"status"`
+		Attempts      int64           `json:"attempts"`
+		NextAttemptAt time.Time       `json:"next_attempt_at"`
+		LastError     string          `json:"last_error,omitempty"`
+		CreatedAt     time.Time       `json:"created_at"`
+		DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+		Payload       json.RawMessage `json:"payload"`
+	}
+	// the outbox endpoint response
+	GetOutboxResponse struct {
+		Message string        `json:"message"`
+		Data    []OutboxEvent `json:"data"`
+		Page    int64         `json:"page"`
+		Limit   int64         `json:"limit"`
+		Total   int64         `json:"total"`
+	}
+)
+
+// webhooksEnabled reports whether todo changes are recorded in the outbox.
+func webhooksEnabled() bool {
+	return len(currentConfig().Webhooks.URLs) > 0
+}
+
+// outboxEnabled reports whether anything is delivered through the outbox:
+// todo events to the webhooks, reminders by Web Push.
+func outboxEnabled() bool {
+	return webhooksEnabled() || pushEnabled()
+}
+
+// detectTransactions asks MongoDB whether it can run transactions. A
+// standalone server can't, and multi-document changes fall back to
+// best-effort writes.
+func detectTransactions(ctx context.Context) bool {
+	var hello bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Printf("failed to detect transaction support: %v\n", err)
+		return false
+	}
+	_, replicaSet := hello["setName"]
+	return replicaSet || hello["msg"] == "isdbgrid"
+}
+
+// runInTransaction runs fn, which changes todos and records their events, in
+// a transaction so the change and its events are written together or not at
+// all. Without an outbox, or on a standalone server, fn runs on its own.
+func runInTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !outboxEnabled() {
+		return fn(ctx)
+	}
+	return runAtomically(ctx, fn)
+}
+
+// runAtomically runs fn, a change spanning several documents that must not be
+// left half done, in a transaction whenever the server supports them, outbox
+// or not. On a standalone server fn runs on its own and the caller cleans up.
+func runAtomically(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !transactionsSupported.Load() {
+		return fn(ctx)
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// the transaction follows the causally consistent session of the
+	// request, if any, and the request the transaction
+	requestSession := mongo.SessionFromContext(ctx)
+	if requestSession != nil {
+		advanceSession(session, requestSession)
+	}
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	if requestSession != nil {
+		advanceSession(requestSession, session)
+	}
+	return err
+}
+
+// recordTodoEvent queues an event about the todo id for the webhooks. Except
+// for deletions the event carries the todo as read through ctx, which inside
+// runInTransaction includes the change being made. Outside a transaction the
+// change is already stored, so a failure is only logged.
+func recordTodoEvent(ctx context.Context, eventType string, id primitive.ObjectID) error {
+	return recordEvent(ctx, eventType, id, nil)
+}
+
+// recordEvent is recordTodoEvent for events that carry a reminder as well.
+func recordEvent(ctx context.Context, eventType string, id primitive.ObjectID, reminder *Reminder) error {
+	if !webhooksEnabled() {
+		return nil
+	}
+	err := insertTodoEvent(ctx, eventType, id, reminder)
+	if err != nil && mongo.SessionFromContext(ctx) == nil {
+		log.Printf("failed to record %s event of %s: %v\n", eventType, id.Hex(), err)
+		return nil
+	}
+	return err
+}
+
+func insertTodoEvent(ctx context.Context, eventType string, id primitive.ObjectID, reminder *Reminder) error {
+	event := WebhookEvent{
+		Type:     eventType,
+		TodoID:   formatID(id),
+		Reminder: reminder,
+	}
+	if eventType != eventTodoDeleted {
+		var td TodoModel
+		if err := tenantDB(ctx).Collection(collectionName).FindOne(ctx, bson.M{"id": id}).Decode(&td); err != nil {
+			return err
+		}
+		todo := td.toTodo(time.UTC)
+		event.Todo = &todo
+	}
+	return queueEvent(ctx, event)
+}
+
+// queueEvent adds event to the outbox of the tenant of ctx, filling in its
+// id, tenant and time.
+func queueEvent(ctx context.Context, event WebhookEvent) error {
+	now := time.Now().UTC()
+	eventID := primitive.NewObjectID()
+	event.ID = eventID.Hex()
+	event.OccurredAt = now
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		event.Tenant = tenant
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tenantDB(ctx).Collection(outboxCollectionName).InsertOne(ctx, OutboxModel{
+		ID:            eventID,
+		Type:          event.Type,
+		Payload:       string(payload),
+		Status:        outboxPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	})
+	return err
+}
+
+// ensureOutboxIndexes indexes the events the dispatcher looks for and drops
+// delivered events after outboxRetention. Pending and dead events are kept.
+func ensureOutboxIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(outboxCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+			Options: options.Index().SetName("status_next_attempt_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "delivered_at", Value: 1}},
+			Options: options.Index().SetName("delivered_at_ttl").SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	})
+	return err
+}
+
+// webhooksJob delivers the pending events of every tenant. Events are
+// claimed by pushing their next attempt past outboxLease, so several
+// instances can dispatch side by side and an event claimed by an instance
+// that crashed is picked up again: delivery is at least once.
+func webhooksJob(tenants []string) func(ctx context.Context) error {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, tenantCtx := range tenantContexts(ctx, tenants) {
+			if err := dispatchOutbox(tenantCtx, httpClient); err != nil {
+				errs = append(errs, fmt.Errorf("dispatch the outbox of %s: %w", tenantDB(tenantCtx).Name(), err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// dispatchOutbox delivers the due events of the tenant of ctx, oldest first.
+func dispatchOutbox(ctx context.Context, httpClient *http.Client) error {
+	coll := tenantDB(ctx).Collection(outboxCollectionName)
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	for ctx.Err() == nil {
+		now := time.Now().UTC()
+		filter := bson.M{"status": outboxPending, "next_attempt_at": bson.M{"$lte": now}}
+		update := bson.M{
+			"$set": bson.M{"next_attempt_at": now.Add(outboxLease)},
+			"$inc": bson.M{"attempts": 1},
+		}
+		var event OutboxModel
+		err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&event)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		deliveryErr := deliverEvent(ctx, httpClient, event)
+		if err := settleEvent(context.WithoutCancel(ctx), event, deliveryErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverEvent POSTs the payload to every webhook. A failure at any of them
+// fails the attempt, and the retry goes to all of them again. An event for a
+// push subscription goes to that alone.
+func deliverEvent(ctx context.Context, httpClient *http.Client, event OutboxModel) error {
+	if !event.Subscription.IsZero() {
+		return deliverPush(ctx, httpClient, event)
+	}
+	for _, url := range currentConfig().Webhooks.URLs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(event.Payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Event-ID", event.ID.Hex())
+		req.Header.Set("X-Event-Type", event.Type)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %s", url, resp.Status)
+		}
+	}
+	return nil
+}
+
+// settleEvent stores the outcome of a delivery attempt. Failed events are
+// retried with exponential backoff until webhooks.max_attempts, then they are
+// dead and wait for an admin to retry them. Events for a push subscription
+// that is gone are dead at once, retrying them can't succeed.
+func settleEvent(ctx context.Context, event OutboxModel, deliveryErr error) error {
+	now := time.Now().UTC()
+	var update bson.M
+	switch {
+	case deliveryErr == nil:
+		outboxEvents.WithLabelValues("delivered").Inc()
+		update = bson.M{
+			"$set":   bson.M{"status": outboxDelivered, "delivered_at": now},
+			"$unset": bson.M{"last_error": ""},
+		}
+	case errors.Is(deliveryErr, errPushGone):
+		outboxEvents.WithLabelValues("dead").Inc()
+		update = bson.M{"$set": bson.M{"status": outboxDead, "last_error": deliveryErr.Error()}}
+	case event.Attempts >= currentConfig().Webhooks.MaxAttempts:
+		outboxEvents.WithLabelValues("dead").Inc()
+		log.Printf("giving up on outbox event %s after %d attempts: %v\n", event.ID.Hex(), event.Attempts, deliveryErr)
+		update = bson.M{"$set": bson.M{"status": outboxDead, "last_error": deliveryErr.Error()}}
+	default:
+		outboxEvents.WithLabelValues("failed").Inc()
+		update = bson.M{"$set": bson.M{
+			"next_attempt_at": now.Add(outboxBackoff(event.Attempts)),
+			"last_error":      deliveryErr.Error(),
+		}}
+	}
+	_, err := tenantDB(ctx).Collection(outboxCollectionName).UpdateByID(ctx, event.ID, update)
+	return err
+}
+
+// outboxBackoff is the delay before the attempt following the given one.
+func outboxBackoff(attempts int64) time.Duration {
+	backoff := time.Second
+	for i := int64(1); i < attempts && backoff < maxOutboxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxOutboxBackoff)
+}
+
+// getOutbox lists outbox events newest first, dead ones unless ?status names
+// another state, with ?page and ?limit.
+func getOutbox(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, limit, err := parsePagination(query.Get("page"), query.Get("limit"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_pagination", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	status := query.Get("status")
+	switch status {
+	case "":
+		status = outboxDead
+	case outboxPending, outboxDelivered, outboxDead:
+	default:
+		writeError(rw, r, http.StatusBadRequest, "invalid_outbox_status", renderer.M{
+			"allowed": outboxPending + ", " + outboxDelivered + ", " + outboxDead,
+		})
+		return
+	}
+
+	coll := tenantDB(r.Context()).Collection(outboxCollectionName)
+	filter := bson.M{"status": status}
+	total, err := coll.CountDocuments(r.Context(), filter)
+	if err != nil {
+		logRequestError(r, "failed to count outbox events: %v\n", err)
+		writeDBError(rw, r, err, "outbox_fetch_failed")
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := coll.Find(r.Context(), filter, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch outbox events: %v\n", err)
+		writeDBError(rw, r, err, "outbox_fetch_failed")
+		return
+	}
+
+	var eventsFromDB []OutboxModel
+	if err := cursor.All(r.Context(), &eventsFromDB); err != nil {
+		logRequestError(r, "failed to decode outbox events: %v\n", err)
+		writeDBError(rw, r, err, "outbox_fetch_failed")
+		return
+	}
+
+	events := []OutboxEvent{}
+	for _, e := range eventsFromDB {
+		event := OutboxEvent{
+			ID:            e.ID.Hex(),
+			Type:          e.Type,
+			Status:        e.Status,
+			Attempts:      e.Attempts,
+			NextAttemptAt: e.NextAttemptAt,
+			LastError:     e.LastError,
+			CreatedAt:     e.CreatedAt,
+			DeliveredAt:   e.DeliveredAt,
+			Payload:       json.RawMessage(e.Payload),
+		}
+		if !e.Subscription.IsZero() {
+			event.Subscription = e.Subscription.Hex()
+		}
+		events = append(events, event)
+	}
+	renderJSON(rw, r, http.StatusOK, GetOutboxResponse{
+		Message: localize(r, "outbox_retrieved"),
+		Data:    events,
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+	})
+}
+
+// retryOutboxEvent puts a dead event back in the queue with its attempts reset.
+func retryOutboxEvent(rw http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_outbox_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	auditID, err := beginAudit(r, "outbox.retry")
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_outbox")
+		return
+	}
+
+	update := bson.M{"$set": bson.M{
+		"status":          outboxPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now().UTC(),
+	}}
+	filter := bson.M{"_id": id, "status": outboxDead}
+	data, err := tenantDB(r.Context()).Collection(outboxCollectionName).UpdateOne(r.Context(), filter, update)
+	if err != nil {
+		finishAudit(r.Context(), auditID, 0, err)
+		logRequestError(r, "failed to requeue outbox event: %v\n", err)
+		writeDBError(rw, r, err, "outbox_retry_failed")
+		return
+	}
+	finishAudit(r.Context(), auditID, data.ModifiedCount, nil)
+	if data.MatchedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "outbox_event_not_found", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "outbox_event_requeued"),
+	})
+}
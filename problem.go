@@ -0,0 +1,64 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thedevsaddam/renderer"
+)
+
+const (
+	// error formats
+	errorFormatSimple  string = "simple"
+	errorFormatProblem string = "problem"
+
+	problemContentType string = "application/problem+json"
+	// the type of a problem is this followed by its code, stable across
+	// languages and releases
+	problemTypePrefix string = "urn:golang-todo-app:error:"
+)
+
+// wantsProblem reports whether the error answering r is an RFC 7807 problem
+// document: error_format says so, or the client asks for one in Accept.
+func wantsProblem(r *http.Request) bool {
+	if currentConfig().ErrorFormat == errorFormatProblem {
+		return true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == problemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProblem responds with an RFC 7807 problem document. The message is
+// the detail, the code names the type, and the code, language, request ID
+// and fields are extension members.
+func writeProblem(rw http.ResponseWriter, r *http.Request, status int, code, lang, message string, fields renderer.M) {
+	problem := renderer.M{}
+	for name, value := range fields {
+		problem[name] = value
+	}
+	problem["type"] = problemTypePrefix + code
+	problem["title"] = http.StatusText(status)
+	problem["status"] = status
+	problem["detail"] = message
+	problem["instance"] = r.URL.Path
+	problem["code"] = code
+	problem["lang"] = lang
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		problem["request_id"] = id
+	}
+
+	render(rw, r, func(w http.ResponseWriter) error {
+		body, err := marshalJSON(r, problem)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", problemContentType)
+		return rnd.Render(w, status, body)
+	})
+}
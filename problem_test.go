@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thedevsaddam/renderer"
+)
+
+func TestWantsProblem(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		accept string
+		want   bool
+	}{
+		{"simple by default", errorFormatSimple, "", false},
+		{"JSON accepted", errorFormatSimple, "application/json", false},
+		{"problem accepted", errorFormatSimple, "application/problem+json", true},
+		{"problem among others", errorFormatSimple, "application/json;q=0.9, application/problem+json", true},
+		{"problem with parameters", errorFormatSimple, "application/problem+json; charset=utf-8", true},
+		{"problem configured", errorFormatProblem, "", true},
+		{"problem configured, JSON accepted", errorFormatProblem, "application/json", true},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.ErrorFormat = tt.format
+		useConfig(t, cfg)
+		r := httptest.NewRequest(http.MethodGet, "/todo", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsProblem(r); got != tt.want {
+			t.Errorf("%s: wantsProblem() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+
+	r := httptest.NewRequest(http.MethodDelete, "/todo/abc", nil)
+	r.Header.Set("Accept", problemContentType)
+	r.Header.Set("Accept-Language", "pt")
+	r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, "req-1"))
+	rw := httptest.NewRecorder()
+	writeError(rw, r, http.StatusMethodNotAllowed, "method_not_allowed", renderer.M{"method": "DELETE"})
+
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405", rw.Code)
+	}
+	if got := rw.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("Content-Type = %q, want %q", got, problemContentType)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"type":       problemTypePrefix + "method_not_allowed",
+		"title":      "Method Not Allowed",
+		"status":     float64(http.StatusMethodNotAllowed),
+		"detail":     "DELETE não é permitido aqui",
+		"instance":   "/todo/abc",
+		"code":       "method_not_allowed",
+		"lang":       "pt",
+		"request_id": "req-1",
+		"method":     "DELETE",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("problem = %v, want only %v", got, want)
+	}
+}
+
+// A 404, a 422 and a 500 all come as problem documents with the members of
+// RFC 9457 and the extensions of their error.
+func TestProblemDocuments(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.ErrorFormat = "problem"
+	})
+	tests := []struct {
+		name       string
+		serve      func() *httptest.ResponseRecorder
+		status     int
+		code       string
+		instance   string
+		extensions []string
+	}{
+		{
+			name: "unknown route",
+			serve: func() *httptest.ResponseRecorder {
+				rw := httptest.NewRecorder()
+				router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/nowhere", nil))
+				return rw
+			},
+			status:   http.StatusNotFound,
+			code:     "route_not_found",
+			instance: "/api/v1/nowhere",
+		},
+		{
+			name: "invalid fields",
+			serve: func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/api/v1/todo", strings.NewReader(`{"title":"","color":"not a color"}`))
+				r.Header.Set("Content-Type", "application/json")
+				rw := httptest.NewRecorder()
+				router.ServeHTTP(rw, r)
+				return rw
+			},
+			status:     http.StatusUnprocessableEntity,
+			code:       "validation_failed",
+			instance:   "/api/v1/todo",
+			extensions: []string{"count", "errors"},
+		},
+		{
+			name: "database failure",
+			serve: func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/todo/stats", nil)
+				r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, "req-500"))
+				rw := httptest.NewRecorder()
+				writeDBError(rw, r, errors.New("connection reset"), "stats_failed")
+				return rw
+			},
+			status:     http.StatusInternalServerError,
+			code:       "stats_failed",
+			instance:   "/api/v1/todo/stats",
+			extensions: []string{"error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := tt.serve()
+			if rw.Code != tt.status || rw.Header().Get("Content-Type") != problemContentType {
+				t.Fatalf("answered %d as %q, want %d as %s: %s", rw.Code, rw.Header().Get("Content-Type"), tt.status, problemContentType, rw.Body)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{
+				"type":     problemTypePrefix + tt.code,
+				"title":    http.StatusText(tt.status),
+				"status":   float64(tt.status),
+				"instance": tt.instance,
+				"code":     tt.code,
+				"lang":     "en",
+			}
+			for name, value := range want {
+				if got[name] != value {
+					t.Errorf("%s = %v, want %v", name, got[name], value)
+				}
+			}
+			if detail, _ := got["detail"].(string); detail == "" {
+				t.Error("no detail")
+			}
+			if _, ok := got["request_id"].(string); !ok {
+				t.Error("no request_id")
+			}
+			for _, name := range tt.extensions {
+				if _, ok := got[name]; !ok {
+					t.Errorf("no %s extension: %v", name, got)
+				}
+			}
+		})
+	}
+}
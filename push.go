@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	pushCollectionName string = "push_subscriptions"
+
+	// event type of the notification POST /push/test sends
+	eventPushTest string = "push.test"
+
+	maxPushEndpointLength = 2048
+	// longer titles are cut in notifications, which show a line or two
+	maxPushTitleLength = 120
+)
+
+// errPushGone is the answer of a push service to a subscription that has
+// expired or was unsubscribed.
+var errPushGone = errors.New("push subscription gone")
+
+var pushSubscriptionsPruned = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "todo_push_subscriptions_pruned_total",
+	Help: "Push subscriptions removed because their push service answered 404 or 410.",
+})
+
+func init() {
+	prometheus.MustRegister(pushSubscriptionsPruned)
+}
+
+type (
+	// struct to db model
+	PushSubscriptionModel struct {
+		ID        primitive.ObjectID `bson:"_id"`
+		Endpoint  string             `bson:"endpoint"`
+		P256dh    string             `bson:"p256dh"`
+		Auth      string             `bson:"auth"`
+		UserAgent string             `bson:"user_agent,omitempty"`
+		CreatedAt time.Time          `bson:"created_at"`
+	}
+	// a subscription as a browser's PushSubscription.toJSON() gives it
+	CreatePushSubscription struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	// the subscription to remove, or to test
+	PushEndpoint struct {
+		Endpoint string `json:"endpoint"`
+	}
+	// a stored subscription; its keys stay on the server
+	PushSubscription struct {
+		ID        string    `json:"id"`
+		Endpoint  string    `json:"endpoint"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	// the subscribe endpoint response
+	CreatePushSubscriptionResponse struct {
+		Message string           `json:"message"`
+		Data    PushSubscription `json:"data"`
+	}
+	// the public VAPID key the frontend subscribes with
+	GetPushKeyResponse struct {
+		Message   string `json:"message"`
+		PublicKey string `json:"public_key"`
+	}
+	// what a push notification carries, for the service worker to show
+	PushNotification struct {
+		Type     string    `json:"type"`
+		Title    string    `json:"title"`
+		Body     string    `json:"body,omitempty"`
+		TodoID   string    `json:"todo_id,omitempty"`
+		Tenant   string    `json:"tenant,omitempty"`
+		Reminder *Reminder `json:"reminder,omitempty"`
+	}
+	// the outcome of a test notification to one subscription
+	PushTestResult struct {
+		ID       string `json:"id"`
+		Endpoint string `json:"endpoint"`
+		// sent, failed or gone, in which case the subscription was removed
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+	// the test endpoint response
+	PushTestResponse struct {
+		Message string           `json:"message"`
+		Data    []PushTestResult `json:"data"`
+	}
+)
+
+func (s PushSubscriptionModel) toPushSubscription() PushSubscription {
+	return PushSubscription{ID: s.ID.Hex(), Endpoint: s.Endpoint, CreatedAt: s.CreatedAt}
+}
+
+// pushEnabled reports whether reminders are sent by Web Push as well.
+func pushEnabled() bool {
+	return currentConfig().vapidKey != nil
+}
+
+func pushHandlers() http.Handler {
+	router := chi.NewRouter()
+	router.Use(withAPIVersion(apiV1), limitBody, routeOptions, pushOnly)
+	router.Get("/key", getPushKey)
+	router.Post("/subscribe", subscribePush)
+	router.Post("/unsubscribe", unsubscribePush)
+	router.Post("/test", testPush)
+
+	return router
+}
+
+// printVAPIDKeys writes a new VAPID key pair to w, the private key as the
+// setting it goes in.
+func printVAPIDKeys(w io.Writer) error {
+	private, public, err := generateVAPIDKeys()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "push:\n  vapid_private_key: %s  # PUSH_VAPID_PRIVATE_KEY, keep it secret\n# public key, served by GET /api/v1/push/key: %s\n", private, public)
+	return err
+}
+
+// pushOnly answers the push routes with 404 while no VAPID key is
+// configured.
+func pushOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !pushEnabled() {
+			writeError(rw, r, http.StatusNotFound, "push_disabled", nil)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ensurePushIndexes keeps a single subscription per push endpoint.
+func ensurePushIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(pushCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "endpoint", Value: 1}},
+		Options: options.Index().SetName("endpoint").SetUnique(true),
+	})
+	return err
+}
+
+// getPushKey returns the public VAPID key, which browsers need to subscribe.
+func getPushKey(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	renderJSON(rw, r, http.StatusOK, GetPushKeyResponse{
+		Message:   localize(r, "push_key_retrieved"),
+		PublicKey: vapidPublicKey(currentConfig().vapidKey),
+	})
+}
+
+// subscribePush stores the push subscription of a browser, one per device.
+// Subscribing the same endpoint again replaces its keys and answers 200.
+func subscribePush(rw http.ResponseWriter, r *http.Request) {
+	var req CreatePushSubscription
+	if err := decodeJSON(r, &req); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	problems := newFieldErrors(r)
+	if err := checkPushEndpoint(req.Endpoint); err != nil {
+		problems.addError("endpoint", "invalid_push_endpoint", nil, err)
+	}
+	if _, _, err := parsePushKeys(req.Keys.P256dh, req.Keys.Auth); err != nil {
+		problems.addError("keys", "invalid_push_keys", nil, err)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	coll := tenantDB(r.Context()).Collection(pushCollectionName)
+	update := bson.M{
+		"$set": bson.M{
+			"p256dh":     req.Keys.P256dh,
+			"auth":       req.Keys.Auth,
+			"user_agent": r.UserAgent(),
+		},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "created_at": time.Now().UTC()},
+	}
+	data, err := coll.UpdateOne(r.Context(), bson.M{"endpoint": req.Endpoint}, update, options.Update().SetUpsert(true))
+	var stored PushSubscriptionModel
+	if err == nil {
+		err = coll.FindOne(r.Context(), bson.M{"endpoint": req.Endpoint}).Decode(&stored)
+	}
+	if err != nil {
+		logRequestError(r, "failed to store push subscription: %v\n", err)
+		writeDBError(rw, r, err, "push_subscribe_failed")
+		return
+	}
+
+	status, code := http.StatusOK, "push_subscription_updated"
+	if data.UpsertedCount > 0 {
+		status, code = http.StatusCreated, "push_subscribed"
+	}
+	renderJSON(rw, r, status, CreatePushSubscriptionResponse{
+		Message: localize(r, code),
+		Data:    stored.toPushSubscription(),
+	})
+}
+
+// checkPushEndpoint accepts the https URLs push services hand out.
+func checkPushEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+	if len(endpoint) > maxPushEndpointLength {
+		return fmt.Errorf("endpoints are limited to %d characters", maxPushEndpointLength)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("expected an https URL")
+	}
+	return nil
+}
+
+// unsubscribePush removes the subscription of an endpoint, as a browser
+// does when the user turns notifications off.
+func unsubscribePush(rw http.ResponseWriter, r *http.Request) {
+	var req PushEndpoint
+	if err := decodeJSON(r, &req); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data, err := tenantDB(r.Context()).Collection(pushCollectionName).DeleteOne(r.Context(), bson.M{"endpoint": req.Endpoint})
+	if err != nil {
+		logRequestError(r, "failed to delete push subscription: %v\n", err)
+		writeDBError(rw, r, err, "push_unsubscribe_failed")
+		return
+	}
+	if data.DeletedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "push_subscription_not_found", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "push_unsubscribed"),
+	})
+}
+
+// testPush sends a notification to the subscription of the endpoint in the
+// body, or with no body to every subscription, right away rather than
+// through the outbox, and reports how each push service answered.
+// Subscriptions that are gone are removed as deliveries would.
+func testPush(rw http.ResponseWriter, r *http.Request) {
+	var req PushEndpoint
+	body, err := io.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := bson.M{}
+	if req.Endpoint != "" {
+		filter["endpoint"] = req.Endpoint
+	}
+	cursor, err := tenantDB(r.Context()).Collection(pushCollectionName).Find(r.Context(), filter)
+	var subscriptions []PushSubscriptionModel
+	if err == nil {
+		err = cursor.All(r.Context(), &subscriptions)
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch push subscriptions: %v\n", err)
+		writeDBError(rw, r, err, "push_test_failed")
+		return
+	}
+	if len(subscriptions) == 0 {
+		writeError(rw, r, http.StatusNotFound, "push_subscription_not_found", nil)
+		return
+	}
+
+	payload, err := pushPayload(r.Context(), PushNotification{
+		Type:  eventPushTest,
+		Title: localize(r, "push_test_title"),
+		Body:  localize(r, "push_test_body"),
+	})
+	if err != nil {
+		logRequestError(r, "failed to encode the test notification: %v\n", err)
+		writeError(rw, r, http.StatusInternalServerError, "push_test_failed", nil)
+		return
+	}
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	results := []PushTestResult{}
+	for _, subscription := range subscriptions {
+		result := PushTestResult{ID: subscription.ID.Hex(), Endpoint: subscription.Endpoint, Status: "sent"}
+		if err := sendPush(r.Context(), httpClient, subscription, payload); err != nil {
+			result.Status, result.Error = "failed", err.Error()
+			if errors.Is(err, errPushGone) {
+				result.Status = "gone"
+			}
+		}
+		results = append(results, result)
+	}
+	renderJSON(rw, r, http.StatusOK, PushTestResponse{
+		Message: localize(r, "push_test_sent"),
+		Data:    results,
+	})
+}
+
+// queuePushReminder queues a notification of the reminder of td for every
+// push subscription of the tenant of ctx, to be delivered by the outbox
+// like the webhook events.
+func queuePushReminder(ctx context.Context, td TodoModel, reminder *Reminder) error {
+	if !pushEnabled() {
+		return nil
+	}
+	cursor, err := tenantDB(ctx).Collection(pushCollectionName).Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var subscriptions []PushSubscriptionModel
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	payload, err := pushPayload(ctx, PushNotification{
+		Type:     eventTodoReminder,
+		Title:    string(td.Title),
+		Body:     reminder.Note,
+		TodoID:   formatID(td.ID),
+		Reminder: reminder,
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	events := make([]interface{}, len(subscriptions))
+	for i, subscription := range subscriptions {
+		events[i] = OutboxModel{
+			ID:            primitive.NewObjectID(),
+			Type:          eventTodoReminder,
+			Payload:       string(payload),
+			Subscription:  subscription.ID,
+			Status:        outboxPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+	_, err = tenantDB(ctx).Collection(outboxCollectionName).InsertMany(ctx, events)
+	return err
+}
+
+// pushPayload encodes notification for the tenant of ctx, its title cut to
+// maxPushTitleLength.
+func pushPayload(ctx context.Context, notification PushNotification) ([]byte, error) {
+	if utf8.RuneCountInString(notification.Title) > maxPushTitleLength {
+		notification.Title = string([]rune(notification.Title)[:maxPushTitleLength-1]) + "…"
+	}
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		notification.Tenant = tenant
+	}
+	return json.Marshal(notification)
+}
+
+// deliverPush sends the payload of event to its subscription. A
+// subscription that is no longer stored is gone as well.
+func deliverPush(ctx context.Context, httpClient *http.Client, event OutboxModel) error {
+	var subscription PushSubscriptionModel
+	err := tenantDB(ctx).Collection(pushCollectionName).FindOne(ctx, bson.M{"_id": event.Subscription}).Decode(&subscription)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errPushGone
+	}
+	if err != nil {
+		return err
+	}
+	return sendPush(ctx, httpClient, subscription, []byte(event.Payload))
+}
+
+// sendPush encrypts payload for subscription and POSTs it to its push
+// service, signed with the VAPID key. A subscription the service answers
+// 404 or 410 for has expired or was revoked: it is removed and errPushGone
+// returned.
+func sendPush(ctx context.Context, httpClient *http.Client, subscription PushSubscriptionModel, payload []byte) error {
+	cfg := currentConfig()
+	body, err := encryptPush(subscription.P256dh, subscription.Auth, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(cfg.vapidKey, cfg.Push.Subject, subscription.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.FormatInt(int64(cfg.Push.TTL.Seconds()), 10))
+	req.Header.Set("Urgency", "high")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	// the endpoint is a capability of the browser, so errors name its host only
+	host := req.URL.Host
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		ctx = context.WithoutCancel(ctx)
+		if _, err := tenantDB(ctx).Collection(pushCollectionName).DeleteOne(ctx, bson.M{"_id": subscription.ID}); err != nil {
+			log.Printf("failed to remove push subscription %s: %v\n", subscription.ID.Hex(), err)
+		} else {
+			pushSubscriptionsPruned.Inc()
+		}
+		return fmt.Errorf("%s answered %s: %w", host, resp.Status, errPushGone)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("%s answered %s", host, resp.Status)
+	}
+	return nil
+}
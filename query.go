@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sortable fields of the list endpoint, by query name
+var sortFields = map[string]string{
+	"created_at": "created_at",
+	"title":      "title",
+	"completed":  "completed",
+	"due_date":   "due_date",
+}
+
+// listParams are the query parameters listFilter and listSort read, which are
+// also the fields of a saved filter.
+var listParams = []string{"completed", "starred", "color", "tag", "overdue", "blocked", "over_estimate", "stale", "stale_after_days", "deferred", "sort"}
+
+// ICU locales as MongoDB names them, like en, de_AT or zh_Hant
+var collationLocalePattern = regexp.MustCompile(`^[a-z]{2,3}(_[A-Za-z0-9]+)*$`)
+
+// listCollation returns the collation a list sorted by title uses: the
+// configured one, in the locale of ?collation when it is an allowed one.
+func listCollation(query url.Values) (*options.Collation, error) {
+	cfg := currentConfig().Collation
+	locale := cfg.Locale
+	if value := query.Get("collation"); value != "" && value != locale {
+		if !slices.Contains(cfg.Locales, value) {
+			return nil, fmt.Errorf("collation must be one of %s", strings.Join(append([]string{locale}, cfg.Locales...), ", "))
+		}
+		locale = value
+	}
+	return &options.Collation{Locale: locale, Strength: int(cfg.Strength), CaseLevel: cfg.CaseLevel}, nil
+}
+
+// listFilter builds the Mongo filter for the list query parameters. Day
+// boundaries, as for ?overdue, are those of loc. It reports the problems of
+// every parameter at once, as paramErrors.
+func listFilter(query url.Values, loc *time.Location) (bson.M, error) {
+	filter := bson.M{}
+	var problems paramErrors
+
+	if value := query.Get("completed"); value != "" {
+		completed, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, paramError{"completed", fmt.Errorf("completed must be true or false")})
+		} else {
+			filter["completed"] = completed
+		}
+	}
+
+	if value := query.Get("starred"); value != "" {
+		starred, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, paramError{"starred", fmt.Errorf("starred must be true or false")})
+		} else {
+			filter["starred"] = starred
+		}
+	}
+
+	if value := query.Get("color"); value != "" {
+		if color, err := normalizeColor(value); err != nil {
+			problems = append(problems, paramError{"color", err})
+		} else {
+			filter["color"] = color
+		}
+	}
+
+	// work/* matches every tag below work, not work itself
+	if value := query.Get("tag"); value != "" {
+		tags := cleanTags([]string{value})
+		namespace, isNamespace := "", false
+		if len(tags) > 0 {
+			namespace, isNamespace = tagNamespace(tags[0])
+		}
+		switch {
+		case len(tags) == 0:
+			problems = append(problems, paramError{"tag", fmt.Errorf("tag must not be blank")})
+		case isNamespace && tagProblem(strings.TrimSuffix(namespace, tagSeparator)) != "":
+			problems = append(problems, paramError{"tag", fmt.Errorf("the namespace of %s must not be empty", value)})
+		case isNamespace:
+			filter["tags"] = tagNamespaceFilter(namespace)
+		default:
+			filter["tags"] = tags[0]
+		}
+	}
+
+	// the filters below constrain fields the ones above may match on too,
+	// ?completed say, so they are clauses of an $and instead of keys that
+	// would replace the others
+	var and bson.A
+
+	// overdue todos are open and were due before today
+	if value := query.Get("overdue"); value != "" {
+		overdue, err := strconv.ParseBool(value)
+		today := startOfDay(time.Now().In(loc))
+		switch {
+		case err != nil:
+			problems = append(problems, paramError{"overdue", fmt.Errorf("overdue must be true or false")})
+		case overdue:
+			and = append(and, bson.M{"completed": false, "due_date": bson.M{"$lt": today}})
+		default:
+			and = append(and, bson.M{"$or": bson.A{
+				bson.M{"completed": true},
+				bson.M{"due_date": bson.M{"$not": bson.M{"$lt": today}}},
+			}})
+		}
+	}
+
+	// stale todos are open and older than ?stale_after_days
+	after, afterErr := staleAfter(query)
+	if afterErr != nil {
+		problems = append(problems, paramError{"stale_after_days", afterErr})
+	}
+	if value := query.Get("stale"); value != "" {
+		stale, err := strconv.ParseBool(value)
+		switch {
+		case err != nil:
+			problems = append(problems, paramError{"stale", fmt.Errorf("stale must be true or false")})
+		case afterErr == nil:
+			and = append(and, staleFilter(stale, after, time.Now()))
+		}
+	}
+
+	// blocked todos wait for at least one open todo
+	if value := query.Get("blocked"); value != "" {
+		if blocked, err := strconv.ParseBool(value); err != nil {
+			problems = append(problems, paramError{"blocked", fmt.Errorf("blocked must be true or false")})
+		} else {
+			filter["open_blockers.0"] = bson.M{"$exists": blocked}
+		}
+	}
+
+	// todos over their estimate have one and spent more time than it
+	if value := query.Get("over_estimate"); value != "" {
+		over, err := strconv.ParseBool(value)
+		exceeded := bson.M{"$and": bson.A{
+			bson.M{"$gt": bson.A{"$estimate_minutes", 0}},
+			bson.M{"$gt": bson.A{"$spent_minutes", "$estimate_minutes"}},
+		}}
+		switch {
+		case err != nil:
+			problems = append(problems, paramError{"over_estimate", fmt.Errorf("over_estimate must be true or false")})
+		case over:
+			filter["$expr"] = exceeded
+		default:
+			filter["$expr"] = bson.M{"$not": bson.A{exceeded}}
+		}
+	}
+
+	// open todos deferred to a later time are left out unless ?deferred=true
+	// asks for just them
+	deferred := false
+	if value := query.Get("deferred"); value != "" {
+		var err error
+		if deferred, err = strconv.ParseBool(value); err != nil {
+			problems = append(problems, paramError{"deferred", fmt.Errorf("deferred must be true or false")})
+		}
+	}
+	filter["$and"] = append(and, deferredFilter(deferred, time.Now()))
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return filter, nil
+}
+
+// paramError is a problem with the query parameter param.
+type paramError struct {
+	param string
+	err   error
+}
+
+// paramErrors are the problems of the parameters of a query.
+type paramErrors []paramError
+
+func (e paramErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, problem := range e {
+		messages[i] = problem.err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// listSort builds the sort order for ?sort=<field> (ascending) or ?sort=-<field>
+// (descending), created_at by default. Starred todos always come first and the
+// id breaks ties so pages are stable.
+func listSort(query url.Values) (bson.D, error) {
+	key, order := "created_at", 1
+	if value := query.Get("sort"); value != "" {
+		if strings.HasPrefix(value, "-") {
+			value, order = value[1:], -1
+		}
+		field, ok := sortFields[value]
+		if !ok {
+			return nil, fmt.Errorf("cannot sort by %q", value)
+		}
+		if field == "title" && titlesEncrypted() {
+			return nil, fmt.Errorf("cannot sort by title: %w", errTitlesEncrypted)
+		}
+		key = field
+	}
+
+	return bson.D{
+		{Key: "starred", Value: -1},
+		{Key: key, Value: order},
+		{Key: "id", Value: order},
+	}, nil
+}
+
+// findTodoPage returns the todos matching filter in the order of sort,
+// compared with collation unless it is nil, skipping the first skip. With a
+// limit it returns at most limit of them and reports whether more follow;
+// without one, limit being 0, it returns all. Documents that don't decode
+// as todos, written by other tools, are left out and counted in skipped;
+// they still take their place in the page.
+func findTodoPage(ctx context.Context, filter bson.M, sort bson.D, collation *options.Collation, skip, limit int64) (todoPage, error) {
+	opts := options.Find().SetSort(sort).SetCollation(collation)
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+	if limit > 0 {
+		// one more tells whether there is a next page
+		opts.SetLimit(limit + 1)
+	}
+	cursor, err := tenantDB(ctx).Collection(collectionName).Find(ctx, filter, opts)
+	if err != nil {
+		return todoPage{}, err
+	}
+	defer cursor.Close(ctx)
+
+	page := todoPage{todos: []TodoModel{}}
+	var seen int64
+	for cursor.Next(ctx) {
+		if seen++; limit > 0 && seen > limit {
+			page.more = true
+			break
+		}
+		var td TodoModel
+		if err := cursor.Decode(&td); err != nil {
+			skipMalformed(collectionName, cursor.Current, err)
+			page.skipped++
+			continue
+		}
+		page.todos = append(page.todos, td)
+	}
+	return page, cursor.Err()
+}
+
+// todoPage is a result of findTodoPage.
+type todoPage struct {
+	todos   []TodoModel
+	more    bool
+	skipped int
+}
+
+// listReadKey identifies the todos a list request reads, whatever the
+// pagination, for coalesce: the view, the zone of its day boundaries and
+// the parameters that select and order the todos.
+func listReadKey(query url.Values, view string, loc *time.Location) string {
+	var key strings.Builder
+	key.WriteString("view=" + view + "|tz=" + loc.String())
+	for _, param := range append([]string{"days", "collation"}, listParams...) {
+		key.WriteString("|" + param + "=" + query.Get(param))
+	}
+	return key.String()
+}
+
+// titleSearchFilter matches the todos whose title, or one of their former
+// titles, contains search, compared in the form of normalizeTitle.
+func titleSearchFilter(search string) bson.M {
+	pattern := bson.M{"$regex": regexp.QuoteMeta(normalizeTitle(search))}
+	return bson.M{"$or": bson.A{
+		bson.M{"normalized_title": pattern},
+		bson.M{"previous_titles.normalized": pattern},
+	}}
+}
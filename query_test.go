@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The filters of ?overdue and ?stale constrain completed too; they must
+// add to ?completed, not replace it.
+func TestListFilterKeepsCompleted(t *testing.T) {
+	useConfig(t, defaultConfig())
+
+	tests := []struct {
+		query   string
+		clauses int
+	}{
+		{"completed=true&stale=true", 3},
+		{"completed=true&overdue=true", 3},
+		{"completed=true&overdue=false&stale=false", 4},
+		{"completed=false&overdue=true&stale=true", 4},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		filter, err := listFilter(query, time.UTC)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if want := query.Get("completed"); filter["completed"] != (want == "true") {
+			t.Errorf("%s: completed = %v, want %s", tt.query, filter["completed"], want)
+		}
+		and, _ := filter["$and"].(bson.A)
+		if len(and) != tt.clauses-1 || len(filter) != 2 {
+			t.Errorf("%s: filter = %v, want completed and an $and of %d clauses", tt.query, filter, tt.clauses-1)
+		}
+	}
+}
+
+func TestListFilterOverdueAndStale(t *testing.T) {
+	useConfig(t, defaultConfig())
+	query := url.Values{"overdue": {"true"}, "stale": {"true"}}
+	filter, err := listFilter(query, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	and := filter["$and"].(bson.A)
+	overdue, stale := and[0].(bson.M), and[1].(bson.M)
+	if overdue["completed"] != false || overdue["due_date"] == nil {
+		t.Errorf("overdue clause = %v", overdue)
+	}
+	if stale["completed"] != false || stale["created_at"] == nil {
+		t.Errorf("stale clause = %v", stale)
+	}
+	if _, ok := filter["completed"]; ok {
+		t.Errorf("filter = %v, want completed only in the clauses", filter)
+	}
+}
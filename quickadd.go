@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// priorities a todo can have, lowest first
+var priorities = []string{"low", "medium", "high", "urgent"}
+
+var (
+	quickTagPattern = regexp.MustCompile(`^#(\p{L}[\p{L}\p{N}_-]*)$`)
+	isoDatePattern  = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+// QuickAdd is what parseQuickAdd extracted from a one-line todo.
+type QuickAdd struct {
+	Title    string     `json:"title"`
+	Tags     []string   `json:"tags"`
+	Priority string     `json:"priority,omitempty"`
+	DueDate  *time.Time `json:"due_date,omitempty"`
+}
+
+// parseQuickAdd extracts the quick-add tokens of input:
+//
+//	#tag            adds a tag; it must start with a letter, so "#1" stays in the title
+//	!low … !urgent  sets the priority
+//	due:<when>      sets the due date: YYYY-MM-DD, today, tomorrow, next-week
+//	                or a weekday name (the next one, today excluded)
+//
+// Dates are resolved at midnight in now's location. Recognised tokens are
+// removed from the title, anything else is left untouched, including a second
+// priority or due date.
+func parseQuickAdd(input string, now time.Time) QuickAdd {
+	parsed := QuickAdd{Tags: []string{}}
+	var title []string
+
+	for _, token := range strings.Fields(input) {
+		lower := strings.ToLower(token)
+
+		if m := quickTagPattern.FindStringSubmatch(lower); m != nil {
+			if !slices.Contains(parsed.Tags, m[1]) {
+				parsed.Tags = append(parsed.Tags, m[1])
+			}
+			continue
+		}
+
+		if priority, ok := strings.CutPrefix(lower, "!"); ok && parsed.Priority == "" && slices.Contains(priorities, priority) {
+			parsed.Priority = priority
+			continue
+		}
+
+		if when, ok := strings.CutPrefix(lower, "due:"); ok && parsed.DueDate == nil {
+			if due, ok := resolveDueDate(when, now); ok {
+				parsed.DueDate = &due
+				continue
+			}
+		}
+
+		title = append(title, token)
+	}
+
+	parsed.Title = strings.Join(title, " ")
+	return parsed
+}
+
+// resolveDueDate turns the value of a due: token into a date.
+func resolveDueDate(when string, now time.Time) (time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch when {
+	case "today":
+		return today, true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), true
+	case "next-week":
+		return today.AddDate(0, 0, 7), true
+	}
+
+	if day, ok := weekdays[when]; ok {
+		days := (int(day) - int(today.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return today.AddDate(0, 0, days), true
+	}
+
+	if isoDatePattern.MatchString(when) {
+		if due, err := time.ParseInLocation(time.DateOnly, when, now.Location()); err == nil {
+			return due, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// normalizePriority validates a priority, the empty string meaning none.
+func normalizePriority(priority string) (string, bool) {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	return priority, priority == "" || slices.Contains(priorities, priority)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseQuickAdd(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a Thursday
+	now := time.Date(2026, 10, 15, 22, 30, 0, 0, loc)
+	date := func(year int, month time.Month, day int) *time.Time {
+		d := time.Date(year, month, day, 0, 0, 0, 0, loc)
+		return &d
+	}
+
+	tests := []struct {
+		input    string
+		title    string
+		tags     []string
+		priority string
+		due      *time.Time
+	}{
+		{input: "buy milk", title: "buy milk"},
+		{input: "buy milk #home #Errands", title: "buy milk", tags: []string{"home", "errands"}},
+		{input: "#home buy #home milk", title: "buy milk", tags: []string{"home"}},
+		{input: "fix bug #1", title: "fix bug #1"},
+		{input: "call mom !high", title: "call mom", priority: "high"},
+		{input: "call mom !HIGH !low", title: "call mom !low", priority: "high"},
+		{input: "wow!", title: "wow!"},
+		{input: "!later", title: "!later"},
+		{input: "pay rent due:2026-11-01", title: "pay rent", due: date(2026, 11, 1)},
+		{input: "pay rent due:today", title: "pay rent", due: date(2026, 10, 15)},
+		{input: "pay rent due:tomorrow", title: "pay rent", due: date(2026, 10, 16)},
+		{input: "pay rent due:next-week", title: "pay rent", due: date(2026, 10, 22)},
+		{input: "pay rent due:fri", title: "pay rent", due: date(2026, 10, 16)},
+		{input: "pay rent due:Thursday", title: "pay rent", due: date(2026, 10, 22)},
+		{input: "pay rent due:someday", title: "pay rent due:someday"},
+		{input: "pay rent due:2026-02-30", title: "pay rent due:2026-02-30"},
+		{input: "a due:today due:tomorrow", title: "a due:tomorrow", due: date(2026, 10, 15)},
+		{input: "  spaced   out  ", title: "spaced out"},
+		{input: "#ação !urgent café", title: "café", tags: []string{"ação"}, priority: "urgent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got := parseQuickAdd(tt.input, now)
+			if got.Title != tt.title {
+				t.Errorf("title = %q, want %q", got.Title, tt.title)
+			}
+			if !slices.Equal(got.Tags, tt.tags) {
+				t.Errorf("tags = %q, want %q", got.Tags, tt.tags)
+			}
+			if got.Priority != tt.priority {
+				t.Errorf("priority = %q, want %q", got.Priority, tt.priority)
+			}
+			switch {
+			case (got.DueDate == nil) != (tt.due == nil):
+				t.Errorf("due date = %v, want %v", got.DueDate, tt.due)
+			case got.DueDate != nil && !got.DueDate.Equal(*tt.due):
+				t.Errorf("due date = %v, want %v", *got.DueDate, *tt.due)
+			}
+		})
+	}
+}
+
+func TestNormalizePriority(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{" High ", "high", true},
+		{"urgent", "urgent", true},
+		{"critical", "critical", false},
+	}
+	for _, tt := range tests {
+		if got, ok := normalizePriority(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("normalizePriority(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
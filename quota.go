@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// a cached todo count is trusted this long before it is counted again
+const quotaRefresh = 30 * time.Second
+
+// todoCounts caches the number of todos of every database, so the quota check
+// doesn't count the collection on every create. Creates add to the cached
+// count, deletes drop it so the freed quota shows up right away.
+var todoCounts = struct {
+	sync.Mutex
+	entries map[string]todoCount
+}{entries: map[string]todoCount{}}
+
+type todoCount struct {
+	count   int64
+	fetched time.Time
+}
+
+// quotaUsage returns the number of todos of the tenant of ctx. The count is
+// the collection's estimated count, read from its metadata rather than by
+// scanning it, and at most quotaRefresh old.
+func quotaUsage(ctx context.Context) (int64, error) {
+	todos := tenantDB(ctx).Collection(collectionName)
+	key := todos.Database().Name()
+
+	todoCounts.Lock()
+	cached, ok := todoCounts.entries[key]
+	todoCounts.Unlock()
+	if ok && time.Since(cached.fetched) < quotaRefresh {
+		return cached.count, nil
+	}
+
+	count, err := todos.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	todoCounts.Lock()
+	todoCounts.entries[key] = todoCount{count: count, fetched: time.Now()}
+	todoCounts.Unlock()
+	return count, nil
+}
+
+// addQuotaUsage counts n created todos of the tenant of ctx.
+func addQuotaUsage(ctx context.Context, n int64) {
+	key := tenantDB(ctx).Name()
+	todoCounts.Lock()
+	defer todoCounts.Unlock()
+	if cached, ok := todoCounts.entries[key]; ok {
+		cached.count += n
+		todoCounts.entries[key] = cached
+	}
+}
+
+// releaseQuota forgets the count of the tenant of ctx after a delete, so the
+// next check counts again.
+func releaseQuota(ctx context.Context) {
+	todoCounts.Lock()
+	delete(todoCounts.entries, tenantDB(ctx).Name())
+	todoCounts.Unlock()
+}
+
+// quotaRemaining returns how many more todos the tenant of ctx may create and
+// whether a quota is configured at all.
+func quotaRemaining(ctx context.Context) (remaining int64, limited bool, err error) {
+	limit := currentConfig().Quota.MaxTodos
+	if limit <= 0 {
+		return 0, false, nil
+	}
+	used, err := quotaUsage(ctx)
+	if err != nil {
+		return 0, true, err
+	}
+	return max(limit-used, 0), true, nil
+}
+
+// checkQuota reports whether adding more todos stays within quota.max_todos.
+// Otherwise it answers with 403 and the usage and limit. Requests that pass
+// get the remaining headroom in X-Todo-Quota-Remaining. Concurrent creates
+// may overshoot the limit by a few todos.
+func checkQuota(rw http.ResponseWriter, r *http.Request, adding int64) bool {
+	limit := currentConfig().Quota.MaxTodos
+	if limit <= 0 {
+		return true
+	}
+	// the count itself rather than what quotaRemaining makes of it, which
+	// stops at the limit when concurrent creates went past it
+	used, err := quotaUsage(r.Context())
+	if err != nil {
+		writeDBError(rw, r, err, "quota_check_failed")
+		return false
+	}
+
+	remaining := max(limit-used, 0)
+	if adding > remaining {
+		rw.Header().Set("X-Todo-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		writeError(rw, r, http.StatusForbidden, "quota_exceeded", renderer.M{
+			"used":  used,
+			"limit": limit,
+		})
+		return false
+	}
+	rw.Header().Set("X-Todo-Quota-Remaining", strconv.FormatInt(remaining-adding, 10))
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A create over quota.max_todos is answered with the todos counted, even
+// once concurrent creates took them past the limit.
+func TestQuotaExceeded(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	cfg := *currentConfig()
+	cfg.Quota.MaxTodos = 5
+	useConfig(t, cfg)
+
+	for _, count := range []int64{5, 7} {
+		todoCounts.Lock()
+		todoCounts.entries[tenantDB(context.Background()).Name()] = todoCount{count: count, fetched: time.Now()}
+		todoCounts.Unlock()
+		t.Cleanup(func() { releaseQuota(context.Background()) })
+
+		r := httptest.NewRequest(http.MethodPost, apiV1.prefix()+"/todo", strings.NewReader(`{"title":"write report"}`))
+		r.Header.Set("Content-Type", jsonContentType)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		if rw.Code != http.StatusForbidden {
+			t.Fatalf("create with %d todos = %d: %s, want %d", count, rw.Code, rw.Body, http.StatusForbidden)
+		}
+		var body struct {
+			Code  string `json:"code"`
+			Used  int64  `json:"used"`
+			Limit int64  `json:"limit"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Code != "quota_exceeded" || body.Used != count || body.Limit != 5 {
+			t.Errorf("create with %d todos answered %s, want %d used of 5", count, rw.Body, count)
+		}
+		if got := rw.Header().Get("X-Todo-Quota-Remaining"); got != "0" {
+			t.Errorf("create with %d todos: X-Todo-Quota-Remaining = %q, want 0", count, got)
+		}
+	}
+}
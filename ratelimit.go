@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rateLimited = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "todo_rate_limit_exceeded_total",
+		Help: "Requests made by clients that had used up their rate limit budget.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+// clientRequests counts the requests of each client in fixed windows of
+// rate_limit.window, aligned to the clock so every instance agrees on when a
+// window resets. The counts start over with every window.
+var clientRequests = &rateCounter{}
+
+type rateCounter struct {
+	mu     sync.Mutex
+	start  time.Time
+	window time.Duration
+	counts map[string]int64
+}
+
+// take counts a request of client at now and returns how many requests the
+// client made in the current window, this one included, and when it started.
+func (c *rateCounter) take(client string, now time.Time, window time.Duration) (int64, time.Time) {
+	start := now.Truncate(window)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !start.Equal(c.start) || window != c.window {
+		c.start, c.window, c.counts = start, window, map[string]int64{}
+	}
+	c.counts[client]++
+	return c.counts[client], start
+}
+
+// rateLimitHeaders returns the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset values for a client that made count requests in the window
+// starting at start. Reset is in seconds from now, rounded up, so clients
+// don't depend on their clock agreeing with ours.
+func rateLimitHeaders(limit, count int64, start, now time.Time, window time.Duration) (remaining, reset int64) {
+	remaining = max(limit-count, 0)
+	reset = int64(math.Ceil(start.Add(window).Sub(now).Seconds()))
+	return remaining, max(reset, 1)
+}
+
+// rateLimitMiddleware tells every client its budget through the draft IETF
+// RateLimit headers, preflight requests included. The limit is soft unless
+// rate_limit.enforce is set: clients over their budget are counted but
+// served. Enforced, they are answered with 429 until the window resets.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig().RateLimit
+		if cfg.Requests <= 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		now := time.Now()
+		count, start := clientRequests.take(clientIP(r), now, cfg.Window)
+		remaining, reset := rateLimitHeaders(cfg.Requests, count, start, now, cfg.Window)
+		rw.Header().Set("RateLimit-Limit", strconv.FormatInt(cfg.Requests, 10))
+		rw.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		rw.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+
+		if count > cfg.Requests {
+			rateLimited.Inc()
+			if cfg.Enforce {
+				rw.Header().Set("Retry-After", strconv.FormatInt(reset, 10))
+				writeError(rw, r, http.StatusTooManyRequests, "rate_limited", nil)
+				return
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
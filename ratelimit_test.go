@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	start := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		count         int64
+		now           time.Time
+		window        time.Duration
+		wantRemaining int64
+		wantReset     int64
+	}{
+		{"first request", 1, start, time.Minute, 9, 60},
+		{"within the window", 4, start.Add(15 * time.Second), time.Minute, 6, 45},
+		{"partial second rounds up", 4, start.Add(15*time.Second + time.Millisecond), time.Minute, 6, 45},
+		{"last request of the budget", 10, start.Add(30 * time.Second), time.Minute, 0, 30},
+		{"over the budget", 12, start.Add(30 * time.Second), time.Minute, 0, 30},
+		{"last nanosecond", 3, start.Add(time.Minute - time.Nanosecond), time.Minute, 7, 1},
+		{"hour window", 2, start.Add(59 * time.Minute), time.Hour, 8, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remaining, reset := rateLimitHeaders(10, tt.count, start, tt.now, tt.window)
+			if remaining != tt.wantRemaining || reset != tt.wantReset {
+				t.Errorf("rateLimitHeaders() = %d, %d, want %d, %d", remaining, reset, tt.wantRemaining, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestRateCounterWindows(t *testing.T) {
+	c := &rateCounter{}
+	window := time.Minute
+	start := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		client    string
+		now       time.Time
+		window    time.Duration
+		wantCount int64
+		wantStart time.Time
+	}{
+		{"a", start, window, 1, start},
+		{"a", start.Add(59 * time.Second), window, 2, start},
+		{"b", start.Add(59 * time.Second), window, 1, start},
+		// the next window starts over
+		{"a", start.Add(window), window, 1, start.Add(window)},
+		{"a", start.Add(window + time.Second), window, 2, start.Add(window)},
+		// and so does a changed window
+		{"a", start.Add(window + 2*time.Second), 2 * window, 1, start},
+	}
+	for i, tt := range tests {
+		count, began := c.take(tt.client, tt.now, tt.window)
+		if count != tt.wantCount || !began.Equal(tt.wantStart) {
+			t.Errorf("take %d by %s = %d since %s, want %d since %s", i, tt.client, count, began.Format(time.TimeOnly), tt.wantCount, tt.wantStart.Format(time.TimeOnly))
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	prevRequests := clientRequests
+	clientRequests = &rateCounter{}
+	t.Cleanup(func() { clientRequests = prevRequests })
+	useRenderer(t, nil)
+
+	cfg := defaultConfig()
+	cfg.RateLimit.Requests = 3
+	cfg.RateLimit.Window = time.Hour
+	useConfig(t, cfg)
+	handler := rateLimitMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	serve := func(method, client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/todo", nil)
+		r.RemoteAddr = client + ":5000"
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw
+	}
+
+	// preflight requests are told their budget and use it up like any other
+	for i, method := range []string{http.MethodOptions, http.MethodGet, http.MethodOptions, http.MethodGet} {
+		rw := serve(method, "192.0.2.1")
+		wantRemaining := strconv.Itoa(max(2-i, 0))
+		if rw.Code != http.StatusOK || rw.Header().Get("RateLimit-Limit") != "3" || rw.Header().Get("RateLimit-Remaining") != wantRemaining {
+			t.Errorf("%s %d = %d, limit %q, remaining %q, want 200, 3, %s", method, i, rw.Code, rw.Header().Get("RateLimit-Limit"), rw.Header().Get("RateLimit-Remaining"), wantRemaining)
+		}
+		if reset, err := strconv.Atoi(rw.Header().Get("RateLimit-Reset")); err != nil || reset < 1 || reset > 3600 {
+			t.Errorf("%s %d: RateLimit-Reset = %q, want seconds within the window", method, i, rw.Header().Get("RateLimit-Reset"))
+		}
+	}
+
+	cfg.RateLimit.Enforce = true
+	useConfig(t, cfg)
+	if rw := serve(http.MethodGet, "192.0.2.1"); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != rw.Header().Get("RateLimit-Reset") {
+		t.Errorf("enforced request over the budget = %d, Retry-After %q, want 429 at the reset", rw.Code, rw.Header().Get("Retry-After"))
+	}
+
+	// under concurrency every remaining value is handed out exactly once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[string]int{}
+	const clients, requests = 4, 5
+	for c := 0; c < clients; c++ {
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(client string) {
+				defer wg.Done()
+				rw := serve(http.MethodGet, client)
+				mu.Lock()
+				seen[client+" "+rw.Header().Get("RateLimit-Remaining")]++
+				if rw.Code == http.StatusTooManyRequests {
+					seen[client+" refused"]++
+				}
+				mu.Unlock()
+			}(fmt.Sprintf("198.51.100.%d", c))
+		}
+	}
+	wg.Wait()
+	for c := 0; c < clients; c++ {
+		client := fmt.Sprintf("198.51.100.%d", c)
+		for _, remaining := range []string{"2", "1"} {
+			if seen[client+" "+remaining] != 1 {
+				t.Errorf("%s got remaining %s %d times, want once", client, remaining, seen[client+" "+remaining])
+			}
+		}
+		if seen[client+" 0"] != requests-2 || seen[client+" refused"] != requests-3 {
+			t.Errorf("%s got remaining 0 %d times and was refused %d times, want %d and %d", client, seen[client+" 0"], seen[client+" refused"], requests-2, requests-3)
+		}
+	}
+}
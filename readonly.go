@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how long clients are told to wait before retrying a refused write
+const readOnlyRetryAfter = 2 * time.Minute
+
+var (
+	readOnly atomic.Bool
+
+	readOnlyGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_read_only",
+		Help: "1 while the service refuses writes, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(readOnlyGauge)
+}
+
+// setReadOnly flips read-only mode; it is safe to call while requests are in flight.
+func setReadOnly(enabled bool) {
+	readOnly.Store(enabled)
+	if enabled {
+		readOnlyGauge.Set(1)
+	} else {
+		readOnlyGauge.Set(0)
+	}
+}
+
+// readOnlyMiddleware answers mutating requests with 503 while read-only mode is on.
+// Safe methods always go through.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if readOnly.Load() {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(readOnlyRetryAfter.Seconds())))
+			writeError(rw, r, http.StatusServiceUnavailable, "read_only", nil)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
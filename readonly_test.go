@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// useReadOnly sets read-only mode for the test, turning it off afterwards.
+func useReadOnly(t *testing.T, enabled bool) {
+	t.Helper()
+	setReadOnly(enabled)
+	t.Cleanup(func() { setReadOnly(false) })
+}
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	handler := readOnlyMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		method  string
+		blocked bool
+	}{
+		{http.MethodGet, false},
+		{http.MethodHead, false},
+		{http.MethodOptions, false},
+		{http.MethodPost, true},
+		{http.MethodPut, true},
+		{http.MethodPatch, true},
+		{http.MethodDelete, true},
+	}
+	for _, readOnly := range []bool{false, true} {
+		useReadOnly(t, readOnly)
+		for _, tt := range tests {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(tt.method, "/todo", nil))
+
+			want := http.StatusNoContent
+			if readOnly && tt.blocked {
+				want = http.StatusServiceUnavailable
+			}
+			if rw.Code != want {
+				t.Errorf("%s with read-only %v: status = %d, want %d", tt.method, readOnly, rw.Code, want)
+			}
+			if retry := rw.Header().Get("Retry-After"); (want == http.StatusServiceUnavailable) != (retry != "") {
+				t.Errorf("%s with read-only %v: Retry-After = %q", tt.method, readOnly, retry)
+			}
+		}
+		gauge := 0.0
+		if readOnly {
+			gauge = 1
+		}
+		if got := metricValue(t, "todo_read_only", nil); got != gauge {
+			t.Errorf("todo_read_only = %v with read-only %v, want %v", got, readOnly, gauge)
+		}
+	}
+}
+
+func TestReadOnlyToggleUnderLoad(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	useReadOnly(t, false)
+	handler := readOnlyMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				setReadOnly(j%2 == 0)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/todo", nil))
+				if rw.Code != http.StatusCreated && rw.Code != http.StatusServiceUnavailable {
+					t.Errorf("status = %d while toggling, want 201 or 503", rw.Code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
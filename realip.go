@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// clientIP returns the client address resolved by realIPMiddleware, falling
+// back to the connection's remote address.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return hostOnly(r.RemoteAddr)
+}
+
+// parseTrustedProxies parses a list of CIDRs or bare IP addresses.
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// realIPMiddleware resolves the real client address and stores it in the
+// request context. X-Forwarded-For and X-Real-IP are only honoured when the
+// direct peer is one of the trusted proxies; the client is then the right-most
+// hop of the chain that is not itself a trusted proxy. With no trusted proxies
+// the headers are ignored so clients can't spoof their address.
+//
+// Peers connecting through a unix socket have no address and count as trusted
+// whenever trusted proxies are configured, since only local processes can reach them.
+func realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, currentConfig().trustedProxies)
+		r.RemoteAddr = ip
+		ctx := context.WithValue(r.Context(), clientIPKey{}, ip)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// resolveClientIP implements the trust rules described on realIPMiddleware.
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := hostOnly(r.RemoteAddr)
+	if len(trusted) == 0 {
+		return peer
+	}
+
+	peerIP := net.ParseIP(peer)
+	if peerIP != nil && !isTrusted(peerIP, trusted) {
+		return peer
+	}
+
+	// walk the chain right to left: every hop was appended by the proxy after it
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hostOnly(strings.TrimSpace(hops[i])))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !isTrusted(ip, trusted) {
+			return client
+		}
+	}
+	if len(hops) > 0 {
+		return client
+	}
+
+	if ip := net.ParseIP(hostOnly(strings.TrimSpace(r.Header.Get("X-Real-IP")))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips an optional port and IPv6 brackets from addr.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
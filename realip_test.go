@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		trusted    bool
+		want       string
+	}{
+		{
+			name:       "no trusted proxies ignores the headers",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"203.0.113.7"},
+			realIP:     "203.0.113.8",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "untrusted peer can't forge its address",
+			remoteAddr: "198.51.100.2:4321",
+			forwarded:  []string{"203.0.113.7"},
+			trusted:    true,
+			want:       "198.51.100.2",
+		},
+		{
+			name:       "trusted peer forwarding a client",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"203.0.113.7"},
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "right-most untrusted hop of a chain",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"1.2.3.4, 203.0.113.7, 10.0.0.2"},
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forged left-most hop is not believed",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"127.0.0.1", "203.0.113.7"},
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "chain of trusted proxies only",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"192.168.1.1, 10.0.0.3"},
+			trusted:    true,
+			want:       "192.168.1.1",
+		},
+		{
+			name:       "garbage hop stops the walk",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"203.0.113.7, not-an-ip"},
+			trusted:    true,
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "hop with a port",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"203.0.113.7:5555"},
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "IPv6 peer and client",
+			remoteAddr: "[fd00::1]:4321",
+			forwarded:  []string{"2001:db8::7"},
+			trusted:    true,
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "bracketed IPv6 hop with a port",
+			remoteAddr: "[fd00::1]:4321",
+			forwarded:  []string{"[2001:db8::7]:5555"},
+			trusted:    true,
+			want:       "2001:db8::7",
+		},
+		{
+			name:       "untrusted IPv6 peer",
+			remoteAddr: "[2001:db8::9]:4321",
+			forwarded:  []string{"2001:db8::7"},
+			trusted:    true,
+			want:       "2001:db8::9",
+		},
+		{
+			name:       "X-Real-IP without X-Forwarded-For",
+			remoteAddr: "10.0.0.1:4321",
+			realIP:     "203.0.113.8",
+			trusted:    true,
+			want:       "203.0.113.8",
+		},
+		{
+			name:       "X-Forwarded-For wins over X-Real-IP",
+			remoteAddr: "10.0.0.1:4321",
+			forwarded:  []string{"203.0.113.7"},
+			realIP:     "203.0.113.8",
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "unix socket peer is trusted",
+			remoteAddr: "@",
+			forwarded:  []string{"203.0.113.7"},
+			trusted:    true,
+			want:       "203.0.113.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			var proxies = trusted
+			if !tt.trusted {
+				proxies = nil
+			}
+			if got := resolveClientIP(r, proxies); got != tt.want {
+				t.Errorf("resolveClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", false},
+		{"192.168.1.1", false},
+		{"::1", false},
+		{"fd00::/8", false},
+		{"10.0.0.0/33", true},
+		{"localhost", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseTrustedProxies([]string{tt.value}); (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRealIPMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.HTTP.TrustedProxies = []string{"10.0.0.0/8"}
+	var err error
+	if cfg.trustedProxies, err = parseTrustedProxies(cfg.HTTP.TrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+
+	var seen, remote string
+	handler := realIPMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		seen, remote = clientIP(r), r.RemoteAddr
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:4321"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if seen != "203.0.113.7" || remote != "203.0.113.7" {
+		t.Errorf("clientIP = %q, RemoteAddr = %q, want both 203.0.113.7", seen, remote)
+	}
+}
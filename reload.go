@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"os"
+	"reflect"
+)
+
+// logLevel is the minimum level of the default slog logger and can change on reload.
+var logLevel = new(slog.LevelVar)
+
+func init() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// reloadConfig re-reads the configuration (on SIGHUP) and applies it as a
+// whole: if anything is invalid the current configuration stays in effect.
+// Settings tagged reload:"restart" keep their running value and a warning
+// says a restart is required to change them.
+func reloadConfig(path string, flagValues map[string]string) error {
+	next, warnings, err := loadConfig(path, flagValues)
+	for _, warning := range warnings {
+		log.Printf("config: %s\n", warning)
+	}
+	if err != nil {
+		return err
+	}
+
+	prev := currentConfig()
+	prevSettings := configSettings(prev)
+	for i, s := range configSettings(&next) {
+		if s.field.Tag.Get("reload") != "restart" {
+			continue
+		}
+		if !reflect.DeepEqual(s.value.Interface(), prevSettings[i].value.Interface()) {
+			slog.Warn("setting changed but requires a restart to take effect", "setting", s.path)
+			s.value.Set(prevSettings[i].value)
+		}
+	}
+	// derived from push.vapid_private_key, which kept its value
+	next.vapidKey = prev.vapidKey
+
+	activeConfig.Store(&next)
+	logLevel.Set(next.logLevel)
+	// only touch read-only mode when the configured value changed, so a reload
+	// doesn't undo a toggle made through the admin endpoint
+	if next.ReadOnly != prev.ReadOnly {
+		setReadOnly(next.ReadOnly)
+	}
+
+	log.Println("configuration reloaded")
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// event type of a reminder that is due
+	eventTodoReminder string = "todo.reminder"
+
+	maxRemindersPerTodo    = 20
+	maxReminderNoteLength  = 200
+	defaultUpcomingHours   = 24
+	maxUpcomingHours       = 30 * 24
+	remindersFiredPerRound = 100
+)
+
+type (
+	// struct to db model, embedded in its todo
+	ReminderModel struct {
+		ID   primitive.ObjectID `bson:"id"`
+		At   time.Time          `bson:"at"`
+		Note string             `bson:"note,omitempty"`
+		Sent bool               `bson:"sent"`
+	}
+	// a pending reminder as returned by the API
+	Reminder struct {
+		ID   string    `json:"id"`
+		At   time.Time `json:"at"`
+		Note string    `json:"note,omitempty"`
+	}
+	// create reminder
+	CreateReminder struct {
+		At   *time.Time `json:"at"`
+		Note string     `json:"note"`
+	}
+	// a created reminder
+	CreateReminderResponse struct {
+		Message string   `json:"message"`
+		Data    Reminder `json:"data"`
+	}
+	// a pending reminder with its todo, as listed by the agenda
+	UpcomingReminder struct {
+		Reminder
+		TodoID string `json:"todo_id"`
+		Title  string `json:"title"`
+	}
+	// the upcoming reminders endpoint response
+	GetUpcomingRemindersResponse struct {
+		Message string             `json:"message"`
+		Hours   int                `json:"hours"`
+		Data    []UpcomingReminder `json:"data"`
+	}
+)
+
+// toReminder converts the db model to what the frontend displays, with the
+// time in loc.
+func (rm ReminderModel) toReminder(loc *time.Location) Reminder {
+	return Reminder{ID: rm.ID.Hex(), At: rm.At.In(loc), Note: rm.Note}
+}
+
+// pendingReminders returns the unsent reminders, soonest first.
+func pendingReminders(reminders []ReminderModel, loc *time.Location) []Reminder {
+	pending := []Reminder{}
+	for _, rm := range reminders {
+		if !rm.Sent {
+			pending = append(pending, rm.toReminder(loc))
+		}
+	}
+	slices.SortFunc(pending, func(a, b Reminder) int { return a.At.Compare(b.At) })
+	return pending
+}
+
+// cancelReminders makes update drop the unsent reminders of a todo it
+// completes.
+func cancelReminders(update bson.M, completed bool) {
+	if completed {
+		update["$pull"] = bson.M{"reminders": bson.M{"sent": false}}
+	}
+}
+
+// ensureReminderIndexes indexes the reminders the scheduler looks for.
+func ensureReminderIndexes(ctx context.Context) error {
+	_, err := tenantDB(ctx).Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "reminders.sent", Value: 1}, {Key: "reminders.at", Value: 1}},
+		Options: options.Index().SetName("reminders_due").SetSparse(true),
+	})
+	return err
+}
+
+// createReminder adds a reminder at a future time to an open todo.
+func createReminder(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var reminderReq CreateReminder
+	if err := decodeJSON(r, &reminderReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	note := strings.TrimSpace(cleanText(reminderReq.Note, false))
+	problems := newFieldErrors(r)
+	switch {
+	case reminderReq.At == nil:
+		problems.add("at", "reminder_time_required", nil)
+	case !reminderReq.At.After(time.Now()):
+		problems.add("at", "reminder_in_past", nil)
+	}
+	if utf8.RuneCountInString(note) > maxReminderNoteLength {
+		problems.add("note", "reminder_note_too_long", renderer.M{"max_length": maxReminderNoteLength})
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	reminder := ReminderModel{
+		ID:   primitive.NewObjectID(),
+		At:   reminderReq.At.UTC(),
+		Note: note,
+	}
+	// a full or completed todo matches nothing and is told apart below
+	filter := bson.M{
+		"id":        todoID,
+		"completed": false,
+		"reminders." + strconv.Itoa(maxRemindersPerTodo-1): bson.M{"$exists": false},
+	}
+	update := bumpVersion(bson.M{
+		"$push": bson.M{"reminders": reminder},
+		"$set":  bson.M{"updated_at": time.Now().UTC()},
+	})
+	var data *mongo.UpdateResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, update)
+		if err != nil || data.MatchedCount == 0 {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, todoID)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "reminder_add_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeReminderRejection(rw, r, todoID)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusCreated, CreateReminderResponse{
+		Message: localize(r, "reminder_created"),
+		Data:    reminder.toReminder(loc),
+	})
+}
+
+// writeReminderRejection explains why a reminder couldn't be added to the
+// todo id: it doesn't exist, is completed or has maxRemindersPerTodo already.
+func writeReminderRejection(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID) {
+	var td TodoModel
+	err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}).Decode(&td)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+	case err != nil:
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "reminder_add_failed")
+	case td.Completed:
+		writeError(rw, r, http.StatusConflict, "reminder_todo_completed", nil)
+	default:
+		writeError(rw, r, http.StatusConflict, "too_many_reminders", renderer.M{
+			"max": maxRemindersPerTodo,
+		})
+	}
+}
+
+// deleteReminder removes a reminder from a todo, sent or not.
+func deleteReminder(rw http.ResponseWriter, r *http.Request) {
+	todoID, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	reminderID, err := primitive.ObjectIDFromHex(chi.URLParam(r, "reminderId"))
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_reminder_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := bson.M{"id": todoID, "reminders.id": reminderID}
+	update := bumpVersion(bson.M{
+		"$pull": bson.M{"reminders": bson.M{"id": reminderID}},
+		"$set":  bson.M{"updated_at": time.Now().UTC()},
+	})
+	var data *mongo.UpdateResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, update)
+		if err != nil || data.MatchedCount == 0 {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, todoID)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "reminder_delete_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "reminder_not_found", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "reminder_deleted"),
+	})
+}
+
+// getUpcomingReminders lists the pending reminders of open todos due in the
+// next ?hours hours, soonest first, as an agenda.
+func getUpcomingReminders(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+	hours := defaultUpcomingHours
+	if value := r.URL.Query().Get("hours"); value != "" {
+		if hours, err = strconv.Atoi(value); err != nil || hours < 1 || hours > maxUpcomingHours {
+			writeError(rw, r, http.StatusBadRequest, "invalid_hours", renderer.M{
+				"max": maxUpcomingHours,
+			})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	due := bson.M{"sent": false, "at": bson.M{"$gte": now, "$lt": now.Add(time.Duration(hours) * time.Hour)}}
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"completed": false, "reminders": bson.M{"$elemMatch": due}}},
+		bson.M{"$unwind": "$reminders"},
+		bson.M{"$match": bson.M{
+			"reminders.sent": due["sent"],
+			"reminders.at":   due["at"],
+		}},
+		bson.M{"$sort": bson.D{{Key: "reminders.at", Value: 1}, {Key: "id", Value: 1}}},
+		bson.M{"$project": bson.M{"id": 1, "title": 1, "reminder": "$reminders"}},
+	}
+	cursor, err := tenantDB(r.Context()).Collection(collectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		logRequestError(r, "failed to aggregate upcoming reminders: %v\n", err)
+		writeDBError(rw, r, err, "reminders_fetch_failed")
+		return
+	}
+	var results []struct {
+		ID       primitive.ObjectID `bson:"id"`
+		Title    sealedText         `bson:"title"`
+		Reminder ReminderModel      `bson:"reminder"`
+	}
+	if err := cursor.All(r.Context(), &results); err != nil {
+		logRequestError(r, "failed to decode upcoming reminders: %v\n", err)
+		writeDBError(rw, r, err, "reminders_fetch_failed")
+		return
+	}
+
+	agenda := []UpcomingReminder{}
+	for _, result := range results {
+		agenda = append(agenda, UpcomingReminder{
+			Reminder: result.Reminder.toReminder(loc),
+			TodoID:   formatID(result.ID),
+			Title:    string(result.Title),
+		})
+	}
+	renderJSON(rw, r, http.StatusOK, GetUpcomingRemindersResponse{
+		Message: localize(r, "reminders_retrieved"),
+		Hours:   hours,
+		Data:    agenda,
+	})
+}
+
+// remindersJob fires the due reminders of every tenant, see fireReminders.
+func remindersJob(tenants []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, tenantCtx := range tenantContexts(ctx, tenants) {
+			if err := fireReminders(tenantCtx); err != nil {
+				errs = append(errs, fmt.Errorf("fire the reminders of %s: %w", tenantDB(tenantCtx).Name(), err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// fireReminders queues a todo.reminder event for every due reminder of the
+// open todos of the tenant of ctx, for the webhooks and for every push
+// subscription. A reminder is marked sent by the same update that claims
+// it, so instances firing side by side send it once.
+func fireReminders(ctx context.Context) error {
+	todos := tenantDB(ctx).Collection(collectionName)
+	now := time.Now().UTC()
+	filter := bson.M{
+		"completed": false,
+		"reminders": bson.M{"$elemMatch": bson.M{"sent": false, "at": bson.M{"$lte": now}}},
+	}
+	opts := options.Find().
+		SetProjection(bson.M{"id": 1, "title": 1, "reminders": 1}).
+		SetLimit(remindersFiredPerRound)
+	cursor, err := todos.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	var due []TodoModel
+	if err := cursor.All(ctx, &due); err != nil {
+		return err
+	}
+
+	for _, td := range due {
+		for _, reminder := range td.Reminders {
+			if reminder.Sent || reminder.At.After(now) {
+				continue
+			}
+			err := runInTransaction(ctx, func(ctx context.Context) error {
+				claim := bson.M{"id": td.ID, "reminders": bson.M{"$elemMatch": bson.M{"id": reminder.ID, "sent": false}}}
+				data, err := todos.UpdateOne(ctx, claim, bumpVersion(bson.M{"$set": bson.M{"reminders.$.sent": true}}))
+				if err != nil || data.ModifiedCount == 0 {
+					return err
+				}
+				fired := reminder.toReminder(time.UTC)
+				if err := recordEvent(ctx, eventTodoReminder, td.ID, &fired); err != nil {
+					return err
+				}
+				return queuePushReminder(ctx, td, &fired)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// Renderer writes the bodies of responses. *renderer.Render is the one in
+// production, templateReloader the one of debug.reload_templates.
+type Renderer interface {
+	// JSON writes v encoded as JSON.
+	JSON(w http.ResponseWriter, status int, v interface{}) error
+	// HTML writes the template name executed on v.
+	HTML(w http.ResponseWriter, status int, name string, v interface{}) error
+	// Render writes v, a []byte or string body, as it is.
+	Render(w http.ResponseWriter, status int, v interface{}) error
+}
+
+// templateReloader renders like the renderer it wraps but parses the HTML
+// templates itself, again whenever a file of them changed, so edits show
+// without a restart. A template that fails to parse is answered with a page
+// showing why instead of taking the process down.
+type templateReloader struct {
+	base    *renderer.Render
+	pattern string
+	funcs   template.FuncMap
+
+	mu        sync.RWMutex
+	templates *template.Template
+	parseErr  error
+	// the names, sizes and times of the files parsed last
+	stamp string
+}
+
+func newTemplateReloader(base *renderer.Render, pattern string, funcs template.FuncMap) *templateReloader {
+	return &templateReloader{base: base, pattern: pattern, funcs: funcs}
+}
+
+func (t *templateReloader) JSON(w http.ResponseWriter, status int, v interface{}) error {
+	return t.base.JSON(w, status, v)
+}
+
+func (t *templateReloader) Render(w http.ResponseWriter, status int, v interface{}) error {
+	return t.base.Render(w, status, v)
+}
+
+func (t *templateReloader) HTML(w http.ResponseWriter, status int, name string, v interface{}) error {
+	t.reload()
+	t.mu.RLock()
+	templates, parseErr := t.templates, t.parseErr
+	t.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if parseErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<title>Template error</title>\n<h1>Template error</h1>\n<pre>%s</pre>\n",
+			template.HTMLEscapeString(parseErr.Error()))
+		return err
+	}
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, v); err != nil {
+		return err
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// reload parses the templates again when their files changed since the
+// last parse. Requests rendering meanwhile keep the templates they got.
+func (t *templateReloader) reload() {
+	stamp := templateStamp(t.pattern)
+	t.mu.RLock()
+	current := t.stamp == stamp && (t.templates != nil || t.parseErr != nil)
+	t.mu.RUnlock()
+	if current {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stamp == stamp && (t.templates != nil || t.parseErr != nil) {
+		return
+	}
+	t.templates, t.parseErr = template.New("").Funcs(t.funcs).ParseGlob(t.pattern)
+	t.stamp = stamp
+	if t.parseErr != nil {
+		log.Printf("failed to parse the HTML templates: %v\n", t.parseErr)
+	}
+}
+
+// templateStamp describes the files matching pattern, so that any edit,
+// addition or removal changes it.
+func templateStamp(pattern string) string {
+	matches, _ := filepath.Glob(pattern)
+	var stamp strings.Builder
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&stamp, "%s|%d|%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp.String()
+}
+
+// renderWriter holds back the status line until the first byte of the body.
+// The renderer writes the header before encoding, so without it a failed
+// render would already have committed to its status.
+type renderWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *renderWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status = status
+	}
+}
+
+func (w *renderWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// renderJSON responds with v as JSON, indented when prettyJSON says so; see
+// render.
+func renderJSON(rw http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	render(rw, r, func(w http.ResponseWriter) error {
+		if !prettyJSON(r) {
+			return rnd.JSON(w, status, v)
+		}
+		body, err := marshalJSON(r, v)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		return rnd.Render(w, status, body)
+	})
+}
+
+// prettyJSON reports whether the JSON answering r is to be indented for
+// people: as ?pretty says, else with debug.pretty_json set or when Accept
+// asks for JSON with a pretty=true parameter. Machine clients get compact
+// JSON.
+func prettyJSON(r *http.Request) bool {
+	if pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty")); err == nil {
+		return pretty
+	}
+	if currentConfig().Debug.PrettyJSON {
+		return true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			continue
+		}
+		if pretty, err := strconv.ParseBool(params["pretty"]); err == nil && pretty {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalJSON encodes v for r, indented when prettyJSON says so. Both forms
+// hold the same JSON value.
+func marshalJSON(r *http.Request, v interface{}) ([]byte, error) {
+	if prettyJSON(r) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// renderHTML responds with the template name executed on v; see render.
+func renderHTML(rw http.ResponseWriter, r *http.Request, status int, name string, v interface{}) {
+	render(rw, r, func(w http.ResponseWriter) error {
+		return rnd.HTML(w, status, name, v)
+	})
+}
+
+// render runs a renderer call and logs its failure. A failure before any of
+// the body went out, like a missing template or a value that can't be
+// encoded, becomes a 500; once bytes are on the wire, usually because the
+// client hung up, there is nothing left to answer. Nothing is written to a
+// client known to have hung up already.
+func render(rw http.ResponseWriter, r *http.Request, fn func(http.ResponseWriter) error) {
+	if clientClosed(r) {
+		return
+	}
+	w := &renderWriter{ResponseWriter: rw, status: http.StatusOK}
+	err := fn(w)
+	if err == nil {
+		return
+	}
+	log.Printf("failed to render the response to %s %s: %v\n", r.Method, r.URL.Path, err)
+	if !w.written {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
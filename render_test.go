@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// renderCall is one call of a captureRenderer.
+type renderCall struct {
+	// JSON, HTML or Render
+	method string
+	status int
+	// the template, for HTML
+	name  string
+	value interface{}
+}
+
+// captureRenderer records what the handlers render instead of writing it,
+// so their tests can look at the data given to a template. Each call only
+// writes its status, or fails with err when that is set.
+type captureRenderer struct {
+	calls []renderCall
+	err   error
+}
+
+func (c *captureRenderer) record(w http.ResponseWriter, call renderCall) error {
+	c.calls = append(c.calls, call)
+	if c.err != nil {
+		return c.err
+	}
+	w.WriteHeader(call.status)
+	return nil
+}
+
+func (c *captureRenderer) JSON(w http.ResponseWriter, status int, v interface{}) error {
+	return c.record(w, renderCall{method: "JSON", status: status, value: v})
+}
+
+func (c *captureRenderer) HTML(w http.ResponseWriter, status int, name string, v interface{}) error {
+	return c.record(w, renderCall{method: "HTML", status: status, name: name, value: v})
+}
+
+func (c *captureRenderer) Render(w http.ResponseWriter, status int, v interface{}) error {
+	return c.record(w, renderCall{method: "Render", status: status, value: v})
+}
+
+// useTemplates makes the handlers render with c as if html_dir held the
+// templates.
+func useTemplates(t *testing.T, c *captureRenderer) {
+	t.Helper()
+	useRenderer(t, c)
+	prev := haveTemplates
+	haveTemplates = true
+	t.Cleanup(func() { haveTemplates = prev })
+}
+
+func TestHomeHandler(t *testing.T) {
+	useConfig(t, defaultConfig())
+	capture := &captureRenderer{}
+	useTemplates(t, capture)
+
+	r := httptest.NewRequest(http.MethodGet, "/?lang=pt", nil)
+	r.Header.Set("Accept-Language", "en")
+	rw := httptest.NewRecorder()
+	homeHandler(rw, r)
+
+	if len(capture.calls) != 1 {
+		t.Fatalf("rendered %+v, want the index page once", capture.calls)
+	}
+	call := capture.calls[0]
+	if call.method != "HTML" || call.name != "indexPage" || call.status != http.StatusOK || rw.Code != http.StatusOK {
+		t.Errorf("rendered %s %s with %d, answered %d, want HTML indexPage with 200", call.method, call.name, call.status, rw.Code)
+	}
+	page, ok := call.value.(IndexPage)
+	if !ok {
+		t.Fatalf("rendered %T, want IndexPage", call.value)
+	}
+	if page.Lang != "pt" {
+		t.Errorf("page language = %q, want pt as ?lang asked", page.Lang)
+	}
+	current := 0
+	for _, link := range page.Languages {
+		if link.Current {
+			current++
+			if link.Lang != "pt" {
+				t.Errorf("current language link = %s, want pt", link.Lang)
+			}
+		}
+		if link.URL != "/?lang="+link.Lang {
+			t.Errorf("link to %s = %q", link.Lang, link.URL)
+		}
+	}
+	if current != 1 || len(page.Languages) != len(catalogs) {
+		t.Errorf("language links = %+v, want one per catalog with one current", page.Languages)
+	}
+	if cookie := rw.Result().Cookies(); len(cookie) != 1 || cookie[0].Name != languageCookie || cookie[0].Value != "pt" {
+		t.Errorf("cookies = %v, want %s=pt", cookie, languageCookie)
+	}
+}
+
+// failingWriter accepts the header but fails every write of the body, as a
+// connection the client closed does.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	headers int
+}
+
+func (w *failingWriter) WriteHeader(status int) {
+	w.headers++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *failingWriter) Write([]byte) (int, error) {
+	if w.headers == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestRenderFailures(t *testing.T) {
+	useConfig(t, defaultConfig())
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.html"), []byte(`{{define "page"}}<p>{{.}}</p>{{end}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reload := range []bool{false, true} {
+		pages, ok := newRenderer(dir, &assetManifest{}, reload)
+		if !ok {
+			t.Fatal("newRenderer() found no templates")
+		}
+		useRenderer(t, pages)
+
+		rw := httptest.NewRecorder()
+		renderHTML(rw, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "page", "hello")
+		if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "<p>hello</p>") {
+			t.Errorf("reload %v: page = %d %q, want it rendered", reload, rw.Code, rw.Body)
+		}
+
+		rw = httptest.NewRecorder()
+		renderHTML(rw, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "missing", nil)
+		if rw.Code != http.StatusInternalServerError {
+			t.Errorf("reload %v: missing template answered %d, want 500", reload, rw.Code)
+		}
+	}
+
+	useRenderer(t, nil)
+	rw := httptest.NewRecorder()
+	renderJSON(rw, httptest.NewRequest(http.MethodGet, "/todo", nil), http.StatusCreated, map[string]interface{}{"c": make(chan int)})
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value answered %d, want 500", rw.Code)
+	}
+
+	// the status went out with the first write, there is no 500 to send
+	failing := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	renderJSON(failing, httptest.NewRequest(http.MethodGet, "/todo", nil), http.StatusCreated, map[string]string{"id": "1"})
+	if failing.headers != 1 || failing.Code != http.StatusCreated {
+		t.Errorf("failed write: %d headers, status %d, want 201 once", failing.headers, failing.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rw = httptest.NewRecorder()
+	renderJSON(rw, httptest.NewRequest(http.MethodGet, "/todo", nil).WithContext(ctx), http.StatusOK, map[string]string{})
+	if rw.Body.Len() != 0 {
+		t.Errorf("wrote %q to a client that hung up", rw.Body)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		config bool
+		want   bool
+	}{
+		{"default", "", "application/json", false, false},
+		{"query", "?pretty=true", "", false, true},
+		{"query over config", "?pretty=0", "", true, false},
+		{"config", "", "", true, true},
+		{"Accept parameter", "", "text/html, application/json; pretty=true", false, true},
+		{"Accept parameter of problems", "", "application/problem+json;pretty=1", false, true},
+		{"Accept parameter of another type", "", "text/html; pretty=true", false, false},
+		{"invalid query", "?pretty=very", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Debug.PrettyJSON = tt.config
+			useConfig(t, cfg)
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/todo"+tt.query, nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := prettyJSON(r); got != tt.want {
+				t.Errorf("prettyJSON() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Pretty and compact answers hold the same JSON value, successes and
+// errors, simple or problem documents alike.
+func TestPrettyOutputEquivalent(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	tests := []struct {
+		path   string
+		accept string
+	}{
+		{"/api/v1/todo", ""},
+		{"/api/v1/todo/stats", ""},
+		{"/api/v1/todo/streak", ""},
+		{"/api/v1/todo/tags/counts", ""},
+		{"/api/v1/nowhere", ""},
+		{"/api/v1/nowhere", problemContentType},
+	}
+	for _, tt := range tests {
+		serve := func(query string) []byte {
+			r := httptest.NewRequest(http.MethodGet, tt.path+query, nil)
+			r.Header.Set("Accept", tt.accept)
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			return rw.Body.Bytes()
+		}
+		compact, pretty := serve(""), serve("?pretty=true")
+		if bytes.Contains(bytes.TrimSpace(compact), []byte("\n")) || !bytes.Contains(pretty, []byte("\n  \"")) {
+			t.Errorf("GET %s: compact %s, pretty %s", tt.path, compact, pretty)
+		}
+		var a, b interface{}
+		if err := json.Unmarshal(compact, &a); err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		if err := json.Unmarshal(pretty, &b); err != nil {
+			t.Fatalf("GET %s?pretty=true: %v", tt.path, err)
+		}
+		// each request gets an id of its own
+		for _, v := range []interface{}{a, b} {
+			if fields, ok := v.(map[string]interface{}); ok {
+				delete(fields, "request_id")
+			}
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("GET %s: compact %s and pretty %s differ", tt.path, compact, pretty)
+		}
+	}
+}
+
+// The reloader picks up an edit of a template on the next render, answers
+// one that doesn't parse with the error, and keeps rendering while the
+// files change underneath concurrent requests.
+func TestTemplateReloader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "page.html")
+	version := 0
+	// write replaces the template as editors save, by renaming a new file
+	// over it, so no render finds it half written
+	write := func(body string) {
+		t.Helper()
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// the stamp goes by size and time, which a quick rewrite may not move
+		version++
+		at := time.Now().Add(time.Duration(version) * time.Second)
+		if err := os.Chtimes(tmp, at, at); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloader := newTemplateReloader(renderer.New(), filepath.Join(dir, "*.html"), template.FuncMap{
+		"shout": strings.ToUpper,
+	})
+	render := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		if err := reloader.HTML(rw, http.StatusOK, "page", "todo"); err != nil {
+			t.Errorf("HTML() error = %v", err)
+		}
+		return rw
+	}
+
+	steps := []struct {
+		template string
+		status   int
+		body     string
+	}{
+		{`{{define "page"}}v1 {{.}}{{end}}`, http.StatusOK, "v1 todo"},
+		{`{{define "page"}}v2 {{shout .}}{{end}}`, http.StatusOK, "v2 TODO"},
+		{`{{define "page"}}v3 {{.}{{end}}`, http.StatusInternalServerError, "Template error"},
+		{`{{define "page"}}v4 {{.}}{{end}}`, http.StatusOK, "v4 todo"},
+	}
+	for _, step := range steps {
+		write(step.template)
+		rw := render()
+		if rw.Code != step.status || !strings.Contains(rw.Body.String(), step.body) {
+			t.Errorf("after writing %s: %d %q, want %d with %q", step.template, rw.Code, rw.Body, step.status, step.body)
+		}
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				rw := render()
+				if rw.Code != http.StatusOK || !strings.HasPrefix(rw.Body.String(), "v") {
+					t.Errorf("render during edits = %d %q", rw.Code, rw.Body)
+					return
+				}
+			}
+		}()
+	}
+	for i := 5; i < 25; i++ {
+		write(fmt.Sprintf(`{{define "page"}}v%d {{.}}{{end}}`, i))
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	if rw := render(); rw.Body.String() != "v24 todo" {
+		t.Errorf("after the edits: %q, want the last version", rw.Body)
+	}
+}
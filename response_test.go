@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var snakeCase = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)*$`)
+
+// Every struct sent or read as JSON names each of its exported fields in
+// snake_case, so none goes out under its Go name; the legacy fields keep
+// their old names until http.compatibility_mode drops them.
+func TestJSONFieldNames(t *testing.T) {
+	files, err := parser.ParseDir(token.NewFileSet(), ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range files {
+		ast.Inspect(pkg, func(n ast.Node) bool {
+			spec, ok := n.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			if st, ok := spec.Type.(*ast.StructType); ok && hasJSONTags(st) {
+				checkJSONFields(t, spec.Name.Name, st)
+			}
+			return true
+		})
+	}
+}
+
+func hasJSONTags(st *ast.StructType) bool {
+	for _, field := range st.Fields.List {
+		if _, ok := jsonTag(field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTag(field *ast.Field) (string, bool) {
+	if field.Tag == nil {
+		return "", false
+	}
+	tag, _ := strconv.Unquote(field.Tag.Value)
+	return reflect.StructTag(tag).Lookup("json")
+}
+
+func checkJSONFields(t *testing.T, typeName string, st *ast.StructType) {
+	t.Helper()
+	for _, field := range st.Fields.List {
+		tag, tagged := jsonTag(field)
+		name, _, _ := strings.Cut(tag, ",")
+		for _, ident := range field.Names {
+			switch {
+			case !ident.IsExported() || name == "-" || legacyFields[name]:
+			case !tagged || name == "":
+				t.Errorf("%s.%s has no JSON name", typeName, ident.Name)
+			case !snakeCase.MatchString(name):
+				t.Errorf("%s.%s is named %q in JSON, not snake_case", typeName, ident.Name, name)
+			}
+		}
+		if inner, ok := field.Type.(*ast.StructType); ok {
+			checkJSONFields(t, typeName, inner)
+		}
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"created todo", CreateTodoResponse{Message: "ok", ID: "652f1c2e9b1e8a0001a1b2c3"}, `{"message":"ok","id":"652f1c2e9b1e8a0001a1b2c3"}`},
+		{"update without the todo", UpdateTodoResponse{Message: "ok"}, `{"message":"ok","modified_count":0}`},
+		{"deletion", DeleteTodoResponse{Message: "ok", DeletedCount: 2}, `{"message":"ok","deleted_count":2}`},
+		{"last page", GetTodoResponse{Message: "ok", Data: []Todo{}}, `{"message":"ok","data":[]}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// dataKeys are the fields whose keys are data rather than field names, like
+// the configuration paths of /admin/config.
+var dataKeys = map[string]bool{"config": true}
+
+// snakeCaseKeys reports the first key of a decoded JSON value, at any depth,
+// that isn't snake_case.
+func snakeCaseKeys(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if !snakeCase.MatchString(key) {
+				return key, false
+			}
+			if dataKeys[key] {
+				continue
+			}
+			if key, ok := snakeCaseKeys(value); !ok {
+				return key, false
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if key, ok := snakeCaseKeys(value); !ok {
+				return key, false
+			}
+		}
+	}
+	return "", true
+}
+
+// What every GET route answers, success or error, uses snake_case keys only,
+// errors carry their message and code, and the typed responses decode
+// without a field the client types don't know.
+func TestResponseContract(t *testing.T) {
+	router, paths, _ := emptyDatabaseRouter(t)
+	typed := map[string]interface{}{
+		apiV1.prefix() + "/todo":        &GetTodoResponse{},
+		apiV1.prefix() + "/todo/streak": &GetStreakResponse{},
+	}
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("X-Admin-Key", testAdminKey)
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if !strings.HasPrefix(rw.Header().Get("Content-Type"), "application/json") {
+				return
+			}
+
+			var body interface{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			if key, ok := snakeCaseKeys(body); !ok {
+				t.Errorf("GET %s answered key %q: %s", path, key, rw.Body)
+			}
+			if rw.Code >= http.StatusBadRequest {
+				fields, _ := body.(map[string]interface{})
+				if message, _ := fields["message"].(string); message == "" || fields["code"] == nil {
+					t.Errorf("GET %s = %d without a message and code: %s", path, rw.Code, rw.Body)
+				}
+				return
+			}
+
+			if v, ok := typed[path]; ok {
+				dec := json.NewDecoder(bytes.NewReader(rw.Body.Bytes()))
+				dec.DisallowUnknownFields()
+				if err := dec.Decode(v); err != nil {
+					t.Errorf("GET %s doesn't match %T: %v", path, v, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Updates and deletes answer with the todo as their own write left it, even
+// when another write changes it right after.
+func TestUpdateAnswersItsOwnWrite(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	now := time.Now().UTC()
+	written := newTodoModel("write report", now)
+	written.Version = 2
+	racing := written
+	racing.Title, racing.NormalizedTitle, racing.Version = "written by someone else", titleIndex("written by someone else"), 3
+	id := formatID(written.ID)
+
+	tests := []struct {
+		method, body string
+		want         int
+	}{
+		{http.MethodPut, `{"title":"write report","completed":false}`, http.StatusOK},
+		{http.MethodPatch, `{"title":"write report"}`, http.StatusOK},
+		{http.MethodPatch, `{"completed":false}`, http.StatusOK},
+		{http.MethodDelete, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.body, func(t *testing.T) {
+			mongo.seed(collectionName, written)
+			mongo.afterModify = func(collection string) {
+				if collection == collectionName {
+					mongo.seed(collectionName, racing)
+				}
+			}
+			t.Cleanup(func() { mongo.afterModify = nil })
+			mongo.commands()
+
+			r := httptest.NewRequest(tt.method, "/api/v1/todo/"+id, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", jsonContentType)
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if rw.Code != tt.want {
+				t.Fatalf("%s = %d: %s", tt.method, rw.Code, rw.Body)
+			}
+			var resp struct {
+				Data *Todo `json:"data"`
+			}
+			if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data == nil || resp.Data.ID != id || resp.Data.Title != "write report" || resp.Data.Version != 2 {
+				t.Errorf("%s answered %s, want the todo at version 2", tt.method, rw.Body)
+			}
+
+			var modifies int
+			for _, cmd := range mongo.commands() {
+				if cmd.Collection == collectionName && cmd.Name == "findAndModify" {
+					modifies++
+					if tt.method != http.MethodDelete && !cmd.Command.Lookup("new").Boolean() {
+						t.Errorf("%s doesn't ask for the todo after the update: %s", tt.method, cmd.Command)
+					}
+				}
+			}
+			if modifies != 1 {
+				t.Errorf("%s sent %d findAndModify, want 1", tt.method, modifies)
+			}
+		})
+	}
+
+	// nothing matched is still a 404
+	for _, tt := range tests {
+		mongo.seed(collectionName)
+		r := httptest.NewRequest(tt.method, "/api/v1/todo/"+id, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", jsonContentType)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("%s of no todo = %d, want 404", tt.method, rw.Code)
+		}
+	}
+}
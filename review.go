@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// the todos completed on one day of the reviewed week
+	ReviewDay struct {
+		Date      string `json:"date"`
+		Completed []Todo `json:"completed"`
+	}
+	// summary numbers of a weekly review
+	ReviewSummary struct {
+		Completed int64 `json:"completed"`
+		Open      int64 `json:"open"`
+		Stale     int64 `json:"stale"`
+		// completed / (completed + open), 0 for an empty week
+		CompletionRate float64 `json:"completion_rate"`
+	}
+	// a digest of one ISO week
+	WeeklyReview struct {
+		Week    string        `json:"week"`
+		From    time.Time     `json:"from"`
+		To      time.Time     `json:"to"`
+		Days    []ReviewDay   `json:"days"`
+		Stale   []Todo        `json:"stale"`
+		Summary ReviewSummary `json:"summary"`
+	}
+	// the weekly review endpoint response
+	GetReviewResponse struct {
+		Message string       `json:"message"`
+		Data    WeeklyReview `json:"data"`
+	}
+)
+
+// getReview summarizes ?week=YYYY-Www, the current ISO week of the request's
+// zone by default. ?stale_days sets how old open todos must be to be stale,
+// stale_after_days by default.
+func getReview(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	start := startOfISOWeek(time.Now().In(loc))
+	if value := query.Get("week"); value != "" {
+		if start, err = parseISOWeek(value, loc); err != nil {
+			writeError(rw, r, http.StatusBadRequest, "invalid_week", renderer.M{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	staleDays := int(currentConfig().StaleAfterDays)
+	if value := query.Get("stale_days"); value != "" {
+		if staleDays, err = strconv.Atoi(value); err != nil || staleDays < 1 {
+			writeError(rw, r, http.StatusBadRequest, "invalid_stale_days", nil)
+			return
+		}
+	}
+
+	review, err := weeklyReview(r.Context(), start, time.Duration(staleDays)*24*time.Hour)
+	if err != nil {
+		logRequestError(r, "failed to compute the weekly review: %v\n", err)
+		writeDBError(rw, r, err, "review_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetReviewResponse{
+		Message: localize(r, "review_computed"),
+		Data:    review,
+	})
+}
+
+// weeklyReview computes the review of the week starting at start, in start's
+// location, with a single aggregation. Open todos created staleAfter before the
+// end of the week, or before now for the current week, are stale.
+func weeklyReview(ctx context.Context, start time.Time, staleAfter time.Duration) (WeeklyReview, error) {
+	loc := start.Location()
+	end := start.AddDate(0, 0, 7)
+	staleBefore := end
+	if now := time.Now(); now.Before(end) {
+		staleBefore = now
+	}
+	staleBefore = staleBefore.Add(-staleAfter)
+
+	pipeline := bson.A{
+		bson.M{"$addFields": bson.M{"done_at": completedAtExpr}},
+		bson.M{"$facet": bson.M{
+			"completed": bson.A{
+				bson.M{"$match": bson.M{"completed": true, "done_at": bson.M{"$gte": start, "$lt": end}}},
+				bson.M{"$sort": bson.M{"done_at": 1}},
+				bson.M{"$group": bson.M{
+					"_id":   dayOfExpr("$done_at", loc),
+					"todos": bson.M{"$push": "$$ROOT"},
+				}},
+			},
+			"stale": bson.A{
+				bson.M{"$match": bson.M{"completed": false, "created_at": bson.M{"$lt": staleBefore}}},
+				bson.M{"$sort": bson.M{"created_at": 1}},
+			},
+			"open": bson.A{
+				bson.M{"$match": bson.M{"completed": false, "created_at": bson.M{"$lt": end}}},
+				bson.M{"$count": "count"},
+			},
+		}},
+	}
+
+	cursor, err := tenantDB(ctx).Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return WeeklyReview{}, err
+	}
+	var results []struct {
+		Completed []struct {
+			Date  string      `bson:"_id"`
+			Todos []TodoModel `bson:"todos"`
+		} `bson:"completed"`
+		Stale []TodoModel `bson:"stale"`
+		Open  []struct {
+			Count int64 `bson:"count"`
+		} `bson:"open"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return WeeklyReview{}, err
+	}
+
+	year, week := start.ISOWeek()
+	review := WeeklyReview{
+		Week:  fmt.Sprintf("%04d-W%02d", year, week),
+		From:  start,
+		To:    end,
+		Days:  []ReviewDay{},
+		Stale: []Todo{},
+	}
+
+	byDate := map[string][]TodoModel{}
+	for _, f := range results[0].Completed {
+		byDate[f.Date] = f.Todos
+	}
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		completed := []Todo{}
+		for _, td := range byDate[date] {
+			completed = append(completed, td.toTodo(loc))
+		}
+		review.Days = append(review.Days, ReviewDay{Date: date, Completed: completed})
+		review.Summary.Completed += int64(len(completed))
+	}
+	for _, td := range results[0].Stale {
+		review.Stale = append(review.Stale, td.toTodo(loc))
+	}
+	review.Summary.Stale = int64(len(review.Stale))
+	if len(results[0].Open) > 0 {
+		review.Summary.Open = results[0].Open[0].Count
+	}
+	if total := review.Summary.Completed + review.Summary.Open; total > 0 {
+		review.Summary.CompletionRate = float64(review.Summary.Completed) / float64(total)
+	}
+	return review, nil
+}
+
+// startOfISOWeek returns midnight of the Monday of t's week.
+func startOfISOWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// parseISOWeek parses YYYY-Www and returns the Monday starting that week in loc.
+func parseISOWeek(value string, loc *time.Location) (time.Time, error) {
+	var year, week int
+	if _, err := fmt.Sscanf(value, "%4d-W%2d", &year, &week); err != nil || len(value) != len("2006-W01") {
+		return time.Time{}, fmt.Errorf("week must look like 2024-W21")
+	}
+	// January 4th is always in week 1
+	start := startOfISOWeek(time.Date(year, time.January, 4, 0, 0, 0, 0, loc)).AddDate(0, 0, (week-1)*7)
+	if y, w := start.ISOWeek(); y != year || w != week {
+		return time.Time{}, fmt.Errorf("%d has no week %d", year, week)
+	}
+	return start, nil
+}
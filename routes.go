@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// routeMap is the route table of the main router, built at startup.
+var routeMap []Route
+
+type (
+	// a route of the router: the methods answered on a pattern
+	Route struct {
+		Pattern string   `json:"pattern"`
+		Methods []string `json:"methods"`
+		// methods switched off, see routeSwitch
+		Disabled []string `json:"disabled,omitempty"`
+		// methods answered with 405 by refuseMethods
+		refused []string
+	}
+	// the route table endpoint response
+	GetRoutesResponse struct {
+		Message string  `json:"message"`
+		Count   int     `json:"count"`
+		Data    []Route `json:"data"`
+	}
+)
+
+// routeTable lists the routes of router, subrouters included, sorted by
+// pattern.
+func routeTable(router chi.Routes) ([]Route, error) {
+	byPattern := map[string]*Route{}
+	err := chi.Walk(router, func(method, pattern string, handler http.Handler, _ ...func(http.Handler) http.Handler) error {
+		// a subrouter's "/" is its mount point
+		if len(pattern) > 1 {
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		route, ok := byPattern[pattern]
+		if !ok {
+			route = &Route{Pattern: pattern}
+			byPattern[pattern] = route
+		}
+		switch {
+		case handler == refusal:
+			route.refused = append(route.refused, method)
+		case !slices.Contains(route.Methods, method):
+			route.Methods = append(route.Methods, method)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]Route, 0, len(byPattern))
+	for _, route := range byPattern {
+		slices.Sort(route.Methods)
+		routes = append(routes, *route)
+	}
+	slices.SortFunc(routes, func(a, b Route) int { return strings.Compare(a.Pattern, b.Pattern) })
+	return routes, nil
+}
+
+// shadows reports whether some path matches both patterns and the router
+// prefers literal for it: at the first segment where one pattern has a
+// parameter or wildcard and the other a fixed segment, literal is fixed.
+func shadows(param, literal string) bool {
+	ps, ls := strings.Split(param, "/"), strings.Split(literal, "/")
+	decided, preferred := false, false
+	for i := 0; i < max(len(ps), len(ls)); i++ {
+		if i >= len(ps) || i >= len(ls) {
+			return false
+		}
+		p, l := ps[i], ls[i]
+		pVar, lVar := isRouteParam(p), isRouteParam(l)
+		switch {
+		case !pVar && !lVar && p != l:
+			return false
+		case pVar && !lVar && !decided:
+			decided, preferred = true, true
+		case !pVar && lVar:
+			decided = true
+		}
+		// a wildcard matches the rest of the path
+		if p == "*" || l == "*" {
+			return preferred && p == "*"
+		}
+	}
+	return preferred
+}
+
+// isRouteParam reports whether a pattern segment is a parameter or wildcard.
+func isRouteParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") || segment == "*"
+}
+
+// auditRoutes checks the route table for routes shadowed by a parameter
+// route. The router prefers the literal segment, but a method the literal
+// route doesn't answer falls through to the parameter route, which takes the
+// literal for its parameter: GET /todo/completed would fetch the todo with id
+// "completed" and fail with a confusing 400. Every method of the parameter
+// route must be answered by the literal one as well.
+func auditRoutes(routes []Route) error {
+	var errs []string
+	for _, param := range routes {
+		for _, literal := range routes {
+			if !shadows(param.Pattern, literal.Pattern) {
+				continue
+			}
+			for _, method := range param.Methods {
+				if !slices.Contains(literal.Methods, method) && !slices.Contains(literal.refused, method) {
+					errs = append(errs, fmt.Sprintf("%s %s is served by %s", method, literal.Pattern, param.Pattern))
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("shadowed routes:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// refusal answers a method a route doesn't support; see refuseMethods.
+var refusal http.Handler = &refuser{}
+
+type refuser struct{}
+
+func (*refuser) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	methodNotAllowed(rw, r)
+}
+
+// refuseMethods answers methods on patterns with 405. Routes registered on
+// the patterns afterwards replace it for their method.
+func refuseMethods(r chi.Router, patterns []string, methods ...string) {
+	for _, pattern := range patterns {
+		for _, method := range methods {
+			r.Method(method, pattern, refusal)
+		}
+	}
+}
+
+// routesHandler serves the route table when debug.routes is set, with the
+// methods disabled at the moment.
+func routesHandler(rw http.ResponseWriter, r *http.Request) {
+	if !currentConfig().Debug.Routes {
+		notFound(rw, r)
+		return
+	}
+	routes := make([]Route, len(routeMap))
+	for i, route := range routeMap {
+		routes[i] = route
+		for _, method := range route.Methods {
+			if routeDisabled(routeKey(method, route.Pattern)) {
+				routes[i].Disabled = append(routes[i].Disabled, method)
+			}
+		}
+	}
+	renderJSON(rw, r, http.StatusOK, GetRoutesResponse{
+		Message: localize(r, "routes_listed"),
+		Count:   len(routes),
+		Data:    routes,
+	})
+}
+
+// logRoutes logs the route table, one pattern per line.
+func logRoutes(routes []Route) {
+	for _, route := range routes {
+		log.Printf("route %-24s %s\n", strings.Join(route.Methods, ","), route.Pattern)
+	}
+}
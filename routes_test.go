@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The route table as built has no route shadowed by another, which would
+// stop the process at startup.
+func TestRoutesNotShadowed(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	routes, err := routeTable(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auditRoutes(routes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShadows(t *testing.T) {
+	tests := []struct {
+		param, literal string
+		want           bool
+	}{
+		{"/todo/{id}", "/todo/completed", true},
+		{"/todo/{id}", "/todo/{id}", false},
+		{"/todo/completed", "/todo/{id}", false},
+		{"/todo/{id}", "/todo/completed/count", false},
+		{"/todo/{id}/tags", "/todo/stats/tags", true},
+		{"/todo/{id}/tags", "/todo/stats/count", false},
+		{"/todo/*", "/todo/export", true},
+		{"/todo/{id}", "/attachment/export", false},
+		{"/{tenant}/todo/{id}", "/{tenant}/todo/stats", true},
+	}
+	for _, tt := range tests {
+		if got := shadows(tt.param, tt.literal); got != tt.want {
+			t.Errorf("shadows(%q, %q) = %v, want %v", tt.param, tt.literal, got, tt.want)
+		}
+	}
+}
+
+// A literal route that doesn't answer every method of a parameter route
+// next to it is caught, unless it refuses the others.
+func TestAuditRoutesShadowed(t *testing.T) {
+	handler := func(rw http.ResponseWriter, r *http.Request) {}
+	build := func(refuse bool) []Route {
+		r := chi.NewRouter()
+		r.Route("/todo", func(r chi.Router) {
+			if refuse {
+				refuseMethods(r, []string{"/completed"}, http.MethodPut, http.MethodDelete)
+			}
+			r.Get("/completed", handler)
+			r.Get("/{id}", handler)
+			r.Put("/{id}", handler)
+			r.Delete("/{id}", handler)
+		})
+		routes, err := routeTable(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return routes
+	}
+
+	err := auditRoutes(build(false))
+	if err == nil {
+		t.Fatal("auditRoutes() accepted a shadowed route")
+	}
+	for _, want := range []string{"PUT /todo/completed is served by /todo/{id}", "DELETE /todo/completed is served by /todo/{id}"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("auditRoutes() = %v, want it to report %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "GET") {
+		t.Errorf("auditRoutes() = %v, reporting the GET the literal route answers", err)
+	}
+
+	if err := auditRoutes(build(true)); err != nil {
+		t.Errorf("auditRoutes() = %v with the other methods refused", err)
+	}
+}
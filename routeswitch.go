@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// settings changed at runtime, in the shared database, one per document
+	settingsCollectionName string = "settings"
+
+	// the settings document of the routes switched by the admin endpoints
+	routeSwitchesSetting string = "route_switches"
+)
+
+var (
+	// the routes switched off or back on by the admin endpoints, which win
+	// over disabled_routes; a new map replaces it on every switch
+	routeSwitches atomic.Pointer[map[string]bool]
+	// serializes the switches, so none is lost between reading and saving
+	routeSwitchesMu sync.Mutex
+)
+
+type (
+	// switch a route off or on
+	RouteSwitchRequest struct {
+		Route string `json:"route"`
+	}
+	// the state of a route after a switch
+	RouteSwitchResponse struct {
+		Message  string `json:"message"`
+		Route    string `json:"route"`
+		Disabled bool   `json:"disabled"`
+	}
+	// the routes switched at runtime, kept across restarts
+	routeSwitchesModel struct {
+		ID       string             `bson:"_id"`
+		Switches []routeSwitchModel `bson:"switches"`
+	}
+	routeSwitchModel struct {
+		Route    string `bson:"route"`
+		Disabled bool   `bson:"disabled"`
+	}
+)
+
+// routeKey names the route of method and pattern as disabled_routes and the
+// switches do, e.g. "GET /api/v1/todo/{id}".
+func routeKey(method, pattern string) string {
+	if len(pattern) > 1 {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	return method + " " + pattern
+}
+
+// routeDisabled reports whether route is switched off, by the admin endpoints
+// when they switched it and by disabled_routes otherwise.
+func routeDisabled(route string) bool {
+	if switches := routeSwitches.Load(); switches != nil {
+		if disabled, ok := (*switches)[route]; ok {
+			return disabled
+		}
+	}
+	return slices.Contains(currentConfig().DisabledRoutes, route)
+}
+
+// anyRouteDisabled reports whether routeDisabled may hold for some route.
+func anyRouteDisabled() bool {
+	if len(currentConfig().DisabledRoutes) > 0 {
+		return true
+	}
+	if switches := routeSwitches.Load(); switches != nil {
+		for _, disabled := range *switches {
+			if disabled {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routeSwitch answers the requests of a disabled route with 503 before they
+// reach it. The router hasn't matched the request yet, so it matches it
+// itself, and only while some route is disabled. HEAD goes with GET.
+func routeSwitch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || rctx.Routes == nil || !anyRouteDisabled() {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if pattern, _, ok := matchRoute(r, method); ok {
+			if route := routeKey(method, pattern); routeDisabled(route) {
+				writeError(rw, r, http.StatusServiceUnavailable, "route_disabled", renderer.M{
+					"route": route,
+				})
+				return
+			}
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// matchRoute matches the path of r with method against the whole router, as
+// middlewares run before the router matched the request itself. It returns
+// the pattern of the route, with the router's context of the match.
+func matchRoute(r *http.Request, method string) (string, *chi.Context, bool) {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return "", nil, false
+	}
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	match := chi.NewRouteContext()
+	if !rctx.Routes.Match(match, method, path) {
+		return "", nil, false
+	}
+	return match.RoutePattern(), match, true
+}
+
+// knownRoute reports whether route names a method and pattern of the route
+// table.
+func knownRoute(route string) bool {
+	method, pattern, _ := strings.Cut(route, " ")
+	return slices.ContainsFunc(routeMap, func(known Route) bool {
+		return known.Pattern == pattern && slices.Contains(known.Methods, method)
+	})
+}
+
+// loadRouteSwitches restores the routes switched before a restart.
+func loadRouteSwitches(ctx context.Context) error {
+	var saved routeSwitchesModel
+	err := db.Collection(settingsCollectionName).FindOne(ctx, bson.M{"_id": routeSwitchesSetting}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switches := map[string]bool{}
+	for _, s := range saved.Switches {
+		switches[s.Route] = s.Disabled
+	}
+	routeSwitches.Store(&switches)
+	return nil
+}
+
+// switchRoute switches route off or back on and saves it, so the switch
+// survives a restart. Requests in flight see either state.
+func switchRoute(ctx context.Context, route string, disabled bool) error {
+	routeSwitchesMu.Lock()
+	defer routeSwitchesMu.Unlock()
+
+	switches := map[string]bool{}
+	if current := routeSwitches.Load(); current != nil {
+		for k, v := range *current {
+			switches[k] = v
+		}
+	}
+	switches[route] = disabled
+
+	saved := routeSwitchesModel{ID: routeSwitchesSetting, Switches: []routeSwitchModel{}}
+	for k, v := range switches {
+		saved.Switches = append(saved.Switches, routeSwitchModel{Route: k, Disabled: v})
+	}
+	slices.SortFunc(saved.Switches, func(a, b routeSwitchModel) int { return strings.Compare(a.Route, b.Route) })
+	_, err := db.Collection(settingsCollectionName).ReplaceOne(ctx, bson.M{"_id": routeSwitchesSetting}, saved, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	routeSwitches.Store(&switches)
+	return nil
+}
+
+// switchRouteHandler switches the route of the body off when disabled is
+// set, back on otherwise. The switches themselves can't be switched off.
+func switchRouteHandler(disabled bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req RouteSwitchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Printf("failed to decode json data: %v\n", err.Error())
+			writeError(rw, r, http.StatusBadRequest, "invalid_body", nil)
+			return
+		}
+		route := strings.Join(strings.Fields(req.Route), " ")
+		if !knownRoute(route) {
+			writeError(rw, r, http.StatusNotFound, "route_unknown", renderer.M{"route": route})
+			return
+		}
+		if _, pattern, _ := strings.Cut(route, " "); strings.HasPrefix(pattern, "/admin/routes/") {
+			writeError(rw, r, http.StatusBadRequest, "route_not_switchable", renderer.M{"route": route})
+			return
+		}
+
+		action := "route.enable"
+		if disabled {
+			action = "route.disable"
+		}
+		auditID, err := beginAudit(r, action)
+		if err != nil {
+			logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+			writeDBError(rw, r, err, "audit_failed_route_switch")
+			return
+		}
+		if err := switchRoute(r.Context(), route, disabled); err != nil {
+			finishAudit(r.Context(), auditID, 0, err)
+			logRequestError(r, "failed to save route switch: %v\n", err)
+			writeDBError(rw, r, err, "route_switch_failed")
+			return
+		}
+		finishAudit(r.Context(), auditID, 1, nil)
+		log.Printf("route %s disabled set to %t by %s\n", route, disabled, clientIP(r))
+
+		renderJSON(rw, r, http.StatusOK, RouteSwitchResponse{
+			Message:  localize(r, "route_switched"),
+			Route:    route,
+			Disabled: disabled,
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// useRouteSwitches starts the test without routes switched at runtime, and
+// with the route table of router.
+func useRouteSwitches(t *testing.T, routes []Route) {
+	t.Helper()
+	prevSwitches, prevMap := routeSwitches.Load(), routeMap
+	routeSwitches.Store(nil)
+	routeMap = routes
+	t.Cleanup(func() {
+		routeSwitches.Store(prevSwitches)
+		routeMap = prevMap
+	})
+}
+
+func TestRouteDisabled(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DisabledRoutes = []string{"GET /api/v1/todo/export", "DELETE /api/v1/todo/{id}"}
+	useConfig(t, cfg)
+	useRouteSwitches(t, nil)
+	routeSwitches.Store(&map[string]bool{"GET /api/v1/todo/export": false, "GET /api/v1/todo/stats": true})
+
+	tests := []struct {
+		route string
+		want  bool
+	}{
+		{"GET /api/v1/todo/export", false},
+		{"DELETE /api/v1/todo/{id}", true},
+		{"GET /api/v1/todo/stats", true},
+		{"GET /api/v1/todo", false},
+	}
+	for _, tt := range tests {
+		if got := routeDisabled(tt.route); got != tt.want {
+			t.Errorf("routeDisabled(%q) = %v, want %v", tt.route, got, tt.want)
+		}
+	}
+}
+
+// Switching a route off and on while it is requested answers each request
+// either normally or with 503, and the last switch holds once it returned.
+func TestRouteSwitchUnderTraffic(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	routes, err := routeTable(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useRouteSwitches(t, routes)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Admin-Key", testAdminKey)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw
+	}
+	toggle := func(action string) {
+		t.Helper()
+		if rw := serve(http.MethodPost, "/admin/routes/"+action, `{"route":"GET  /api/v1/todo/stats"}`); rw.Code != http.StatusOK {
+			t.Fatalf("%s = %d: %s", action, rw.Code, rw.Body)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var served, refused, other atomic.Int64
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rw := serve(http.MethodGet, "/api/v1/todo/stats", "")
+				var body struct {
+					Code string `json:"code"`
+				}
+				json.Unmarshal(rw.Body.Bytes(), &body)
+				switch {
+				case rw.Code == http.StatusOK:
+					served.Add(1)
+				case rw.Code == http.StatusServiceUnavailable && body.Code == "route_disabled":
+					refused.Add(1)
+				default:
+					other.Add(1)
+				}
+			}
+		}()
+	}
+	mongo.commands()
+	const toggles = 5
+	for i := 0; i < toggles; i++ {
+		toggle("disable")
+		if rw := serve(http.MethodHead, "/api/v1/todo/stats", ""); rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("HEAD of a disabled GET route = %d, want 503", rw.Code)
+		}
+		toggle("enable")
+		if rw := serve(http.MethodGet, "/api/v1/todo/stats", ""); rw.Code != http.StatusOK {
+			t.Errorf("GET of an enabled route = %d, want 200", rw.Code)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if other.Load() > 0 {
+		t.Errorf("%d requests were answered with neither 200 nor 503", other.Load())
+	}
+	if served.Load() == 0 {
+		t.Error("no request was served")
+	}
+	saves := 0
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "update" && cmd.Collection == settingsCollectionName {
+			saves++
+		}
+	}
+	if saves != 2*toggles {
+		t.Errorf("saved %d switches, want %d", saves, 2*toggles)
+	}
+
+	for _, body := range []string{`{"route":"GET /api/v1/nowhere"}`, `{"route":"POST /admin/routes/disable"}`} {
+		if rw := serve(http.MethodPost, "/admin/routes/disable", body); rw.Code == http.StatusOK {
+			t.Errorf("switched %s off", body)
+		}
+	}
+}
+
+func TestLoadRouteSwitches(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRouteSwitches(t, nil)
+	mongo := useEmptyDatabase(t)
+	mongo.seed(settingsCollectionName, bson.M{"_id": routeSwitchesSetting, "switches": bson.A{
+		bson.M{"route": "GET /api/v1/todo/stats", "disabled": true},
+		bson.M{"route": "GET /api/v1/todo/export", "disabled": false},
+	}})
+
+	if err := loadRouteSwitches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !routeDisabled("GET /api/v1/todo/stats") || routeDisabled("GET /api/v1/todo/export") {
+		t.Errorf("switches = %v after a restart", *routeSwitches.Load())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Client uploads backups to S3 compatible object stores; the timeout
+// leaves room for large archives.
+var s3Client = &http.Client{Timeout: 30 * time.Minute}
+
+// putS3Object uploads size bytes of body, whose SHA-256 is sum, as key into
+// the configured bucket and returns its s3:// location. The request is
+// signed with AWS Signature Version 4.
+func putS3Object(ctx context.Context, cfg BackupS3Config, key string, body io.Reader, size int64, sum []byte) (string, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	target := *endpoint
+	if cfg.PathStyle {
+		target.Path = strings.TrimSuffix(target.Path, "/") + "/" + cfg.Bucket + "/" + key
+	} else {
+		target.Host = cfg.Bucket + "." + target.Host
+		target.Path = strings.TrimSuffix(target.Path, "/") + "/" + key
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target.String(), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	signS3Request(req, cfg, hex.EncodeToString(sum), time.Now().UTC())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return "", fmt.Errorf("%s answered %s: %s", target.Host, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return "s3://" + cfg.Bucket + "/" + key, nil
+}
+
+// signS3Request adds the Signature Version 4 headers to req, whose body has
+// the hex SHA-256 payloadHash.
+func signS3Request(req *http.Request, cfg BackupS3Config, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + cfg.SecretKey)
+	for _, part := range []string{day, cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
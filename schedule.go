@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression of five fields: minute, hour, day
+// of month, month and day of week, each a set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// as in cron, with both day fields restricted a day matching either will do
+	domAny, dowAny bool
+}
+
+// cronDescriptors are the shorthands accepted for common schedules.
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseSchedule reads a cron expression such as "30 2 * * 1-5" or one of
+// cronDescriptors. Fields take *, values, ranges, lists and /steps; a day of
+// week of 7 is Sunday like 0.
+func parseSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day month weekday), found %d", len(fields))
+	}
+
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		name     string
+		set      *uint64
+		min, max int
+	}{
+		{"minute", &s.minute, 0, 59},
+		{"hour", &s.hour, 0, 23},
+		{"day", &s.dom, 1, 31},
+		{"month", &s.month, 1, 12},
+		{"weekday", &s.dow, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+// parseCronField returns the set of values from minValue to maxValue matched
+// by a comma separated list of *, n or n-m, each optionally followed by /step.
+func parseCronField(field string, minValue, maxValue int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		lo, hi := minValue, maxValue
+		if rangePart != "*" {
+			first, last, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				// n/step runs from n to the end, as in cron
+				hi = maxValue
+			}
+		}
+		if lo < minValue || hi > maxValue || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", rangePart, minValue, maxValue)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first minute after after that the schedule matches, in
+// the location of after, or the zero time if there is none within five
+// years, as with February 30.
+func (s *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
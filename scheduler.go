@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thedevsaddam/renderer"
+)
+
+// job run outcomes
+const (
+	jobSucceeded   string = "succeeded"
+	jobFailed      string = "failed"
+	jobInterrupted string = "interrupted"
+)
+
+var errJobRunning = errors.New("the job is running")
+
+var (
+	jobRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "todo_job_runs_total",
+			Help: "Background job runs by job and outcome: succeeded, failed or interrupted.",
+		},
+		[]string{"job", "outcome"},
+	)
+	jobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "todo_job_duration_seconds",
+			Help:    "Duration of background job runs by job.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobRuns, jobDuration)
+}
+
+// jobs runs the background work of the instance; main registers the jobs
+// the configuration enables before starting it.
+var jobs = &scheduler{}
+
+type (
+	// the state of a background job, as listed by the admin API
+	JobStatus struct {
+		Name string `json:"name"`
+		// "every" and the interval, the cron expression or "manual"
+		Schedule string `json:"schedule"`
+		Running  bool   `json:"running"`
+		// absent while it runs and when the schedule never matches
+		NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+		LastRunAt      *time.Time `json:"last_run_at,omitempty"`
+		LastDurationMS int64      `json:"last_duration_ms"`
+		// empty before the first run
+		LastOutcome string `json:"last_outcome,omitempty"`
+		LastError   string `json:"last_error,omitempty"`
+		Runs        int64  `json:"runs"`
+		Failures    int64  `json:"failures"`
+	}
+	// the jobs endpoint response
+	GetJobsResponse struct {
+		Message string      `json:"message"`
+		Data    []JobStatus `json:"data"`
+	}
+	// a job that was asked to run
+	JobResponse struct {
+		Message string    `json:"message"`
+		Data    JobStatus `json:"data"`
+	}
+)
+
+// a job of the scheduler, run every interval, whenever schedule matches or,
+// when manual, only when asked to
+type job struct {
+	name     string
+	interval time.Duration
+	schedule *cronSchedule
+	manual   bool
+	run      func(ctx context.Context) error
+	// asks the loop of the job for a run now
+	trigger chan struct{}
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// scheduler runs each of its jobs in a goroutine of its own, one run at a
+// time, from start until stop.
+type scheduler struct {
+	jobs   []*job
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// every registers the job name running run every interval, the first time
+// right after start.
+func (s *scheduler) every(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.add(&job{name: name, interval: interval, run: run, status: JobStatus{Schedule: "every " + interval.String()}})
+}
+
+// cron registers the job name running run whenever schedule, parsed from
+// spec, matches in the configured timezone.
+func (s *scheduler) cron(name, spec string, schedule *cronSchedule, run func(ctx context.Context) error) {
+	s.add(&job{name: name, schedule: schedule, run: run, status: JobStatus{Schedule: spec}})
+}
+
+// manual registers the job name running run only when asked to through the
+// admin API.
+func (s *scheduler) manual(name string, run func(ctx context.Context) error) {
+	s.add(&job{name: name, manual: true, run: run, status: JobStatus{Schedule: "manual"}})
+}
+
+func (s *scheduler) add(j *job) {
+	j.status.Name = j.name
+	j.trigger = make(chan struct{}, 1)
+	s.jobs = append(s.jobs, j)
+}
+
+// start runs the jobs until stop.
+func (s *scheduler) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, j)
+	}
+}
+
+// stop cancels the runs in progress and waits for them to return.
+func (s *scheduler) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// loop runs j whenever it is due or triggered until ctx is cancelled. While
+// the instance drains the scheduled runs are skipped, the one replacing it
+// does the work; runs asked for through the admin API still happen.
+func (s *scheduler) loop(ctx context.Context, j *job) {
+	defer s.wg.Done()
+	next := time.Now()
+	if j.schedule != nil || j.manual {
+		next = j.next(next)
+		if next.IsZero() && !j.manual {
+			log.Printf("the schedule of job %s never matches, it only runs when asked to\n", j.name)
+		}
+	}
+	for {
+		j.setNextRun(next)
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		scheduled := false
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-due:
+			scheduled = true
+		case <-j.trigger:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+
+		if !scheduled || !draining.Load() {
+			j.runOnce(ctx)
+		}
+		next = j.next(time.Now())
+	}
+}
+
+// next returns when j is due after now, zero when never.
+func (j *job) next(now time.Time) time.Time {
+	if j.manual {
+		return time.Time{}
+	}
+	if j.schedule != nil {
+		return j.schedule.next(now.In(currentConfig().location))
+	}
+	return now.Add(j.interval)
+}
+
+// runOnce runs j and records how it went. A panic fails the run instead of
+// taking the instance down with it.
+func (j *job) runOnce(ctx context.Context) {
+	started := time.Now().UTC()
+	j.mu.Lock()
+	j.status.Running = true
+	j.status.NextRunAt = nil
+	j.mu.Unlock()
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("job %s panicked: %v\n%s", j.name, v, debug.Stack())
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return j.run(ctx)
+	}()
+	duration := time.Since(started)
+
+	outcome := jobSucceeded
+	switch {
+	case err != nil && ctx.Err() != nil:
+		outcome = jobInterrupted
+	case err != nil:
+		outcome = jobFailed
+		log.Printf("job %s failed: %v\n", j.name, err)
+	}
+	jobRuns.WithLabelValues(j.name, outcome).Inc()
+	jobDuration.WithLabelValues(j.name).Observe(duration.Seconds())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.LastRunAt = &started
+	j.status.LastDurationMS = duration.Milliseconds()
+	j.status.LastOutcome = outcome
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+	}
+	j.status.Runs++
+	if outcome == jobFailed {
+		j.status.Failures++
+	}
+}
+
+func (j *job) setNextRun(next time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.NextRunAt = nil
+	if !next.IsZero() {
+		next = next.UTC()
+		j.status.NextRunAt = &next
+	}
+}
+
+func (j *job) snapshot() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// find returns the job name, or nil when there is none.
+func (s *scheduler) find(name string) *job {
+	index := slices.IndexFunc(s.jobs, func(j *job) bool { return j.name == name })
+	if index < 0 {
+		return nil
+	}
+	return s.jobs[index]
+}
+
+// runNow asks j for a run right away, unless it is running or was already
+// asked.
+func (j *job) runNow() error {
+	if j.snapshot().Running {
+		return errJobRunning
+	}
+	select {
+	case j.trigger <- struct{}{}:
+		return nil
+	default:
+		return errJobRunning
+	}
+}
+
+// getJobs lists the background jobs with how their last run went.
+func getJobs(rw http.ResponseWriter, r *http.Request) {
+	statuses := []JobStatus{}
+	for _, j := range jobs.jobs {
+		statuses = append(statuses, j.snapshot())
+	}
+	renderJSON(rw, r, http.StatusOK, GetJobsResponse{
+		Message: localize(r, "jobs_retrieved"),
+		Data:    statuses,
+	})
+}
+
+// runJob runs the job {name} right away, answering 202 before it is done;
+// its outcome shows in the list of jobs.
+func runJob(rw http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(chi.URLParam(r, "name"))
+	j := jobs.find(name)
+	if j == nil {
+		writeError(rw, r, http.StatusNotFound, "job_not_found", renderer.M{
+			"name": name,
+		})
+		return
+	}
+
+	auditID, err := beginAudit(r, "job.run")
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_job")
+		return
+	}
+	err = j.runNow()
+	finishAudit(r.Context(), auditID, 0, err)
+	if err != nil {
+		writeError(rw, r, http.StatusConflict, "job_running", renderer.M{
+			"name": name,
+		})
+		return
+	}
+	log.Printf("job %s run by %s\n", name, clientIP(r))
+
+	renderJSON(rw, r, http.StatusAccepted, JobResponse{
+		Message: localize(r, "job_triggered"),
+		Data:    j.snapshot(),
+	})
+}
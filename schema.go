@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// what the todos collection does with writes failing its validator,
+// mongo.schema_validation
+const (
+	schemaValidationOff   string = "off"
+	schemaValidationWarn  string = "warn"
+	schemaValidationError string = "error"
+)
+
+var schemaValidations = []string{schemaValidationOff, schemaValidationWarn, schemaValidationError}
+
+var malformedDocuments = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_malformed_documents_total",
+		Help: "Documents left out of responses because they don't decode, by collection.",
+	},
+	[]string{"collection"},
+)
+
+func init() {
+	prometheus.MustRegister(malformedDocuments)
+}
+
+// todoSchema is the validator of the todos collection: the types of the
+// fields other tools have got wrong, which make a todo fail to decode. Any
+// other field may be missing or extra.
+var todoSchema = bson.M{"$jsonSchema": bson.M{
+	"bsonType": "object",
+	"required": bson.A{"title", "completed"},
+	"properties": bson.M{
+		"id":             bson.M{"bsonType": "objectId"},
+		"title":          bson.M{"bsonType": "string"},
+		"completed":      bson.M{"bsonType": "bool"},
+		"starred":        bson.M{"bsonType": "bool"},
+		"tags":           bson.M{"bsonType": "array", "items": bson.M{"bsonType": "string"}},
+		"due_date":       bson.M{"bsonType": bson.A{"date", "null"}},
+		"deferred_until": bson.M{"bsonType": bson.A{"date", "null"}},
+		"created_at":     bson.M{"bsonType": "date"},
+		"updated_at":     bson.M{"bsonType": "date"},
+		"comment_count":  bson.M{"bsonType": bson.A{"int", "long"}},
+		"version":        bson.M{"bsonType": bson.A{"int", "long"}},
+	},
+}}
+
+// skipMalformed logs and counts a document of collection that failed to
+// decode with err, so a single one doesn't fail a whole list.
+func skipMalformed(collection string, raw bson.Raw, err error) {
+	malformedDocuments.WithLabelValues(collection).Inc()
+	log.Printf("skipping malformed document %s of %s: %v\n", raw.Lookup("_id"), collection, err)
+}
+
+// ensureTodoSchema sets the validator of the todos collection with the
+// action of mongo.schema_validation, or switches it off. The moderate level
+// leaves updates of documents already invalid alone, so tools that wrote
+// them can still fix them.
+func ensureTodoSchema(ctx context.Context, action string) error {
+	cmd := bson.D{{Key: "collMod", Value: collectionName}}
+	if action == schemaValidationOff {
+		cmd = append(cmd, bson.E{Key: "validator", Value: bson.M{}}, bson.E{Key: "validationLevel", Value: "off"})
+	} else {
+		cmd = append(cmd,
+			bson.E{Key: "validator", Value: todoSchema},
+			bson.E{Key: "validationLevel", Value: "moderate"},
+			bson.E{Key: "validationAction", Value: action},
+		)
+	}
+	return tenantDB(ctx).RunCommand(ctx, cmd).Err()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A list with documents other tools wrote wrong answers with the good ones
+// and counts the others.
+func TestListSkipsMalformedDocuments(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	now := time.Now().UTC()
+	mongo.seed(collectionName,
+		newTodoModel("write report", now),
+		bson.M{"_id": primitive.NewObjectID(), "id": primitive.NewObjectID(), "title": 42, "completed": "yes"},
+		bson.M{"_id": primitive.NewObjectID(), "id": primitive.NewObjectID(), "title": "tags", "tags": "work"},
+		newTodoModel("call ana", now),
+	)
+	skipped := metricValue(t, "todo_malformed_documents_total", map[string]string{"collection": collectionName})
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET todo = %d: %s", rw.Code, rw.Body)
+	}
+	var resp GetTodoResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 || resp.Data[0].Title != "write report" || resp.Data[1].Title != "call ana" || resp.Skipped != 2 {
+		t.Errorf("listed %+v, skipped %d, want the 2 good todos and 2 skipped", resp.Data, resp.Skipped)
+	}
+	if got := metricValue(t, "todo_malformed_documents_total", map[string]string{"collection": collectionName}) - skipped; got != 2 {
+		t.Errorf("counted %v malformed documents, want 2", got)
+	}
+}
+
+func TestEnsureTodoSchema(t *testing.T) {
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+	tests := []struct {
+		action    string
+		wantLevel string
+	}{
+		{"warn", "moderate"},
+		{"error", "moderate"},
+		{schemaValidationOff, "off"},
+	}
+	for _, tt := range tests {
+		mongo.commands()
+		if err := ensureTodoSchema(context.Background(), tt.action); err != nil {
+			t.Fatal(err)
+		}
+		sent := mongo.commands()
+		if len(sent) == 0 || sent[len(sent)-1].Name != "collMod" {
+			t.Fatalf("%s: sent %v, want collMod", tt.action, sent)
+		}
+		cmd := sent[len(sent)-1].Command
+		if level, _ := cmd.Lookup("validationLevel").StringValueOK(); level != tt.wantLevel {
+			t.Errorf("%s: validationLevel = %q, want %q", tt.action, level, tt.wantLevel)
+		}
+		action, hasAction := cmd.Lookup("validationAction").StringValueOK()
+		if tt.action != schemaValidationOff && action != tt.action || tt.action == schemaValidationOff && hasAction {
+			t.Errorf("%s: validationAction = %q", tt.action, action)
+		}
+	}
+}
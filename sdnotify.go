@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// states sent to systemd, see sd_notify(3)
+const (
+	sdReady     string = "READY=1"
+	sdReloading string = "RELOADING=1"
+	sdStopping  string = "STOPPING=1"
+	sdWatchdog  string = "WATCHDOG=1"
+)
+
+// sdNotify sends state to the service manager on $NOTIFY_SOCKET. Outside a
+// systemd unit of Type=notify there is no socket and it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// a leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyState is sdNotify logging its failure, which never stops the server.
+func notifyState(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("failed to notify systemd of %s: %v\n", state, err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, half
+// of WatchdogSec= as sd_watchdog_enabled(3) advises, or 0 when the unit has
+// no watchdog or it is meant for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings systemd's watchdog every interval for as long as check
+// passes, until the returned function is called. A check failing past
+// WatchdogSec= leaves systemd to restart the unit.
+func runWatchdog(interval time.Duration, check func(ctx context.Context) error) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				err := check(ctx)
+				cancel()
+				if err != nil {
+					log.Printf("watchdog check failed, not pinging systemd: %v\n", err)
+					continue
+				}
+				notifyState(sdWatchdog)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
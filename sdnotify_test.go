@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a unixgram socket at name as systemd does and
+// points NOTIFY_SOCKET at it, returning what it receives.
+func notifySocket(t *testing.T, name string) <-chan string {
+	t.Helper()
+	addr := name
+	if name[0] == '@' {
+		addr = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+
+	states := make(chan string, 16)
+	go func() {
+		defer close(states)
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return states
+}
+
+// received returns the next state sent to states, failing after a while.
+func received(t *testing.T, states <-chan string) string {
+	t.Helper()
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(5 * time.Second):
+		t.Fatal("systemd was notified of nothing")
+		return ""
+	}
+}
+
+func TestSDNotify(t *testing.T) {
+	t.Run("no socket", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		if err := sdNotify(sdReady); err != nil {
+			t.Errorf("sdNotify() outside systemd = %v", err)
+		}
+	})
+
+	t.Run("path", func(t *testing.T) {
+		states := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+		for _, state := range []string{sdReady, sdReloading, sdReady, sdStopping} {
+			if err := sdNotify(state); err != nil {
+				t.Fatal(err)
+			}
+			if got := received(t, states); got != state {
+				t.Errorf("systemd was notified of %q, want %q", got, state)
+			}
+		}
+	})
+
+	t.Run("abstract", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("abstract sockets are linux only")
+		}
+		states := notifySocket(t, "@todo-test-notify-"+strconv.Itoa(os.Getpid()))
+		if err := sdNotify(sdReady); err != nil {
+			t.Fatal(err)
+		}
+		if got := received(t, states); got != sdReady {
+			t.Errorf("systemd was notified of %q, want %q", got, sdReady)
+		}
+	})
+
+	t.Run("socket gone", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone"))
+		if err := sdNotify(sdReady); err == nil {
+			t.Error("sdNotify() to no socket succeeded")
+		}
+	})
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name, usec, pid string
+		want            time.Duration
+	}{
+		{"no watchdog", "", "", 0},
+		{"invalid", "soon", "", 0},
+		{"zero", "0", "", 0},
+		{"half of it", "3000000", "", 1500 * time.Millisecond},
+		{"for this process", "3000000", strconv.Itoa(os.Getpid()), 1500 * time.Millisecond},
+		{"for another process", "3000000", strconv.Itoa(os.Getpid() + 1), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := watchdogInterval(); got != tt.want {
+				t.Errorf("watchdogInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The watchdog pings only while its check passes, and stops with stop.
+func TestRunWatchdog(t *testing.T) {
+	states := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	var healthy, checks atomic.Int32
+	stop := runWatchdog(5*time.Millisecond, func(ctx context.Context) error {
+		checks.Add(1)
+		if healthy.Load() == 0 {
+			return errors.New("database unreachable")
+		}
+		return nil
+	})
+
+	for checks.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case state := <-states:
+		t.Fatalf("a failing check notified systemd of %q", state)
+	default:
+	}
+
+	healthy.Store(1)
+	if got := received(t, states); got != sdWatchdog {
+		t.Errorf("systemd was notified of %q, want %q", got, sdWatchdog)
+	}
+
+	stop()
+	// a ping under way may still arrive
+	time.Sleep(20 * time.Millisecond)
+	for len(states) > 0 {
+		<-states
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(states) > 0 {
+		t.Errorf("the watchdog pinged %d times after it stopped", len(states))
+	}
+}
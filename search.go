@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the states a search hit is labelled with
+const (
+	searchStateOpen      string = "open"
+	searchStateCompleted string = "completed"
+)
+
+// the query parameters of the search
+var searchParams = append(slices.Clone(commonParams), "q", "page", "limit")
+
+// searchOrder ranks search hits, newest first; the id keeps pages apart
+// when todos share a creation time
+var searchOrder = bson.D{{Key: "created_at", Value: -1}, {Key: "id", Value: -1}}
+
+type (
+	// a todo found by a search, with whether it is still open
+	SearchHit struct {
+		Todo
+		State string `json:"state"`
+	}
+	// the search endpoint response
+	GetSearchResponse struct {
+		Message string      `json:"message"`
+		Query   string      `json:"q"`
+		Data    []SearchHit `json:"data"`
+		// documents of the page that aren't valid todos, see findTodoPage
+		Skipped int `json:"skipped,omitempty"`
+	}
+)
+
+// searchTodos finds the todos whose title contains ?q, in the form of
+// normalizeTitle, open and completed alike. Hits come newest first, a page
+// of ?limit at a time, with the total in X-Total-Count.
+func searchTodos(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	problems := newFieldErrors(r)
+	loc, err := requestLocation(r)
+	if err != nil {
+		problems.addError("tz", "invalid_timezone", renderer.M{"expected": expectedTimezone}, err)
+	}
+	checkUnknownParams(problems, query, searchParams)
+	search := strings.TrimSpace(query.Get("q"))
+	switch {
+	case search == "":
+		problems.add("q", "search_query_required", nil)
+	case utf8.RuneCountInString(search) > maxTitleLength:
+		problems.add("q", "search_query_too_long", renderer.M{"max_length": maxTitleLength})
+	case titlesEncrypted():
+		problems.add("q", "search_encrypted", nil)
+	}
+	if _, _, err := parsePagination(query.Get("page"), ""); err != nil {
+		problems.addError("page", "invalid_pagination", nil, err)
+	}
+	if _, _, err := parsePagination("", query.Get("limit")); err != nil {
+		problems.addError("limit", "invalid_pagination", nil, err)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+	page, limit, _ := parsePagination(query.Get("page"), query.Get("limit"))
+
+	filter := titleSearchFilter(search)
+	total, err := tenantDB(r.Context()).Collection(collectionName).CountDocuments(r.Context(), filter)
+	if err != nil {
+		logRequestError(r, "failed to count search hits: %v\n", err)
+		writeDBError(rw, r, err, "search_failed")
+		return
+	}
+	found, err := findTodoPage(r.Context(), filter, searchOrder, nil, (page-1)*limit, limit)
+	if err != nil {
+		logRequestError(r, "failed to search todos: %v\n", err)
+		writeDBError(rw, r, err, "search_failed")
+		return
+	}
+
+	hits := []SearchHit{}
+	for _, td := range found.todos {
+		state := searchStateOpen
+		if td.Completed {
+			state = searchStateCompleted
+		}
+		hits = append(hits, SearchHit{Todo: td.toTodo(loc), State: state})
+	}
+	rw.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	renderJSON(rw, r, http.StatusOK, GetSearchResponse{
+		Message: localize(r, "search_completed"),
+		Query:   search,
+		Data:    hits,
+		Skipped: found.skipped,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Open and completed hits come in the order the database ranked them, each
+// labelled with its state.
+func TestSearchTodos(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	now := time.Now().UTC()
+	done := newTodoModel("report draft", now.Add(-time.Minute))
+	done.Completed = true
+	mongo.seed(collectionName, newTodoModel("write report", now), done, newTodoModel("report expenses", now.Add(-time.Hour)))
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo/search?q=report&limit=10", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("search = %d: %s", rw.Code, rw.Body)
+	}
+	var resp GetSearchResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ title, state string }{
+		{"write report", searchStateOpen},
+		{"report draft", searchStateCompleted},
+		{"report expenses", searchStateOpen},
+	}
+	if resp.Query != "report" || len(resp.Data) != len(want) {
+		t.Fatalf("search answered %s", rw.Body)
+	}
+	for i, hit := range resp.Data {
+		if hit.Title != want[i].title || hit.State != want[i].state {
+			t.Errorf("hit %d = %s (%s), want %s (%s)", i, hit.Title, hit.State, want[i].title, want[i].state)
+		}
+	}
+	if got := rw.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("X-Total-Count = %q, want 3", got)
+	}
+}
+
+func TestSearchTodosEmpty(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo/search?q=report", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("search = %d: %s", rw.Code, rw.Body)
+	}
+	var resp GetSearchResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data == nil || len(resp.Data) != 0 || rw.Header().Get("X-Total-Count") != "0" {
+		t.Errorf("search of nothing answered %s with %s hits", rw.Body, rw.Header().Get("X-Total-Count"))
+	}
+}
+
+func TestSearchTodosProblems(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"q"}},
+		{"q=%20%20", []string{"q"}},
+		{"q=report&page=0&limit=1000", []string{"page", "limit"}},
+		{"q=report&tz=Mars/Olympus", []string{"tz"}},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/todo/search?"+tt.query, nil))
+		var fields []string
+		for _, e := range decodeValidation(t, rw).Errors {
+			fields = append(fields, e.Field)
+		}
+		if len(fields) != len(tt.want) {
+			t.Errorf("?%s: problems with %v, want %v", tt.query, fields, tt.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const unixScheme = "unix://"
+
+// socketPath returns the filesystem path of a "unix://" address, or "" for TCP addresses.
+func socketPath(addr string) string {
+	if strings.HasPrefix(addr, unixScheme) {
+		return strings.TrimPrefix(addr, unixScheme)
+	}
+	return ""
+}
+
+// listen opens a listener for addr, which is either a TCP address such as
+// ":9000" or "127.0.0.1:9000", or a Unix socket such as "unix:///run/todo.sock".
+// A stale socket left behind by a previous run is removed first and the new
+// socket is given the requested permissions.
+func listen(addr string, socketMode fs.FileMode) (net.Listener, error) {
+	path := socketPath(addr)
+	if path == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// removeStaleSocket deletes path if it is a socket; anything else is left
+// alone so a typo in HTTP_ADDR can't delete a regular file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+var (
+	// listening is set once every listener is open, see readyHandler.
+	listening atomic.Bool
+	// shuttingDown is set when the servers start draining, see healthHandler.
+	shuttingDown atomic.Bool
+	// inFlight counts the requests of the main router being handled.
+	inFlight atomic.Int64
+)
+
+// countInFlight keeps inFlight up to date.
+func countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// reportDrain logs the requests still in flight every interval until the
+// returned function is called.
+func reportDrain(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				slog.Info("draining connections", "in_flight", inFlight.Load())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// serve starts srv on a listener for addr in a goroutine. Failing to listen
+// is returned right away; should serving stop for any other reason than
+// Shutdown, the error is sent on failed.
+func serve(srv *http.Server, addr string, socketMode fs.FileMode, failed chan<- error) error {
+	ln, err := listen(addr, socketMode)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
+
+	go func() {
+		log.Println("Server listening on", addr)
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			failed <- fmt.Errorf("serve on %s: %w", addr, err)
+		}
+	}()
+	return nil
+}
+
+// cleanupSocket removes the socket file of a "unix://" address after shutdown.
+func cleanupSocket(addr string) {
+	path := socketPath(addr)
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove socket %s: %v\n", path, err)
+	}
+}
+
+type (
+	// the /healthz response
+	HealthResponse struct {
+		Status   string `json:"status"`
+		ReadOnly bool   `json:"read_only"`
+		Draining bool   `json:"draining"`
+		InFlight int64  `json:"in_flight"`
+	}
+	// the /readyz response; Error says why the database can't be reached
+	ReadyResponse struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+)
+
+// healthHandler reports that the process is up, or with a 503 that it is
+// shutting down, along with the requests in flight. A drained instance is
+// still up: it reports "draining" with a 200.
+func healthHandler(rw http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		renderJSON(rw, r, http.StatusServiceUnavailable, HealthResponse{
+			Status:   "shutting_down",
+			ReadOnly: readOnly.Load(),
+			Draining: draining.Load(),
+			InFlight: inFlight.Load(),
+		})
+		return
+	}
+	status := "ok"
+	if draining.Load() {
+		status = "draining"
+	}
+	renderJSON(rw, r, http.StatusOK, HealthResponse{
+		Status:   status,
+		ReadOnly: readOnly.Load(),
+		Draining: draining.Load(),
+		InFlight: inFlight.Load(),
+	})
+}
+
+// readyHandler reports whether the listeners are up, the instance isn't
+// drained and the database can be reached.
+func readyHandler(rw http.ResponseWriter, r *http.Request) {
+	if !listening.Load() {
+		renderJSON(rw, r, http.StatusServiceUnavailable, ReadyResponse{
+			Status: "starting",
+		})
+		return
+	}
+	if draining.Load() {
+		renderJSON(rw, r, http.StatusServiceUnavailable, ReadyResponse{
+			Status: "draining",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := checkDatabase(ctx, db, false); err != nil {
+		renderJSON(rw, r, http.StatusServiceUnavailable, ReadyResponse{
+			Status: "unavailable",
+			Error:  err.Error(),
+		})
+		return
+	}
+	renderJSON(rw, r, http.StatusOK, ReadyResponse{
+		Status: "ready",
+	})
+}
+
+// adminHandlers serves the operational endpoints meant for the ADMIN_ADDR listener.
+func adminHandlers() http.Handler {
+	router := chi.NewRouter()
+	router.NotFound(notFound)
+	router.MethodNotAllowed(methodNotAllowed)
+	router.Get("/healthz", healthHandler)
+	router.Get("/readyz", readyHandler)
+	router.Handle("/metrics", promhttp.Handler())
+	router.Get("/debug/routes", routesHandler)
+	router.Mount("/debug", middleware.Profiler())
+
+	return router
+}
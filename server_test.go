@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shortTempDir returns a temporary directory with a path short enough for a
+// Unix socket, which t.TempDir may not be.
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSocketPath(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{":9000", ""},
+		{"127.0.0.1:9000", ""},
+		{"[::1]:9000", ""},
+		{"unix:///run/todo.sock", "/run/todo.sock"},
+		{"unix://todo.sock", "todo.sock"},
+	}
+	for _, tt := range tests {
+		if got := socketPath(tt.addr); got != tt.want {
+			t.Errorf("socketPath(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "todo.sock")
+	// a socket left behind by a previous run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("can't listen on a Unix socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	addr := unixScheme + path
+	srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	})}
+	failed := make(chan error, 1)
+	if err := serve(srv, addr, 0o660, failed); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Shutdown(context.Background())
+		cleanupSocket(addr)
+	})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0o660 {
+		t.Errorf("socket mode = %v, want 0660", got)
+	}
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := httpClient.Get("http://todo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("body = %q, want the handler's", body)
+	}
+	select {
+	case err := <-failed:
+		t.Errorf("serving failed: %v", err)
+	default:
+	}
+}
+
+func TestListenRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "todo.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(unixScheme+path, 0o660); err == nil {
+		ln.Close()
+		t.Fatal("listen() replaced a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "keep me" {
+		t.Errorf("file = %q, %v after listen(), want it untouched", data, err)
+	}
+}
+
+func TestCleanupSocket(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "todo.sock")
+	ln, err := listen(unixScheme+path, 0o600)
+	if err != nil {
+		t.Skipf("can't listen on a Unix socket: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	cleanupSocket(unixScheme + path)
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still there after cleanupSocket(): %v", err)
+	}
+	// TCP addresses have nothing to remove
+	cleanupSocket(":9000")
+}
+
+// TestMain runs main in place of the tests when a test starts this binary
+// to watch the process exit, see runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("TODO_TEST_RUN_MAIN") == "1" {
+		os.Args = os.Args[:1]
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main in a process of its own with env added to its
+// environment, returning its exit code and output once it exits or after
+// timeout.
+func runMain(t *testing.T, timeout time.Duration, env ...string) (int, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0])
+	cmd.Env = append(os.Environ(), append(env, "TODO_TEST_RUN_MAIN=1")...)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		t.Fatalf("main still running after %v:\n%s", timeout, out)
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+func TestServeOccupiedPort(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen on a local port: %v", err)
+	}
+	defer taken.Close()
+
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	failed := make(chan error, 1)
+	if err := serve(srv, taken.Addr().String(), 0, failed); err == nil {
+		srv.Close()
+		t.Fatal("serve() on a taken port succeeded")
+	}
+
+	code, out := runMain(t, 10*time.Second,
+		"MONGO_URI=mongodb://"+newEmptyMongo(t).listener.Addr().String(),
+		"HTTP_ADDR="+taken.Addr().String())
+	if code == 0 || !strings.Contains(out, "listen on "+taken.Addr().String()) {
+		t.Errorf("main exited with %d:\n%s\nwant a failure to listen", code, out)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	t.Cleanup(func() {
+		shuttingDown.Store(false)
+		draining.Store(false)
+	})
+
+	tests := []struct {
+		shuttingDown, draining bool
+		code                   int
+		status                 string
+	}{
+		{false, false, http.StatusOK, "ok"},
+		{false, true, http.StatusOK, "draining"},
+		{true, false, http.StatusServiceUnavailable, "shutting_down"},
+		{true, true, http.StatusServiceUnavailable, "shutting_down"},
+	}
+	for _, tt := range tests {
+		shuttingDown.Store(tt.shuttingDown)
+		draining.Store(tt.draining)
+		rw := httptest.NewRecorder()
+		healthHandler(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		var health HealthResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		if rw.Code != tt.code || health.Status != tt.status || health.Draining != tt.draining {
+			t.Errorf("shutting down %v, draining %v: %d %+v, want %d %s", tt.shuttingDown, tt.draining, rw.Code, health, tt.code, tt.status)
+		}
+	}
+}
+
+func TestCountInFlight(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	const requests = 20
+	release := make(chan struct{})
+	handler := countInFlight(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	inFlightNow := func() int64 {
+		rw := httptest.NewRecorder()
+		healthHandler(rw, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var health HealthResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		return health.InFlight
+	}
+	waitFor := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for inFlightNow() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("in_flight = %d, want %d", inFlightNow(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	before := inFlightNow()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/todo", nil))
+		}()
+	}
+	waitFor(before + requests)
+	close(release)
+	wg.Wait()
+	if got := inFlightNow(); got != before {
+		t.Errorf("in_flight = %d after the requests finished, want %d", got, before)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// what a share link allows besides viewing its todo
+	shareActionView     string = "view"
+	shareActionComplete string = "complete"
+
+	// share keys shorter than this are refused by the configuration
+	minShareKeyLength = 32
+)
+
+var (
+	errShareTokenInvalid = errors.New("invalid share token")
+	errShareTokenExpired = errors.New("expired share token")
+)
+
+type (
+	// what a share token grants; it is signed, not encrypted
+	shareClaims struct {
+		TodoID  string   `json:"t"`
+		Tenant  string   `json:"n,omitempty"`
+		Actions []string `json:"a"`
+		Expires int64    `json:"e"`
+	}
+	// create share link
+	CreateShare struct {
+		Complete  bool   `json:"complete"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	// a created share link
+	ShareResponse struct {
+		Message   string    `json:"message"`
+		URL       string    `json:"url"`
+		Token     string    `json:"token"`
+		Actions   []string  `json:"actions"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	// what a share link shows of its todo: what it says and where it stands,
+	// without its id, blockers, reminders or anything else pointing into the
+	// rest of the list
+	SharedTodo struct {
+		Title       string     `json:"title"`
+		Completed   bool       `json:"completed"`
+		Color       string     `json:"color,omitempty"`
+		Tags        []string   `json:"tags"`
+		Priority    string     `json:"priority,omitempty"`
+		DueDate     *time.Time `json:"due_date,omitempty"`
+		CreatedAt   time.Time  `json:"created_at"`
+		UpdatedAt   time.Time  `json:"updated_at"`
+		CompletedAt *time.Time `json:"completed_at,omitempty"`
+	}
+	// the todo of a share link, and nothing else
+	SharedTodoResponse struct {
+		Message   string     `json:"message"`
+		Data      SharedTodo `json:"data"`
+		Actions   []string   `json:"actions"`
+		ExpiresAt time.Time  `json:"expires_at"`
+	}
+)
+
+// signShareToken returns the token for claims, signed with the first key.
+func signShareToken(claims shareClaims, key string) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(shareSignature(encoded, key)), nil
+}
+
+func shareSignature(payload, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifyShareToken checks the signature of token against every key, so links
+// signed before a key rotation keep working, and then its expiry.
+func verifyShareToken(token string, keys []string, now time.Time) (shareClaims, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return shareClaims{}, errShareTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return shareClaims{}, errShareTokenInvalid
+	}
+	if !slices.ContainsFunc(keys, func(key string) bool { return hmac.Equal(mac, shareSignature(payload, key)) }) {
+		return shareClaims{}, errShareTokenInvalid
+	}
+
+	var claims shareClaims
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return shareClaims{}, errShareTokenInvalid
+	}
+	if !now.Before(time.Unix(claims.Expires, 0)) {
+		return claims, errShareTokenExpired
+	}
+	return claims, nil
+}
+
+// shareTodo creates a link to one todo that works without any credentials,
+// for viewing it and, when asked for, completing it.
+func shareTodo(rw http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig().Share
+	if len(cfg.Keys) == 0 {
+		writeError(rw, r, http.StatusForbidden, "sharing_disabled", nil)
+		return
+	}
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var shareReq CreateShare
+	if err := decodeJSON(r, &shareReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	ttl := cfg.TTL
+	if shareReq.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(shareReq.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > cfg.MaxTTL {
+			problems := newFieldErrors(r)
+			problems.add("expires_in", "invalid_share_expiry", renderer.M{"max": cfg.MaxTTL.String()})
+			problems.write(rw, r)
+			return
+		}
+	}
+
+	// the todo has to exist now; a link to a todo deleted later stops working
+	count, err := tenantDB(r.Context()).Collection(collectionName).CountDocuments(r.Context(), bson.M{"id": id})
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "share_failed")
+		return
+	}
+	if count == 0 {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+
+	claims := shareClaims{
+		TodoID:  id.Hex(),
+		Actions: []string{shareActionView},
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+	if shareReq.Complete {
+		claims.Actions = append(claims.Actions, shareActionComplete)
+	}
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		claims.Tenant = tenant
+	}
+	token, err := signShareToken(claims, cfg.Keys[0])
+	if err != nil {
+		log.Printf("failed to sign share token: %v\n", err)
+		writeError(rw, r, http.StatusInternalServerError, "share_failed", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusCreated, ShareResponse{
+		Message:   localize(r, "share_created"),
+		URL:       shareBaseURL(r) + "/t/" + token,
+		Token:     token,
+		Actions:   claims.Actions,
+		ExpiresAt: time.Unix(claims.Expires, 0).UTC(),
+	})
+}
+
+// shareBaseURL is share.base_url or else the scheme and host r was sent to.
+func shareBaseURL(r *http.Request) string {
+	if base := currentConfig().Share.BaseURL; base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// withShareToken verifies the {token} of a public share link and puts the
+// tenant it was issued for in the context. A token that doesn't verify is
+// answered like an unknown link, an expired one with 410.
+func withShareToken(next func(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID, claims shareClaims)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		claims, err := verifyShareToken(chi.URLParam(r, "token"), currentConfig().Share.Keys, time.Now())
+		if errors.Is(err, errShareTokenExpired) {
+			writeError(rw, r, http.StatusGone, "share_link_expired", nil)
+			return
+		}
+		id, idErr := primitive.ObjectIDFromHex(claims.TodoID)
+		tenants := currentConfig().Tenants
+		if err != nil || idErr != nil || (len(tenants) > 0 && !slices.Contains(tenants, claims.Tenant)) {
+			writeError(rw, r, http.StatusNotFound, "share_link_not_found", nil)
+			return
+		}
+		ctx := r.Context()
+		if claims.Tenant != "" {
+			ctx = context.WithValue(ctx, tenantKey{}, claims.Tenant)
+		}
+		next(rw, r.WithContext(ctx), id, claims)
+	}
+}
+
+// getSharedTodo shows the todo of a share link.
+func getSharedTodo(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID, claims shareClaims) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	var td TodoModel
+	err = tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "todo_fetch_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, SharedTodoResponse{
+		Message:   localize(r, "todo_retrieved"),
+		Data:      toSharedTodo(td.toTodo(loc)),
+		Actions:   claims.Actions,
+		ExpiresAt: time.Unix(claims.Expires, 0).In(loc),
+	})
+}
+
+// toSharedTodo trims todo to what a share link shows.
+func toSharedTodo(todo Todo) SharedTodo {
+	return SharedTodo{
+		Title:       todo.Title,
+		Completed:   todo.Completed,
+		Color:       todo.Color,
+		Tags:        todo.Tags,
+		Priority:    todo.Priority,
+		DueDate:     todo.DueDate,
+		CreatedAt:   todo.CreatedAt,
+		UpdatedAt:   todo.UpdatedAt,
+		CompletedAt: todo.CompletedAt,
+	}
+}
+
+// completeSharedTodo completes the todo of a share link that allows it.
+func completeSharedTodo(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID, claims shareClaims) {
+	if !slices.Contains(claims.Actions, shareActionComplete) {
+		writeError(rw, r, http.StatusForbidden, "share_action_forbidden", renderer.M{
+			"action": shareActionComplete,
+		})
+		return
+	}
+
+	update := bumpVersion(bson.M{"$set": bson.M{"completed": true, "updated_at": time.Now().UTC()}})
+	cancelReminders(update, true)
+	var data *mongo.UpdateResult
+	err := runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, bson.M{"id": id}, update)
+		if err != nil || data.MatchedCount == 0 {
+			return err
+		}
+		stampCompletion(ctx, id)
+		if _, _, err := stopTimer(ctx, id, time.Now().UTC()); err != nil {
+			return err
+		}
+		if err := syncBlocked(ctx, id, true); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_update_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	renderJSON(rw, r, http.StatusOK, UpdateTodoResponse{
+		Message:       localize(r, "todo_updated"),
+		ModifiedCount: data.ModifiedCount,
+	})
+}
+
+// shareRequests counts the requests of each client to the public share
+// links, which need no credentials and are limited whatever rate_limit says.
+var shareRequests = &rateCounter{}
+
+// shareRateLimit answers clients over share.rate_limit requests a minute
+// with 429.
+func shareRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		limit := currentConfig().Share.RateLimit
+		count, start := shareRequests.take(clientIP(r), now, time.Minute)
+		if count > limit {
+			_, reset := rateLimitHeaders(limit, count, start, now, time.Minute)
+			rw.Header().Set("Retry-After", strconv.FormatInt(reset, 10))
+			writeError(rw, r, http.StatusTooManyRequests, "rate_limited", nil)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
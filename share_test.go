@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestVerifyShareToken(t *testing.T) {
+	oldKey := strings.Repeat("o", minShareKeyLength)
+	newKey := strings.Repeat("n", minShareKeyLength)
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	claims := shareClaims{
+		TodoID:  "652f1c2e9b1e8a0001a1b2c3",
+		Actions: []string{shareActionView, shareActionComplete},
+		Expires: now.Add(time.Hour).Unix(),
+	}
+	sign := func(c shareClaims, key string) string {
+		token, err := signShareToken(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(claims, newKey)
+	payload, signature, _ := strings.Cut(valid, ".")
+	forged := claims
+	forged.TodoID = "652f1c2e9b1e8a0001a1b2c4"
+	forgedPayload, _, _ := strings.Cut(sign(forged, newKey), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		keys  []string
+		now   time.Time
+		err   error
+	}{
+		{name: "valid", token: valid, keys: []string{newKey}, now: now},
+		{name: "signed with a rotated out key", token: sign(claims, oldKey), keys: []string{newKey, oldKey}, now: now},
+		{name: "unknown key", token: sign(claims, oldKey), keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "payload swapped", token: forgedPayload + "." + signature, keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "signature truncated", token: payload + "." + signature[:10], keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "signature not base64", token: payload + ".***", keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "no signature", token: payload, keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "empty", token: "", keys: []string{newKey}, now: now, err: errShareTokenInvalid},
+		{name: "no keys", token: valid, now: now, err: errShareTokenInvalid},
+		{name: "expired", token: valid, keys: []string{newKey}, now: now.Add(2 * time.Hour), err: errShareTokenExpired},
+		{name: "expiring this second", token: valid, keys: []string{newKey}, now: now.Add(time.Hour), err: errShareTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyShareToken(tt.token, tt.keys, tt.now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("verifyShareToken() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (got.TodoID != claims.TodoID || !slices.Equal(got.Actions, claims.Actions)) {
+				t.Errorf("verifyShareToken() = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+// A share link shows what its todo says and where it stands, not the ids of
+// the todo or of the others it points at.
+func TestSharedTodoResponse(t *testing.T) {
+	key := strings.Repeat("k", minShareKeyLength)
+	router, _, mongo := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.Share.Keys = []string{key}
+	})
+	td := newTodoModel("write report", time.Now().UTC())
+	td.Tags = []string{"work"}
+	td.BlockedBy = []primitive.ObjectID{primitive.NewObjectID()}
+	td.Reminders = []ReminderModel{{ID: primitive.NewObjectID(), At: time.Now().Add(time.Hour).UTC()}}
+	mongo.seed(collectionName, td)
+	token, err := signShareToken(shareClaims{
+		TodoID:  formatID(td.ID),
+		Actions: []string{shareActionView},
+		Expires: time.Now().Add(time.Hour).Unix(),
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/t/"+token, nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET /t/ = %d: %s", rw.Code, rw.Body)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Data["title"] != "write report" || body.Data["completed"] != false {
+		t.Errorf("shared %s, want the todo", rw.Body)
+	}
+	for _, field := range []string{"id", "blocked_by", "blocked", "reminders", "version", "timer_started_at"} {
+		if _, ok := body.Data[field]; ok {
+			t.Errorf("shared todo has %s: %s", field, rw.Body)
+		}
+	}
+	if strings.Contains(rw.Body.String(), td.BlockedBy[0].Hex()) || strings.Contains(rw.Body.String(), td.ID.Hex()) {
+		t.Errorf("shared todo names an id: %s", rw.Body)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the longest ?stale_after_days, about a century
+const maxStaleAfterDays = 36500
+
+// staleAfter returns how long an open todo may sit before it is stale: the
+// ?stale_after_days of query, stale_after_days of the configuration by
+// default.
+func staleAfter(query url.Values) (time.Duration, error) {
+	days := currentConfig().StaleAfterDays
+	if value := query.Get("stale_after_days"); value != "" {
+		var err error
+		if days, err = strconv.ParseInt(value, 10, 64); err != nil || days < 1 || days > maxStaleAfterDays {
+			return 0, fmt.Errorf("stale_after_days must be a number of days between 1 and %d", maxStaleAfterDays)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// staleFilter matches the open todos created staleAfter before now or
+// earlier, or with stale unset the others, as a range on created_at.
+func staleFilter(stale bool, staleAfter time.Duration, now time.Time) bson.M {
+	old := bson.M{"completed": false, "created_at": bson.M{"$lt": now.Add(-staleAfter)}}
+	if stale {
+		return old
+	}
+	return bson.M{"$nor": bson.A{old}}
+}
+
+// setAge fills in the computed age_days and stale of t as of now; they are
+// never stored, so they are current whenever t is rendered.
+func (t *Todo) setAge(staleAfter time.Duration, now time.Time) {
+	t.AgeDays = 0
+	if age := now.Sub(t.CreatedAt); age > 0 {
+		t.AgeDays = int64(age / (24 * time.Hour))
+	}
+	t.Stale = !t.Completed && t.CreatedAt.Before(now.Add(-staleAfter))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StarResponse reports the starred state after a star or unstar.
+type StarResponse struct {
+	Message string `json:"message"`
+	Starred bool   `json:"starred"`
+}
+
+// starTodo marks a todo as starred; starring it again is a no-op.
+func starTodo(rw http.ResponseWriter, r *http.Request) {
+	setStarred(rw, r, true)
+}
+
+// unstarTodo ...
+func unstarTodo(rw http.ResponseWriter, r *http.Request) {
+	setStarred(rw, r, false)
+}
+
+func setStarred(rw http.ResponseWriter, r *http.Request, starred bool) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		log.Printf("invalid id: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	filter := bson.M{"id": id}
+	update := bumpVersion(bson.M{"$set": bson.M{"starred": starred, "updated_at": time.Now().UTC()}})
+	var data *mongo.UpdateResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, update)
+		if err != nil || data.MatchedCount == 0 {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_update_failed")
+		return
+	}
+	if data.MatchedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+
+	setTodoETag(rw, r, id)
+	renderJSON(rw, r, http.StatusOK, StarResponse{
+		Message: localize(r, "todo_updated"),
+		Starred: starred,
+	})
+}
+
+// parseTodoID reads the {id} url param.
+func parseTodoID(r *http.Request) (primitive.ObjectID, error) {
+	return parseID(chi.URLParam(r, "id"))
+}
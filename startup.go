@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// admin keys shorter than this are warned about
+const minAdminKeyLength = 16
+
+type (
+	// what a configuration turns on, logged at startup and served by
+	// /admin/config
+	StartupReport struct {
+		Storage string `json:"storage"`
+		// the connection string with its password redacted
+		Mongo string `json:"mongo"`
+		// "connected", or why the database can't be reached
+		Database  string   `json:"database"`
+		Tenants   []string `json:"tenants,omitempty"`
+		Addr      string   `json:"addr"`
+		AdminAddr string   `json:"admin_addr,omitempty"`
+		// "none" while auth.policy lets anonymous requests read and write,
+		// "api_key" otherwise; /admin takes admin.key
+		APIAuth   string `json:"api_auth"`
+		AdminAuth string `json:"admin_auth"`
+		RateLimit string `json:"rate_limit"`
+		// the optional parts the configuration enables
+		Subsystems []string `json:"subsystems"`
+		ReadOnly   bool     `json:"read_only"`
+	}
+	// the admin config endpoint response; secrets are redacted
+	AdminConfigResponse struct {
+		Message  string                 `json:"message"`
+		Report   StartupReport          `json:"report"`
+		Warnings []string               `json:"warnings"`
+		Config   map[string]interface{} `json:"config"`
+	}
+)
+
+// startupReport describes what cfg turns on. The database is left for the
+// caller, who knows whether it connected.
+func startupReport(cfg Config) StartupReport {
+	report := StartupReport{
+		Storage:    "mongodb",
+		Mongo:      redactMongoURI(cfg.Mongo.URI),
+		Tenants:    cfg.Tenants,
+		Addr:       cfg.HTTP.Addr,
+		AdminAddr:  cfg.HTTP.AdminAddr,
+		APIAuth:    "none",
+		AdminAuth:  "disabled",
+		RateLimit:  "off",
+		Subsystems: []string{},
+		ReadOnly:   cfg.ReadOnly,
+	}
+	anonymous := cfg.Auth.Policy.Anonymous
+	if !slices.Contains(anonymous, permRead) || !slices.Contains(anonymous, permWrite) {
+		report.APIAuth = "api_key"
+	}
+	if cfg.Admin.Key != "" {
+		report.AdminAuth = "key"
+	}
+	if cfg.RateLimit.Requests > 0 {
+		mode := "advertised"
+		if cfg.RateLimit.Enforce {
+			mode = "enforced"
+		}
+		report.RateLimit = fmt.Sprintf("%d per %s, %s", cfg.RateLimit.Requests, cfg.RateLimit.Window, mode)
+	}
+
+	// reminders fire with the outbox deliveries
+	if len(cfg.Webhooks.URLs) > 0 {
+		report.Subsystems = append(report.Subsystems, "webhooks")
+	}
+	if cfg.vapidKey != nil {
+		report.Subsystems = append(report.Subsystems, "push")
+	}
+	if len(cfg.Webhooks.URLs) > 0 || cfg.vapidKey != nil {
+		report.Subsystems = append(report.Subsystems, "reminders")
+	}
+	if cfg.Backup.Schedule != "" {
+		report.Subsystems = append(report.Subsystems, "backups")
+	}
+	if len(cfg.Encryption.Keys) > 0 {
+		report.Subsystems = append(report.Subsystems, "encryption")
+	}
+	if len(cfg.Share.Keys) > 0 {
+		report.Subsystems = append(report.Subsystems, "sharing")
+	}
+	if cfg.Quota.MaxTodos > 0 {
+		report.Subsystems = append(report.Subsystems, "quota")
+	}
+	if len(cfg.Tenants) > 0 {
+		report.Subsystems = append(report.Subsystems, "tenants")
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		report.Subsystems = append(report.Subsystems, "tracing")
+	}
+	return report
+}
+
+// configWarnings returns the risky combinations of settings in cfg, each
+// naming the settings at fault. A new setting that can expose data or lock
+// clients out belongs here.
+func configWarnings(cfg Config) []string {
+	var warnings []string
+	if cfg.HTTP.AdminAddr != "" && !isLocalAddr(cfg.HTTP.AdminAddr) {
+		warnings = append(warnings, fmt.Sprintf("http.admin_addr %s serves /debug and /metrics without authentication beyond this host", cfg.HTTP.AdminAddr))
+	}
+	if cfg.Debug.Routes {
+		warnings = append(warnings, "debug.routes serves the route table on http.addr without authentication")
+	}
+	if cfg.Debug.CaptureBodies {
+		warnings = append(warnings, "debug.capture_bodies logs request bodies, which hold user data")
+	}
+	if cfg.ReadOnly {
+		warnings = append(warnings, "read_only is set, writes are refused until POST /admin/readonly")
+	}
+	if cfg.Admin.Key != "" && len(cfg.Admin.Key) < minAdminKeyLength {
+		warnings = append(warnings, fmt.Sprintf("admin.key is shorter than %d characters", minAdminKeyLength))
+	}
+	for _, network := range cfg.trustedProxies {
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			warnings = append(warnings, fmt.Sprintf("http.trusted_proxies trusts %s, any client can choose its address with X-Forwarded-For", network))
+		}
+	}
+	if slices.Contains(cfg.Auth.Policy.Anonymous, permAdmin) && cfg.Admin.Key != "" {
+		warnings = append(warnings, "auth.policy.anonymous grants admin, /admin needs no key")
+	}
+	if len(cfg.Auth.APIKeys) == 0 && !slices.Contains(cfg.Auth.Policy.Anonymous, permWrite) && !slices.Contains(cfg.Auth.Policy.AdminKey, permWrite) {
+		warnings = append(warnings, "auth.policy leaves nobody the write permission, the API is read-only")
+	}
+	if cfg.Backup.S3.Bucket != "" && cfg.Backup.Key == "" {
+		warnings = append(warnings, "backup.s3.bucket is set without backup.key, backups leave this host unencrypted")
+	}
+	return warnings
+}
+
+// isLocalAddr reports whether addr only listens on this host: a unix socket
+// or a loopback address.
+func isLocalAddr(addr string) bool {
+	if socketPath(addr) != "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// logStartupReport logs what cfg turns on and warns about its risky
+// combinations.
+func logStartupReport(cfg Config, database string) {
+	report := startupReport(cfg)
+	slog.Info("configuration in effect",
+		"storage", report.Storage,
+		"mongo", report.Mongo,
+		"database", database,
+		"tenants", strings.Join(report.Tenants, ","),
+		"addr", report.Addr,
+		"admin_addr", report.AdminAddr,
+		"api_auth", report.APIAuth,
+		"admin_auth", report.AdminAuth,
+		"rate_limit", report.RateLimit,
+		"subsystems", strings.Join(report.Subsystems, ","),
+		"read_only", report.ReadOnly,
+	)
+	for _, warning := range configWarnings(cfg) {
+		slog.Warn("risky configuration", "warning", warning)
+	}
+}
+
+// getAdminConfig serves the startup report of the configuration in effect,
+// its warnings and every setting, secrets redacted.
+func getAdminConfig(rw http.ResponseWriter, r *http.Request) {
+	cfg := *currentConfig()
+	report := startupReport(cfg)
+	report.Database = "connected"
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := checkDatabase(ctx, db, false); err != nil {
+		report.Database = err.Error()
+	}
+
+	settings := map[string]interface{}{}
+	for _, s := range configSettings(&cfg) {
+		switch v := settingValue(s).(type) {
+		case time.Duration:
+			settings[s.path] = v.String()
+		case fs.FileMode:
+			settings[s.path] = fmt.Sprintf("%04o", uint32(v))
+		case []string:
+			// an unset list is [] like any other
+			if v == nil {
+				v = []string{}
+			}
+			settings[s.path] = v
+		default:
+			settings[s.path] = v
+		}
+	}
+	warnings := configWarnings(cfg)
+	if warnings == nil {
+		warnings = []string{}
+	}
+	renderJSON(rw, r, http.StatusOK, AdminConfigResponse{
+		Message:  localize(r, "config_retrieved"),
+		Report:   report,
+		Warnings: warnings,
+		Config:   settings,
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConfigWarnings(t *testing.T) {
+	_, anywhere, _ := net.ParseCIDR("0.0.0.0/0")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name      string
+		configure func(cfg *Config)
+		// a part of each warning expected, in order
+		want []string
+	}{
+		{"defaults", func(cfg *Config) {}, nil},
+		{"admin on loopback", func(cfg *Config) { cfg.HTTP.AdminAddr = "127.0.0.1:9090" }, nil},
+		{"admin on localhost", func(cfg *Config) { cfg.HTTP.AdminAddr = "localhost:9090" }, nil},
+		{"admin on a unix socket", func(cfg *Config) { cfg.HTTP.AdminAddr = "unix:///run/todo-admin.sock" }, nil},
+		{"admin on every interface", func(cfg *Config) { cfg.HTTP.AdminAddr = ":9090" }, []string{"http.admin_addr :9090"}},
+		{"debug routes", func(cfg *Config) { cfg.Debug.Routes = true }, []string{"debug.routes"}},
+		{"captured bodies", func(cfg *Config) { cfg.Debug.CaptureBodies = true }, []string{"debug.capture_bodies"}},
+		{"read only", func(cfg *Config) { cfg.ReadOnly = true }, []string{"read_only"}},
+		{"short admin key", func(cfg *Config) { cfg.Admin.Key = "short" }, []string{"admin.key is shorter than 16"}},
+		{"long admin key", func(cfg *Config) { cfg.Admin.Key = "a-long-enough-admin-key" }, nil},
+		{"proxies trusted", func(cfg *Config) { cfg.trustedProxies = []*net.IPNet{private} }, nil},
+		{"every proxy trusted", func(cfg *Config) { cfg.trustedProxies = []*net.IPNet{private, anywhere} }, []string{"trusts 0.0.0.0/0"}},
+		{"anonymous admin", func(cfg *Config) {
+			cfg.Admin.Key = "a-long-enough-admin-key"
+			cfg.Auth.Policy.Anonymous = []string{permRead, permWrite, permAdmin}
+		}, []string{"auth.policy.anonymous grants admin"}},
+		{"nobody writes", func(cfg *Config) {
+			cfg.Auth.Policy.Anonymous = []string{permRead}
+			cfg.Auth.Policy.AdminKey = []string{permAdmin}
+		}, []string{"nobody the write permission"}},
+		{"keys write", func(cfg *Config) {
+			cfg.Auth.APIKeys = []string{"client-key"}
+			cfg.Auth.Policy.Anonymous = []string{permRead}
+		}, nil},
+		{"unencrypted backups", func(cfg *Config) { cfg.Backup.S3.Bucket = "backups" }, []string{"backup.s3.bucket"}},
+		{"encrypted backups", func(cfg *Config) {
+			cfg.Backup.S3.Bucket = "backups"
+			cfg.Backup.Key = "backup-key"
+		}, nil},
+		{"several", func(cfg *Config) {
+			cfg.HTTP.AdminAddr = "0.0.0.0:9090"
+			cfg.ReadOnly = true
+			cfg.Admin.Key = "short"
+		}, []string{"http.admin_addr", "read_only", "admin.key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.configure(&cfg)
+			warnings := configWarnings(cfg)
+			if len(warnings) != len(tt.want) {
+				t.Fatalf("warnings %q, want %d of them", warnings, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d = %q, want it about %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
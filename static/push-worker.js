@@ -0,0 +1,16 @@
+// Shows the reminders the server pushes, see POST /api/v1/push/subscribe.
+self.addEventListener("push", (event) => {
+  const notification = event.data ? event.data.json() : { title: "ToDo" };
+  event.waitUntil(
+    self.registration.showNotification(notification.title, {
+      body: notification.body,
+      tag: notification.reminder ? notification.reminder.id : notification.type,
+      data: notification,
+    })
+  );
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow("/"));
+});
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// counts reported by the stats endpoint
+	TodoStats struct {
+		Total       int64 `json:"total" bson:"total"`
+		Completed   int64 `json:"completed" bson:"completed"`
+		Open        int64 `json:"open" bson:"open"`
+		StarredOpen int64 `json:"starred_open" bson:"starred_open"`
+		// open todos due before or during today in the request's zone, not
+		// counting those deferred
+		Overdue  int64 `json:"overdue" bson:"overdue"`
+		DueToday int64 `json:"due_today" bson:"due_today"`
+		// open todos deferred to a later time, see deferTodo
+		Deferred int64 `json:"deferred" bson:"deferred"`
+		// creation time of the oldest open todo, absent when nothing is open
+		OldestOpen *time.Time `json:"oldest_open,omitempty" bson:"oldest_open"`
+		// todos that can still be created, absent without a quota
+		QuotaRemaining *int64 `json:"quota_remaining,omitempty" bson:"-"`
+	}
+	// data of the stats page; Error replaces the numbers when they could not be computed
+	StatsPage struct {
+		PageLocale
+		Stats    TodoStats
+		Timezone string
+		Error    string
+	}
+	// the stats endpoint response
+	GetStatsResponse struct {
+		Message string    `json:"message"`
+		Data    TodoStats `json:"data"`
+	}
+)
+
+// getStats reports the todo counts, with day boundaries in the request's zone.
+func getStats(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	stats, err := sharedStats(r.Context(), loc)
+	if err != nil {
+		logRequestError(r, "failed to aggregate todo stats: %v\n", err)
+		writeDBError(rw, r, err, "stats_failed")
+		return
+	}
+	remaining, limited, err := quotaRemaining(r.Context())
+	if err != nil {
+		log.Printf("failed to count todos for the quota: %v\n", err)
+	} else if limited {
+		stats.QuotaRemaining = &remaining
+		rw.Header().Set("X-Todo-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetStatsResponse{
+		Message: localize(r, "stats_computed"),
+		Data:    stats,
+	})
+}
+
+// statsPageHandler renders the stats as an HTML page. When the database fails
+// the page still renders, with an error in place of the numbers.
+func statsPageHandler(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	if !haveTemplates {
+		writeFallbackPage(rw)
+		return
+	}
+
+	status := http.StatusOK
+	page := StatsPage{PageLocale: newPageLocale(rw, r, "/stats", r.URL.Query()), Timezone: loc.String()}
+	if page.Stats, err = sharedStats(r.Context(), loc); err != nil {
+		log.Printf("failed to aggregate todo stats: %v\n", err)
+		status = dbErrorStatus(err)
+		if status == http.StatusServiceUnavailable {
+			rw.Header().Set("Retry-After", dbRetryAfter)
+		}
+		page.Error = translate(page.Lang, "stats_failed", nil)
+	}
+	if oldest := page.Stats.OldestOpen; oldest != nil {
+		// a copy, the stats are shared with the requests coalesced
+		inZone := oldest.In(loc)
+		page.Stats.OldestOpen = &inZone
+	}
+
+	renderHTML(rw, r, status, "statsPage", page)
+}
+
+// sharedStats is computeStats shared with the identical requests in flight,
+// see coalesce.
+func sharedStats(ctx context.Context, loc *time.Location) (TodoStats, error) {
+	return coalesce(ctx, "stats", "tz="+loc.String(), func(ctx context.Context) (TodoStats, error) {
+		return computeStats(ctx, loc)
+	})
+}
+
+// computeStats counts the todos in a single aggregation. Day boundaries are
+// those of loc.
+func computeStats(ctx context.Context, loc *time.Location) (TodoStats, error) {
+	now := time.Now()
+	today := startOfDay(now.In(loc))
+	tomorrow := today.AddDate(0, 0, 1)
+
+	// a missing due_date or deferred_until is null, which sorts before every date
+	deferred := bson.M{"$and": bson.A{bson.M{"$not": bson.A{"$completed"}}, bson.M{"$gt": bson.A{"$deferred_until", now}}}}
+	openAndDue := func(conditions ...bson.M) bson.M {
+		and := bson.A{
+			bson.M{"$not": bson.A{"$completed"}},
+			bson.M{"$gt": bson.A{"$due_date", nil}},
+			bson.M{"$not": bson.A{deferred}},
+		}
+		for _, c := range conditions {
+			and = append(and, c)
+		}
+		return bson.M{"$cond": bson.A{bson.M{"$and": and}, 1, 0}}
+	}
+
+	pipeline := bson.A{
+		bson.M{"$group": bson.M{
+			"_id":       nil,
+			"total":     bson.M{"$sum": 1},
+			"completed": bson.M{"$sum": bson.M{"$cond": bson.A{"$completed", 1, 0}}},
+			"open":      bson.M{"$sum": bson.M{"$cond": bson.A{"$completed", 0, 1}}},
+			"starred_open": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$and": bson.A{"$starred", bson.M{"$not": bson.A{"$completed"}}}}, 1, 0,
+			}}},
+			"overdue": bson.M{"$sum": openAndDue(bson.M{"$lt": bson.A{"$due_date", today}})},
+			"due_today": bson.M{"$sum": openAndDue(
+				bson.M{"$gte": bson.A{"$due_date", today}},
+				bson.M{"$lt": bson.A{"$due_date", tomorrow}},
+			)},
+			"deferred": bson.M{"$sum": bson.M{"$cond": bson.A{deferred, 1, 0}}},
+			// $min skips the nulls of completed todos
+			"oldest_open": bson.M{"$min": bson.M{"$cond": bson.A{"$completed", nil, "$created_at"}}},
+		}},
+	}
+
+	cursor, err := tenantDB(ctx).Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return TodoStats{}, err
+	}
+
+	// an empty collection produces no group at all: report zeros
+	var results []TodoStats
+	if err := cursor.All(ctx, &results); err != nil {
+		return TodoStats{}, err
+	}
+	var stats TodoStats
+	if len(results) > 0 {
+		stats = results[0]
+	}
+	if stats.OldestOpen != nil {
+		oldest := stats.OldestOpen.In(loc)
+		stats.OldestOpen = &oldest
+	}
+	return stats, nil
+}
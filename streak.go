@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// days of completions returned for the heatmap, today included
+	streakDays = 90
+	// how long a computed streak is served before it is aggregated again
+	streakCacheTTL = 5 * time.Minute
+)
+
+type (
+	// completions of one day in the request's zone
+	StreakDay struct {
+		Date      string `json:"date"`
+		Completed int64  `json:"completed"`
+	}
+	// consecutive days with at least one completed todo
+	CompletionStreak struct {
+		// today only ends the current streak once it is over
+		Current  int64       `json:"current"`
+		Longest  int64       `json:"longest"`
+		Timezone string      `json:"timezone"`
+		Days     []StreakDay `json:"days"`
+	}
+	// the streak endpoint response
+	GetStreakResponse struct {
+		Message string           `json:"message"`
+		Data    CompletionStreak `json:"data"`
+	}
+)
+
+// getStreak reports the completion streaks and the completions of the last
+// streakDays days, with days in the request's zone.
+func getStreak(rw http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+
+	streak, err := cachedStreak(r.Context(), time.Now().In(loc))
+	if err != nil {
+		logRequestError(r, "failed to compute the completion streak: %v\n", err)
+		writeDBError(rw, r, err, "streak_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetStreakResponse{
+		Message: localize(r, "streak_computed"),
+		Data:    streak,
+	})
+}
+
+// streaks caches computed streaks by tenant, zone and day.
+var streaks = struct {
+	sync.Mutex
+	entries map[string]streakEntry
+}{entries: map[string]streakEntry{}}
+
+type streakEntry struct {
+	streak  CompletionStreak
+	expires time.Time
+}
+
+// cachedStreak returns the streak as of now, aggregating it at most once per
+// streakCacheTTL. Completions newer than that may be missing.
+func cachedStreak(ctx context.Context, now time.Time) (CompletionStreak, error) {
+	key := tenantDB(ctx).Name() + "|" + now.Location().String() + "|" + now.Format(time.DateOnly)
+
+	streaks.Lock()
+	entry, ok := streaks.entries[key]
+	streaks.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.streak, nil
+	}
+
+	counts, err := completionsPerDay(ctx, now.Location())
+	if err != nil {
+		return CompletionStreak{}, err
+	}
+	streak := computeStreak(counts, now)
+
+	streaks.Lock()
+	defer streaks.Unlock()
+	// drop what expired so the cache holds no more than the recent keys
+	for k, e := range streaks.entries {
+		if !now.Before(e.expires) {
+			delete(streaks.entries, k)
+		}
+	}
+	streaks.entries[key] = streakEntry{streak: streak, expires: now.Add(streakCacheTTL)}
+	return streak, nil
+}
+
+// completionsPerDay counts the completed todos of every day in loc with a
+// single aggregation, keyed by YYYY-MM-DD.
+func completionsPerDay(ctx context.Context, loc *time.Location) (map[string]int64, error) {
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"completed": true}},
+		bson.M{"$group": bson.M{
+			"_id":   dayOfExpr(completedAtExpr, loc),
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+
+	cursor, err := tenantDB(ctx).Collection(collectionName).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Date  string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(results))
+	for _, result := range results {
+		counts[result.Date] = result.Count
+	}
+	return counts, nil
+}
+
+// computeStreak derives the streaks from the completions per day as of now.
+// It steps through calendar dates rather than 24 hour periods, so days of 23
+// or 25 hours around a DST change count once like any other.
+func computeStreak(counts map[string]int64, now time.Time) CompletionStreak {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	date := func(day time.Time) string { return day.Format(time.DateOnly) }
+
+	streak := CompletionStreak{Timezone: now.Location().String(), Days: []StreakDay{}}
+	for day := today.AddDate(0, 0, 1-streakDays); !day.After(today); day = day.AddDate(0, 0, 1) {
+		streak.Days = append(streak.Days, StreakDay{Date: date(day), Completed: counts[date(day)]})
+	}
+
+	// a today without completions yet doesn't break the streak
+	day := today
+	if counts[date(day)] == 0 {
+		day = day.AddDate(0, 0, -1)
+	}
+	for ; counts[date(day)] > 0; day = day.AddDate(0, 0, -1) {
+		streak.Current++
+	}
+
+	// a streak starts on every completed day whose day before had none
+	for completed := range counts {
+		start, err := time.Parse(time.DateOnly, completed)
+		if err != nil || counts[date(start.AddDate(0, 0, -1))] > 0 {
+			continue
+		}
+		length := int64(0)
+		for day := start; counts[date(day)] > 0; day = day.AddDate(0, 0, 1) {
+			length++
+		}
+		streak.Longest = max(streak.Longest, length)
+	}
+	return streak
+}
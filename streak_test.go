@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestComputeStreak(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the clocks went forward on March 10 and the day had 23 hours
+	tests := []struct {
+		name        string
+		counts      map[string]int64
+		now         time.Time
+		wantCurrent int64
+		wantLongest int64
+	}{
+		{
+			name:        "across the DST change",
+			counts:      map[string]int64{"2024-03-08": 1, "2024-03-09": 2, "2024-03-10": 1, "2024-03-11": 3},
+			now:         time.Date(2024, time.March, 11, 23, 30, 0, 0, loc),
+			wantCurrent: 4,
+			wantLongest: 4,
+		},
+		{
+			name:        "today still in progress",
+			counts:      map[string]int64{"2024-03-09": 1, "2024-03-10": 1},
+			now:         time.Date(2024, time.March, 11, 0, 30, 0, 0, loc),
+			wantCurrent: 2,
+			wantLongest: 2,
+		},
+		{
+			name:        "a day without completions",
+			counts:      map[string]int64{"2024-03-05": 1, "2024-03-06": 1, "2024-03-07": 1, "2024-03-09": 1, "2024-03-10": 1},
+			now:         time.Date(2024, time.March, 10, 12, 0, 0, 0, loc),
+			wantCurrent: 2,
+			wantLongest: 3,
+		},
+		{
+			name:        "broken yesterday",
+			counts:      map[string]int64{"2024-03-08": 1},
+			now:         time.Date(2024, time.March, 10, 12, 0, 0, 0, loc),
+			wantCurrent: 0,
+			wantLongest: 1,
+		},
+		{
+			name:        "across the change back",
+			counts:      map[string]int64{"2024-11-02": 1, "2024-11-03": 1, "2024-11-04": 1},
+			now:         time.Date(2024, time.November, 4, 0, 0, 0, 0, loc),
+			wantCurrent: 3,
+			wantLongest: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streak := computeStreak(tt.counts, tt.now)
+			if streak.Current != tt.wantCurrent || streak.Longest != tt.wantLongest {
+				t.Errorf("streak = %d, longest %d, want %d, longest %d", streak.Current, streak.Longest, tt.wantCurrent, tt.wantLongest)
+			}
+			if streak.Timezone != "America/New_York" {
+				t.Errorf("timezone = %q", streak.Timezone)
+			}
+			if len(streak.Days) != streakDays {
+				t.Fatalf("%d days, want %d", len(streak.Days), streakDays)
+			}
+			// one entry per calendar date, ending today
+			for i := 1; i < len(streak.Days); i++ {
+				prev, _ := time.Parse(time.DateOnly, streak.Days[i-1].Date)
+				if next := prev.AddDate(0, 0, 1).Format(time.DateOnly); streak.Days[i].Date != next {
+					t.Fatalf("day %d is %s, want %s", i, streak.Days[i].Date, next)
+				}
+			}
+			if last := streak.Days[streakDays-1]; last.Date != tt.now.Format(time.DateOnly) || last.Completed != tt.counts[last.Date] {
+				t.Errorf("last day = %+v, want today", last)
+			}
+		})
+	}
+}
+
+func TestCachedStreak(t *testing.T) {
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+	prevEntries := streaks.entries
+	streaks.entries = map[string]streakEntry{}
+	t.Cleanup(func() { streaks.entries = prevEntries })
+
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	mongo.seed(collectionName, bson.M{"_id": "2024-03-09", "count": 2}, bson.M{"_id": "2024-03-10", "count": 1})
+	streak, err := cachedStreak(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streak.Current != 2 {
+		t.Fatalf("streak = %d, want 2", streak.Current)
+	}
+
+	// within the TTL the aggregation isn't run again
+	mongo.seed(collectionName)
+	mongo.commands()
+	if streak, err = cachedStreak(context.Background(), now.Add(streakCacheTTL-time.Second)); err != nil || streak.Current != 2 {
+		t.Errorf("cached streak = %d, %v, want 2", streak.Current, err)
+	}
+	if sent := mongo.commands(); len(sent) > 0 {
+		t.Errorf("a cached streak sent %+v", sent)
+	}
+	if streak, err = cachedStreak(context.Background(), now.Add(streakCacheTTL)); err != nil || streak.Current != 0 {
+		t.Errorf("expired streak = %d, %v, want 0", streak.Current, err)
+	}
+	if len(streaks.entries) != 1 {
+		t.Errorf("%d cached streaks, want the expired one dropped", len(streaks.entries))
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// separates the namespaces of a tag, as in work/proja
+const tagSeparator string = "/"
+
+type (
+	// rename tag
+	RenameTag struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	// merge tags
+	MergeTags struct {
+		Sources []string `json:"sources"`
+		Target  string   `json:"target"`
+	}
+	// the todos with a tag
+	TagCount struct {
+		Tag       string `json:"tag" bson:"_id"`
+		Open      int64  `json:"open" bson:"open"`
+		Completed int64  `json:"completed" bson:"completed"`
+	}
+	// the tag counts endpoint response
+	GetTagCountsResponse struct {
+		Message string     `json:"message"`
+		Data    []TagCount `json:"data"`
+	}
+	// a namespace of the tag tree with the todos tagged with it or anything
+	// below it, each todo counted once
+	TagNode struct {
+		Tag       string    `json:"tag" bson:"_id"`
+		Name      string    `json:"name" bson:"-"`
+		Open      int64     `json:"open" bson:"open"`
+		Completed int64     `json:"completed" bson:"completed"`
+		Children  []TagNode `json:"children" bson:"-"`
+	}
+	// the tag counts endpoint response with ?tree=true
+	GetTagTreeResponse struct {
+		Message string    `json:"message"`
+		Data    []TagNode `json:"data"`
+	}
+)
+
+// getTagCounts counts the open and completed todos of every tag, most open
+// first, leaving out tags with fewer than ?min_open open todos. With
+// ?tree=true the tags are nested by namespace, see tagTree.
+func getTagCounts(rw http.ResponseWriter, r *http.Request) {
+	minOpen := int64(0)
+	if value := r.URL.Query().Get("min_open"); value != "" {
+		var err error
+		if minOpen, err = strconv.ParseInt(value, 10, 64); err != nil || minOpen < 0 {
+			writeError(rw, r, http.StatusBadRequest, "invalid_min_open", nil)
+			return
+		}
+	}
+	tree := false
+	if value := r.URL.Query().Get("tree"); value != "" {
+		var err error
+		if tree, err = strconv.ParseBool(value); err != nil {
+			writeError(rw, r, http.StatusBadRequest, "invalid_tree", nil)
+			return
+		}
+	}
+
+	// each todo counts once for every namespace of its tags
+	tagsExpr := "$tags"
+	if tree {
+		tagsExpr = "$namespaces"
+	}
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"tags.0": bson.M{"$exists": true}}},
+	}
+	if tree {
+		pipeline = append(pipeline, bson.M{"$set": bson.M{"namespaces": bson.M{"$reduce": bson.M{
+			"input":        "$tags",
+			"initialValue": bson.A{},
+			"in":           bson.M{"$setUnion": bson.A{"$$value", tagNamespacesExpr("$$this")}},
+		}}}})
+	}
+	pipeline = append(pipeline,
+		bson.M{"$unwind": tagsExpr},
+		bson.M{"$group": bson.M{
+			"_id":       tagsExpr,
+			"open":      bson.M{"$sum": bson.M{"$cond": bson.A{"$completed", 0, 1}}},
+			"completed": bson.M{"$sum": bson.M{"$cond": bson.A{"$completed", 1, 0}}},
+		}},
+		bson.M{"$match": bson.M{"open": bson.M{"$gte": minOpen}}},
+		bson.M{"$sort": bson.D{{Key: "open", Value: -1}, {Key: "_id", Value: 1}}},
+	)
+	cursor, err := tenantDB(r.Context()).Collection(collectionName).Aggregate(r.Context(), pipeline)
+	if err != nil {
+		logRequestError(r, "failed to aggregate tag counts: %v\n", err)
+		writeDBError(rw, r, err, "tag_counts_failed")
+		return
+	}
+
+	if tree {
+		nodes := []TagNode{}
+		if err := cursor.All(r.Context(), &nodes); err != nil {
+			logRequestError(r, "failed to decode tag counts: %v\n", err)
+			writeDBError(rw, r, err, "tag_counts_failed")
+			return
+		}
+		renderJSON(rw, r, http.StatusOK, GetTagTreeResponse{
+			Message: localize(r, "tag_counts_computed"),
+			Data:    tagTree(nodes),
+		})
+		return
+	}
+	counts := []TagCount{}
+	if err := cursor.All(r.Context(), &counts); err != nil {
+		logRequestError(r, "failed to decode tag counts: %v\n", err)
+		writeDBError(rw, r, err, "tag_counts_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, GetTagCountsResponse{
+		Message: localize(r, "tag_counts_computed"),
+		Data:    counts,
+	})
+}
+
+// tagNamespacesExpr is the expression of the namespaces of the tag expr, from
+// the outermost to the tag itself: work, work/proja for work/proja.
+func tagNamespacesExpr(expr interface{}) bson.M {
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"parts": bson.M{"$split": bson.A{expr, tagSeparator}}},
+		"in": bson.M{"$map": bson.M{
+			"input": bson.M{"$range": bson.A{1, bson.M{"$add": bson.A{bson.M{"$size": "$$parts"}, 1}}}},
+			"as":    "n",
+			"in": bson.M{"$reduce": bson.M{
+				"input":        bson.M{"$slice": bson.A{"$$parts", "$$n"}},
+				"initialValue": nil,
+				"in": bson.M{"$cond": bson.A{
+					bson.M{"$eq": bson.A{"$$value", nil}},
+					"$$this",
+					bson.M{"$concat": bson.A{"$$value", tagSeparator, "$$this"}},
+				}},
+			}},
+		}},
+	}}
+}
+
+// tagTree nests the namespaces of nodes under their parents, keeping their
+// order. A namespace has at least the open todos of any below it, so one
+// that min_open left in has its parents as well.
+func tagTree(nodes []TagNode) []TagNode {
+	order := map[string]int{}
+	for i, node := range nodes {
+		order[node.Tag] = i
+	}
+	byOrder := func(a, b TagNode) int { return order[a.Tag] - order[b.Tag] }
+
+	// the deepest go first, so the children are complete when their parent
+	// is placed
+	slices.SortStableFunc(nodes, func(a, b TagNode) int {
+		return strings.Count(b.Tag, tagSeparator) - strings.Count(a.Tag, tagSeparator)
+	})
+	children := map[string][]TagNode{}
+	tree := []TagNode{}
+	for _, node := range nodes {
+		node.Children = children[node.Tag]
+		if node.Children == nil {
+			node.Children = []TagNode{}
+		}
+		slices.SortFunc(node.Children, byOrder)
+		parent, name, nested := cutLastNamespace(node.Tag)
+		node.Name = name
+		if nested {
+			children[parent] = append(children[parent], node)
+		} else {
+			tree = append(tree, node)
+		}
+	}
+	slices.SortFunc(tree, byOrder)
+	return tree
+}
+
+// cutLastNamespace splits tag before its last namespace, reporting whether it
+// has a parent.
+func cutLastNamespace(tag string) (parent, name string, nested bool) {
+	i := strings.LastIndex(tag, tagSeparator)
+	if i < 0 {
+		return "", tag, false
+	}
+	return tag[:i], tag[i+len(tagSeparator):], true
+}
+
+// renameTag renames a tag on every todo; a todo that has both tags keeps one.
+// A namespace such as work/* is renamed with everything below it.
+func renameTag(rw http.ResponseWriter, r *http.Request) {
+	var renameReq RenameTag
+	if err := decodeJSON(r, &renameReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	from, to := cleanTag(renameReq.From), cleanTag(renameReq.To)
+	fromNamespace, fromIsNamespace := tagNamespace(from)
+	toNamespace, toIsNamespace := tagNamespace(to)
+
+	problems := newFieldErrors(r)
+	if from == "" {
+		problems.add("from", "tag_required", nil)
+	}
+	switch {
+	case to == "":
+		problems.add("to", "tag_required", nil)
+	case from != "" && from == to:
+		problems.add("to", "tag_unchanged", nil)
+	case fromIsNamespace != toIsNamespace:
+		problems.add("to", "tag_namespace_mismatch", nil)
+	case toIsNamespace:
+		if code := tagProblem(strings.TrimSuffix(toNamespace, tagSeparator)); code != "" {
+			problems.add("to", code, renderer.M{"tag": to})
+		}
+	default:
+		if code := tagProblem(to); code != "" {
+			problems.add("to", code, renderer.M{"tag": to})
+		}
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	if fromIsNamespace {
+		retag(rw, r, "tags.rename", tagNamespaceFilter(fromNamespace), renameNamespaceUpdate(fromNamespace, toNamespace))
+		return
+	}
+	retag(rw, r, "tags.rename", bson.M{"$in": bson.A{from}}, mergeTagsUpdate([]string{from}, to))
+}
+
+// mergeTags replaces several tags by one on every todo, without repeating it.
+func mergeTags(rw http.ResponseWriter, r *http.Request) {
+	var mergeReq MergeTags
+	if err := decodeJSON(r, &mergeReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+	target := cleanTag(mergeReq.Target)
+	var sources []string
+	for _, tag := range cleanTags(mergeReq.Sources) {
+		if tag != target {
+			sources = append(sources, tag)
+		}
+	}
+
+	problems := newFieldErrors(r)
+	if len(sources) == 0 {
+		problems.add("sources", "tag_required", nil)
+	}
+	if target == "" {
+		problems.add("target", "tag_required", nil)
+	} else if code := tagProblem(target); code != "" {
+		problems.add("target", code, renderer.M{"tag": target})
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	retag(rw, r, "tags.merge", bson.M{"$in": sources}, mergeTagsUpdate(sources, target))
+}
+
+// deleteTag removes a tag from every todo.
+func deleteTag(rw http.ResponseWriter, r *http.Request) {
+	tag := cleanTag(chi.URLParam(r, "tag"))
+	if tag == "" {
+		writeError(rw, r, http.StatusBadRequest, "tag_required", nil)
+		return
+	}
+
+	retag(rw, r, "tags.delete", tag, bumpVersion(bson.M{
+		"$pull": bson.M{"tags": tag},
+		"$set":  bson.M{"updated_at": time.Now().UTC()},
+	}))
+}
+
+// cleanTag normalizes a single tag as cleanTags does.
+func cleanTag(tag string) string {
+	return strings.ToLower(cleanTitle(tag))
+}
+
+// tagProblem returns the error code of a tag with an empty namespace, as in
+// work/ or work//proja, or a namespace *, which ?tag reads as every tag of
+// a namespace; "" when it is fine.
+func tagProblem(tag string) string {
+	for _, part := range strings.Split(tag, tagSeparator) {
+		if part == "" || part == "*" {
+			return "invalid_tag"
+		}
+	}
+	return ""
+}
+
+// tagNamespace returns the namespace pattern names, with its separator, and
+// whether pattern is one, such as work/* for work/.
+func tagNamespace(pattern string) (string, bool) {
+	namespace, ok := strings.CutSuffix(pattern, tagSeparator+"*")
+	if !ok {
+		return "", false
+	}
+	return namespace + tagSeparator, true
+}
+
+// tagNamespaceFilter matches the tags below namespace. Anchored at the start,
+// the regular expression can use an index on the tags.
+func tagNamespaceFilter(namespace string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(namespace)}
+}
+
+// mergeTagsUpdate is the update pipeline replacing sources by target in the
+// tags of a todo.
+func mergeTagsUpdate(sources []string, target string) bson.A {
+	// $literal keeps tags starting with $ from being read as field paths
+	return replaceTagsUpdate(bson.M{"$cond": bson.A{
+		bson.M{"$in": bson.A{"$$tag", bson.M{"$literal": sources}}},
+		bson.M{"$literal": target},
+		"$$tag",
+	}})
+}
+
+// renameNamespaceUpdate is the update pipeline moving the tags below the
+// namespace from to the namespace to, both with their separator.
+func renameNamespaceUpdate(from, to string) bson.A {
+	return replaceTagsUpdate(bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$indexOfBytes": bson.A{"$$tag", bson.M{"$literal": from}}}, 0}},
+		bson.M{"$concat": bson.A{bson.M{"$literal": to}, bson.M{"$substrBytes": bson.A{"$$tag", len(from), -1}}}},
+		"$$tag",
+	}})
+}
+
+// replaceTagsUpdate is the update pipeline replacing each $$tag of a todo by
+// replacement. It keeps the order of the tags and drops the repeats the
+// replacement makes.
+func replaceTagsUpdate(replacement bson.M) bson.A {
+	replaced := bson.M{"$map": bson.M{
+		"input": "$tags",
+		"as":    "tag",
+		"in":    replacement,
+	}}
+	deduped := bson.M{"$reduce": bson.M{
+		"input":        replaced,
+		"initialValue": bson.A{},
+		"in": bson.M{"$cond": bson.A{
+			bson.M{"$in": bson.A{"$$this", "$$value"}},
+			"$$value",
+			bson.M{"$concatArrays": bson.A{"$$value", bson.A{"$$this"}}},
+		}},
+	}}
+	return bson.A{bson.M{"$set": bson.M{"tags": deduped, "updated_at": time.Now().UTC()}}, versionStage}
+}
+
+// retag applies update to every todo with a tag matching tags, a query on
+// the tags, audited as action, and answers with the number of todos changed.
+// With ?dry_run it stops short of the audit entry and answers with the todos
+// it found.
+func retag(rw http.ResponseWriter, r *http.Request, action string, tags interface{}, update interface{}) {
+	dryRun, ok := parseDryRun(rw, r)
+	if !ok {
+		return
+	}
+
+	var tagged []TodoModel
+	filter := bson.M{"tags": tags}
+	cursor, err := tenantDB(r.Context()).Collection(collectionName).Find(r.Context(), filter, options.Find().SetProjection(bson.M{"id": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &tagged)
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch tagged todos: %v\n", err)
+		writeDBError(rw, r, err, "todos_fetch_failed")
+		return
+	}
+
+	// only the todos that were found, so each gets its event
+	ids := make([]primitive.ObjectID, len(tagged))
+	for i, td := range tagged {
+		ids[i] = td.ID
+	}
+	// every todo found has one of the tags, so the update changes all of them
+	if dryRun {
+		writeDryRun(rw, r, ids, false)
+		return
+	}
+
+	auditID, err := beginAudit(r, action)
+	if err != nil {
+		logRequestError(r, "failed to write audit entry: %v\n", err.Error())
+		writeDBError(rw, r, err, "audit_failed_tags")
+		return
+	}
+
+	var data *mongo.UpdateResult
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		filter := bson.M{"id": bson.M{"$in": ids}, "tags": tags}
+		data, err = tenantDB(ctx).Collection(collectionName).UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := recordTodoEvent(ctx, eventTodoUpdated, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		finishAudit(r.Context(), auditID, 0, err)
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "todo_update_failed")
+		return
+	}
+	finishAudit(r.Context(), auditID, data.ModifiedCount, nil)
+
+	renderJSON(rw, r, http.StatusOK, UpdateTodoResponse{
+		Message:       localize(r, "tags_updated"),
+		ModifiedCount: data.ModifiedCount,
+	})
+}
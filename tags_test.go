@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lastAggregation returns the pipeline of the last aggregate command sent.
+func lastAggregation(t *testing.T, sent []mongoCommand) string {
+	t.Helper()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].Name == "aggregate" {
+			return sent[i].Command.Lookup("pipeline").String()
+		}
+	}
+	t.Fatal("no aggregate command was sent")
+	return ""
+}
+
+// Todos tagged both work and home count for each of their tags, once open
+// and once completed as they are.
+func TestGetTagCounts(t *testing.T) {
+	router, _, mongo := emptyDatabaseRouter(t)
+	// what the aggregation makes of an open todo tagged work and home, an
+	// open one tagged work and a completed one tagged work and home
+	mongo.seed(collectionName,
+		bson.M{"_id": "work", "open": 2, "completed": 1},
+		bson.M{"_id": "home", "open": 1, "completed": 1},
+	)
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+
+	mongo.commands()
+	rw := serve("/api/v1/todo/tags/counts?min_open=1")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("GET tags = %d: %s", rw.Code, rw.Body)
+	}
+	var resp GetTagCountsResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []TagCount{{Tag: "work", Open: 2, Completed: 1}, {Tag: "home", Open: 1, Completed: 1}}
+	if len(resp.Data) != len(want) || resp.Data[0] != want[0] || resp.Data[1] != want[1] {
+		t.Errorf("counts = %+v, want %+v", resp.Data, want)
+	}
+	// every tag of a todo is counted, open or completed by its state, and
+	// min_open leaves out the tags with fewer open todos
+	pipeline := lastAggregation(t, mongo.commands())
+	for _, stage := range []string{
+		`{"$unwind": "$tags"}`,
+		`"open": {"$sum": {"$cond": ["$completed",{"$numberInt":"0"},{"$numberInt":"1"}]}}`,
+		`"completed": {"$sum": {"$cond": ["$completed",{"$numberInt":"1"},{"$numberInt":"0"}]}}`,
+		`{"$match": {"open": {"$gte": {"$numberLong":"1"}}}}`,
+	} {
+		if !strings.Contains(pipeline, stage) {
+			t.Errorf("pipeline %s lacks %s", pipeline, stage)
+		}
+	}
+
+	for _, path := range []string{"/api/v1/todo/tags/counts?min_open=-1", "/api/v1/todo/tags/counts?min_open=some", "/api/v1/todo/tags/counts?tree=maybe"} {
+		if rw := serve(path); rw.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, rw.Code)
+		}
+	}
+}
+
+func TestTagTree(t *testing.T) {
+	// a todo tagged work and work/proja counts once for work
+	nodes := []TagNode{
+		{Tag: "work", Open: 3, Completed: 1},
+		{Tag: "work/proja", Open: 2},
+		{Tag: "home", Open: 2},
+		{Tag: "work/projb", Open: 1, Completed: 1},
+		{Tag: "work/proja/docs", Open: 1},
+	}
+	tree := tagTree(nodes)
+
+	var describe func(nodes []TagNode) string
+	describe = func(nodes []TagNode) string {
+		var parts []string
+		for _, node := range nodes {
+			part := node.Name
+			if len(node.Children) > 0 {
+				part += "(" + describe(node.Children) + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, " ")
+	}
+	if got, want := describe(tree), "work(proja(docs) projb) home"; got != want {
+		t.Errorf("tree = %s, want %s", got, want)
+	}
+	if docs := tree[0].Children[0].Children[0]; docs.Tag != "work/proja/docs" || docs.Children == nil {
+		t.Errorf("leaf = %+v, want work/proja/docs with no children", docs)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// templateFuncs are the helpers available to every HTML template. asset
+// returns the fingerprinted URL of a static file. The others take the
+// language of the page first, its .Lang: t returns a message of the
+// catalogs with its placeholders filled from name, value pairs, date,
+// number and timeAgo format in that language.
+func templateFuncs(assets *assetManifest) template.FuncMap {
+	return template.FuncMap{
+		"asset":   assets.url,
+		"percent": percent,
+		"t":       templateMessage,
+		"date":    formatDate,
+		"number":  formatNumber,
+		"timeAgo": func(lang string, t time.Time) string { return timeAgo(lang, t, time.Now()) },
+	}
+}
+
+// templateMessage is translate for templates, with the parameters as name,
+// value pairs.
+func templateMessage(lang, code string, pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", errors.New("t: the parameters must come in name, value pairs")
+	}
+	params := renderer.M{}
+	for i := 0; i < len(pairs); i += 2 {
+		name, ok := pairs[i].(string)
+		if !ok {
+			return "", fmt.Errorf("t: parameter name %v is not a string", pairs[i])
+		}
+		params[name] = pairs[i+1]
+	}
+	return translate(lang, code, params), nil
+}
+
+// formatDate writes the day of t in lang, like "March 5, 2024" or
+// "5 de março de 2024", in the zone of t.
+func formatDate(lang string, t time.Time) string {
+	return translate(lang, "date_long", renderer.M{
+		"day":   t.Day(),
+		"month": translate(lang, "month_"+strconv.Itoa(int(t.Month())), nil),
+		"year":  t.Year(),
+	})
+}
+
+// formatNumber writes n with the digit grouping and decimal separator of
+// lang, like 12,345.5 or 12.345,5.
+func formatNumber(lang string, n interface{}) string {
+	return message.NewPrinter(language.Make(lang)).Sprint(number.Decimal(n))
+}
+
+// fallbackPage is served in place of the HTML pages when html_dir holds no
+// templates, typically because the binary runs from another directory.
+const fallbackPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>ToDo</title>
+  </head>
+  <body>
+    <h1>ToDo</h1>
+    <p>The HTML templates were not found, set <code>html_dir</code> (or <code>-html_dir</code>) to their directory.</p>
+    <p>The JSON API is available under <a href="/api/v1/todo">/api/v1/todo</a>.</p>
+  </body>
+</html>
+`
+
+// writeFallbackPage responds with fallbackPage.
+func writeFallbackPage(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	rw.WriteHeader(http.StatusOK)
+	io.WriteString(rw, fallbackPage)
+}
+
+// percent formats part as a whole percentage of total, 0% when total is 0.
+func percent(part, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", part*100/total)
+}
+
+// timeAgo describes t relative to now in its largest whole unit in lang,
+// like "3 days ago" or "in 2 hours".
+func timeAgo(lang string, t, now time.Time) string {
+	d := now.Sub(t)
+	code := "time_ago"
+	if d < 0 {
+		d, code = -d, "time_from_now"
+	}
+
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, u := range units {
+		if n := int64(d / u.size); n > 0 {
+			unit := "unit_" + u.name
+			if n > 1 {
+				unit += "s"
+			}
+			amount := translate(lang, unit, renderer.M{"n": formatNumber(lang, n)})
+			return translate(lang, code, renderer.M{"amount": amount})
+		}
+	}
+	return translate(lang, "time_just_now", nil)
+}
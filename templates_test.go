@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Without templates the HTML pages answer the built-in page, whatever html_dir
+// holds instead.
+func TestMissingTemplates(t *testing.T) {
+	cfg, _, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg)
+
+	other := t.TempDir()
+	if err := os.WriteFile(filepath.Join(other, "README.md"), []byte("# templates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dirs := map[string]string{
+		"empty":       t.TempDir(),
+		"missing":     filepath.Join(t.TempDir(), "html"),
+		"other files": other,
+	}
+	for name, dir := range dirs {
+		t.Run(name, func(t *testing.T) {
+			pages, ok := newRenderer(dir, &assetManifest{}, false)
+			if ok {
+				t.Fatal("newRenderer() reported templates")
+			}
+			useRenderer(t, pages)
+			prev := haveTemplates
+			haveTemplates = ok
+			t.Cleanup(func() { haveTemplates = prev })
+
+			for path, handler := range map[string]http.HandlerFunc{"/": homeHandler, "/stats": statsPageHandler} {
+				rw := httptest.NewRecorder()
+				handler(rw, httptest.NewRequest(http.MethodGet, path, nil))
+				if rw.Code != http.StatusOK || rw.Body.String() != fallbackPage {
+					t.Errorf("GET %s = %d %q, want the fallback page", path, rw.Code, rw.Body)
+				}
+				if got := rw.Header().Get("Content-Type"); got != "text/html; charset=UTF-8" {
+					t.Errorf("GET %s: Content-Type = %q", path, got)
+				}
+			}
+		})
+	}
+}
+
+// The admin list renders its labels and dates in the language negotiated
+// for it: ?lang first, then the language cookie, then Accept-Language.
+func TestAdminTodosPageLanguages(t *testing.T) {
+	_, _, mongo := emptyDatabaseRouter(t)
+	pages, ok := newRenderer("html", &assetManifest{}, false)
+	if !ok {
+		t.Fatal("no templates in html")
+	}
+	useRenderer(t, pages)
+	prev := haveTemplates
+	haveTemplates = true
+	t.Cleanup(func() { haveTemplates = prev })
+	mongo.seed(collectionName, newTodoModel("write report", time.Date(2024, time.May, 3, 12, 0, 0, 0, time.UTC)))
+
+	english := []string{`<html lang="en">`, "<h1>Todos</h1>", "<th>Created</th>", `title="May 3, 2024"`, ">Complete</button>"}
+	portuguese := []string{`<html lang="pt">`, "<h1>Tarefas</h1>", "<th>Criada</th>", `title="3 de maio de 2024"`, ">Concluir</button>"}
+	tests := []struct {
+		name, query, cookie, acceptLanguage string
+		want                                []string
+		// the language ?lang keeps in the cookie
+		keep string
+	}{
+		{"default", "", "", "", english, ""},
+		{"accept language", "", "", "pt-BR,pt;q=0.9,en;q=0.5", portuguese, ""},
+		{"unknown language", "", "", "de-DE", english, ""},
+		{"cookie over accept language", "", "pt", "en-US", portuguese, ""},
+		{"lang over cookie", "?lang=en", "pt", "pt-BR", english, "en"},
+		{"lang", "?lang=pt", "", "en-US", portuguese, "pt"},
+		{"unknown lang", "?lang=de", "", "pt-BR", portuguese, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/todos"+tt.query, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: languageCookie, Value: tt.cookie})
+			}
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			rw := httptest.NewRecorder()
+			adminTodosPage(rw, r)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("GET /admin/todos%s = %d: %s", tt.query, rw.Code, rw.Body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rw.Body.String(), want) {
+					t.Errorf("the page lacks %s", want)
+				}
+			}
+
+			var kept string
+			for _, cookie := range rw.Result().Cookies() {
+				if cookie.Name == languageCookie {
+					kept = cookie.Value
+				}
+			}
+			if kept != tt.keep {
+				t.Errorf("the language cookie is set to %q, want %q", kept, tt.keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// tenant names become part of a database name
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+type tenantKey struct{}
+
+// withTenant resolves the tenant of a request in multi-tenant mode, that is
+// when tenants are configured, and refuses requests without one. The tenant
+// is named by the X-Tenant header or else by the first label of the host, so
+// team.todo.example.com works without the header.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		tenants := currentConfig().Tenants
+		if len(tenants) == 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		tenant := requestTenant(r)
+		if !slices.Contains(tenants, tenant) {
+			writeError(rw, r, http.StatusBadRequest, "tenant_required", renderer.M{
+				"header": "X-Tenant",
+			})
+			return
+		}
+		ctx := context.WithValue(r.Context(), tenantKey{}, tenant)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// requestTenant returns the tenant named by r, which may not be a known one.
+func requestTenant(r *http.Request) string {
+	if tenant := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Tenant"))); tenant != "" {
+		return tenant
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if label, _, found := strings.Cut(host, "."); found && net.ParseIP(host) == nil {
+		return strings.ToLower(label)
+	}
+	return ""
+}
+
+// tenantDB returns the database of the tenant of ctx. Every tenant has a
+// database of its own, named after dbName, so a query can't reach the
+// documents of another tenant whatever its filter, and each tenant gets its
+// own indexes. Without a tenant it returns the shared database.
+func tenantDB(ctx context.Context) *mongo.Database {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return client.Database(dbName + "-" + tenant)
+	}
+	return db
+}
+
+// tenantContexts returns a context derived from parent for each configured
+// tenant, or parent alone when multi-tenancy is off. Startup tasks such as
+// creating indexes run once per context.
+func tenantContexts(parent context.Context, tenants []string) []context.Context {
+	if len(tenants) == 0 {
+		return []context.Context{parent}
+	}
+	ctxs := make([]context.Context, len(tenants))
+	for i, tenant := range tenants {
+		ctxs[i] = context.WithValue(parent, tenantKey{}, tenant)
+	}
+	return ctxs
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTenant(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		header string
+		want   string
+	}{
+		{"header", "todo.example.com", "Team-A", "team-a"},
+		{"header over host", "beta.todo.example.com", "alpha", "alpha"},
+		{"first host label", "Beta.todo.example.com", "", "beta"},
+		{"host with port", "beta.todo.example.com:9000", "", "beta"},
+		{"single label host", "localhost:9000", "", ""},
+		{"IPv4 address", "192.168.1.10:9000", "", ""},
+		{"IPv6 address", "[::1]:9000", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/todo", nil)
+			r.Host = tt.host
+			if tt.header != "" {
+				r.Header.Set("X-Tenant", tt.header)
+			}
+			if got := requestTenant(r); got != tt.want {
+				t.Errorf("requestTenant() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// In multi-tenant mode every API route refuses a request without a known
+// tenant, and one with a tenant only reaches the database of that tenant.
+func TestTenantIsolation(t *testing.T) {
+	router, paths, mongo := emptyDatabaseRouter(t, func(cfg *Config) {
+		cfg.Tenants = []string{"alpha", "beta"}
+	})
+	serve := func(path, tenant string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = "localhost"
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	var checked int
+	for _, path := range paths {
+		if !strings.HasPrefix(path, apiV1.prefix()) && !strings.HasPrefix(path, "/todo") && !strings.HasPrefix(path, "/attachment") {
+			continue
+		}
+		checked++
+		for _, tenant := range []string{"", "gamma"} {
+			mongo.commands()
+			if code := serve(path, tenant); code != http.StatusBadRequest {
+				t.Errorf("GET %s with tenant %q = %d, want 400", path, tenant, code)
+			}
+			if sent := mongo.commands(); len(sent) > 0 {
+				t.Errorf("GET %s with tenant %q sent %+v", path, tenant, sent)
+			}
+		}
+
+		serve(path, "beta")
+		for _, cmd := range mongo.commands() {
+			// new connections introduce themselves first
+			handshake := strings.EqualFold(cmd.Name, "hello") || strings.EqualFold(cmd.Name, "isMaster")
+			if !handshake && cmd.Database != dbName+"-beta" {
+				t.Errorf("GET %s for beta sent %s to %s.%s", path, cmd.Name, cmd.Database, cmd.Collection)
+			}
+		}
+	}
+	if checked == 0 {
+		t.Fatal("found no API routes")
+	}
+}
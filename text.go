@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// limits are counted in runes, so emoji don't use up several characters each
+const maxTitleLength = 500
+
+var errInvalidUTF8 = errors.New("request body is not valid UTF-8")
+
+// decodeJSON decodes the request body into v. json.Decoder silently replaces
+// invalid UTF-8 with U+FFFD, so the body is checked first and rejected instead.
+func decodeJSON(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(body) {
+		return errInvalidUTF8
+	}
+	return json.Unmarshal(body, v)
+}
+
+// cleanText converts user text to NFC and removes control characters and
+// invisible zero-width characters. Newlines are kept when multiline is set,
+// otherwise they become spaces like other whitespace controls. Zero-width
+// joiners stay: emoji sequences and some scripts depend on them.
+func cleanText(s string, multiline bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' && multiline:
+			return r
+		case r == '\n', r == '\r', r == '\t':
+			return ' '
+		case unicode.IsControl(r), r == '\u200b', r == '\u2060', r == '\ufeff':
+			return -1
+		}
+		return r
+	}, norm.NFC.String(s))
+}
+
+// cleanTitle prepares a title for storage.
+func cleanTitle(title string) string {
+	return strings.TrimSpace(cleanText(title, false))
+}
+
+// cleanTags normalizes tags like titles, lower-cased and without empty or
+// repeated entries.
+func cleanTags(tags []string) []string {
+	var cleaned []string
+	for _, tag := range tags {
+		tag = strings.ToLower(cleanTitle(tag))
+		if tag != "" && !slices.Contains(cleaned, tag) {
+			cleaned = append(cleaned, tag)
+		}
+	}
+	return cleaned
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCleanText(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		multiline bool
+		want      string
+	}{
+		{name: "plain", in: "buy milk", want: "buy milk"},
+		{name: "decomposed accent", in: "cafe\u0301", want: "caf\u00e9"},
+		{name: "newline in a title", in: "buy\nmilk", want: "buy milk"},
+		{name: "newline in a comment", in: "buy\nmilk", multiline: true, want: "buy\nmilk"},
+		{name: "carriage return and tab", in: "buy\r\tmilk", multiline: true, want: "buy  milk"},
+		{name: "control characters", in: "buy\x00\x07 milk\x7f", want: "buy milk"},
+		{name: "zero-width characters", in: "\ufeffbuy\u200b mi\u2060lk", want: "buy milk"},
+		{name: "emoji sequence keeps its joiner", in: "\U0001F469\u200d\U0001F4BB code", want: "\U0001F469\u200d\U0001F4BB code"},
+		{name: "flag", in: "🇧🇷 trip", want: "🇧🇷 trip"},
+	}
+	for _, tt := range tests {
+		if got := cleanText(tt.in, tt.multiline); got != tt.want {
+			t.Errorf("%s: cleanText(%q, %v) = %q, want %q", tt.name, tt.in, tt.multiline, got, tt.want)
+		}
+	}
+}
+
+func TestCleanTitle(t *testing.T) {
+	if got := cleanTitle(" \u200b buy\nmilk \t"); got != "buy milk" {
+		t.Errorf("cleanTitle() = %q, want %q", got, "buy milk")
+	}
+}
+
+func TestCleanTags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"Home", " home ", "HOME"}, []string{"home"}},
+		{[]string{"", " ", "\u200b"}, nil},
+		{[]string{"Cafe\u0301", "caf\u00e9"}, []string{"caf\u00e9"}},
+		{[]string{"work", "home"}, []string{"work", "home"}},
+	}
+	for _, tt := range tests {
+		if got := cleanTags(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("cleanTags(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+		err  error
+	}{
+		{name: "valid", body: `{"title":"café ☕"}`, want: "café ☕"},
+		{name: "escaped", body: `{"title":"caf\u00e9"}`, want: "café"},
+		{name: "invalid UTF-8", body: "{\"title\":\"caf\xe9\"}", err: errInvalidUTF8},
+		{name: "truncated sequence", body: "{\"title\":\"\xe2\x98\"}", err: errInvalidUTF8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v struct{ Title string }
+			err := decodeJSON(httptest.NewRequest("POST", "/todo", strings.NewReader(tt.body)), &v)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("decodeJSON() error = %v, want %v", err, tt.err)
+			}
+			if v.Title != tt.want {
+				t.Errorf("title = %q, want %q", v.Title, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// estimates above this are refused, 0 means the todo has none
+const maxEstimateMinutes = 100000
+
+type (
+	// a stretch of work on a todo, embedded in its work log
+	WorkInterval struct {
+		StartedAt time.Time `json:"started_at" bson:"started_at"`
+		StoppedAt time.Time `json:"stopped_at" bson:"stopped_at"`
+	}
+	// a started or stopped timer; Interval is the work a stop logged
+	TimerResponse struct {
+		Message      string        `json:"message"`
+		StartedAt    *time.Time    `json:"started_at,omitempty"`
+		Interval     *WorkInterval `json:"interval,omitempty"`
+		SpentMinutes int64         `json:"spent_minutes"`
+	}
+)
+
+// workDuration is the length of the interval from start to stop, or zero
+// when the clock went backwards in between.
+func workDuration(start, stop time.Time) time.Duration {
+	return max(stop.Sub(start), 0)
+}
+
+// spentMinutes is the whole minutes of work in workLog.
+func spentMinutes(workLog []WorkInterval) int64 {
+	var total time.Duration
+	for _, interval := range workLog {
+		total += workDuration(interval.StartedAt, interval.StoppedAt)
+	}
+	return int64(total / time.Minute)
+}
+
+// estimateProblem returns the error code of an invalid estimate, or "".
+func estimateProblem(minutes int64) (string, renderer.M) {
+	if minutes < 0 || minutes > maxEstimateMinutes {
+		return "invalid_estimate", renderer.M{"max": maxEstimateMinutes}
+	}
+	return "", nil
+}
+
+// startTimer starts tracking work on an open todo; only one timer runs per
+// todo.
+func startTimer(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	var td TodoModel
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		filter := bson.M{"id": id, "completed": false, "timer_started_at": bson.M{"$exists": false}}
+		update := bumpVersion(bson.M{"$set": bson.M{"timer_started_at": now, "updated_at": now}})
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		if err := tenantDB(ctx).Collection(collectionName).FindOneAndUpdate(ctx, filter, update, opts).Decode(&td); err != nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeTimerConflict(rw, r, id, "timer_running")
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "timer_failed")
+		return
+	}
+
+	rw.Header().Set("ETag", todoETag(r, td))
+	renderJSON(rw, r, http.StatusOK, TimerResponse{
+		Message:      localize(r, "timer_started"),
+		StartedAt:    &now,
+		SpentMinutes: td.SpentMinutes,
+	})
+}
+
+// stopTimerHandler stops the running timer of a todo and logs the work.
+func stopTimerHandler(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTodoID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var interval *WorkInterval
+	var spent int64
+	err = runInTransaction(r.Context(), func(ctx context.Context) error {
+		var err error
+		interval, spent, err = stopTimer(ctx, id, time.Now().UTC())
+		if err != nil || interval == nil {
+			return err
+		}
+		return recordTodoEvent(ctx, eventTodoUpdated, id)
+	})
+	if err != nil {
+		logRequestError(r, "failed to update db collection: %v\n", err.Error())
+		writeDBError(rw, r, err, "timer_failed")
+		return
+	}
+	if interval == nil {
+		writeTimerConflict(rw, r, id, "timer_not_running")
+		return
+	}
+
+	setTodoETag(rw, r, id)
+	renderJSON(rw, r, http.StatusOK, TimerResponse{
+		Message:      localize(r, "timer_stopped"),
+		Interval:     interval,
+		SpentMinutes: spent,
+	})
+}
+
+// stopTimer stops the running timer of a todo at now, appending the interval
+// to its work log, and returns it with the minutes spent since. It returns a
+// nil interval when no timer was running. Completing a todo stops its timer
+// with this as well.
+func stopTimer(ctx context.Context, id primitive.ObjectID, now time.Time) (*WorkInterval, int64, error) {
+	todos := tenantDB(ctx).Collection(collectionName)
+
+	// unsetting the start first makes concurrent stops log the interval once
+	var td TodoModel
+	filter := bson.M{"id": id, "timer_started_at": bson.M{"$exists": true}}
+	update := bumpVersion(bson.M{"$unset": bson.M{"timer_started_at": ""}})
+	err := todos.FindOneAndUpdate(ctx, filter, update).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	interval := WorkInterval{StartedAt: *td.TimerStartedAt, StoppedAt: now}
+	spent := spentMinutes(append(td.WorkLog, interval))
+	_, err = todos.UpdateOne(ctx, bson.M{"id": id}, bumpVersion(bson.M{
+		"$push": bson.M{"work_log": interval},
+		"$set":  bson.M{"spent_minutes": spent, "updated_at": now},
+	}))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &interval, spent, nil
+}
+
+// writeTimerConflict answers a timer request that found nothing to change
+// with code, or with 404 when the todo doesn't exist. A completed todo
+// can't start a timer.
+func writeTimerConflict(rw http.ResponseWriter, r *http.Request, id primitive.ObjectID, code string) {
+	var td TodoModel
+	opts := options.FindOne().SetProjection(bson.M{"completed": 1, "timer_started_at": 1})
+	err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": id}, opts).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "todo_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch todo %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "timer_failed")
+		return
+	}
+	if code == "timer_running" && td.Completed && td.TimerStartedAt == nil {
+		code = "timer_todo_completed"
+	}
+	writeError(rw, r, http.StatusConflict, code, nil)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWorkDuration(t *testing.T) {
+	start := time.Date(2024, time.March, 10, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		stop time.Time
+		want time.Duration
+	}{
+		{"forward", start.Add(90 * time.Minute), 90 * time.Minute},
+		{"same instant", start, 0},
+		{"clock went back a second", start.Add(-time.Second), 0},
+		{"clock went back an hour", start.Add(-time.Hour), 0},
+	}
+	for _, tt := range tests {
+		if got := workDuration(start, tt.stop); got != tt.want {
+			t.Errorf("%s: workDuration() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpentMinutes(t *testing.T) {
+	at := func(minutes int) time.Time {
+		return time.Date(2024, time.March, 10, 9, 0, 0, 0, time.UTC).Add(time.Duration(minutes) * time.Minute)
+	}
+	tests := []struct {
+		name string
+		log  []WorkInterval
+		want int64
+	}{
+		{"nothing logged", nil, 0},
+		{"one interval", []WorkInterval{{at(0), at(25)}}, 25},
+		// a backwards interval adds nothing and takes nothing away
+		{"with a backwards interval", []WorkInterval{{at(0), at(25)}, {at(40), at(30)}, {at(50), at(60)}}, 35},
+		// seconds add up before they are cut to whole minutes
+		{"partial minutes", []WorkInterval{{at(0), at(0).Add(90 * time.Second)}, {at(5), at(5).Add(30 * time.Second)}}, 2},
+		{"under a minute", []WorkInterval{{at(0), at(0).Add(59 * time.Second)}}, 0},
+	}
+	for _, tt := range tests {
+		if got := spentMinutes(tt.log); got != tt.want {
+			t.Errorf("%s: spentMinutes() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A timer stopped before it started, as seen by a clock that went back since,
+// logs an empty interval rather than negative work.
+func TestStopTimerClockBackwards(t *testing.T) {
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+
+	now := time.Date(2024, time.March, 10, 9, 0, 0, 0, time.UTC)
+	started := now.Add(10 * time.Minute)
+	todo := newTodoModel("write report", now)
+	todo.TimerStartedAt = &started
+	todo.WorkLog = []WorkInterval{{StartedAt: now.Add(-time.Hour), StoppedAt: now.Add(-30 * time.Minute)}}
+	mongo.seed(collectionName, todo)
+
+	mongo.commands()
+	interval, spent, err := stopTimer(context.Background(), primitive.NewObjectID(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval == nil || !interval.StartedAt.Equal(started) || !interval.StoppedAt.Equal(now) {
+		t.Errorf("interval = %+v, want from %s to %s", interval, started, now)
+	}
+	if spent != 30 {
+		t.Errorf("spent = %d minutes, want the 30 logged before", spent)
+	}
+
+	var updates int
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "update" {
+			updates++
+		}
+	}
+	if updates != 1 {
+		t.Errorf("sent %d updates, want the interval logged once", updates)
+	}
+
+	// without a running timer there is nothing to stop
+	mongo.seed(collectionName)
+	if interval, _, err := stopTimer(context.Background(), primitive.NewObjectID(), now); interval != nil || err != nil {
+		t.Errorf("stopTimer() = %+v, %v without a timer, want nothing", interval, err)
+	}
+}
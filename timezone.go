@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// what the invalid_timezone error tells clients to send instead
+const expectedTimezone string = "an IANA time zone name such as Europe/Lisbon or UTC"
+
+// loadTimezone resolves an IANA zone name. "Local" is refused since it would
+// depend on wherever the server happens to run.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errors.New("unknown time zone Local")
+	}
+	return time.LoadLocation(name)
+}
+
+// requestLocation returns the zone used to interpret the dates of r: the
+// ?tz= query parameter when given, the configured timezone otherwise.
+func requestLocation(r *http.Request) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return currentConfig().location, nil
+	}
+	return loadTimezone(name)
+}
+
+// writeTimezoneError answers a request naming an unknown zone.
+func writeTimezoneError(rw http.ResponseWriter, r *http.Request, err error) {
+	writeError(rw, r, http.StatusBadRequest, "invalid_timezone", renderer.M{
+		"expected": expectedTimezone,
+		"error":    err.Error(),
+	})
+}
+
+// startOfDay returns midnight of t's day in t's location.
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// dayOfExpr is the aggregation expression of the YYYY-MM-DD day of the date
+// expression date in loc.
+func dayOfExpr(date interface{}, loc *time.Location) bson.M {
+	return bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": date, "timezone": loc.String()}}
+}
+
+// completedAtExpr is the aggregation expression of when a completed todo was
+// completed. Todos completed before completed_at existed fall back to their
+// last update.
+var completedAtExpr = bson.M{"$ifNull": bson.A{"$completed_at", bson.M{"$ifNull": bson.A{"$updated_at", "$created_at"}}}}
+
+// DateInput is a date sent by a client, either an RFC 3339 timestamp or a
+// plain YYYY-MM-DD date meaning midnight in the request's zone. Decoding only
+// rejects non-strings; handlers check the format with Valid so a bad date is
+// reported along with the other problems of the body.
+type DateInput struct {
+	raw string
+}
+
+func (d *DateInput) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &d.raw); err != nil {
+		return errors.New("dates must be strings")
+	}
+	return nil
+}
+
+// Valid reports whether the date has one of the accepted formats.
+func (d DateInput) Valid() bool {
+	_, err := parseDateParam(d.raw)
+	return err == nil
+}
+
+// In resolves the date, placing plain dates in loc. The result is in UTC.
+func (d DateInput) In(loc *time.Location) time.Time {
+	if t, err := time.Parse(time.RFC3339, d.raw); err == nil {
+		return t.UTC()
+	}
+	t, _ := time.ParseInLocation(time.DateOnly, d.raw, loc)
+	return t.UTC()
+}
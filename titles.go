@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// indexes on normalized_title, limited to open todos; only one of them
+	// exists at a time depending on unique_titles
+	titleIndexName       string = "normalized_title_open"
+	uniqueTitleIndexName string = "normalized_title_open_unique"
+)
+
+// the former titles a todo keeps, see recordRename
+const maxPreviousTitles = 10
+
+// normalizeTitle is the form titles are compared and searched in: NFC,
+// case-folded, with surrounding and repeated whitespace removed.
+func normalizeTitle(title string) string {
+	return strings.ToLower(strings.Join(strings.Fields(norm.NFC.String(title)), " "))
+}
+
+// ensureTitleIndexes creates the index used to find duplicate titles. With
+// unique set it rejects a second open todo with the same normalized title, so
+// concurrent creates can't both succeed.
+func ensureTitleIndexes(ctx context.Context, unique bool) error {
+	indexes := tenantDB(ctx).Collection(collectionName).Indexes()
+	name, stale := titleIndexName, uniqueTitleIndexName
+	if unique {
+		name, stale = uniqueTitleIndexName, titleIndexName
+	}
+
+	var cmdErr mongo.CommandError
+	if _, err := indexes.DropOne(ctx, stale); err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "IndexNotFound") {
+		return err
+	}
+
+	opts := options.Index().
+		SetName(name).
+		SetUnique(unique).
+		SetPartialFilterExpression(bson.M{"completed": false})
+	_, err := indexes.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "normalized_title", Value: 1}},
+		Options: opts,
+	})
+	if unique && mongo.IsDuplicateKeyError(err) {
+		return errors.New("unique_titles: open todos with the same title already exist, complete or rename them first")
+	}
+	return err
+}
+
+// recordRename keeps the current title of the todo id in previous_titles
+// when update sets another one, as told by its normalized form, so searches
+// still find the todo by it. It must run before update. A title is kept
+// once, not at all while it is the todo's title again, and the oldest go
+// beyond maxPreviousTitles.
+func recordRename(ctx context.Context, id primitive.ObjectID, update bson.M) error {
+	set, _ := update["$set"].(bson.M)
+	normalized, ok := set["normalized_title"].(string)
+	if !ok {
+		return nil
+	}
+	kept := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$previous_titles", bson.A{}}},
+		"cond": bson.M{"$and": bson.A{
+			bson.M{"$ne": bson.A{"$$this.normalized", "$normalized_title"}},
+			bson.M{"$ne": bson.A{"$$this.normalized", bson.M{"$literal": normalized}}},
+		}},
+	}}
+	previous := bson.M{"$slice": bson.A{
+		bson.M{"$concatArrays": bson.A{kept, bson.A{bson.M{"title": "$title", "normalized": "$normalized_title"}}}},
+		-maxPreviousTitles,
+	}}
+	filter := bson.M{"id": id, "normalized_title": bson.M{"$ne": normalized}}
+	_, err := tenantDB(ctx).Collection(collectionName).UpdateOne(ctx, filter, bson.A{
+		bson.M{"$set": bson.M{"previous_titles": previous}},
+	})
+	return err
+}
+
+// backfillNormalizedTitles sets normalized_title on todos created before it
+// existed. It is migration 1.
+func backfillNormalizedTitles(ctx context.Context) error {
+	coll := tenantDB(ctx).Collection(collectionName)
+	cursor, err := coll.Find(ctx, bson.M{"normalized_title": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var td TodoModel
+		if err := cursor.Decode(&td); err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"normalized_title": titleIndex(string(td.Title))}}
+		if _, err := coll.UpdateOne(ctx, bson.M{"id": td.ID}, update); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// findOpenDuplicate returns the id of an open todo whose title matches
+// normalized, ignoring the todo exclude. It returns NilObjectID when there is none.
+func findOpenDuplicate(ctx context.Context, normalized string, exclude primitive.ObjectID) (primitive.ObjectID, error) {
+	filter := bson.M{
+		"normalized_title": normalized,
+		"completed":        false,
+		"id":               bson.M{"$ne": exclude},
+	}
+	var td TodoModel
+	err := tenantDB(ctx).Collection(collectionName).FindOne(ctx, filter).Decode(&td)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, nil
+	}
+	return td.ID, err
+}
+
+// writeDuplicateTitle answers a write rejected by the unique title index with
+// a 409 naming the open todo that already has the title. An empty normalized
+// title is looked up from the todo being written.
+func writeDuplicateTitle(rw http.ResponseWriter, r *http.Request, normalized string, todoID primitive.ObjectID) {
+	fields := renderer.M{}
+	if normalized == "" {
+		var td TodoModel
+		if err := tenantDB(r.Context()).Collection(collectionName).FindOne(r.Context(), bson.M{"id": todoID}).Decode(&td); err == nil {
+			normalized = td.NormalizedTitle
+		}
+	}
+	existing, err := findOpenDuplicate(r.Context(), normalized, todoID)
+	if err != nil {
+		log.Printf("failed to look up the duplicate of %q: %v\n", normalized, err)
+	}
+	if !existing.IsZero() {
+		fields["duplicate_of"] = formatID(existing)
+	}
+	writeError(rw, r, http.StatusConflict, "duplicate_title", fields)
+}
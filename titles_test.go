@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// evalExpr evaluates the aggregation expression expr against doc, for the
+// operators recordRename uses.
+func evalExpr(t *testing.T, expr any, doc, this bson.M) any {
+	t.Helper()
+	switch expr := expr.(type) {
+	case string:
+		switch {
+		case strings.HasPrefix(expr, "$$this."):
+			return this[strings.TrimPrefix(expr, "$$this.")]
+		case strings.HasPrefix(expr, "$"):
+			return doc[strings.TrimPrefix(expr, "$")]
+		}
+		return expr
+	case bson.D:
+		return evalExpr(t, expr.Map(), doc, this)
+	case bson.A:
+		values := bson.A{}
+		for _, e := range expr {
+			values = append(values, evalExpr(t, e, doc, this))
+		}
+		return values
+	case bson.M:
+		args := func(key string) bson.A { return evalExpr(t, expr[key], doc, this).(bson.A) }
+		switch {
+		case expr["$literal"] != nil:
+			return expr["$literal"]
+		case expr["$ifNull"] != nil:
+			values := args("$ifNull")
+			if values[0] != nil {
+				return values[0]
+			}
+			return values[1]
+		case expr["$ne"] != nil:
+			values := args("$ne")
+			return !reflect.DeepEqual(values[0], values[1])
+		case expr["$and"] != nil:
+			for _, value := range args("$and") {
+				if !value.(bool) {
+					return false
+				}
+			}
+			return true
+		case expr["$concatArrays"] != nil:
+			joined := bson.A{}
+			for _, value := range args("$concatArrays") {
+				joined = append(joined, value.(bson.A)...)
+			}
+			return joined
+		case expr["$slice"] != nil:
+			values := args("$slice")
+			list, n := values[0].(bson.A), int(values[1].(int32))
+			return list[max(0, len(list)+n):]
+		case expr["$filter"] != nil:
+			filter := toM(expr["$filter"])
+			kept := bson.A{}
+			for _, item := range evalExpr(t, filter["input"], doc, this).(bson.A) {
+				if evalExpr(t, filter["cond"], doc, toM(item)).(bool) {
+					kept = append(kept, item)
+				}
+			}
+			return kept
+		}
+		object := bson.M{}
+		for key, value := range expr {
+			object[key] = evalExpr(t, value, doc, this)
+		}
+		return object
+	}
+	return expr
+}
+
+// toM returns a document decoded as either bson.M or bson.D as a bson.M.
+func toM(v any) bson.M {
+	if d, ok := v.(bson.D); ok {
+		return d.Map()
+	}
+	return v.(bson.M)
+}
+
+// previousTitles returns the former titles of doc, oldest first.
+func previousTitles(doc bson.M) []string {
+	var titles []string
+	previous, _ := doc["previous_titles"].(bson.A)
+	for _, p := range previous {
+		titles = append(titles, fmt.Sprint(toM(p)["title"]))
+	}
+	return titles
+}
+
+// rename has recordRename keep the title of doc as it is renamed to title,
+// applying the update it sends the way the database would.
+func rename(t *testing.T, mongo *emptyMongo, doc bson.M, title string) {
+	t.Helper()
+	normalized := titleIndex(title)
+	if err := recordRename(context.Background(), primitive.NewObjectID(), bson.M{"$set": bson.M{"normalized_title": normalized}}); err != nil {
+		t.Fatal(err)
+	}
+	var commands []mongoCommand
+	for _, cmd := range mongo.commands() {
+		if cmd.Name == "update" {
+			commands = append(commands, cmd)
+		}
+	}
+	if len(commands) != 1 {
+		t.Fatalf("recordRename sent %d updates", len(commands))
+	}
+	var cmd struct {
+		Updates []struct {
+			Q bson.M `bson:"q"`
+			U bson.A `bson:"u"`
+		} `bson:"updates"`
+	}
+	if err := bson.Unmarshal(commands[0].Command, &cmd); err != nil {
+		t.Fatal(err)
+	}
+	update := cmd.Updates[0]
+	// the filter doesn't match a todo that already has the title
+	if toM(update.Q["normalized_title"])["$ne"] != doc["normalized_title"] {
+		for _, stage := range update.U {
+			for field, value := range toM(toM(stage)["$set"]) {
+				doc[field] = evalExpr(t, value, doc, nil)
+			}
+		}
+	}
+	doc["title"], doc["normalized_title"] = title, normalized
+}
+
+func TestRecordRename(t *testing.T) {
+	useConfig(t, defaultConfig())
+	mongo := useEmptyDatabase(t)
+
+	tests := []struct {
+		name    string
+		renames []string
+		want    []string
+	}{
+		{"first rename", []string{"write draft"}, []string{"write report"}},
+		{"same title", []string{"Write  REPORT"}, nil},
+		{"renamed back", []string{"write draft", "write report"}, []string{"write draft"}},
+		{"former title again", []string{"write draft", "write report", "write final"}, []string{"write draft", "write report"}},
+		{"bounded", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"},
+			[]string{"2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := bson.M{"title": "write report", "normalized_title": titleIndex("write report")}
+			for _, title := range tt.renames {
+				rename(t, mongo, doc, title)
+			}
+			if got := previousTitles(doc); !slices.Equal(got, tt.want) {
+				t.Errorf("previous titles %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// a todo is found by a title it no longer has
+	doc := bson.M{"title": "write report", "normalized_title": titleIndex("write report")}
+	rename(t, mongo, doc, "send report")
+	var found bool
+	for _, clause := range titleSearchFilter("WRITE report")["$or"].(bson.A) {
+		pattern, ok := clause.(bson.M)["previous_titles.normalized"]
+		if !ok {
+			continue
+		}
+		re := regexp.MustCompile(pattern.(bson.M)["$regex"].(string))
+		for _, p := range doc["previous_titles"].(bson.A) {
+			found = found || re.MatchString(toM(p)["normalized"].(string))
+		}
+	}
+	if !found {
+		t.Errorf("search of the former title doesn't find the todo with %v", doc["previous_titles"])
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// the fields of TodoModel that Todo doesn't have under the same name, with
+// what the API shows of them
+var modelOnlyFields = map[string]string{
+	"NormalizedTitle": "derived from Title for lookups",
+	"OpenBlockers":    "shown as Blocked",
+	"WorkLog":         "shown as SpentMinutes",
+	"IdempotencyKey":  "only matches a retried create to the todo it made",
+}
+
+// the fields of Todo that TodoModel doesn't have under the same name, with
+// where they come from
+var apiOnlyFields = map[string]string{
+	"Blocked": "derived from OpenBlockers",
+	"AgeDays": "computed from CreatedAt as it is rendered",
+	"Stale":   "computed from Completed and CreatedAt as it is rendered",
+}
+
+// checkTodoFields checks that every field of TodoModel has a counterpart in
+// Todo and the other way round, or is listed in modelOnlyFields or
+// apiOnlyFields, so a field added to one of them isn't forgotten by toTodo
+// and its API without anyone noticing. A mismatch is a bug of this code.
+func checkTodoFields() error {
+	var errs []string
+	missing := func(from, to reflect.Type, listed map[string]string, list string) {
+		for i := 0; i < from.NumField(); i++ {
+			name := from.Field(i).Name
+			_, found := to.FieldByName(name)
+			_, ok := listed[name]
+			switch {
+			case !found && !ok:
+				errs = append(errs, fmt.Sprintf("%s.%s has no counterpart in %s nor is it in %s", from.Name(), name, to.Name(), list))
+			case found && ok:
+				errs = append(errs, fmt.Sprintf("%s.%s is in %s but %s has it", from.Name(), name, list, to.Name()))
+			}
+		}
+	}
+	model, api := reflect.TypeOf(TodoModel{}), reflect.TypeOf(Todo{})
+	missing(model, api, modelOnlyFields, "modelOnlyFields")
+	missing(api, model, apiOnlyFields, "apiOnlyFields")
+	if len(errs) > 0 {
+		return fmt.Errorf("todo fields:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
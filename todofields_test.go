@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The models as they are pass the check made at startup.
+func TestCheckTodoFields(t *testing.T) {
+	if err := checkTodoFields(); err != nil {
+		t.Error(err)
+	}
+}
+
+// toTodo carries every field of a todo that has all of them set over to the
+// field of Todo of the same name, and Todo survives the round trip through
+// its JSON.
+func TestToTodoCopiesEveryField(t *testing.T) {
+	useConfig(t, defaultConfig())
+	now := time.Now().UTC().Truncate(time.Second)
+	later := now.Add(24 * time.Hour)
+	blocker := primitive.NewObjectID()
+	td := newTodoModel("write report", now.Add(-time.Hour))
+	td.Completed = true
+	td.Starred = true
+	td.Color = "#ff0000"
+	td.Tags = []string{"work"}
+	td.Priority = "high"
+	td.DueDate = &later
+	td.CommentCount = 2
+	td.CompletedAt = &now
+	td.Reminders = []ReminderModel{{ID: primitive.NewObjectID(), At: later, Note: "start"}}
+	td.BlockedBy = []primitive.ObjectID{blocker}
+	td.OpenBlockers = []primitive.ObjectID{blocker}
+	td.EstimateMinutes = 30
+	td.SpentMinutes = 20
+	td.WorkLog = []WorkInterval{{StartedAt: now.Add(-20 * time.Minute), StoppedAt: now}}
+	td.TimerStartedAt = &now
+	td.DeferredUntil = &later
+	td.Version = 3
+	td.PreviousTitles = []PreviousTitle{{Title: "write draft", Normalized: titleIndex("write draft")}}
+	td.IdempotencyKey = "key"
+
+	// a field of the model still zero here was added without being set above
+	model := reflect.ValueOf(td)
+	for i := 0; i < model.NumField(); i++ {
+		if model.Field(i).IsZero() {
+			t.Errorf("the test todo leaves TodoModel.%s unset", model.Type().Field(i).Name)
+		}
+	}
+
+	todo := td.toTodo(time.UTC)
+	api := reflect.ValueOf(todo)
+	for i := 0; i < api.NumField(); i++ {
+		name := api.Type().Field(i).Name
+		// computed from the age, and only shown by GET /todo/{id}
+		if name == "AgeDays" || name == "Stale" || name == "PreviousTitles" {
+			continue
+		}
+		if api.Field(i).IsZero() {
+			t.Errorf("toTodo() leaves Todo.%s unset", name)
+		}
+	}
+
+	body, err := json.Marshal(todo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Todo
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, todo) {
+		t.Errorf("round trip through JSON:\n got %+v\nwant %+v", decoded, todo)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	templateCollectionName string = "templates"
+
+	maxTemplateItems = 100
+)
+
+// a due offset relative to the anchor date, like "+3d" or "+2w"
+var dueOffsetPattern = regexp.MustCompile(`^([+-]?)(\d{1,4})([dw])$`)
+
+type (
+	// one todo of a template; Due is an offset such as "+3d", empty for none
+	TemplateItem struct {
+		Title    sealedText `json:"title" bson:"title"`
+		Tags     []string   `json:"tags" bson:"tags,omitempty"`
+		Priority string     `json:"priority,omitempty" bson:"priority,omitempty"`
+		Color    string     `json:"color,omitempty" bson:"color,omitempty"`
+		Due      string     `json:"due,omitempty" bson:"due,omitempty"`
+	}
+	// struct to db model
+	TodoTemplateModel struct {
+		ID        primitive.ObjectID `bson:"_id,omitempty"`
+		Name      string             `bson:"name"`
+		Items     []TemplateItem     `bson:"items"`
+		CreatedAt time.Time          `bson:"created_at"`
+	}
+	// a template as returned by the API
+	TodoTemplate struct {
+		ID        string         `json:"id"`
+		Name      string         `json:"name"`
+		Items     []TemplateItem `json:"items"`
+		CreatedAt time.Time      `json:"created_at"`
+	}
+	// create template
+	CreateTemplate struct {
+		Name  string         `json:"name"`
+		Items []TemplateItem `json:"items"`
+	}
+	// instantiate template; due offsets count from Anchor, today by default
+	InstantiateTemplate struct {
+		Anchor   *DateInput `json:"anchor"`
+		Timezone string     `json:"timezone"`
+	}
+	// the templates endpoint response
+	GetTemplatesResponse struct {
+		Message string         `json:"message"`
+		Data    []TodoTemplate `json:"data"`
+	}
+	// a single template
+	TemplateResponse struct {
+		Message string       `json:"message"`
+		Data    TodoTemplate `json:"data"`
+	}
+	// the ids of the todos created from a template
+	InstantiateTemplateResponse struct {
+		Message string   `json:"message"`
+		IDs     []string `json:"ids"`
+	}
+)
+
+// createTemplate saves a named set of todos. Every item is validated like a
+// new todo so instantiating the template can't fail on its content.
+func createTemplate(rw http.ResponseWriter, r *http.Request) {
+	var templateReq CreateTemplate
+	if err := decodeJSON(r, &templateReq); err != nil {
+		log.Printf("failed to decode json data: %v\n", err.Error())
+		writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	problems := newFieldErrors(r)
+	name := cleanTitle(templateReq.Name)
+	if name == "" {
+		problems.add("name", "template_name_required", nil)
+	}
+	if len(templateReq.Items) == 0 || len(templateReq.Items) > maxTemplateItems {
+		problems.add("items", "template_items_required", renderer.M{
+			"max_items": maxTemplateItems,
+		})
+	}
+
+	items := make([]TemplateItem, len(templateReq.Items))
+	for i, item := range templateReq.Items {
+		items[i] = cleanTemplateItem(problems, i, item)
+	}
+	if problems.write(rw, r) {
+		return
+	}
+
+	tmpl := TodoTemplateModel{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Items:     items,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := tenantDB(r.Context()).Collection(templateCollectionName).InsertOne(r.Context(), tmpl); err != nil {
+		logRequestError(r, "failed to insert template into the db: %v\n", err.Error())
+		writeDBError(rw, r, err, "template_save_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusCreated, TemplateResponse{
+		Message: localize(r, "template_saved"),
+		Data:    tmpl.toTemplate(),
+	})
+}
+
+// cleanTemplateItem applies the rules of createTodo to the template item at
+// index, recording its problems in problems.
+func cleanTemplateItem(problems *fieldErrors, index int, item TemplateItem) TemplateItem {
+	title := cleanTitle(string(item.Title))
+	item.Title = sealedText(title)
+	if code, params := titleProblem(title); code != "" {
+		problems.addAt(index, "title", code, params)
+	}
+	item.Tags = cleanTags(item.Tags)
+	for _, tag := range item.Tags {
+		if code := tagProblem(tag); code != "" {
+			problems.addAt(index, "tags", code, renderer.M{"tag": tag})
+		}
+	}
+
+	priority, ok := normalizePriority(item.Priority)
+	if !ok {
+		problems.addAt(index, "priority", "invalid_priority", renderer.M{
+			"allowed": strings.Join(priorities, ", "),
+		})
+	}
+	item.Priority = priority
+
+	color, err := normalizeColor(item.Color)
+	if err != nil {
+		problems.addAt(index, "color", "invalid_color", nil)
+	}
+	item.Color = color
+
+	item.Due = strings.ToLower(strings.TrimSpace(item.Due))
+	if item.Due != "" {
+		if _, err := parseDueOffset(item.Due); err != nil {
+			problems.addAt(index, "due", "invalid_due_offset", nil)
+		}
+	}
+	return item
+}
+
+// parseDueOffset returns the number of days of an offset such as "+3d",
+// "2w" or "-1d".
+func parseDueOffset(offset string) (int, error) {
+	m := dueOffsetPattern.FindStringSubmatch(offset)
+	if m == nil {
+		return 0, fmt.Errorf("invalid due offset %q, expected a number of days or weeks such as +3d or +2w", offset)
+	}
+	days, _ := strconv.Atoi(m[2])
+	if m[3] == "w" {
+		days *= 7
+	}
+	if m[1] == "-" {
+		days = -days
+	}
+	return days, nil
+}
+
+// getTemplates lists the templates by name.
+func getTemplates(rw http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := tenantDB(r.Context()).Collection(templateCollectionName).Find(r.Context(), bson.M{}, opts)
+	if err != nil {
+		logRequestError(r, "failed to fetch templates: %v\n", err)
+		writeDBError(rw, r, err, "templates_fetch_failed")
+		return
+	}
+
+	var templatesFromDB []TodoTemplateModel
+	if err := cursor.All(r.Context(), &templatesFromDB); err != nil {
+		logRequestError(r, "failed to decode templates: %v\n", err)
+		writeDBError(rw, r, err, "templates_fetch_failed")
+		return
+	}
+
+	templateList := []TodoTemplate{}
+	for _, t := range templatesFromDB {
+		templateList = append(templateList, t.toTemplate())
+	}
+	renderJSON(rw, r, http.StatusOK, GetTemplatesResponse{
+		Message: localize(r, "templates_retrieved"),
+		Data:    templateList,
+	})
+}
+
+// getTemplate returns a single template.
+func getTemplate(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTemplateID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_template_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	tmpl, err := findTemplate(r.Context(), id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "template_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch template %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "template_fetch_failed")
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, TemplateResponse{
+		Message: localize(r, "template_retrieved"),
+		Data:    tmpl.toTemplate(),
+	})
+}
+
+// deleteTemplate removes a template; todos created from it are kept.
+func deleteTemplate(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTemplateID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_template_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data, err := tenantDB(r.Context()).Collection(templateCollectionName).DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		logRequestError(r, "could not delete template from database: %v\n", err.Error())
+		writeDBError(rw, r, err, "template_delete_failed")
+		return
+	}
+	if data.DeletedCount == 0 {
+		writeError(rw, r, http.StatusNotFound, "template_not_found", nil)
+		return
+	}
+
+	renderJSON(rw, r, http.StatusOK, MessageResponse{
+		Message: localize(r, "template_deleted"),
+	})
+}
+
+// instantiateTemplate creates the todos of a template with a single
+// InsertMany, in a transaction when the server supports them. On a standalone
+// server a failed insert is undone by removing the todos it did create, which
+// is best-effort: should that removal fail too, the instance stays partial.
+func instantiateTemplate(rw http.ResponseWriter, r *http.Request) {
+	id, err := parseTemplateID(r)
+	if err != nil {
+		writeError(rw, r, http.StatusBadRequest, "invalid_template_id", renderer.M{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// the body is optional
+	var instantiateReq InstantiateTemplate
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &instantiateReq); err != nil {
+			log.Printf("failed to decode json data: %v\n", err.Error())
+			writeError(rw, r, http.StatusBadRequest, "invalid_body", renderer.M{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	loc, err := requestLocation(r)
+	if instantiateReq.Timezone != "" {
+		loc, err = loadTimezone(instantiateReq.Timezone)
+	}
+	if err != nil {
+		writeTimezoneError(rw, r, err)
+		return
+	}
+	anchor := startOfDay(time.Now().In(loc))
+	if instantiateReq.Anchor != nil {
+		if !instantiateReq.Anchor.Valid() {
+			problems := newFieldErrors(r)
+			problems.add("anchor", "invalid_date", renderer.M{"param": "anchor"})
+			problems.write(rw, r)
+			return
+		}
+		anchor = instantiateReq.Anchor.In(loc)
+	}
+
+	tmpl, err := findTemplate(r.Context(), id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeError(rw, r, http.StatusNotFound, "template_not_found", nil)
+		return
+	}
+	if err != nil {
+		logRequestError(r, "failed to fetch template %s: %v\n", id.Hex(), err)
+		writeDBError(rw, r, err, "template_fetch_failed")
+		return
+	}
+
+	if !checkQuota(rw, r, int64(len(tmpl.Items))) {
+		return
+	}
+
+	now := time.Now().UTC()
+	ids := make([]primitive.ObjectID, len(tmpl.Items))
+	todos := make([]interface{}, len(tmpl.Items))
+	for i, item := range tmpl.Items {
+		var dueDate *time.Time
+		if item.Due != "" {
+			// validated when the template was saved
+			days, _ := parseDueOffset(item.Due)
+			due := anchor.AddDate(0, 0, days).UTC()
+			dueDate = &due
+		}
+		td := newTodoModel(string(item.Title), now)
+		td.Color = item.Color
+		td.Tags = item.Tags
+		td.Priority = item.Priority
+		td.DueDate = dueDate
+		ids[i], todos[i] = td.ID, td
+	}
+
+	// in a transaction when the server has them; on a standalone server the
+	// cleanup below removes what a failed insert left behind
+	err = runAtomically(r.Context(), func(ctx context.Context) error {
+		if _, err := tenantDB(ctx).Collection(collectionName).InsertMany(ctx, todos); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := recordTodoEvent(ctx, eventTodoCreated, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to instantiate template %s: %v\n", id.Hex(), err)
+		// the ids are new, so this only removes what the failed insert created
+		filter := bson.M{"id": bson.M{"$in": ids}}
+		if _, err := tenantDB(r.Context()).Collection(collectionName).DeleteMany(context.WithoutCancel(r.Context()), filter); err != nil {
+			log.Printf("failed to remove the partial instance of template %s: %v\n", id.Hex(), err)
+		}
+		// a sync may have seen some of them meanwhile
+		recordDeletions(context.WithoutCancel(r.Context()), ids, primitive.NilObjectID)
+		releaseQuota(r.Context())
+		writeDBError(rw, r, err, "template_instantiate_failed")
+		return
+	}
+
+	addQuotaUsage(r.Context(), int64(len(ids)))
+
+	hexIDs := make([]string, len(ids))
+	for i, id := range ids {
+		hexIDs[i] = formatID(id)
+	}
+	renderJSON(rw, r, http.StatusCreated, InstantiateTemplateResponse{
+		Message: localize(r, "template_instantiated"),
+		IDs:     hexIDs,
+	})
+}
+
+func parseTemplateID(r *http.Request) (primitive.ObjectID, error) {
+	return parseID(chi.URLParam(r, "id"))
+}
+
+func findTemplate(ctx context.Context, id primitive.ObjectID) (TodoTemplateModel, error) {
+	var tmpl TodoTemplateModel
+	err := tenantDB(ctx).Collection(templateCollectionName).FindOne(ctx, bson.M{"_id": id}).Decode(&tmpl)
+	return tmpl, err
+}
+
+func (t TodoTemplateModel) toTemplate() TodoTemplate {
+	// a template stored without items, or an item without tags, still
+	// lists them as []
+	items := make([]TemplateItem, len(t.Items))
+	for i, item := range t.Items {
+		if item.Tags == nil {
+			item.Tags = []string{}
+		}
+		items[i] = item
+	}
+	return TodoTemplate{
+		ID:        formatID(t.ID),
+		Name:      t.Name,
+		Items:     items,
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+// templateHandlers serves the todo templates.
+func templateHandlers(version apiVersion) http.Handler {
+	router := chi.NewRouter()
+	router.Use(withAPIVersion(version), limitBody, routeOptions)
+	router.Get("/", getTemplates)
+	router.Head("/", getTemplates)
+	router.Post("/", createTemplate)
+	router.Get("/{id}", getTemplate)
+	router.Delete("/{id}", deleteTemplate)
+	router.Post("/{id}/instantiate", instantiateTemplate)
+
+	return router
+}
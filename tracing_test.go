@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	// the monitor takes the tracer provider in effect when the client connects
+	cfg := defaultConfig()
+	cfg.Mongo.URI = "mongodb://" + newEmptyMongo(t).listener.Addr().String()
+	useConfig(t, cfg)
+	mongoClient, err := connectMongo(cfg, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mongoClient.Disconnect(context.Background()) })
+
+	router := chi.NewRouter()
+	router.Use(tracingMiddleware)
+	router.Get("/todo/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		err := mongoClient.Database(dbName).Collection(collectionName).FindOne(r.Context(), bson.M{}).Err()
+		if err != mongo.ErrNoDocuments {
+			t.Errorf("FindOne() error = %v, want ErrNoDocuments", err)
+		}
+		rw.WriteHeader(http.StatusNotFound)
+	})
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/todo/abc", nil)
+	req.Header.Set("traceparent", incoming)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var server, command sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.SpanKind() {
+		case trace.SpanKindServer:
+			server = span
+		case trace.SpanKindClient:
+			if span.Name() == collectionName+".find" {
+				command = span
+			}
+		}
+	}
+	if server == nil || command == nil {
+		t.Fatalf("recorded %d spans, want a server span and a find span", len(recorder.Ended()))
+	}
+
+	if got := server.Name(); got != "GET /todo/{id}" {
+		t.Errorf("server span name = %q, want the route pattern", got)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want the span of the traceparent header", got)
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span trace = %s, want the trace of the traceparent header", got)
+	}
+	if command.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("find span parent = %s, want the server span %s", command.Parent().SpanID(), server.SpanContext().SpanID())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// FieldError is one problem with a field of a request body or a query
+// parameter. Error is what a parser said about the value, when it said
+// anything. Index is set for the elements of a batch, such as the items of a
+// template.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+	Index   *int   `json:"index,omitempty"`
+}
+
+// fieldErrors collects every problem of a request body, so clients can fix
+// them all at once instead of discovering them one request at a time.
+type fieldErrors struct {
+	lang string
+	errs []FieldError
+}
+
+func newFieldErrors(r *http.Request) *fieldErrors {
+	return &fieldErrors{lang: requestLanguage(r)}
+}
+
+// add records a problem with field. The code is a catalog code whose message
+// is filled in with params, as for writeError.
+func (v *fieldErrors) add(field, code string, params renderer.M) {
+	v.errs = append(v.errs, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: translate(v.lang, code, params),
+	})
+}
+
+// addError is add for a problem reported by err.
+func (v *fieldErrors) addError(field, code string, params renderer.M, err error) {
+	v.add(field, code, params)
+	v.errs[len(v.errs)-1].Error = err.Error()
+}
+
+// addAt records a problem with field of the batch element at index.
+func (v *fieldErrors) addAt(index int, field, code string, params renderer.M) {
+	v.add(field, code, params)
+	v.errs[len(v.errs)-1].Index = &index
+}
+
+// titleProblem checks a cleaned title and returns the code and params of its
+// problem, or an empty code when it is fine.
+func titleProblem(title string) (string, renderer.M) {
+	switch {
+	case title == "":
+		return "title_required", nil
+	case utf8.RuneCountInString(title) > maxTitleLength:
+		return "title_too_long", renderer.M{"max_length": maxTitleLength}
+	}
+	return "", nil
+}
+
+// write answers with 422 and every recorded problem, if there are any, and
+// reports whether it did.
+func (v *fieldErrors) write(rw http.ResponseWriter, r *http.Request) bool {
+	if len(v.errs) == 0 {
+		return false
+	}
+	writeError(rw, r, http.StatusUnprocessableEntity, "validation_failed", renderer.M{
+		"count":  len(v.errs),
+		"errors": v.errs,
+	})
+	return true
+}
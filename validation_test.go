@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/thedevsaddam/renderer"
+)
+
+// validationBody is the body answering a request with invalid fields.
+type validationBody struct {
+	Code   string       `json:"code"`
+	Count  int          `json:"count"`
+	Errors []FieldError `json:"errors"`
+}
+
+func decodeValidation(t *testing.T, rw *httptest.ResponseRecorder) validationBody {
+	t.Helper()
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422: %s", rw.Code, rw.Body)
+	}
+	var body validationBody
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "validation_failed" || body.Count != len(body.Errors) {
+		t.Errorf("code = %s and count = %d for %d errors, want validation_failed and the count", body.Code, body.Count, len(body.Errors))
+	}
+	return body
+}
+
+func TestTitleProblem(t *testing.T) {
+	tests := []struct {
+		title string
+		code  string
+	}{
+		{"buy milk", ""},
+		{"", "title_required"},
+		{strings.Repeat("x", maxTitleLength), ""},
+		{strings.Repeat("☕", maxTitleLength), ""},
+		{strings.Repeat("x", maxTitleLength+1), "title_too_long"},
+	}
+	for _, tt := range tests {
+		if code, _ := titleProblem(tt.title); code != tt.code {
+			t.Errorf("titleProblem(%d runes) = %q, want %q", len([]rune(tt.title)), code, tt.code)
+		}
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+	r := httptest.NewRequest(http.MethodPost, "/todo", nil)
+
+	problems := newFieldErrors(r)
+	if rw := httptest.NewRecorder(); problems.write(rw, r) || rw.Body.Len() > 0 {
+		t.Fatal("write() answered without problems")
+	}
+	problems.add("title", "title_required", nil)
+	problems.addError("due_date", "invalid_date", renderer.M{"param": "due_date"}, errors.New("bad month"))
+	problems.addAt(2, "title", "title_too_long", renderer.M{"max_length": maxTitleLength})
+
+	rw := httptest.NewRecorder()
+	if !problems.write(rw, r) {
+		t.Fatal("write() didn't answer")
+	}
+	body := decodeValidation(t, rw)
+	index := 2
+	want := []FieldError{
+		{Field: "title", Code: "title_required", Message: translate("en", "title_required", nil)},
+		{Field: "due_date", Code: "invalid_date", Message: translate("en", "invalid_date", renderer.M{"param": "due_date"}), Error: "bad month"},
+		{Field: "title", Code: "title_too_long", Message: translate("en", "title_too_long", renderer.M{"max_length": maxTitleLength}), Index: &index},
+	}
+	if len(body.Errors) != len(want) {
+		t.Fatalf("errors = %+v, want %+v", body.Errors, want)
+	}
+	for i, got := range body.Errors {
+		w := want[i]
+		if got.Field != w.Field || got.Code != w.Code || got.Message != w.Message || got.Error != w.Error ||
+			(got.Index == nil) != (w.Index == nil) || got.Index != nil && *got.Index != *w.Index {
+			t.Errorf("errors[%d] = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+// A body with several invalid fields is answered with all of them.
+func TestCreateTodoReportsEveryProblem(t *testing.T) {
+	useConfig(t, defaultConfig())
+	useRenderer(t, nil)
+
+	body := `{"title":"   ","priority":"asap","color":"not a color","due_date":"2026-13-45","estimate_minutes":-5}`
+	rw := httptest.NewRecorder()
+	createTodo(rw, httptest.NewRequest(http.MethodPost, "/todo", strings.NewReader(body)))
+
+	fields := map[string]bool{}
+	for _, e := range decodeValidation(t, rw).Errors {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"title", "priority", "color", "due_date", "estimate_minutes"} {
+		if !fields[field] {
+			t.Errorf("no error for %s, got %v", field, fields)
+		}
+	}
+}
+
+// Updates, patches and templates report every problem too, and the items of
+// a template carry their index.
+func TestValidationAcrossHandlers(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	const id = "652f1c2e9b1e8a0001a1b2c3"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   []string
+	}{
+		{
+			name:   "update",
+			method: http.MethodPut,
+			path:   "/api/v1/todo/" + id,
+			body:   `{"title":"","color":"not a color","estimate_minutes":-5}`,
+			want:   []string{"title", "color", "estimate_minutes"},
+		},
+		{
+			name:   "patch",
+			method: http.MethodPatch,
+			path:   "/api/v1/todo/" + id,
+			body:   `{"title":"` + strings.Repeat("x", maxTitleLength+1) + `","color":"not a color","estimate_minutes":-5}`,
+			want:   []string{"title", "color", "estimate_minutes"},
+		},
+		{
+			name:   "template",
+			method: http.MethodPost,
+			path:   "/api/v1/template",
+			body:   `{"name":"","items":[{"title":"ok"},{"title":"","priority":"asap"},{"title":"ok","due":"soon"}]}`,
+			want:   []string{"name", "1:title", "1:priority", "2:due"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+
+			var got []string
+			for _, e := range decodeValidation(t, rw).Errors {
+				field := e.Field
+				if e.Index != nil {
+					field = strconv.Itoa(*e.Index) + ":" + field
+				}
+				got = append(got, field)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("errors for %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
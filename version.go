@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiVersion identifies the response envelope served under /api/v<N>. Handlers
+// that need to shape a response differently per version ask requestAPIVersion
+// rather than inspecting the path.
+type apiVersion int
+
+const apiV1 apiVersion = 1
+
+// compatibility modes of http.compatibility_mode: responses carry the legacy
+// fields in place of their replacements, besides them, or not at all
+const (
+	compatOld  string = "old"
+	compatBoth string = "both"
+	compatNew  string = "new"
+)
+
+// legacyFields are the response fields kept for clients from before /api/v1,
+// served as http.compatibility_mode says and named in X-Deprecated-Fields.
+var legacyFields = map[string]bool{
+	// the id of a created todo, now "id"
+	"ID": true,
+	// the Go error behind an error response, now told by "code"
+	"error": true,
+}
+
+type apiVersionKey struct{}
+
+var deprecatedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_deprecated_requests_total",
+		Help: "Requests to the deprecated unversioned paths by path: /todo or /attachment.",
+	},
+	[]string{"path"},
+)
+
+var deprecatedFieldsServed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "todo_deprecated_fields_total",
+		Help: "Responses carrying a legacy field by field, see http.compatibility_mode.",
+	},
+	[]string{"field"},
+)
+
+func init() {
+	prometheus.MustRegister(deprecatedRequests, deprecatedFieldsServed)
+}
+
+// prefix is the mount point of the version, e.g. /api/v1.
+func (v apiVersion) prefix() string {
+	return "/api/v" + strconv.Itoa(int(v))
+}
+
+// withAPIVersion records the version a router serves in the request context.
+func withAPIVersion(v apiVersion) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), apiVersionKey{}, v)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestAPIVersion returns the version of the route serving r.
+func requestAPIVersion(r *http.Request) apiVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(apiVersion); ok {
+		return v
+	}
+	return apiV1
+}
+
+// deprecatedAlias marks the unversioned legacy routes as deprecated and points
+// clients at the same path under successor, with the day they go away once
+// http.legacy_sunset sets it. The requests are counted, so the aliases can go
+// once nobody uses them.
+func deprecatedAlias(successor apiVersion) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Deprecation", "true")
+			if sunset := currentConfig().legacySunset; !sunset.IsZero() {
+				rw.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+			}
+			rw.Header().Add("Link", "<"+successor.prefix()+r.URL.Path+`>; rel="successor-version"`)
+			// the first segment keeps the label to the mounted paths
+			path, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+			deprecatedRequests.WithLabelValues("/" + path).Inc()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// deprecateField marks a response carrying the legacy field: Deprecation, the
+// Sunset of http.legacy_sunset and the field in X-Deprecated-Fields. Each is
+// counted, so the default mode can become new once they stop growing.
+func deprecateField(rw http.ResponseWriter, cfg *Config, field string) {
+	rw.Header().Set("Deprecation", "true")
+	if !cfg.legacySunset.IsZero() {
+		rw.Header().Set("Sunset", cfg.legacySunset.Format(http.TimeFormat))
+	}
+	rw.Header().Add("X-Deprecated-Fields", field)
+	deprecatedFieldsServed.WithLabelValues(field).Inc()
+}
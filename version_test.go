@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The legacy paths serve what their /api/v1 counterparts do, and only they
+// are marked deprecated.
+func TestLegacyAliases(t *testing.T) {
+	router, paths, _ := emptyDatabaseRouter(t)
+	cfg := *currentConfig()
+	cfg.legacySunset = time.Date(2027, time.January, 31, 0, 0, 0, 0, time.UTC)
+	useConfig(t, cfg)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+	var compared int
+	for _, path := range paths {
+		legacy, ok := strings.CutPrefix(path, apiV1.prefix())
+		if !ok || !(strings.HasPrefix(legacy, "/todo") || strings.HasPrefix(legacy, "/attachment")) {
+			continue
+		}
+		compared++
+		label := map[string]string{"path": "/" + strings.Split(legacy, "/")[1]}
+		counted := metricValue(t, "todo_deprecated_requests_total", label)
+		current, old := serve(path), serve(legacy)
+
+		if old.Code != current.Code {
+			t.Errorf("GET %s = %d, GET %s = %d", legacy, old.Code, path, current.Code)
+		}
+		// the sync cursor is the time it was asked for
+		if !strings.HasPrefix(legacy, "/todo/changes") && old.Body.String() != current.Body.String() {
+			t.Errorf("GET %s = %s, GET %s = %s", legacy, old.Body, path, current.Body)
+		}
+
+		for _, header := range []string{"Deprecation", "Sunset", "Link"} {
+			if got := current.Header().Get(header); got != "" {
+				t.Errorf("GET %s: %s = %q, want none", path, header, got)
+			}
+		}
+		if got := old.Header().Get("Deprecation"); got != "true" {
+			t.Errorf("GET %s: Deprecation = %q, want true", legacy, got)
+		}
+		if got := old.Header().Get("Sunset"); got != "Sun, 31 Jan 2027 00:00:00 GMT" {
+			t.Errorf("GET %s: Sunset = %q", legacy, got)
+		}
+		successor := "<" + strings.Split(path, "?")[0] + `>; rel="successor-version"`
+		if got := old.Header().Get("Link"); got != successor {
+			t.Errorf("GET %s: Link = %q, want %q", legacy, got, successor)
+		}
+		if got := metricValue(t, "todo_deprecated_requests_total", label) - counted; got != 1 {
+			t.Errorf("GET %s counted %v times, want once", legacy, got)
+		}
+	}
+	if compared == 0 {
+		t.Fatal("found no legacy paths to compare")
+	}
+}
+
+// Writes through the legacy paths are marked and counted as reads are, with
+// a Sunset only once http.legacy_sunset sets one. No legacy field marks the
+// /api/v1 answers, see TestCompatibilityModes.
+func TestLegacyAliasWrites(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	id := formatID(primitive.NewObjectID())
+	requests := []struct{ method, path, body string }{
+		{http.MethodPost, "/todo", `{"title":"write report"}`},
+		{http.MethodPut, "/todo/" + id, `{"title":"write report","completed":true}`},
+		{http.MethodPatch, "/todo/" + id, `{"starred":true}`},
+		{http.MethodDelete, "/todo/" + id, ""},
+		{http.MethodPost, "/todo/" + id + "/comment", `{"text":"soon"}`},
+	}
+	for _, sunset := range []time.Time{{}, time.Date(2027, time.January, 31, 0, 0, 0, 0, time.UTC)} {
+		cfg := *currentConfig()
+		cfg.legacySunset = sunset
+		cfg.HTTP.CompatibilityMode = compatNew
+		useConfig(t, cfg)
+		for _, req := range requests {
+			serve := func(path string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(req.method, path, strings.NewReader(req.body))
+				r.Header.Set("Content-Type", jsonContentType)
+				rw := httptest.NewRecorder()
+				router.ServeHTTP(rw, r)
+				return rw
+			}
+			label := map[string]string{"path": "/todo"}
+			counted := metricValue(t, "todo_deprecated_requests_total", label)
+			current, old := serve(apiV1.prefix()+req.path), serve(req.path)
+			name := req.method + " " + req.path
+
+			if old.Code != current.Code {
+				t.Errorf("%s = %d, want %d as on %s", name, old.Code, current.Code, apiV1.prefix())
+			}
+			if old.Header().Get("Deprecation") != "true" || current.Header().Get("Deprecation") != "" {
+				t.Errorf("%s: Deprecation = %q, on %s %q", name, old.Header().Get("Deprecation"), apiV1.prefix(), current.Header().Get("Deprecation"))
+			}
+			want := ""
+			if !sunset.IsZero() {
+				want = "Sun, 31 Jan 2027 00:00:00 GMT"
+			}
+			if got := old.Header().Get("Sunset"); got != want {
+				t.Errorf("%s: Sunset = %q, want %q", name, got, want)
+			}
+			if got := metricValue(t, "todo_deprecated_requests_total", label) - counted; got != 1 {
+				t.Errorf("%s counted %v times, want once", name, got)
+			}
+		}
+	}
+}
+
+// Each compatibility mode sends the legacy fields it keeps, and only the
+// responses carrying one are marked deprecated and counted.
+func TestCompatibilityModes(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	requests := []struct {
+		name, method, path, body string
+		status                   int
+		legacy, current          string
+	}{
+		{"create", http.MethodPost, apiV1.prefix() + "/todo", `{"title":"write report"}`, http.StatusCreated, "ID", "id"},
+		{"error", http.MethodGet, apiV1.prefix() + "/todo/not-an-id", "", http.StatusBadRequest, "error", "code"},
+	}
+	tests := []struct {
+		mode                 string
+		legacy, current      bool
+		deprecated, problems bool
+	}{
+		{compatOld, true, false, true, false},
+		{compatBoth, true, true, true, false},
+		{compatNew, false, true, false, false},
+		{compatNew, false, true, false, true},
+	}
+	for _, tt := range tests {
+		cfg := *currentConfig()
+		cfg.HTTP.CompatibilityMode = tt.mode
+		cfg.legacySunset = time.Date(2027, time.January, 31, 0, 0, 0, 0, time.UTC)
+		useConfig(t, cfg)
+		for _, req := range requests {
+			name := tt.mode + " " + req.name
+			if tt.problems {
+				name += " as a problem"
+			}
+			label := map[string]string{"field": req.legacy}
+			counted := metricValue(t, "todo_deprecated_fields_total", label)
+
+			r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+			r.Header.Set("Content-Type", jsonContentType)
+			if tt.problems {
+				r.Header.Set("Accept", problemContentType)
+			}
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, r)
+			if rw.Code != req.status {
+				t.Fatalf("%s = %d: %s, want %d", name, rw.Code, rw.Body, req.status)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if _, ok := body[req.legacy]; ok != tt.legacy {
+				t.Errorf("%s: has %s %v, want %v: %s", name, req.legacy, ok, tt.legacy, rw.Body)
+			}
+			// an error always carries its code
+			if _, ok := body[req.current]; ok != (tt.current || req.name == "error") {
+				t.Errorf("%s: has %s %v: %s", name, req.current, ok, rw.Body)
+			}
+
+			wantFields, wantDeprecation, wantSunset, wantCount := "", "", "", 0.0
+			if tt.deprecated {
+				wantFields, wantDeprecation, wantSunset, wantCount = req.legacy, "true", "Sun, 31 Jan 2027 00:00:00 GMT", 1
+			}
+			if got := rw.Header().Get("X-Deprecated-Fields"); got != wantFields {
+				t.Errorf("%s: X-Deprecated-Fields = %q, want %q", name, got, wantFields)
+			}
+			if got := rw.Header().Get("Deprecation"); got != wantDeprecation {
+				t.Errorf("%s: Deprecation = %q, want %q", name, got, wantDeprecation)
+			}
+			if got := rw.Header().Get("Sunset"); got != wantSunset {
+				t.Errorf("%s: Sunset = %q, want %q", name, got, wantSunset)
+			}
+			if got := metricValue(t, "todo_deprecated_fields_total", label) - counted; got != wantCount {
+				t.Errorf("%s counted %v times, want %v", name, got, wantCount)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// days ahead the upcoming view covers unless ?days says otherwise
+const (
+	defaultUpcomingDays = 7
+	maxUpcomingDays     = 365
+)
+
+// todoViews builds the filter of each smart view as of now, whose location is
+// the request's zone. They are combined with the filters of the list.
+var todoViews = map[string]func(query url.Values, now time.Time) (bson.M, error){
+	// open todos due today or before
+	"today": func(_ url.Values, now time.Time) (bson.M, error) {
+		tomorrow := startOfDay(now).AddDate(0, 0, 1)
+		return bson.M{"completed": false, "due_date": bson.M{"$lt": tomorrow}}, nil
+	},
+	// open todos due in the ?days days after today
+	"upcoming": func(query url.Values, now time.Time) (bson.M, error) {
+		days := defaultUpcomingDays
+		if value := query.Get("days"); value != "" {
+			var err error
+			if days, err = strconv.Atoi(value); err != nil || days < 1 || days > maxUpcomingDays {
+				return nil, errors.New("days must be between 1 and " + strconv.Itoa(maxUpcomingDays))
+			}
+		}
+		tomorrow := startOfDay(now).AddDate(0, 0, 1)
+		return bson.M{"completed": false, "due_date": bson.M{
+			"$gte": tomorrow,
+			"$lt":  tomorrow.AddDate(0, 0, days),
+		}}, nil
+	},
+	// open todos without a due date
+	"anytime": func(_ url.Values, _ time.Time) (bson.M, error) {
+		return bson.M{"completed": false, "due_date": nil}, nil
+	},
+}
+
+// getView lists the todos of the smart view named by {view}, taking the
+// sort, filters and pagination of the list.
+func getView(rw http.ResponseWriter, r *http.Request) {
+	view := chi.URLParam(r, "view")
+	if _, ok := todoViews[view]; !ok {
+		writeError(rw, r, http.StatusNotFound, "view_not_found", nil)
+		return
+	}
+	listTodos(rw, r, view)
+}
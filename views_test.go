@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTodoViews(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	day := func(d, h, m int) time.Time { return time.Date(2024, time.March, d, h, m, 0, 0, loc) }
+	tests := []struct {
+		name  string
+		view  string
+		query string
+		now   time.Time
+		want  bson.M
+	}{
+		{
+			name: "today at midnight",
+			view: "today",
+			now:  day(10, 0, 0),
+			want: bson.M{"completed": false, "due_date": bson.M{"$lt": day(11, 0, 0)}},
+		},
+		{
+			name: "today just before midnight",
+			view: "today",
+			now:  day(10, 23, 59),
+			want: bson.M{"completed": false, "due_date": bson.M{"$lt": day(11, 0, 0)}},
+		},
+		{
+			name: "upcoming by default",
+			view: "upcoming",
+			now:  day(10, 0, 0),
+			want: bson.M{"completed": false, "due_date": bson.M{"$gte": day(11, 0, 0), "$lt": day(18, 0, 0)}},
+		},
+		{
+			name:  "upcoming days",
+			view:  "upcoming",
+			query: "days=1",
+			now:   day(10, 23, 59),
+			want:  bson.M{"completed": false, "due_date": bson.M{"$gte": day(11, 0, 0), "$lt": day(12, 0, 0)}},
+		},
+		{
+			name: "anytime",
+			view: "anytime",
+			now:  day(10, 12, 0),
+			want: bson.M{"completed": false, "due_date": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			got, err := todoViews[tt.view](query, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the bounds are midnights in Tokyo, 15:00 UTC the day before
+			if !filterEqual(got, tt.want) {
+				t.Errorf("filter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, days := range []string{"0", "366", "week"} {
+		if _, err := todoViews["upcoming"](url.Values{"days": {days}}, day(10, 0, 0)); err == nil {
+			t.Errorf("upcoming accepted days=%s", days)
+		}
+	}
+}
+
+// filterEqual compares filters, times by the instant they name.
+func filterEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case bson.M:
+		b, ok := b.(bson.M)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			if other, ok := b[key]; !ok || !filterEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case time.Time:
+		b, ok := b.(time.Time)
+		return ok && a.Equal(b)
+	}
+	return a == b
+}
+
+func TestGetView(t *testing.T) {
+	router, _, _ := emptyDatabaseRouter(t)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/v1/todo/views/today?timezone=Asia/Tokyo", http.StatusOK},
+		{"/api/v1/todo/views/upcoming?days=3", http.StatusOK},
+		{"/api/v1/todo/views/anytime", http.StatusOK},
+		{"/api/v1/todo/views/upcoming?days=0", http.StatusUnprocessableEntity},
+		{"/api/v1/todo/views/someday", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rw.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d: %s", tt.path, rw.Code, tt.want, rw.Body)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// the one record of an encrypted push message; push services take
+	// bodies of up to 4096 bytes
+	pushRecordSize = 4096
+	// salt, record size, key id length and the sender's public key
+	pushHeaderSize = 16 + 4 + 1 + 65
+	// what fits in the record besides the padding delimiter and the tag
+	maxPushPayload = pushRecordSize - pushHeaderSize - 1 - 16
+	// how long the signature of a push is valid, at most 24 hours
+	vapidTokenValidity = 12 * time.Hour
+)
+
+var errPushPayloadTooLarge = fmt.Errorf("push payloads are limited to %d bytes", maxPushPayload)
+
+// parseVAPIDKey reads the private VAPID key of push.vapid_private_key: the
+// 32 bytes of a P-256 scalar in base64url, the form web-push libraries
+// generate.
+func parseVAPIDKey(encoded string) (*ecdsa.PrivateKey, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	public := key.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}, nil
+}
+
+// generateVAPIDKeys returns a new private VAPID key and its public key, both
+// in base64url.
+func generateVAPIDKeys() (private, public string, err error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// vapidPublicKey is the public key of key as browsers take it for
+// applicationServerKey: the uncompressed point in base64url.
+func vapidPublicKey(key *ecdsa.PrivateKey) string {
+	public, err := key.PublicKey.ECDH()
+	if err != nil {
+		// parseVAPIDKey only makes valid P-256 keys
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(public.Bytes())
+}
+
+// vapidAuthorization returns the Authorization header of a push to
+// endpoint (RFC 8292): a JWT for the origin of endpoint with subject as its
+// contact, signed with key, and the public key to check it with.
+func vapidAuthorization(key *ecdsa.PrivateKey, subject, endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(struct {
+		Audience  string `json:"aud"`
+		ExpiresAt int64  `json:"exp"`
+		Subject   string `json:"sub"`
+	}{u.Scheme + "://" + u.Host, now.Add(vapidTokenValidity).Unix(), subject})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return "vapid t=" + signed + "." + base64.RawURLEncoding.EncodeToString(signature) + ", k=" + vapidPublicKey(key), nil
+}
+
+// encryptPush encrypts payload for the browser holding the private key of
+// p256dh and the auth secret, both as its subscription gives them, in the
+// aes128gcm content coding of RFC 8188 with the keys of RFC 8291, see
+// sealPush. Every message gets a key pair and salt of its own.
+func encryptPush(p256dh, auth string, payload []byte) ([]byte, error) {
+	if len(payload) > maxPushPayload {
+		return nil, errPushPayloadTooLarge
+	}
+	receiverKey, authSecret, err := parsePushKeys(p256dh, auth)
+	if err != nil {
+		return nil, err
+	}
+	senderKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return sealPush(receiverKey, authSecret, senderKey, salt, payload)
+}
+
+// sealPush returns the body of a push: a header carrying salt and the
+// public key of the sender, then payload in a single record.
+func sealPush(receiverKey *ecdh.PublicKey, authSecret []byte, senderKey *ecdh.PrivateKey, salt, payload []byte) ([]byte, error) {
+	shared, err := senderKey.ECDH(receiverKey)
+	if err != nil {
+		return nil, err
+	}
+	receiver, sender := receiverKey.Bytes(), senderKey.PublicKey().Bytes()
+	keyInfo := append(append([]byte("WebPush: info\x00"), receiver...), sender...)
+	ikm := hkdfSHA256(authSecret, shared, keyInfo, 32)
+	contentKey := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(sender)))
+	body.Write(sender)
+	// the delimiter 2 marks the last record, no padding follows it
+	plaintext := append(append([]byte{}, payload...), 2)
+	body.Write(gcm.Seal(nil, nonce, plaintext, nil))
+	return body.Bytes(), nil
+}
+
+// parsePushKeys decodes the keys of a push subscription: the P-256 public
+// key of the browser and its 16 byte auth secret.
+func parsePushKeys(p256dh, auth string) (*ecdh.PublicKey, []byte, error) {
+	raw, err := decodeBase64URL(p256dh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("p256dh: %w", err)
+	}
+	key, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("p256dh: %w", err)
+	}
+	secret, err := decodeBase64URL(auth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("auth: %w", err)
+	}
+	if len(secret) != 16 {
+		return nil, nil, errors.New("auth: expected 16 bytes")
+	}
+	return key, secret, nil
+}
+
+// hkdfSHA256 derives length bytes, at most 32, from ikm with salt and info
+// (RFC 5869), which takes a single block of the expansion.
+func hkdfSHA256(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// decodeBase64URL decodes base64url with or without its padding, as
+// browsers and libraries write it either way.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the example of RFC 8291 section 5
+const (
+	rfc8291Plaintext    = "When I grow up, I want to be a watermelon"
+	rfc8291SenderKey    = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291ReceiverKey  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291ReceiverPub  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Salt         = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291AuthSecret   = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291EncryptedMsg = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSealPushRFC8291(t *testing.T) {
+	receiverKey, authSecret, err := parsePushKeys(rfc8291ReceiverPub, rfc8291AuthSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderKey, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfc8291SenderKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := sealPush(receiverKey, authSecret, senderKey, mustDecode(t, rfc8291Salt), []byte(rfc8291Plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != rfc8291EncryptedMsg {
+		t.Errorf("sealPush() = %s, want %s", got, rfc8291EncryptedMsg)
+	}
+}
+
+// openPush decrypts a push body as the browser holding receiverKey would,
+// to check encryptPush, which picks its own key and salt.
+func openPush(t *testing.T, receiverKey *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	t.Helper()
+	salt, keyLength := body[:16], int(body[20])
+	senderKey, err := ecdh.P256().NewPublicKey(body[21 : 21+keyLength])
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := receiverKey.ECDH(senderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), receiverKey.PublicKey().Bytes()...), senderKey.Bytes()...)
+	ikm := hkdfSHA256(authSecret, shared, keyInfo, 32)
+	contentKey := hkdfSHA256(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfSHA256(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, body[21+keyLength:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext[len(plaintext)-1] != 2 {
+		t.Fatalf("padding delimiter = %d, want 2", plaintext[len(plaintext)-1])
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+func TestEncryptPush(t *testing.T) {
+	receiverKey, err := ecdh.P256().NewPrivateKey(mustDecode(t, rfc8291ReceiverKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := mustDecode(t, rfc8291AuthSecret)
+	p256dh := base64.RawURLEncoding.EncodeToString(receiverKey.PublicKey().Bytes())
+
+	tests := []struct {
+		name    string
+		payload []byte
+		err     bool
+	}{
+		{name: "short", payload: []byte(`{"title":"buy milk"}`)},
+		{name: "empty", payload: []byte{}},
+		{name: "largest", payload: []byte(strings.Repeat("x", maxPushPayload))},
+		{name: "too large", payload: []byte(strings.Repeat("x", maxPushPayload+1)), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := encryptPush(p256dh, rfc8291AuthSecret+"==", tt.payload)
+			if tt.err {
+				if !errors.Is(err, errPushPayloadTooLarge) {
+					t.Errorf("encryptPush() error = %v, want errPushPayloadTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body) > pushRecordSize {
+				t.Errorf("body is %d bytes, more than a record", len(body))
+			}
+			if got := openPush(t, receiverKey, authSecret, body); string(got) != string(tt.payload) {
+				t.Errorf("decrypted %q, want %q", got, tt.payload)
+			}
+		})
+	}
+}
+
+func TestParsePushKeys(t *testing.T) {
+	tests := []struct {
+		name, p256dh, auth string
+		ok                 bool
+	}{
+		{"valid", rfc8291ReceiverPub, rfc8291AuthSecret, true},
+		{"padded", rfc8291ReceiverPub + "=", rfc8291AuthSecret + "==", true},
+		{"p256dh not base64", "***", rfc8291AuthSecret, false},
+		{"p256dh not a point", base64.RawURLEncoding.EncodeToString(make([]byte, 65)), rfc8291AuthSecret, false},
+		{"auth too short", rfc8291ReceiverPub, "BTBZMqHH6r4T", false},
+		{"auth missing", rfc8291ReceiverPub, "", false},
+	}
+	for _, tt := range tests {
+		if _, _, err := parsePushKeys(tt.p256dh, tt.auth); (err == nil) != tt.ok {
+			t.Errorf("%s: parsePushKeys() error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869 test case 1, the first 32 bytes of its output
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if got := hex.EncodeToString(hkdfSHA256(salt, ikm, info, 32)); got != want {
+		t.Errorf("hkdfSHA256() = %s, want %s", got, want)
+	}
+}
+
+func TestVAPIDKeys(t *testing.T) {
+	private, public, err := generateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseVAPIDKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vapidPublicKey(key); got != public {
+		t.Errorf("vapidPublicKey() = %s, want %s", got, public)
+	}
+	for _, bad := range []string{"", "***", base64.RawURLEncoding.EncodeToString(make([]byte, 32)), rfc8291ReceiverPub} {
+		if _, err := parseVAPIDKey(bad); err == nil {
+			t.Errorf("parseVAPIDKey(%q) accepted", bad)
+		}
+	}
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	key, err := parseVAPIDKey(rfc8291SenderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	header, err := vapidAuthorization(key, "mailto:ops@example.com", "https://push.example.net:8443/wpush/v2/abc?x=1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, publicKey, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !strings.HasPrefix(header, "vapid t=") || !ok {
+		t.Fatalf("Authorization = %q, want vapid t=..., k=...", header)
+	}
+	if publicKey != vapidPublicKey(key) {
+		t.Errorf("k = %s, want %s", publicKey, vapidPublicKey(key))
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q has %d parts, want 3", token, len(parts))
+	}
+
+	var jwtHeader struct{ Typ, Alg string }
+	if err := json.Unmarshal(mustDecode(t, parts[0]), &jwtHeader); err != nil || jwtHeader.Alg != "ES256" || jwtHeader.Typ != "JWT" {
+		t.Errorf("JWT header = %+v, %v, want ES256 JWT", jwtHeader, err)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(mustDecode(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	want := struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{"https://push.example.net:8443", now.Add(vapidTokenValidity).Unix(), "mailto:ops@example.com"}
+	if claims != want {
+		t.Errorf("claims = %+v, want %+v", claims, want)
+	}
+
+	signature := mustDecode(t, parts[2])
+	if len(signature) != 64 {
+		t.Fatalf("signature is %d bytes, want 64", len(signature))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("the signature doesn't verify with the VAPID public key")
+	}
+	other, _ := parseVAPIDKey(rfc8291ReceiverKey)
+	if ecdsa.Verify(&other.PublicKey, digest[:], r, s) {
+		t.Error("the signature verifies with another key")
+	}
+}